@@ -28,6 +28,9 @@ const (
 
 type FileProc func(loop *AeLoop, fd int, extra interface{})
 type TimeProc func(loop *AeLoop, id int, extra interface{})
+
+// BeforeSleepProc 在每次进入 epoll/kqueue 等待之前调用
+type BeforeSleepProc func(loop *AeLoop)
 type AeFileEvent struct {
 	fd    int
 	mask  FeType
@@ -49,6 +52,7 @@ type AeLoop struct {
 	fileEventFd     int
 	timeEventNextId int
 	stop            bool
+	beforeSleep     BeforeSleepProc
 }
 
 // todo 这里有问题 源代码是 : var fe2ep [3]uint32 = [3]uint32{0, unix.EPOLLIN, unix.EPOLLOUT}
@@ -251,8 +255,15 @@ func (loop *AeLoop) AeWait() (tes []*AeTimeEvent, fes []*AeFileEvent) {
 	return
 }
 
+func (loop *AeLoop) SetBeforeSleepProc(proc BeforeSleepProc) {
+	loop.beforeSleep = proc
+}
+
 func (loop *AeLoop) AeMain() {
 	for loop.stop != true {
+		if loop.beforeSleep != nil {
+			loop.beforeSleep(loop)
+		}
 		tes, fes := loop.AeWait()
 		loop.AeProcess(tes, fes)
 	}
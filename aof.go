@@ -2,14 +2,25 @@ package main
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"strconv"
 )
 
+const (
+	AOF_FSYNC_NO       = "no"
+	AOF_FSYNC_ALWAYS   = "always"
+	AOF_FSYNC_EVERYSEC = "everysec"
+)
+
 func stopAppendOnly() {
-	flushAppendOnlyFile()
+	flushAppendOnlyFile(true)
+	if server.appendfd != nil {
+		server.appendfd.Close()
+	}
 	server.appendfd = nil
 	server.appendonly = 0
 }
@@ -18,233 +29,434 @@ const (
 	AOF_REWRITE_ITEMS_PER_CMD = 64
 )
 
-func flushAppendOnlyFile() {
-	if len(server.aofbuf) == 0 {
-		return
+// openAppendOnlyFile 以追加方式打开 AOF 文件，文件句柄在服务器整个生命周期内保持打开
+func openAppendOnlyFile() error {
+	if server.aofuserdbpreamble {
+		return openIncrAofForAppend()
+	}
+	return openAppendFd(server.appendfilename)
+}
+
+func openAppendFd(filename string) error {
+	fd, err := os.OpenFile(filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
 	}
+	info, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	server.appendfd = fd
+	// 新文件中的第一条命令之前要先写 SELECT
+	server.aofselecteddb = -1
+	server.aofcurrentsize = info.Size()
+	server.aoffsyncoffset = info.Size()
+	server.lastfsync = GetMsTime()
+	return nil
+}
+
+/*
+把 aofbuf 中累积的命令写入 AOF 文件，在每次事件循环进入等待之前调用（beforeSleep），
+这样同一轮事件循环中的所有写命令只需要一次 write 调用。
+  - always:   每次写入后立即 fsync
+  - everysec: 由 ServerCron 每秒 fsync 一次，force 为 true 时立即 fsync
+  - no:       由操作系统决定何时刷盘
+*/
+func flushAppendOnlyFile(force bool) {
 	if server.appendfd == nil {
-		var err error
-		server.appendfd, err = os.OpenFile(server.appendfilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+		return
+	}
+	if len(server.aofbuf) > 0 {
+		n, err := server.appendfd.Write(server.aofbuf)
+		server.aofcurrentsize += int64(n)
 		if err != nil {
-			log.Printf("Error opening AOF file: %v\n", err)
+			// 只写了一部分，剩下的留在缓冲区中下次再写
+			log.Printf("Error writing to AOF file: %v\n", err)
+			server.aofbuf = server.aofbuf[n:]
 			return
 		}
-		defer server.appendfd.Close()
-		log.Printf("AOF file opened successfully: %s\n", server.appendfilename)
+		/* Re-use AOF buffer when it is small enough. The maximum comes from the
+		 * arena size of 4k minus some overhead (but is otherwise arbitrary). */
+		if cap(server.aofbuf) < 4000 {
+			server.aofbuf = server.aofbuf[:0]
+		} else {
+			server.aofbuf = nil
+		}
 	}
-	if _, err := server.appendfd.WriteString(server.aofbuf); err != nil {
-		log.Printf("Error writing to AOF file: %v\n", err)
+	if server.appendfsync == AOF_FSYNC_ALWAYS ||
+		(force && server.appendfsync == AOF_FSYNC_EVERYSEC) {
+		aofFsync()
 	}
-	/* 要确保数据不会只停留在操作系统的输出缓冲区里。*/
-	server.appendfd.Sync()
-	server.appendfd.Close()
-	server.appendfd = nil
-	server.lastfsync = GetMsTime()
-	server.dirty = 0
-	log.Printf("AppendOnly file flushed successfully.\n")
-	server.aofbuf = ""
-	server.appendonly = 0
+}
+
+/* 要确保数据不会只停留在操作系统的输出缓冲区里。*/
+func aofFsync() {
+	if server.appendfd == nil || server.aoffsyncoffset == server.aofcurrentsize {
+		return
+	}
+	if err := server.appendfd.Sync(); err != nil {
+		log.Printf("Error fsync AOF file: %v\n", err)
+		return
+	}
+	server.aoffsyncoffset = server.aofcurrentsize
 	server.lastfsync = GetMsTime()
 }
 
 func startAppendOnly() int8 {
 	server.appendonly = 1
-	server.lastfsync = GetMsTime()
-	server.appendfd, _ = os.OpenFile(server.appendfilename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-	if server.appendfd == nil {
+	if err := openAppendOnlyFile(); err != nil {
 		log.Printf("Used tried to switch on AOF via CONFIG, but I can't open the AOF file: %s\n", server.appendfilename)
+		server.appendonly = 0
 		return GODIS_ERR
 	}
-	defer server.appendfd.Close()
 	err := rewriteAppendOnlyFileBackground()
 	if err != nil {
 		log.Printf("Used tried to switch on AOF via CONFIG, I can't trigger a background AOF rewrite operation. Check the above logs for more info about the error: %v\n", err)
-		server.appendonly = 0
+		stopAppendOnly()
 		return GODIS_ERR
 	}
 	return GODIS_OK
 }
+
+/*
+后台重写 AOF：
+ 1. 在主线程中给数据集做一份深拷贝快照（模拟 fork 的 COW）
+ 2. goroutine 把快照写入临时文件，不阻塞事件循环
+ 3. 重写期间新到达的写命令同时追加到 bgrewritebuf 中
+ 4. goroutine 结束后由 ServerCron 调用 backgroundRewriteDoneHandler，
+    把 bgrewritebuf 追加到临时文件，再原子地 rename 覆盖 appendfilename
+
+混合持久化时快照由 rdbSave 写成 RDB 格式，作为新的 base 文件（见 aof_manifest.go）。
+*/
 func rewriteAppendOnlyFileBackground() error {
-	// 模拟fork的COW
-	rewriteAppendOnlyFile(server.db)
+	if server.bgrewritedone != nil {
+		return errors.New("background append only file rewriting already in progress")
+	}
+	// 混合持久化：之后的写命令写到新的 incr 文件中，快照只需要包含在此之前的数据
+	if server.aofuserdbpreamble && server.appendfd != nil {
+		if err := openNewIncrAofForAppend(); err != nil {
+			return err
+		}
+	}
+	snapshot := dupDBs(server.db)
+	tmpfile := fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid())
+	preamble := server.aofuserdbpreamble
+	format := server.rdbformat
+	done := make(chan int8, 1)
+	server.bgrewritebuf = nil
+	server.bgrewritedone = done
+	server.aofrewritetimestart = GetMsTime()
+	server.savekeystotal = dbsKeyCount(snapshot)
+	server.savekeysprocessed.Store(0)
+	/* 重写结束后 bgrewritebuf 被追加到新文件末尾，而新文件最后 SELECT 的数据库是不确定的，
+	 * 所以让之后的第一条命令重新写一次 SELECT */
+	server.aofselecteddb = -1
+	go func() {
+		if !preamble {
+			done <- rewriteAppendOnlyFile(snapshot, tmpfile)
+			return
+		}
+		if err := rdbSaveWithFormat(tmpfile, snapshot, format); err != nil {
+			log.Printf("Failed writing the RDB preamble of the AOF: %v\n", err)
+			done <- GODIS_ERR
+			return
+		}
+		done <- GODIS_OK
+	}()
+	log.Printf("Background append only file rewriting started\n")
 	return nil
 }
 
-func rewriteAppendOnlyFile(db *GodisDB) int8 {
+// 检查后台重写是否已经结束，由 ServerCron 调用
+func checkBackgroundRewriteDone() {
+	if server.bgrewritedone == nil {
+		return
+	}
+	select {
+	case status := <-server.bgrewritedone:
+		backgroundRewriteDoneHandler(status)
+	default:
+	}
+}
+
+func backgroundRewriteDoneHandler(status int8) {
 	tmpfile := fmt.Sprintf("temp-rewriteaof-bg-%d.aof", os.Getpid())
-	fd, err := os.OpenFile(tmpfile, os.O_CREATE|os.O_WRONLY, 0644)
+	defer func() {
+		server.bgrewritebuf = nil
+		server.bgrewritedone = nil
+		server.aofrewritetimelast = (GetMsTime() - server.aofrewritetimestart) / 1000
+		server.aofrewritetimestart = -1
+	}()
+	if status != GODIS_OK {
+		log.Printf("Background AOF rewrite failed\n")
+		server.aoflastbgrewritestatus = GODIS_ERR
+		os.Remove(tmpfile)
+		return
+	}
+	if server.aofuserdbpreamble {
+		if err := backgroundRewriteDoneHandlerMultiPart(tmpfile); err != nil {
+			log.Printf("Error trying to install the rewritten base AOF file: %v\n", err)
+			server.aoflastbgrewritestatus = GODIS_ERR
+			os.Remove(tmpfile)
+			return
+		}
+		server.aoflastbgrewritestatus = GODIS_OK
+		log.Printf("Background AOF rewrite finished successfully\n")
+		return
+	}
+	// 先把 aofbuf 写入旧文件，这部分命令已经在 bgrewritebuf 中了，不会在新文件中重复
+	flushAppendOnlyFile(true)
+	fd, err := os.OpenFile(tmpfile, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		log.Printf("Unable to open the temporary AOF produced by the child: %v\n", err)
+		server.aoflastbgrewritestatus = GODIS_ERR
+		os.Remove(tmpfile)
+		return
+	}
+	if _, err := fd.Write(server.bgrewritebuf); err != nil {
+		log.Printf("Error trying to flush the parent diff to the rewritten AOF: %v\n", err)
+		server.aoflastbgrewritestatus = GODIS_ERR
+		fd.Close()
+		os.Remove(tmpfile)
+		return
+	}
+	fd.Sync()
+	fd.Close()
+	// rename 是原子操作，旧的 AOF 文件要么完整存在，要么被新文件完整替换
+	if err := os.Rename(tmpfile, server.appendfilename); err != nil {
+		log.Printf("Error trying to rename the temporary AOF file: %v\n", err)
+		server.aoflastbgrewritestatus = GODIS_ERR
+		os.Remove(tmpfile)
+		return
+	}
+	// 旧的文件句柄指向的是已经被替换掉的文件，需要重新打开
+	if server.appendfd != nil {
+		server.appendfd.Close()
+		server.appendfd = nil
+		if err := openAppendOnlyFile(); err != nil {
+			log.Printf("Error reopening the rewritten AOF file: %v\n", err)
+			server.aoflastbgrewritestatus = GODIS_ERR
+			return
+		}
+	}
+	server.aoflastbgrewritestatus = GODIS_OK
+	log.Printf("Background AOF rewrite finished successfully\n")
+}
+
+// 把数据集以命令的形式写入 filename，在 goroutine 中执行，只能访问快照 dbs
+func rewriteAppendOnlyFile(dbs []*GodisDB, filename string) int8 {
+	fd, err := os.OpenFile(filename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
 	if err != nil {
 		log.Printf("Failed open the temp append only file: %v\n", err)
 		return GODIS_ERR
 	}
-	defer fd.Close()
+	w := bufio.NewWriter(fd)
+	ret := GODIS_OK
+	for _, db := range dbs {
+		if ret = rewriteAppendOnlyDB(w, db); ret == GODIS_ERR {
+			break
+		}
+	}
+	if ret == GODIS_ERR || w.Flush() != nil || fd.Sync() != nil {
+		log.Printf("Failed writing to the temporary AOF file: %s\n", filename)
+		fd.Close()
+		os.Remove(filename)
+		return GODIS_ERR
+	}
+	fd.Close()
+	log.Printf("AppendOnly file rewrite completed successfully.\n")
+	return GODIS_OK
+}
+
+// 每个非空的数据库之前写一条 SELECT
+func rewriteAppendOnlyDB(w io.Writer, db *GodisDB) int8 {
+	if db.data.usedSize() == 0 {
+		return GODIS_OK
+	}
+	if fwriteBulkCount(w, '*', 2) == GODIS_ERR ||
+		fwriteBulkString(w, "SELECT") == GODIS_ERR ||
+		fwriteBulkLongLong(w, int64(db.id)) == GODIS_ERR {
+		return GODIS_ERR
+	}
 	iter := db.data.NewIterator(true)
 	defer iter.Close()
+	now := GetMsTime()
 	for key, value, exists := iter.Next(); exists; key, value, exists = iter.Next() {
-		expiretime := getExpire(key)
-		if value.Type_ == GSTR {
+		server.savekeysprocessed.Add(1)
+		expiretime := getExpire(db, key)
+		/* Skip keys that are already expired */
+		if expiretime != -1 && expiretime < now {
+			continue
+		}
+		var ret int8
+		switch value.Type_ {
+		case GSTR:
 			/* Emit a SET command */
-			cmd := "*3\r\n$3\r\nSET\r\n"
-			/* Key and value */
-			if _, err := fd.WriteString(cmd); err != nil {
-				log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-			}
-			if fwriteBulkObject(fd, key) == GODIS_ERR {
-				log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-			}
-			if fwriteBulkObject(fd, value) == GODIS_ERR {
-				log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-			}
-		} else if value.Type_ == GSET {
-			if value.encoding != GODIS_ENCODING_HT {
-				// 使用安全迭代器遍历内部 dict
-				innerIter := value.Val_.(*Dict).NewIterator(true) // 内层安全迭代器
-				items := value.setTypeSize()
-				count := int64(0)
-				for {
-					set_key, _, set_exists := innerIter.Next() // 返回(key, val, exists)
-					if !set_exists {
-						break
-					}
-					if count == 0 {
-						cmd_items := int(min(items, AOF_REWRITE_ITEMS_PER_CMD))
-						if fwriteBulkCount(fd, '$', 2+cmd_items) == GODIS_ERR ||
-							fwriteBulkString(fd, "sadd") == GODIS_ERR ||
-							fwriteBulkObject(fd, key) == GODIS_ERR {
-							log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-						}
-					}
-					if fwriteBulkObject(fd, set_key) == GODIS_ERR {
-						log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-						return GODIS_ERR
-					}
-					count++
-					items--
-					if count == AOF_REWRITE_ITEMS_PER_CMD {
-						count = 0
-					}
-				}
-				defer innerIter.Close() // 确保迭代器关闭
-			} else {
-				panic("Unknown set encoding")
-			}
-		} else if value.Type_ == GHASH {
-			if value.encoding != GODIS_ENCODING_HT {
-				innerIter := value.Val_.(*Dict).NewIterator(true) // 内层安全迭代器
-				items := value.setTypeSize()
-				count := int64(0)
-				for {
-					hash_key, hash_val, hash_exists := innerIter.Next() // 返回(key, val, exists)
-					if !hash_exists {
-						break
-					}
-					if count == 0 {
-						cmd_items := int(min(items, AOF_REWRITE_ITEMS_PER_CMD))
-						if fwriteBulkCount(fd, '$', 2+cmd_items) == GODIS_ERR ||
-							fwriteBulkString(fd, "hset") == GODIS_ERR {
-							log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-							return GODIS_ERR
-						}
-					}
-					if fwriteBulkObject(fd, hash_key) == GODIS_ERR || fwriteBulkObject(fd, hash_val) == GODIS_ERR {
-						log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-						return GODIS_ERR
-					}
-					count++
-					items--
-					if count == AOF_REWRITE_ITEMS_PER_CMD {
-						count = 0
-					}
-				}
-				defer innerIter.Close() // 确保迭代器关闭
-			} else if value.encoding == GODIS_ENCODING_ZIPMAP {
-				panic("Unknown hash encoding")
-			} else {
-				panic("Unknown hash encoding")
-			}
-		} else if value.Type_ == GLIST {
-			// 直接遍历链表
-			list := value.Val_.(*List)
-			items := list.Length()
-			count := int64(0)
-			for node := list.First(); node != nil; node = node.next {
-				if count == 0 {
-					cmd_items := int(min(items, AOF_REWRITE_ITEMS_PER_CMD))
-					if fwriteBulkCount(fd, '$', 2+cmd_items) == GODIS_ERR ||
-						fwriteBulkString(fd, "rpush") == GODIS_ERR ||
-						fwriteBulkObject(fd, key) == GODIS_ERR {
-						log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-						return GODIS_ERR
-					}
-				}
-				if fwriteBulkObject(fd, node.Val) == GODIS_ERR {
-					log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-					return GODIS_ERR
-				}
-				count++
-				items--
-				if count == AOF_REWRITE_ITEMS_PER_CMD {
-					count = 0
-				}
-			}
-		} else if value.Type_ == GZSET {
-			zsetObj := value.Val_.(zset)
-			zsl := zsetObj.zsl
-			zslNode := zsl.header.level[0].forward
-			items := zsl.length
-			count := int64(0)
-			for zslNode != nil {
-				if count == 0 {
-					cmd_items := int(min(items, AOF_REWRITE_ITEMS_PER_CMD))
-					if fwriteBulkCount(fd, '$', 2+cmd_items) == GODIS_ERR ||
-						fwriteBulkString(fd, "zadd") == GODIS_ERR {
-						log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-						return GODIS_ERR
-					}
-				}
-				member := zslNode.obj
-				fwriteBulkObject(fd, member)
-				fwriteBulkObject(fd, &Gobj{
-					Type_:    GSTR,
-					Val_:     strconv.FormatFloat(zslNode.score, 'g', 17, 64),
-					refCount: 1,
-					encoding: GODIS_ENCODING_RAW})
-				count++
-				items--
-				if count == AOF_REWRITE_ITEMS_PER_CMD {
-					count = 0
-				}
+			if fwriteBulkCount(w, '*', 3) == GODIS_ERR ||
+				fwriteBulkString(w, "SET") == GODIS_ERR ||
+				fwriteBulkObject(w, key) == GODIS_ERR ||
+				fwriteBulkObject(w, value) == GODIS_ERR {
+				return GODIS_ERR
 			}
-		} else {
+		case GLIST:
+			ret = rewriteListObject(w, key, value)
+		case GSET:
+			ret = rewriteSetObject(w, key, value)
+		case GHASH:
+			ret = rewriteHashObject(w, key, value)
+		case GZSET:
+			ret = rewriteSortedSetObject(w, key, value)
+		default:
 			panic(fmt.Sprintf("Unknown type %v for key %v", value.Type_, key.StrVal()))
 		}
+		if ret == GODIS_ERR {
+			return GODIS_ERR
+		}
 		if expiretime != -1 {
-			cmd := "*3\r\n$8\r\nEXPIREAT" + CRLF
-			cmd += fmt.Sprintf("$%d\r\n%s\r\n$%d\r\n%s\r\n", len(key.StrVal()), key.StrVal(), len(value.StrVal()), value.StrVal())
-			if _, err := fd.WriteString(cmd); err != nil {
-				log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-			}
-			if fwriteBulkObject(fd, key) == GODIS_ERR {
-				log.Printf("Failed writing to the temporary AOF file: %v\n", err)
+			if fwriteBulkCount(w, '*', 3) == GODIS_ERR ||
+				fwriteBulkString(w, "PEXPIREAT") == GODIS_ERR ||
+				fwriteBulkObject(w, key) == GODIS_ERR ||
+				fwriteBulkLongLong(w, expiretime) == GODIS_ERR {
+				return GODIS_ERR
 			}
-			if fwriteBulkLongLong(fd, expiretime, len(key.StrVal())) == GODIS_ERR {
-				log.Printf("Failed writing to the temporary AOF file: %v\n", err)
-			}
-
 		}
 	}
-	if os.Rename(tmpfile, server.appendfilename) != nil {
-		log.Printf("Failed to rename the temporary AOF file to the final AOF file: %v\n", err)
+	return GODIS_OK
+}
+
+// 每条命令最多携带 AOF_REWRITE_ITEMS_PER_CMD 个元素，避免重放时单条命令过大
+func rewriteCommandHeader(w io.Writer, cmd string, key *Gobj, items int64, itemArgs int) int8 {
+	cmdItems := int(min(items, AOF_REWRITE_ITEMS_PER_CMD))
+	if fwriteBulkCount(w, '*', 2+cmdItems*itemArgs) == GODIS_ERR ||
+		fwriteBulkString(w, cmd) == GODIS_ERR ||
+		fwriteBulkObject(w, key) == GODIS_ERR {
 		return GODIS_ERR
 	}
-	log.Printf("AppendOnly file rewrite completed successfully.\n")
-	fd.Sync()
+	return GODIS_OK
+}
+
+func rewriteListObject(w io.Writer, key *Gobj, o *Gobj) int8 {
+	// 直接遍历链表
+	list := o.Val_.(*List)
+	items := list.Length()
+	count := 0
+	for node := list.First(); node != nil; node = node.next {
+		if count == 0 && rewriteCommandHeader(w, "RPUSH", key, items, 1) == GODIS_ERR {
+			return GODIS_ERR
+		}
+		if fwriteBulkObject(w, node.Val) == GODIS_ERR {
+			return GODIS_ERR
+		}
+		count++
+		items--
+		if count == AOF_REWRITE_ITEMS_PER_CMD {
+			count = 0
+		}
+	}
+	return GODIS_OK
+}
+
+func rewriteSetObject(w io.Writer, key *Gobj, o *Gobj) int8 {
+	if o.encoding != GODIS_ENCODING_HT {
+		panic("Unknown set encoding")
+	}
+	items := o.setTypeSize()
+	if items == 0 {
+		return GODIS_OK
+	}
+	iter := o.Val_.(*Dict).NewIterator(true)
+	defer iter.Close()
+	count := 0
+	for member, _, exists := iter.Next(); exists; member, _, exists = iter.Next() {
+		if count == 0 && rewriteCommandHeader(w, "SADD", key, items, 1) == GODIS_ERR {
+			return GODIS_ERR
+		}
+		if fwriteBulkObject(w, member) == GODIS_ERR {
+			return GODIS_ERR
+		}
+		count++
+		items--
+		if count == AOF_REWRITE_ITEMS_PER_CMD {
+			count = 0
+		}
+	}
+	return GODIS_OK
+}
+
+func rewriteHashObject(w io.Writer, key *Gobj, o *Gobj) int8 {
+	if o.encoding != GODIS_ENCODING_HT {
+		panic("Unknown hash encoding")
+	}
+	items := o.setTypeSize()
+	if items == 0 {
+		return GODIS_OK
+	}
+	iter := o.Val_.(*Dict).NewIterator(true)
+	defer iter.Close()
+	count := 0
+	for field, val, exists := iter.Next(); exists; field, val, exists = iter.Next() {
+		if count == 0 && rewriteCommandHeader(w, "HSET", key, items, 2) == GODIS_ERR {
+			return GODIS_ERR
+		}
+		if fwriteBulkObject(w, field) == GODIS_ERR || fwriteBulkObject(w, val) == GODIS_ERR {
+			return GODIS_ERR
+		}
+		count++
+		items--
+		if count == AOF_REWRITE_ITEMS_PER_CMD {
+			count = 0
+		}
+	}
+	return rewriteHashFieldExpires(w, key, o)
+}
+
+// 字段的过期时间写成 HPEXPIREAT key when FIELDS 1 field，已经过期的字段在重放时直接删除
+func rewriteHashFieldExpires(w io.Writer, key *Gobj, o *Gobj) int8 {
+	meta := o.hashTypeExpireMeta()
+	if meta == nil {
+		return GODIS_OK
+	}
+	iter := meta.expires.NewIterator(true)
+	defer iter.Close()
+	for field, expObj, exists := iter.Next(); exists; field, expObj, exists = iter.Next() {
+		if fwriteBulkCount(w, '*', 6) == GODIS_ERR ||
+			fwriteBulkString(w, "HPEXPIREAT") == GODIS_ERR ||
+			fwriteBulkObject(w, key) == GODIS_ERR ||
+			fwriteBulkLongLong(w, expObj.Val_.(int64)) == GODIS_ERR ||
+			fwriteBulkString(w, "FIELDS") == GODIS_ERR ||
+			fwriteBulkLongLong(w, 1) == GODIS_ERR ||
+			fwriteBulkObject(w, field) == GODIS_ERR {
+			return GODIS_ERR
+		}
+	}
+	return GODIS_OK
+}
+
+func rewriteSortedSetObject(w io.Writer, key *Gobj, o *Gobj) int8 {
+	zsl := o.Val_.(zset).zsl
+	items := int64(zsl.length)
+	count := 0
+	for zslNode := zsl.header.level[0].forward; zslNode != nil; zslNode = zslNode.level[0].forward {
+		if count == 0 && rewriteCommandHeader(w, "ZADD", key, items, 2) == GODIS_ERR {
+			return GODIS_ERR
+		}
+		score := strconv.FormatFloat(zslNode.score, 'g', 17, 64)
+		if fwriteBulkString(w, score) == GODIS_ERR || fwriteBulkObject(w, zslNode.obj) == GODIS_ERR {
+			return GODIS_ERR
+		}
+		count++
+		items--
+		if count == AOF_REWRITE_ITEMS_PER_CMD {
+			count = 0
+		}
+	}
 	return GODIS_OK
 }
 
 func catAppendOnlyGenericCommand(buf string, args []*Gobj) string {
 	argc := len(args)
-	buf = fmt.Sprintf("*%d"+CRLF, argc)
+	buf += fmt.Sprintf("*%d"+CRLF, argc)
 	for i := 0; i < argc; i++ {
 		o := getDecodedObject(args[i])
 		buf += fmt.Sprintf("$%d"+CRLF, len(o.StrVal()))
@@ -254,74 +466,118 @@ func catAppendOnlyGenericCommand(buf string, args []*Gobj) string {
 	return buf
 }
 
-func FeedAppendOnlyFile(cmd *GodisCommand, args []*Gobj) {
+/*
+把相对的过期时间转换为绝对的毫秒时间戳 PEXPIREAT key <ms>，否则重放 AOF 时过期时间会往后漂移。
+直接使用命令执行之后 expire 字典里记录的过期时间，这样重放时恢复的过期时间和原来完全一致。
+*/
+func catAppendOnlyExpireAtCommand(buf string, db *GodisDB, key *Gobj) string {
+	when := getExpire(db, key)
+	if when == -1 {
+		// 过期时间已经过去，key 已经被删除了
+		return catAppendOnlyGenericCommand(buf, []*Gobj{CreateObject(GSTR, "DEL"), key})
+	}
+	args := []*Gobj{
+		CreateObject(GSTR, "PEXPIREAT"),
+		key,
+		CreateObject(GSTR, strconv.FormatInt(when, 10)),
+	}
+	return catAppendOnlyGenericCommand(buf, args)
+}
+
+// dictid 是执行命令的客户端当前所在的数据库
+func FeedAppendOnlyFile(cmd *GodisCommand, dictid int, args []*Gobj) {
 	var buf string
-	//tempArgs := make([]*Gobj, 3)
-	// 这里不需要select db 因为正常使用的情况下，我们都是使用一个db，所以开发的时候也是就用一个db
-	// buf = fmt.Sprintf("*2\r\n$6\r\nSELECT\r\n$%lu\r\n%s" + CRLF)
-	if cmd.name == "expire" {
-		//TODO handle expire command
-	} else if cmd.name == "setex" {
-		//TODO handle setex command
+	/* The DB this command was targeting is not the same as the last command
+	 * we appended. To issue a SELECT command is needed. */
+	if dictid != server.aofselecteddb {
+		seldb := strconv.Itoa(dictid)
+		buf = fmt.Sprintf("*2\r\n$6\r\nSELECT\r\n$%d\r\n%s\r\n", len(seldb), seldb)
+		server.aofselecteddb = dictid
+	}
+	db := server.db[dictid]
+	if cmd.name == "expire" || cmd.name == "pexpire" || cmd.name == "expireat" || cmd.name == "pexpireat" {
+		/* Translate EXPIRE/PEXPIRE/EXPIREAT into PEXPIREAT */
+		buf = catAppendOnlyExpireAtCommand(buf, db, args[1])
+	} else if cmd.name == "setex" || cmd.name == "psetex" {
+		/* Translate SETEX/PSETEX to SET and PEXPIREAT */
+		buf = catAppendOnlyGenericCommand(buf, []*Gobj{CreateObject(GSTR, "SET"), args[1], args[3]})
+		buf = catAppendOnlyExpireAtCommand(buf, db, args[1])
+	} else if cmd.name == "set" {
+		/* Translate SET [EX seconds][PX milliseconds][KEEPTTL] to SET and PEXPIREAT.
+		 * NX / XX / GET 只影响是否设置和回复，命令写入 AOF 时已经设置成功了 */
+		buf = catAppendOnlyGenericCommand(buf, []*Gobj{CreateObject(GSTR, "SET"), args[1], args[2]})
+		if db.data.Find(args[1]) == nil || getExpire(db, args[1]) != -1 {
+			buf = catAppendOnlyExpireAtCommand(buf, db, args[1])
+		}
+	} else if cmd.name == "getex" {
+		/* Translate GETEX to PERSIST or PEXPIREAT */
+		if db.data.Find(args[1]) != nil && getExpire(db, args[1]) == -1 {
+			buf = catAppendOnlyGenericCommand(buf, []*Gobj{CreateObject(GSTR, "PERSIST"), args[1]})
+		} else {
+			buf = catAppendOnlyExpireAtCommand(buf, db, args[1])
+		}
 	} else {
-		buf = catAppendOnlyGenericCommand(server.aofbuf, args)
+		buf = catAppendOnlyGenericCommand(buf, args)
+	}
+	// 先追加到 aofbuf，在 beforeSleep 中统一写入文件
+	server.aofbuf = append(server.aofbuf, buf...)
+	// 后台重写期间，新的写命令还要累积到 bgrewritebuf 中，重写结束后追加到新文件末尾
+	// 混合持久化时重写期间的命令已经写到新的 incr 文件中了
+	if server.bgrewritedone != nil && !server.aofuserdbpreamble {
+		server.bgrewritebuf = append(server.bgrewritebuf, buf...)
 	}
-	server.aofbuf = buf
-	flushAppendOnlyFile()
 }
 
-func loadAppendOnlyFile() {
+func loadAppendOnlyFile() error {
 	if server.appendonly == 0 {
-		return
+		return nil
 	}
-	server.aofbuf = ""
-	server.appendfd, _ = os.OpenFile(server.appendfilename, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
-	if server.appendfd == nil {
-		log.Printf("Used tried to switch on AOF via CONFIG, but I can't open the AOF file: %s\n", server.appendfilename)
-		return
+	server.aofbuf = nil
+	if server.aofuserdbpreamble {
+		return loadAppendOnlyFiles()
+	}
+	err := loadSingleAppendOnlyFile(server.appendfilename, true)
+	if os.IsNotExist(err) {
+		// 第一次启动还没有 AOF 文件
+		return nil
+	}
+	return err
+}
+
+// 重放一个命令格式的 AOF 文件，last 为 true 时允许最后一条命令不完整
+func loadSingleAppendOnlyFile(filename string, last bool) error {
+	fp, err := os.Open(filename)
+	if err != nil {
+		log.Printf("Can't open the append-only file %s: %v\n", filename, err)
+		return err
 	}
-	mockClient := &GodisClient{}
-	reader := bufio.NewReader(server.appendfd) //不需要 再定义 buffer 了内置了 4kb 的buffer
+	defer fp.Close()
+	// 每个文件都从 0 号数据库开始，文件中的 SELECT 会切换 mockClient.db
+	mockClient := &GodisClient{fd: -1, db: server.db[0]}
+	ar := newAofReader(fp)
 	for {
-		lineBytes, _, err := reader.ReadLine()
-		// 读到文件末尾
-		if len(lineBytes) == 0 {
-			return
-		}
-		if err != nil {
-			log.Printf("ReadLine error: %s", err)
-			return
+		argv, err := ar.ReadCommand()
+		if err == io.EOF {
+			return nil
 		}
-		if lineBytes[0] != '*' {
-			return
+		if err == io.ErrUnexpectedEOF && last {
+			// 最后一条命令没有写完整（写入过程中宕机），丢掉不完整的部分，否则之后追加的命令也无法解析
+			log.Printf("!!! Warning: short read while loading the AOF file %s!!!\n", filename)
+			log.Printf("AOF loaded anyway because the tail was truncated at offset %d\n", ar.offset)
+			return os.Truncate(filename, ar.offset)
 		}
-		argc, err := strconv.Atoi(string(lineBytes[1:]))
 		if err != nil {
-			log.Printf("Atoi error: %s", err)
-			return
-		}
-		argv := make([]*Gobj, argc)
-		for i := 0; i < argc; i++ {
-			//再读一行
-			lineBytes, _, err := reader.ReadLine()
-			if lineBytes[0] != '$' {
-				log.Printf("Loading Append Only File eror: Error Format File")
-				return
-			}
-			if err != nil {
-				log.Printf("ReadLine error: %s", err)
-				return
-			}
-			lineBytes, _, err = reader.ReadLine()
-			if err != nil {
-				log.Printf("ReadLine error: %s", err)
-				return
-			}
-			argv[i] = CreateObject(GSTR, string(lineBytes[0:])) // \r 不要
+			return fmt.Errorf("%s: %w at offset %d, use godis-check-aof --fix to repair it", filename, err, ar.offset)
 		}
-		mockClient.fd = -1
 		mockClient.args = argv
 		cmd := lookupCommand(argv[0].StrVal())
+		if cmd == nil {
+			return fmt.Errorf("unknown command '%s' reading the append only file", argv[0].StrVal())
+		}
+		// 和 ProcessCommand 一样检查参数个数，否则被手工修改过的 AOF 会让命令访问越界的参数
+		if (cmd.arity > 0 && cmd.arity != len(argv)) || (cmd.arity < 0 && -cmd.arity > len(argv)) {
+			return fmt.Errorf("bad arity for command '%s' reading the append only file %s at offset %d", argv[0].StrVal(), filename, ar.offset)
+		}
 		cmd.proc(mockClient)
 
 		for i := 0; i < len(mockClient.args); i++ {
@@ -329,3 +585,84 @@ func loadAppendOnlyFile() {
 		}
 	}
 }
+
+var errAofFormat = errors.New("bad file format reading the append only file")
+
+// 单个参数的最大长度，防止损坏的长度字段导致分配巨大的内存
+const AOF_MAX_BULK_LEN = 512 * 1024 * 1024
+
+/*
+aofReader 按 RESP 协议逐条读取 AOF 中的命令：*<argc>\r\n 后跟 argc 个 $<len>\r\n<bytes>\r\n。
+参数按长度读取，所以参数中可以包含 \r\n。offset 是最后一条完整命令结束的位置。
+*/
+type aofReader struct {
+	r      *bufio.Reader
+	offset int64
+	pos    int64
+}
+
+func newAofReader(r io.Reader) *aofReader {
+	return &aofReader{r: bufio.NewReader(r)}
+}
+
+/*
+ReadCommand 读取下一条命令：
+  - 文件正好在命令边界结束时返回 io.EOF
+  - 命令不完整（文件被截断）时返回 io.ErrUnexpectedEOF
+  - 格式错误时返回 errAofFormat
+*/
+func (ar *aofReader) ReadCommand() ([]*Gobj, error) {
+	line, err := ar.readLine()
+	if err != nil {
+		if err == io.ErrUnexpectedEOF && ar.pos == ar.offset {
+			return nil, io.EOF
+		}
+		return nil, err
+	}
+	if line[0] != '*' {
+		return nil, fmt.Errorf("%w: expected prefix '*', got: '%c'", errAofFormat, line[0])
+	}
+	argc, err := strconv.Atoi(line[1:])
+	if err != nil || argc < 1 {
+		return nil, fmt.Errorf("%w: invalid multibulk length '%s'", errAofFormat, line[1:])
+	}
+	argv := make([]*Gobj, 0, argc)
+	for i := 0; i < argc; i++ {
+		line, err := ar.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if line[0] != '$' {
+			return nil, fmt.Errorf("%w: expected prefix '$', got: '%c'", errAofFormat, line[0])
+		}
+		blen, err := strconv.Atoi(line[1:])
+		if err != nil || blen < 0 || blen > AOF_MAX_BULK_LEN {
+			return nil, fmt.Errorf("%w: invalid bulk length '%s'", errAofFormat, line[1:])
+		}
+		buf := make([]byte, blen+2)
+		n, err := io.ReadFull(ar.r, buf)
+		ar.pos += int64(n)
+		if err != nil {
+			return nil, io.ErrUnexpectedEOF
+		}
+		if buf[blen] != '\r' || buf[blen+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string not terminated by CRLF", errAofFormat)
+		}
+		argv = append(argv, CreateObject(GSTR, string(buf[:blen])))
+	}
+	ar.offset = ar.pos
+	return argv, nil
+}
+
+// 读取一行（不含 \r\n），空行按格式错误处理
+func (ar *aofReader) readLine() (string, error) {
+	line, err := ar.r.ReadString('\n')
+	ar.pos += int64(len(line))
+	if err != nil {
+		return "", io.ErrUnexpectedEOF
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return "", fmt.Errorf("%w: malformed line", errAofFormat)
+	}
+	return line[:len(line)-2], nil
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+/*
+混合持久化（aofuserdbpreamble 为 true）时，AOF 由 appenddirname 目录中的多个文件组成（参考 Redis 7 的 multi-part AOF）：
+  - base 文件：AOF 重写时由 rdbSave 生成的 RDB 快照，redis.aof.<seq>.base.rdb
+  - incr 文件：base 之后的写命令，redis.aof.<seq>.incr.aof
+  - manifest 文件：记录当前有效的 base 和 incr 文件，redis.aof.manifest
+
+manifest 每行一个文件："file <文件名> seq <序号> type <b|i>"。
+加载时先加载 base，再按顺序重放所有 incr 文件。重写开始时打开一个新的 incr 文件，
+之后的写命令都追加到新文件中，所以不需要 bgrewritebuf；重写结束后 manifest 中只保留
+新的 base 和最后一个 incr 文件，其余的文件被删除。
+*/
+const (
+	AOF_FILE_TYPE_BASE = 'b'
+	AOF_FILE_TYPE_INCR = 'i'
+
+	BASE_FILE_SUFFIX      = ".base"
+	INCR_FILE_SUFFIX      = ".incr"
+	RDB_FORMAT_SUFFIX     = ".rdb"
+	AOF_FORMAT_SUFFIX     = ".aof"
+	MANIFEST_NAME_SUFFIX  = ".manifest"
+	TEMP_FILE_NAME_PREFIX = "temp-"
+)
+
+type aofInfo struct {
+	filename string
+	seq      int64
+	type_    byte
+}
+
+type aofManifest struct {
+	base       *aofInfo   /* 可能为空，例如还没有进行过重写 */
+	incrList   []*aofInfo /* 按 seq 从小到大排列 */
+	curBaseSeq int64
+	curIncrSeq int64
+}
+
+func (am *aofManifest) dup() *aofManifest {
+	dup := *am
+	dup.incrList = append([]*aofInfo(nil), am.incrList...)
+	return &dup
+}
+
+func (am *aofManifest) String() string {
+	var sb strings.Builder
+	if am.base != nil {
+		sb.WriteString(am.base.String())
+	}
+	for _, incr := range am.incrList {
+		sb.WriteString(incr.String())
+	}
+	return sb.String()
+}
+
+func (ai *aofInfo) String() string {
+	return fmt.Sprintf("file %s seq %d type %c\n", ai.filename, ai.seq, ai.type_)
+}
+
+func getAofManifestFilename() string {
+	return filepath.Base(server.appendfilename) + MANIFEST_NAME_SUFFIX
+}
+
+// AOF 目录中的文件名转换成路径
+func aofFilePath(filename string) string {
+	return filepath.Join(server.appenddirname, filename)
+}
+
+// 新的 base 文件名，会增加 am.curBaseSeq
+func getNewBaseFileName(am *aofManifest) *aofInfo {
+	am.curBaseSeq++
+	return &aofInfo{
+		filename: fmt.Sprintf("%s.%d%s%s", filepath.Base(server.appendfilename), am.curBaseSeq, BASE_FILE_SUFFIX, RDB_FORMAT_SUFFIX),
+		seq:      am.curBaseSeq,
+		type_:    AOF_FILE_TYPE_BASE,
+	}
+}
+
+// 新的 incr 文件名，会增加 am.curIncrSeq
+func getNewIncrFileName(am *aofManifest) *aofInfo {
+	am.curIncrSeq++
+	return &aofInfo{
+		filename: fmt.Sprintf("%s.%d%s%s", filepath.Base(server.appendfilename), am.curIncrSeq, INCR_FILE_SUFFIX, AOF_FORMAT_SUFFIX),
+		seq:      am.curIncrSeq,
+		type_:    AOF_FILE_TYPE_INCR,
+	}
+}
+
+// 解析 manifest 文件，文件名都是相对于 manifest 所在的目录
+func aofLoadManifestFromFile(filename string) (*aofManifest, error) {
+	fp, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer fp.Close()
+	am := &aofManifest{}
+	scanner := bufio.NewScanner(fp)
+	for lineno := 1; scanner.Scan(); lineno++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		ai, err := parseAofInfoLine(line)
+		if err != nil {
+			return nil, fmt.Errorf("invalid AOF manifest %s at line %d: %w", filename, lineno, err)
+		}
+		switch ai.type_ {
+		case AOF_FILE_TYPE_BASE:
+			if am.base != nil {
+				return nil, fmt.Errorf("invalid AOF manifest %s at line %d: found duplicate base file information", filename, lineno)
+			}
+			am.base = ai
+			am.curBaseSeq = ai.seq
+		case AOF_FILE_TYPE_INCR:
+			if ai.seq <= am.curIncrSeq {
+				return nil, fmt.Errorf("invalid AOF manifest %s at line %d: found a non-monotonic sequence number", filename, lineno)
+			}
+			am.incrList = append(am.incrList, ai)
+			am.curIncrSeq = ai.seq
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if am.base == nil && len(am.incrList) == 0 {
+		return nil, fmt.Errorf("invalid AOF manifest %s: no file info found", filename)
+	}
+	return am, nil
+}
+
+// "file <文件名> seq <序号> type <b|i>"
+func parseAofInfoLine(line string) (*aofInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("invalid line format")
+	}
+	ai := &aofInfo{}
+	for i := 0; i < len(fields); i += 2 {
+		switch fields[i] {
+		case "file":
+			ai.filename = fields[i+1]
+		case "seq":
+			seq, err := strconv.ParseInt(fields[i+1], 10, 64)
+			if err != nil || seq < 1 {
+				return nil, errors.New("invalid seq")
+			}
+			ai.seq = seq
+		case "type":
+			ai.type_ = fields[i+1][0]
+			if len(fields[i+1]) != 1 || (ai.type_ != AOF_FILE_TYPE_BASE && ai.type_ != AOF_FILE_TYPE_INCR) {
+				return nil, errors.New("unknown file type")
+			}
+		}
+	}
+	// 文件名不能包含目录，避免 manifest 指向目录之外的文件
+	if ai.filename == "" || ai.seq == 0 || ai.type_ == 0 || filepath.Base(ai.filename) != ai.filename {
+		return nil, errors.New("mismatched file info")
+	}
+	return ai, nil
+}
+
+/*
+读取 manifest 到 server.aofmanifest。
+目录中还没有 manifest、但存在旧的单文件 AOF 时，把旧文件移到目录中作为 AOF 格式的 base，
+否则开启混合持久化之后旧文件中的数据就丢了。
+*/
+func aofLoadManifestFromDisk() error {
+	if err := os.MkdirAll(server.appenddirname, 0755); err != nil {
+		return err
+	}
+	am, err := aofLoadManifestFromFile(aofFilePath(getAofManifestFilename()))
+	if err == nil {
+		server.aofmanifest = am
+		return nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	am = &aofManifest{}
+	if _, err := os.Stat(server.appendfilename); err == nil {
+		am.curBaseSeq++
+		am.base = &aofInfo{
+			filename: fmt.Sprintf("%s.%d%s%s", filepath.Base(server.appendfilename), am.curBaseSeq, BASE_FILE_SUFFIX, AOF_FORMAT_SUFFIX),
+			seq:      am.curBaseSeq,
+			type_:    AOF_FILE_TYPE_BASE,
+		}
+		if err := os.Rename(server.appendfilename, aofFilePath(am.base.filename)); err != nil {
+			return err
+		}
+		if err := persistAofManifest(am); err != nil {
+			return err
+		}
+		log.Printf("Successfully migrated an old-style AOF into the AOF directory\n")
+	}
+	server.aofmanifest = am
+	return nil
+}
+
+// 先写临时文件再 rename，manifest 要么是旧的，要么是完整的新内容
+func persistAofManifest(am *aofManifest) error {
+	tmpname := aofFilePath(TEMP_FILE_NAME_PREFIX + getAofManifestFilename())
+	fd, err := os.OpenFile(tmpname, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = fd.WriteString(am.String())
+	if err == nil {
+		err = fd.Sync()
+	}
+	fd.Close()
+	if err == nil {
+		err = os.Rename(tmpname, aofFilePath(getAofManifestFilename()))
+	}
+	if err != nil {
+		os.Remove(tmpname)
+	}
+	return err
+}
+
+// 按 manifest 依次加载 base 和所有 incr 文件，只有最后一个 incr 文件允许末尾不完整
+func loadAppendOnlyFiles() error {
+	if err := aofLoadManifestFromDisk(); err != nil {
+		return err
+	}
+	am := server.aofmanifest
+	if am.base != nil {
+		var err error
+		path := aofFilePath(am.base.filename)
+		if strings.HasSuffix(am.base.filename, RDB_FORMAT_SUFFIX) {
+			err = rdbLoad(path)
+		} else {
+			err = loadSingleAppendOnlyFile(path, false)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	for i, incr := range am.incrList {
+		if err := loadSingleAppendOnlyFile(aofFilePath(incr.filename), i == len(am.incrList)-1); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 打开最后一个 incr 文件用于追加，还没有 incr 文件时新建一个
+func openIncrAofForAppend() error {
+	if server.aofmanifest == nil {
+		if err := aofLoadManifestFromDisk(); err != nil {
+			return err
+		}
+	}
+	am := server.aofmanifest
+	if len(am.incrList) == 0 {
+		return openNewIncrAofForAppend()
+	}
+	return openAppendFd(aofFilePath(am.incrList[len(am.incrList)-1].filename))
+}
+
+/*
+新建一个 incr 文件并把之后的写命令都追加到这个文件中，在 AOF 重写开始时调用。
+manifest 持久化成功之后才切换文件句柄，失败时继续使用旧的文件。
+*/
+func openNewIncrAofForAppend() error {
+	am := server.aofmanifest.dup()
+	incr := getNewIncrFileName(am)
+	fd, err := os.OpenFile(aofFilePath(incr.filename), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	fd.Close()
+	am.incrList = append(am.incrList, incr)
+	if err := persistAofManifest(am); err != nil {
+		os.Remove(aofFilePath(incr.filename))
+		return err
+	}
+	server.aofmanifest = am
+	// 旧文件中剩下的命令先写完
+	flushAppendOnlyFile(true)
+	if server.appendfd != nil {
+		server.appendfd.Close()
+		server.appendfd = nil
+	}
+	return openAppendFd(aofFilePath(incr.filename))
+}
+
+/*
+重写结束后，把 goroutine 生成的 RDB 快照作为新的 base：
+重写开始之前的 base 和 incr 文件中的数据都已经包含在快照里，只需要保留最后一个 incr 文件。
+*/
+func backgroundRewriteDoneHandlerMultiPart(tmpfile string) error {
+	am := server.aofmanifest.dup()
+	base := getNewBaseFileName(am)
+	if err := os.Rename(tmpfile, aofFilePath(base.filename)); err != nil {
+		return err
+	}
+	history := make([]*aofInfo, 0, len(am.incrList)+1)
+	if am.base != nil {
+		history = append(history, am.base)
+	}
+	if server.appendfd != nil && len(am.incrList) > 0 {
+		history = append(history, am.incrList[:len(am.incrList)-1]...)
+		am.incrList = am.incrList[len(am.incrList)-1:]
+	} else {
+		// 没有开启 AOF，快照就是全部的数据
+		history = append(history, am.incrList...)
+		am.incrList = nil
+	}
+	am.base = base
+	if err := persistAofManifest(am); err != nil {
+		os.Remove(aofFilePath(base.filename))
+		return err
+	}
+	server.aofmanifest = am
+	for _, ai := range history {
+		if err := os.Remove(aofFilePath(ai.filename)); err != nil {
+			log.Printf("Failed to remove history AOF file %s: %v\n", ai.filename, err)
+		}
+	}
+	return nil
+}
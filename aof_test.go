@@ -0,0 +1,119 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestAofLoadReplay(t *testing.T) {
+	newTestServer(t, `"appendonly":true,"save":""`)
+	c := newTestClient(t)
+	c.do("set", "str", "hello")
+	c.do("append", "str", " world")
+	c.do("rpush", "list", "a", "b", "c")
+	c.do("lpop", "list")
+	c.do("hset", "hash", "f1", "v1", "f2", "v2")
+	c.do("sadd", "set", "m1", "m2")
+	c.do("zadd", "zset", "1", "one", "2", "two")
+	c.do("set", "tmp", "x")
+	c.do("del", "tmp")
+	c.do("select", "3")
+	c.do("set", "db3", "v")
+
+	restartTestServer(t)
+	c = newTestClient(t)
+	cases := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"get", "str"}, "$11\r\nhello world\r\n"},
+		{[]string{"lrange", "list", "0", "-1"}, "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"hget", "hash", "f2"}, "$2\r\nv2\r\n"},
+		{[]string{"scard", "set"}, ":2\r\n"},
+		{[]string{"zscore", "zset", "two"}, "$1\r\n2\r\n"},
+		{[]string{"get", "tmp"}, "$-1\r\n"},
+		{[]string{"get", "db3"}, "$-1\r\n"},
+		{[]string{"select", "3"}, "+OK\r\n"},
+		{[]string{"get", "db3"}, "$1\r\nv\r\n"},
+	}
+	for _, tc := range cases {
+		if got := c.do(tc.args...); got != tc.reply {
+			t.Errorf("%v: got %q, want %q", tc.args, got, tc.reply)
+		}
+	}
+}
+
+// 参数个数不对的命令不能交给 proc 执行，加载应该报错而不是 panic
+func TestAofLoadBadArity(t *testing.T) {
+	newTestServer(t, `"appendonly":true,"save":""`)
+	stopTestServer()
+	aof := "*2\r\n$3\r\nset\r\n$1\r\nk\r\n"
+	if err := os.WriteFile(server.appendfilename, []byte(aof), 0644); err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadConfig("./config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = GodisServer{}
+	if err := initServer(config); err != nil {
+		t.Fatal(err)
+	}
+	err = loadDataFromDisk()
+	if err == nil || !strings.Contains(err.Error(), "bad arity") {
+		t.Fatalf("got %v, want bad arity error", err)
+	}
+}
+
+// 没有修改数据的命令不写入 AOF
+func TestAofSkipsReadOnlyCommands(t *testing.T) {
+	newTestServer(t, `"appendonly":true,"save":""`)
+	c := newTestClient(t)
+	c.do("get", "k")
+	c.do("del", "missing")
+	c.do("rpush", "list", "a", "b")
+	c.do("ltrim", "list", "0", "-1")
+	if aof := readAppendOnlyFile(t); strings.Contains(aof, "get") ||
+		strings.Contains(aof, "del") || strings.Contains(aof, "ltrim") {
+		t.Fatalf("unexpected command in AOF: %q", aof)
+	}
+}
+
+// SAVE 会把 dirty 清零，但它本身没有修改数据集，不能写入 AOF
+func TestAofSaveNotPropagated(t *testing.T) {
+	newTestServer(t, `"appendonly":true,"save":""`)
+	c := newTestClient(t)
+	c.do("set", "k", "v")
+	if got := c.do("save"); got != "+OK\r\n" {
+		t.Fatalf("save: %q", got)
+	}
+	c.do("save")
+	if aof := readAppendOnlyFile(t); strings.Contains(strings.ToLower(aof), "save") {
+		t.Fatalf("SAVE written to the AOF: %q", aof)
+	}
+}
+
+// FLUSHALL 触发的 rdbSave 会把 dirty 清零，但 FLUSHALL 仍然要写入 AOF，否则重启之后数据又回来了
+func TestAofFlushallPropagated(t *testing.T) {
+	for _, save := range []string{"", "3600 1"} {
+		newTestServer(t, `"appendonly":true,"save":"`+save+`"`)
+		c := newTestClient(t)
+		c.do("set", "k", "v")
+		if got := c.do("flushall"); got != "+OK\r\n" {
+			t.Fatalf("flushall: %q", got)
+		}
+		// 数据库已经是空的
+		c.do("flushall")
+		if aof := readAppendOnlyFile(t); strings.Count(strings.ToLower(aof), "flushall") != 2 {
+			t.Fatalf("save %q: FLUSHALL not written to the AOF: %q", save, aof)
+		}
+
+		restartTestServer(t)
+		c = newTestClient(t)
+		if got := c.do("get", "k"); got != "$-1\r\n" {
+			t.Fatalf("save %q: key back after restart: %q", save, got)
+		}
+		stopTestServer()
+	}
+}
@@ -0,0 +1,691 @@
+package main
+
+import (
+	"math"
+	"math/bits"
+	"strconv"
+	"strings"
+)
+
+/*
+位操作命令（参考 Redis 的 bitops.c），位图就是普通的字符串对象。
+第 0 位是第一个字节的最高位，和 Redis 一致，所以 RDB 和 AOF 中的数据可以直接在两边互相使用。
+修改位图时和其他字符串命令一样，先拷贝出一个字节数组，修改完再创建新的对象替换原来的值。
+*/
+
+// BITFIELD 的溢出处理方式
+const (
+	BFOVERFLOW_WRAP = iota
+	BFOVERFLOW_SAT
+	BFOVERFLOW_FAIL
+)
+
+// BITFIELD 的子命令
+const (
+	BITFIELDOP_GET = iota
+	BITFIELDOP_SET
+	BITFIELDOP_INCRBY
+)
+
+// BITOP 的运算
+const (
+	BITOP_AND = iota
+	BITOP_OR
+	BITOP_XOR
+	BITOP_NOT
+)
+
+/*
+解析位偏移量，hash 为 true 时（BITFIELD）支持 "#N" 的写法，表示第 N 个 bits 位宽的整数。
+偏移量所在的字节不能超过字符串的最大长度。
+*/
+func getBitOffsetFromArgument(c *GodisClient, o *Gobj, offset *uint64, hash bool, bits int) int8 {
+	str := o.StrVal()
+	usehash := hash && len(str) > 1 && str[0] == '#'
+	if usehash {
+		str = str[1:]
+	}
+	loffset, err := strconv.ParseInt(str, 10, 64)
+	if err == nil && usehash {
+		if loffset > math.MaxInt64/int64(bits) {
+			err = strconv.ErrRange
+		}
+		loffset *= int64(bits)
+	}
+	// BITFIELD 的整数的最后一位也不能超出范围
+	last := loffset
+	if bits > 0 {
+		last += int64(bits) - 1
+	}
+	if err != nil || loffset < 0 || last>>3 >= PROTO_MAX_BULK_LEN {
+		c.AddReplyError("bit offset is not an integer or out of range")
+		return GODIS_ERR
+	}
+	*offset = uint64(loffset)
+	return GODIS_OK
+}
+
+// 解析 BITFIELD 的类型，i1 到 i64 是有符号整数，u1 到 u63 是无符号整数
+func getBitfieldTypeFromArgument(c *GodisClient, o *Gobj, sign *bool, bits *int) int8 {
+	str := o.StrVal()
+	var err error
+	if len(str) > 1 && (str[0] == 'i' || str[0] == 'I') {
+		*sign = true
+	} else if len(str) > 1 && (str[0] == 'u' || str[0] == 'U') {
+		*sign = false
+	} else {
+		err = strconv.ErrSyntax
+	}
+	if err == nil {
+		*bits, err = strconv.Atoi(str[1:])
+	}
+	if err != nil || (*sign && (*bits < 1 || *bits > 64)) || (!*sign && (*bits < 1 || *bits > 63)) {
+		c.AddReplyError("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+/*
+取出要修改的位图的一份拷贝，长度至少能容纳第 maxbit 位，key 不存在时返回全 0 的字节数组。
+dirty 表示 key 是新建的或者长度变长了，即使没有修改任何一位也要写回。
+*/
+func lookupStringForBitCommand(c *GodisClient, maxbit uint64, dirty *bool) ([]byte, int8) {
+	byte_ := int(maxbit >> 3)
+	o := lookupKeyWrite(c.db, c.args[1])
+	var str string
+	if o != nil {
+		if o.Type_ != GSTR {
+			c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return nil, GODIS_ERR
+		}
+		str = o.StrVal()
+	}
+	size := len(str)
+	*dirty = o == nil || byte_+1 > size
+	if byte_+1 > size {
+		size = byte_ + 1
+	}
+	buf := make([]byte, size)
+	copy(buf, str)
+	return buf, GODIS_OK
+}
+
+// 把修改之后的位图写回 key，过期时间保持不变
+func setStringForBitCommand(c *GodisClient, key *Gobj, buf []byte) {
+	newObj := CreateObject(GSTR, string(buf))
+	dbOverwrite(c.db, key, newObj)
+	newObj.DecrRefCount()
+}
+
+// SETBIT key offset value：返回这一位原来的值
+func setbitCommand(c *GodisClient) {
+	var bitoffset uint64
+	if getBitOffsetFromArgument(c, c.args[2], &bitoffset, false, 0) != GODIS_OK {
+		return
+	}
+	var on int64
+	if c.getLongFromObject(c.args[3], &on) != GODIS_OK || on & ^1 != 0 {
+		c.AddReplyError("bit is not an integer or out of range")
+		return
+	}
+	var dirty bool
+	buf, ret := lookupStringForBitCommand(c, bitoffset, &dirty)
+	if ret != GODIS_OK {
+		return
+	}
+	byte_ := bitoffset >> 3
+	bit := 7 - (bitoffset & 0x7)
+	bitval := int64(buf[byte_]>>bit) & 1
+	// 只有这一位发生变化或者 key 被创建、变长时才写回
+	if dirty || bitval != on {
+		buf[byte_] &^= 1 << bit
+		buf[byte_] |= byte(on << bit)
+		setStringForBitCommand(c, c.args[1], buf)
+		server.dirty++
+	}
+	c.AddReplyLong(bitval)
+}
+
+func getbitCommand(c *GodisClient) {
+	var bitoffset uint64
+	if getBitOffsetFromArgument(c, c.args[2], &bitoffset, false, 0) != GODIS_OK {
+		return
+	}
+	o := findKeyRead(c.db, c.args[1])
+	if o == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	str := o.StrVal()
+	byte_ := bitoffset >> 3
+	bit := 7 - (bitoffset & 0x7)
+	var bitval byte
+	if byte_ < uint64(len(str)) {
+		bitval = (str[byte_] >> bit) & 1
+	}
+	c.AddReplyInt8(int8(bitval))
+}
+
+// 统计字符串中值为 1 的位数
+func redisPopcount(s string) int64 {
+	var count int64
+	for len(s) >= 8 {
+		count += int64(bits.OnesCount64(uint64(s[0])<<56 | uint64(s[1])<<48 | uint64(s[2])<<40 | uint64(s[3])<<32 |
+			uint64(s[4])<<24 | uint64(s[5])<<16 | uint64(s[6])<<8 | uint64(s[7])))
+		s = s[8:]
+	}
+	for i := 0; i < len(s); i++ {
+		count += int64(bits.OnesCount8(s[i]))
+	}
+	return count
+}
+
+/*
+BITCOUNT / BITPOS 的范围参数：start 和 end 都包含在内，负数表示从末尾开始计算。
+isbit 为 true 时以位为单位，否则以字节为单位。范围为空时返回 false。
+返回的 startBit 和 endBit 都是以位为单位的下标。
+*/
+func bitRangeToBits(start, end int64, strlen int64, isbit bool, startBit, endBit *int64) bool {
+	totlen := strlen
+	if isbit {
+		totlen <<= 3
+	}
+	if start < 0 && end < 0 && start > end {
+		return false
+	}
+	if start < 0 {
+		start = totlen + start
+	}
+	if end < 0 {
+		end = totlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= totlen {
+		end = totlen - 1
+	}
+	if start > end {
+		return false
+	}
+	if isbit {
+		*startBit, *endBit = start, end
+	} else {
+		*startBit, *endBit = start<<3, end<<3+7
+	}
+	return true
+}
+
+// 解析可选的 BYTE | BIT 参数
+func parseBitRangeUnit(c *GodisClient, o *Gobj, isbit *bool) int8 {
+	switch strings.ToLower(o.StrVal()) {
+	case "byte":
+		*isbit = false
+	case "bit":
+		*isbit = true
+	default:
+		c.AddReplyError("syntax error")
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+// BITCOUNT key [start end [BYTE | BIT]]
+func bitcountCommand(c *GodisClient) {
+	var start, end int64
+	isbit := false
+	if len(c.args) == 4 || len(c.args) == 5 {
+		if c.getLongFromObjectOrReply(c.args[2], &start) != GODIS_OK {
+			return
+		}
+		if c.getLongFromObjectOrReply(c.args[3], &end) != GODIS_OK {
+			return
+		}
+		if len(c.args) == 5 && parseBitRangeUnit(c, c.args[4], &isbit) != GODIS_OK {
+			return
+		}
+	} else if len(c.args) == 2 {
+		start, end = 0, -1
+	} else {
+		c.AddReplyError("syntax error")
+		return
+	}
+	o := findKeyRead(c.db, c.args[1])
+	if o == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	str := o.StrVal()
+	var startBit, endBit int64
+	if !bitRangeToBits(start, end, int64(len(str)), isbit, &startBit, &endBit) {
+		c.AddReplyInt8(0)
+		return
+	}
+	first, last := startBit>>3, endBit>>3
+	count := redisPopcount(str[first : last+1])
+	// 去掉第一个字节中 startBit 之前的位和最后一个字节中 endBit 之后的位
+	count -= int64(bits.OnesCount8(str[first] >> (8 - startBit&7)))
+	count -= int64(bits.OnesCount8(str[last] & byte(1<<(7-endBit&7)-1)))
+	c.AddReplyLong(count)
+}
+
+// BITPOS key bit [start [end [BYTE | BIT]]]：返回第一个值为 bit 的位的下标
+func bitposCommand(c *GodisClient) {
+	var bit int64
+	if c.getLongFromObjectOrReply(c.args[2], &bit) != GODIS_OK {
+		return
+	}
+	if bit != 0 && bit != 1 {
+		c.AddReplyError("The bit argument must be 1 or 0.")
+		return
+	}
+	var start, end int64 = 0, -1
+	endGiven := false
+	isbit := false
+	if len(c.args) >= 4 && len(c.args) <= 6 {
+		if c.getLongFromObjectOrReply(c.args[3], &start) != GODIS_OK {
+			return
+		}
+		if len(c.args) >= 5 {
+			if c.getLongFromObjectOrReply(c.args[4], &end) != GODIS_OK {
+				return
+			}
+			endGiven = true
+		}
+		if len(c.args) == 6 && parseBitRangeUnit(c, c.args[5], &isbit) != GODIS_OK {
+			return
+		}
+	} else if len(c.args) != 3 {
+		c.AddReplyError("syntax error")
+		return
+	}
+	o := findKeyRead(c.db, c.args[1])
+	if o == nil {
+		// 不存在的 key 当作空字符串，没有值为 1 的位，第一个值为 0 的位是 0
+		if bit == 1 {
+			c.AddReplyLong(-1)
+		} else {
+			c.AddReplyInt8(0)
+		}
+		return
+	}
+	if o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	str := o.StrVal()
+	var startBit, endBit int64
+	if !bitRangeToBits(start, end, int64(len(str)), isbit, &startBit, &endBit) {
+		c.AddReplyLong(-1)
+		return
+	}
+	// 整字节都不是要找的值时跳过
+	skip := byte(0)
+	if bit == 0 {
+		skip = 0xff
+	}
+	for pos := startBit; pos <= endBit; {
+		if pos&7 == 0 && pos+7 <= endBit && str[pos>>3] == skip {
+			pos += 8
+			continue
+		}
+		if int64(str[pos>>3]>>(7-pos&7))&1 == bit {
+			c.AddReplyLong(pos)
+			return
+		}
+		pos++
+	}
+	/* 没有找到值为 0 的位，并且没有指定 end 时，把字符串右边看作无限长的 0，
+	 * 返回字符串之后的第一位；指定了 end 时只在范围内查找 */
+	if bit == 0 && !endGiven {
+		c.AddReplyLong(int64(len(str)) << 3)
+		return
+	}
+	c.AddReplyLong(-1)
+}
+
+// BITOP <AND | OR | XOR | NOT> destkey key [key ...]：较短的字符串在末尾补 0，结果为空字符串时删除 destkey
+func bitopCommand(c *GodisClient) {
+	var op int
+	switch strings.ToLower(c.args[1].StrVal()) {
+	case "and":
+		op = BITOP_AND
+	case "or":
+		op = BITOP_OR
+	case "xor":
+		op = BITOP_XOR
+	case "not":
+		op = BITOP_NOT
+	default:
+		c.AddReplyError("syntax error")
+		return
+	}
+	targetkey := c.args[2]
+	numkeys := len(c.args) - 3
+	if op == BITOP_NOT && numkeys != 1 {
+		c.AddReplyError("BITOP NOT must be called with a single source key.")
+		return
+	}
+	srcs := make([]string, numkeys)
+	maxlen := 0
+	for j := 0; j < numkeys; j++ {
+		o := findKeyRead(c.db, c.args[j+3])
+		if o == nil {
+			continue
+		}
+		if o.Type_ != GSTR {
+			c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return
+		}
+		srcs[j] = o.StrVal()
+		if len(srcs[j]) > maxlen {
+			maxlen = len(srcs[j])
+		}
+	}
+	res := make([]byte, maxlen)
+	if maxlen > 0 {
+		copy(res, srcs[0])
+		if op == BITOP_NOT {
+			for i := range res {
+				res[i] = ^res[i]
+			}
+		}
+		for j := 1; j < numkeys; j++ {
+			src := srcs[j]
+			for i := range res {
+				var b byte
+				if i < len(src) {
+					b = src[i]
+				}
+				switch op {
+				case BITOP_AND:
+					res[i] &= b
+				case BITOP_OR:
+					res[i] |= b
+				case BITOP_XOR:
+					res[i] ^= b
+				}
+			}
+		}
+	}
+	if maxlen > 0 {
+		newObj := CreateObject(GSTR, string(res))
+		setKey(c.db, targetkey, newObj)
+		newObj.DecrRefCount()
+	} else {
+		dbDelete(c.db, targetkey)
+	}
+	server.dirty++
+	c.AddReplyLong(int64(maxlen))
+}
+
+// 从 offset 开始读取 bits 位无符号整数，超出字符串长度的部分当作 0
+func getUnsignedBitfield(p []byte, offset uint64, bits int) uint64 {
+	var value uint64
+	for j := 0; j < bits; j++ {
+		byte_ := offset >> 3
+		bit := 7 - (offset & 0x7)
+		var bitval uint64
+		if byte_ < uint64(len(p)) {
+			bitval = uint64(p[byte_]>>bit) & 1
+		}
+		value = (value << 1) | bitval
+		offset++
+	}
+	return value
+}
+
+func getSignedBitfield(p []byte, offset uint64, bits int) int64 {
+	value := getUnsignedBitfield(p, offset, bits)
+	// 符号位为 1 时把高位都填充为 1
+	if bits < 64 && value&(1<<(bits-1)) != 0 {
+		value |= math.MaxUint64 << bits
+	}
+	return int64(value)
+}
+
+func setUnsignedBitfield(p []byte, offset uint64, bits int, value uint64) {
+	for j := 0; j < bits; j++ {
+		bitval := byte(value>>(bits-1-j)) & 1
+		byte_ := offset >> 3
+		bit := 7 - (offset & 0x7)
+		p[byte_] &^= 1 << bit
+		p[byte_] |= bitval << bit
+		offset++
+	}
+}
+
+/*
+检查 value + incr 是否超出 bits 位无符号整数的范围，上溢返回 1，下溢返回 -1，没有溢出返回 0。
+溢出时 limit 是按照 owtype 处理之后的结果：WRAP 取模，SAT 取最大值或最小值。
+*/
+func checkUnsignedBitfieldOverflow(value uint64, incr int64, bits int, owtype int, limit *uint64) int {
+	max := uint64(1)<<bits - 1
+	maxincr := int64(max - value)
+	minincr := -int64(value)
+	if value > max || (incr > 0 && incr > maxincr) {
+		if owtype == BFOVERFLOW_WRAP {
+			*limit = (value + uint64(incr)) & max
+		} else if owtype == BFOVERFLOW_SAT {
+			*limit = max
+		}
+		return 1
+	} else if incr < 0 && incr < minincr {
+		if owtype == BFOVERFLOW_WRAP {
+			*limit = (value + uint64(incr)) & max
+		} else if owtype == BFOVERFLOW_SAT {
+			*limit = 0
+		}
+		return -1
+	}
+	return 0
+}
+
+// 有符号整数的版本，i64 时 maxincr 和 minincr 可能溢出，只在确认 value 的符号之后才使用
+func checkSignedBitfieldOverflow(value int64, incr int64, bits int, owtype int, limit *int64) int {
+	var max int64 = math.MaxInt64
+	if bits < 64 {
+		max = int64(1)<<(bits-1) - 1
+	}
+	min := -max - 1
+	maxincr := int64(uint64(max) - uint64(value))
+	minincr := min - value
+	overflow := 0
+	if value > max || (bits != 64 && incr > maxincr) || (value >= 0 && incr > 0 && incr > maxincr) {
+		overflow = 1
+		*limit = max
+	} else if value < min || (bits != 64 && incr < minincr) || (value < 0 && incr < 0 && incr < minincr) {
+		overflow = -1
+		*limit = min
+	}
+	if overflow != 0 && owtype == BFOVERFLOW_WRAP {
+		// 按无符号整数相加，再根据符号位截断到 bits 位
+		c := uint64(value) + uint64(incr)
+		if bits < 64 {
+			mask := uint64(math.MaxUint64) << bits
+			if c&(1<<(bits-1)) != 0 {
+				c |= mask
+			} else {
+				c &^= mask
+			}
+		}
+		*limit = int64(c)
+	}
+	return overflow
+}
+
+type bitfieldOp struct {
+	offset uint64 /* 位偏移量 */
+	i64    int64  /* SET 的值或 INCRBY 的增量 */
+	opcode int    /* BITFIELDOP_* */
+	owtype int    /* BFOVERFLOW_* */
+	bits   int    /* 整数的位宽 */
+	sign   bool   /* 是否是有符号整数 */
+}
+
+/*
+BITFIELD key [GET type offset] [SET type offset value] [INCRBY type offset increment] [OVERFLOW WRAP | SAT | FAIL]
+把位图当作任意位宽、任意偏移量的整数数组来读写，每个 GET / SET / INCRBY 对应回复数组中的一个元素。
+OVERFLOW 只影响它之后的 SET 和 INCRBY，FAIL 时不做修改并回复 nil。
+*/
+func bitfieldGeneric(c *GodisClient, readonly bool) {
+	var ops []bitfieldOp
+	owtype := BFOVERFLOW_WRAP
+	changes := 0
+	var highestWriteOffset uint64
+	for j := 2; j < len(c.args); j++ {
+		remargs := len(c.args) - j - 1
+		subcmd := strings.ToLower(c.args[j].StrVal())
+		var op bitfieldOp
+		if subcmd == "get" && remargs >= 2 {
+			op.opcode = BITFIELDOP_GET
+		} else if subcmd == "set" && remargs >= 3 {
+			op.opcode = BITFIELDOP_SET
+		} else if subcmd == "incrby" && remargs >= 3 {
+			op.opcode = BITFIELDOP_INCRBY
+		} else if subcmd == "overflow" && remargs >= 1 {
+			switch strings.ToLower(c.args[j+1].StrVal()) {
+			case "wrap":
+				owtype = BFOVERFLOW_WRAP
+			case "sat":
+				owtype = BFOVERFLOW_SAT
+			case "fail":
+				owtype = BFOVERFLOW_FAIL
+			default:
+				c.AddReplyError("Invalid OVERFLOW type specified")
+				return
+			}
+			j++
+			continue
+		} else {
+			c.AddReplyError("syntax error")
+			return
+		}
+		if getBitfieldTypeFromArgument(c, c.args[j+1], &op.sign, &op.bits) != GODIS_OK {
+			return
+		}
+		if getBitOffsetFromArgument(c, c.args[j+2], &op.offset, true, op.bits) != GODIS_OK {
+			return
+		}
+		if op.opcode != BITFIELDOP_GET {
+			if c.getLongFromObjectOrReply(c.args[j+3], &op.i64) != GODIS_OK {
+				return
+			}
+			if op.offset+uint64(op.bits)-1 > highestWriteOffset {
+				highestWriteOffset = op.offset + uint64(op.bits) - 1
+			}
+			changes++
+			j++
+		}
+		op.owtype = owtype
+		ops = append(ops, op)
+		j += 2
+	}
+	if readonly && changes > 0 {
+		c.AddReplyError("BITFIELD_RO only supports the GET subcommand")
+		return
+	}
+
+	var buf []byte
+	dirty := false
+	if changes == 0 {
+		// 只有 GET 时不创建 key
+		o := findKeyRead(c.db, c.args[1])
+		if o != nil {
+			if o.Type_ != GSTR {
+				c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+				return
+			}
+			buf = []byte(o.StrVal())
+		}
+	} else {
+		var ret int8
+		if buf, ret = lookupStringForBitCommand(c, highestWriteOffset, &dirty); ret != GODIS_OK {
+			return
+		}
+	}
+
+	c.AddReplyArrayLen(int64(len(ops)))
+	for _, op := range ops {
+		if op.opcode == BITFIELDOP_GET {
+			if op.sign {
+				c.AddReplyLong(getSignedBitfield(buf, op.offset, op.bits))
+			} else {
+				c.AddReplyLong(int64(getUnsignedBitfield(buf, op.offset, op.bits)))
+			}
+			continue
+		}
+		var overflow int
+		var retval int64
+		var newval uint64
+		if op.sign {
+			oldval := getSignedBitfield(buf, op.offset, op.bits)
+			var wrapped int64
+			sval := op.i64
+			if op.opcode == BITFIELDOP_INCRBY {
+				overflow = checkSignedBitfieldOverflow(oldval, op.i64, op.bits, op.owtype, &wrapped)
+				sval = int64(uint64(oldval) + uint64(op.i64))
+			} else {
+				overflow = checkSignedBitfieldOverflow(op.i64, 0, op.bits, op.owtype, &wrapped)
+			}
+			if overflow != 0 {
+				sval = wrapped
+			}
+			// SET 返回原来的值，INCRBY 返回新的值
+			retval = oldval
+			if op.opcode == BITFIELDOP_INCRBY {
+				retval = sval
+			}
+			newval = uint64(sval)
+		} else {
+			oldval := getUnsignedBitfield(buf, op.offset, op.bits)
+			var wrapped uint64
+			uval := uint64(op.i64)
+			if op.opcode == BITFIELDOP_INCRBY {
+				overflow = checkUnsignedBitfieldOverflow(oldval, op.i64, op.bits, op.owtype, &wrapped)
+				uval = oldval + uint64(op.i64)
+			} else {
+				overflow = checkUnsignedBitfieldOverflow(uval, 0, op.bits, op.owtype, &wrapped)
+			}
+			if overflow != 0 {
+				uval = wrapped
+			}
+			retval = int64(oldval)
+			if op.opcode == BITFIELDOP_INCRBY {
+				retval = int64(uval)
+			}
+			newval = uval
+		}
+		if overflow != 0 && op.owtype == BFOVERFLOW_FAIL {
+			c.AddReplyStr("$-1\r\n")
+			continue
+		}
+		c.AddReplyLong(retval)
+		setUnsignedBitfield(buf, op.offset, op.bits, newval)
+		dirty = true
+	}
+	if dirty {
+		setStringForBitCommand(c, c.args[1], buf)
+		server.dirty++
+	}
+}
+
+func bitfieldCommand(c *GodisClient) {
+	bitfieldGeneric(c, false)
+}
+
+func bitfieldroCommand(c *GodisClient) {
+	bitfieldGeneric(c, true)
+}
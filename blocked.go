@@ -0,0 +1,500 @@
+package main
+
+import (
+	"math"
+	"strings"
+)
+
+/*
+阻塞操作（参考 Redis 的 blocked.c）：BLPOP / BRPOP / BLMOVE / BZPOPMIN / BZPOPMAX。
+
+要等待的 key 都是空的时候，客户端被挂在 db.blockingKeys[key] 的队列上，不再处理它后续的命令，
+事件循环照常服务其他客户端。写命令（LPUSH、ZADD 等）往一个有客户端在等待的 key 中添加数据时，
+调用 signalKeyAsReady 把 key 放进 server.readyKeys，命令执行结束后由 handleClientsBlockedOnKeys
+按照阻塞的先后顺序（FIFO）依次服务等待的客户端，直到 key 再次变空。
+设置了超时时间的客户端注册一个 AE_ONCE 的时间事件，超时后回复 nil 并解除阻塞。
+
+解除阻塞的客户端放进 server.unblockedClients，在 beforeSleep 中继续处理它查询缓冲区中剩下的命令。
+被服务的客户端按照非阻塞的版本写入 AOF，例如 BLPOP 写成 LPOP。
+*/
+
+// 客户端阻塞的类型
+const (
+	BLOCKED_NONE = iota
+	BLOCKED_LIST
+	BLOCKED_ZSET
+)
+
+// BZPOPMIN / BZPOPMAX 弹出的位置
+const (
+	ZSET_MIN = iota
+	ZSET_MAX
+)
+
+type blockingState struct {
+	timeout     int64   /* 超时的绝对时间（毫秒），0 表示一直阻塞 */
+	timeEventId int     /* 超时的时间事件，0 表示没有 */
+	keys        []*Gobj /* 等待的 key，按照命令中的顺序，不重复 */
+	target      *Gobj   /* BLMOVE 的目标 key */
+	wherefrom   int8    /* 列表弹出的位置 LIST_HEAD / LIST_TAIL，有序集合是 ZSET_MIN / ZSET_MAX */
+	whereto     int8    /* BLMOVE 插入目标列表的位置 */
+}
+
+// 有客户端在等待并且被添加了数据的 key
+type readyList struct {
+	db  *GodisDB
+	key *Gobj
+}
+
+/*
+解析阻塞命令的超时时间（秒，可以是小数），转换为绝对时间的毫秒数，0 表示一直阻塞。
+*/
+func getTimeoutFromObjectOrReply(c *GodisClient, o *Gobj, timeout *int64) int8 {
+	var ftval float64
+	if c.getDoubleFromObject(o, &ftval) != GODIS_OK || math.IsInf(ftval, 0) {
+		c.AddReplyError("timeout is not a float or out of range")
+		return GODIS_ERR
+	}
+	tval := int64(ftval * 1000.0)
+	if tval < 0 {
+		c.AddReplyError("timeout is negative")
+		return GODIS_ERR
+	}
+	if tval > 0 {
+		now := GetMsTime()
+		if tval > math.MaxInt64-now {
+			c.AddReplyError("timeout is out of range")
+			return GODIS_ERR
+		}
+		tval += now
+	}
+	*timeout = tval
+	return GODIS_OK
+}
+
+/*
+阻塞客户端，等待 keys 中的任意一个有数据。同一个 key 只等待一次。
+target、wherefrom、whereto 是被服务时需要的参数，BLPOP 等没有目标 key 的命令 target 为 nil。
+*/
+func blockForKeys(c *GodisClient, btype int, keys []*Gobj, timeout int64, target *Gobj, wherefrom, whereto int8) {
+	c.bpop.timeout = timeout
+	c.bpop.wherefrom = wherefrom
+	c.bpop.whereto = whereto
+	if target != nil {
+		target.IncrRefCount()
+		c.bpop.target = target
+	}
+	for _, key := range keys {
+		dup := false
+		for _, k := range c.bpop.keys {
+			if GStrEqual(k, key) {
+				dup = true
+				break
+			}
+		}
+		if dup {
+			continue
+		}
+		key.IncrRefCount()
+		c.bpop.keys = append(c.bpop.keys, key)
+		k := key.StrVal()
+		c.db.blockingKeys[k] = append(c.db.blockingKeys[k], c)
+	}
+	c.btype = btype
+	server.blockedClients++
+	if timeout > 0 {
+		c.bpop.timeEventId = server.aeLoop.AddTimeEvent(AE_ONCE, timeout-GetMsTime(), blockedClientTimeout, c)
+	}
+}
+
+// 从所有等待的 key 的队列中移除客户端
+func unblockClientWaitingData(c *GodisClient) {
+	for _, key := range c.bpop.keys {
+		k := key.StrVal()
+		clients := c.db.blockingKeys[k]
+		for i, client := range clients {
+			if client == c {
+				clients = append(clients[:i], clients[i+1:]...)
+				break
+			}
+		}
+		if len(clients) == 0 {
+			delete(c.db.blockingKeys, k)
+		} else {
+			c.db.blockingKeys[k] = clients
+		}
+		key.DecrRefCount()
+	}
+	c.bpop.keys = nil
+	if c.bpop.target != nil {
+		c.bpop.target.DecrRefCount()
+		c.bpop.target = nil
+	}
+	if c.bpop.timeEventId != 0 {
+		server.aeLoop.RemoveTimeEvent(c.bpop.timeEventId)
+		c.bpop.timeEventId = 0
+	}
+}
+
+/*
+解除客户端的阻塞，之后在 beforeSleep 中继续处理它已经收到的命令。
+客户端断开连接时 freeClient 也会调用这里，这时不需要再处理剩下的命令。
+*/
+func unblockClient(c *GodisClient) {
+	if c.btype == BLOCKED_NONE {
+		return
+	}
+	unblockClientWaitingData(c)
+	c.btype = BLOCKED_NONE
+	server.blockedClients--
+	server.unblockedClients = append(server.unblockedClients, c)
+}
+
+// 超时的时间事件：回复 nil 并解除阻塞
+func blockedClientTimeout(loop *AeLoop, id int, extra interface{}) {
+	c := extra.(*GodisClient)
+	if c.btype == BLOCKED_NONE || c.bpop.timeEventId != id {
+		return
+	}
+	// 时间事件执行完之后由事件循环删除
+	c.bpop.timeEventId = 0
+	if c.bpop.target != nil {
+		// BLMOVE 的回复是一个元素，超时时回复 null bulk
+		c.AddReplyStr("$-1\r\n")
+	} else {
+		c.AddReplyStr("*-1\r\n")
+	}
+	unblockClient(c)
+}
+
+// 继续处理被解除阻塞的客户端在阻塞期间收到的命令
+func processUnblockedClients() {
+	for len(server.unblockedClients) > 0 {
+		c := server.unblockedClients[0]
+		server.unblockedClients = server.unblockedClients[1:]
+		// 阻塞期间已经断开连接的客户端
+		if server.clients[c.fd] != c || c.btype != BLOCKED_NONE {
+			continue
+		}
+		if c.queryLen > 0 {
+			if err := ProcessQueryBuf(c); err != nil {
+				freeClient(c)
+			}
+		}
+	}
+	server.unblockedClients = nil
+}
+
+/*
+key 被添加了数据，如果有客户端在等待这个 key，放进 server.readyKeys，
+当前命令执行结束后由 handleClientsBlockedOnKeys 处理。同一个 key 只放一次。
+*/
+func signalKeyAsReady(db *GodisDB, key *Gobj) {
+	k := key.StrVal()
+	if _, ok := db.blockingKeys[k]; !ok {
+		return
+	}
+	if _, ok := db.readyKeys[k]; ok {
+		return
+	}
+	db.readyKeys[k] = struct{}{}
+	key.IncrRefCount()
+	server.readyKeys = append(server.readyKeys, &readyList{db: db, key: key})
+}
+
+// SWAPDB 之后数据库中的 key 都变了，检查所有等待的 key 是否已经有数据
+func scanDatabaseForReadyKeys(db *GodisDB) {
+	for k := range db.blockingKeys {
+		key := CreateObject(GSTR, k)
+		if o := db.data.Find(key); o != nil && (o.Value.Type_ == GLIST || o.Value.Type_ == GZSET) {
+			signalKeyAsReady(db, key)
+		}
+		key.DecrRefCount()
+	}
+}
+
+/*
+服务所有 ready 的 key 上等待的客户端。服务过程中 BLMOVE 可能会往其他 key 中添加数据，
+新的 ready key 会在下一轮中处理，直到没有 ready 的 key 为止。
+*/
+func handleClientsBlockedOnKeys() {
+	for len(server.readyKeys) > 0 {
+		l := server.readyKeys
+		server.readyKeys = nil
+		for _, rl := range l {
+			// 先从 readyKeys 中删除，服务过程中这个 key 可以再次被标记为 ready
+			delete(rl.db.readyKeys, rl.key.StrVal())
+			o := lookupKeyWrite(rl.db, rl.key)
+			if o != nil {
+				if o.Type_ == GLIST {
+					serveClientsBlockedOnListKey(o, rl)
+				} else if o.Type_ == GZSET {
+					serveClientsBlockedOnSortedSetKey(o, rl)
+				}
+			}
+			rl.key.DecrRefCount()
+		}
+	}
+}
+
+// 按照阻塞的先后顺序服务等待列表的客户端，直到列表为空
+func serveClientsBlockedOnListKey(o *Gobj, rl *readyList) {
+	clients := append([]*GodisClient(nil), rl.db.blockingKeys[rl.key.StrVal()]...)
+	list := o.Val_.(*List)
+	for _, receiver := range clients {
+		if list.Length() == 0 {
+			break
+		}
+		if receiver.btype != BLOCKED_LIST {
+			continue
+		}
+		wherefrom := receiver.bpop.wherefrom
+		var node *Node
+		if wherefrom == LIST_HEAD {
+			node = list.First()
+		} else {
+			node = list.Last()
+		}
+		list.DelNode(node)
+		value := node.Val
+		if serveClientBlockedOnList(receiver, rl.key, receiver.bpop.target, rl.db, value, wherefrom, receiver.bpop.whereto) != GODIS_OK {
+			// BLMOVE 的目标 key 类型错误，把元素放回去
+			if wherefrom == LIST_HEAD {
+				list.LPush(value)
+			} else {
+				list.Append(value)
+			}
+		} else {
+			value.DecrRefCount()
+		}
+		unblockClient(receiver)
+	}
+	if list.Length() == 0 {
+		dbDelete(rl.db, rl.key)
+	}
+}
+
+/*
+把弹出的 value 交给等待的客户端：BLPOP / BRPOP 直接回复 key 和 value，BLMOVE 插入到目标列表中。
+按照 LPOP / RPOP / LMOVE 写入 AOF。目标 key 的类型错误时回复错误并返回 GODIS_ERR。
+*/
+func serveClientBlockedOnList(receiver *GodisClient, key, dstkey *Gobj, db *GodisDB, value *Gobj, wherefrom, whereto int8) int8 {
+	if dstkey == nil {
+		propagateBlockedServe(db, CreateObject(GSTR, listPopCommandName(wherefrom)), key)
+		receiver.AddReplyArrayLen(2)
+		receiver.AddReplyBulk(key)
+		receiver.AddReplyBulk(value)
+		return GODIS_OK
+	}
+	dstobj := lookupKeyWrite(db, dstkey)
+	if dstobj != nil && dstobj.Type_ != GLIST {
+		receiver.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return GODIS_ERR
+	}
+	lmoveHandlePush(receiver, db, dstkey, dstobj, value, whereto)
+	propagateBlockedServe(db, CreateObject(GSTR, "LMOVE"), key, dstkey,
+		CreateObject(GSTR, listPositionName(wherefrom)), CreateObject(GSTR, listPositionName(whereto)))
+	return GODIS_OK
+}
+
+// 按照阻塞的先后顺序服务等待有序集合的客户端，直到有序集合为空
+func serveClientsBlockedOnSortedSetKey(o *Gobj, rl *readyList) {
+	clients := append([]*GodisClient(nil), rl.db.blockingKeys[rl.key.StrVal()]...)
+	zs := o.Val_.(zset)
+	for _, receiver := range clients {
+		if zs.zsl.length == 0 {
+			break
+		}
+		if receiver.btype != BLOCKED_ZSET {
+			continue
+		}
+		where := receiver.bpop.wherefrom
+		member, score := zsetPop(zs, where)
+		name := "ZPOPMIN"
+		if where == ZSET_MAX {
+			name = "ZPOPMAX"
+		}
+		propagateBlockedServe(rl.db, CreateObject(GSTR, name), rl.key)
+		receiver.AddReplyArrayLen(3)
+		receiver.AddReplyBulk(rl.key)
+		receiver.AddReplyBulk(member)
+		receiver.AddReplyDouble(score)
+		unblockClient(receiver)
+	}
+	if zs.zsl.length == 0 {
+		dbDelete(rl.db, rl.key)
+	}
+}
+
+// 被服务的阻塞命令不是由 ProcessCommand 执行的，单独写入 AOF
+func propagateBlockedServe(db *GodisDB, args ...*Gobj) {
+	server.dirty++
+	if server.appendonly != 1 {
+		return
+	}
+	FeedAppendOnlyFile(&GodisCommand{name: strings.ToLower(args[0].StrVal())}, db.id, args)
+}
+
+// LIST_HEAD / LIST_TAIL 对应的 LPOP / RPOP
+func listPopCommandName(where int8) string {
+	if where == LIST_HEAD {
+		return "LPOP"
+	}
+	return "RPOP"
+}
+
+func listPositionName(where int8) string {
+	if where == LIST_HEAD {
+		return "LEFT"
+	}
+	return "RIGHT"
+}
+
+// 解析 LMOVE / BLMOVE 的 LEFT / RIGHT 参数
+func getListPositionFromObjectOrReply(c *GodisClient, arg *Gobj, position *int8) int8 {
+	switch strings.ToLower(arg.StrVal()) {
+	case "left":
+		*position = LIST_HEAD
+	case "right":
+		*position = LIST_TAIL
+	default:
+		c.AddReplyError("syntax error")
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+/*
+BLPOP / BRPOP key [key ...] timeout：从第一个非空的列表中弹出元素，回复 key 和元素。
+所有列表都为空时阻塞，超时回复 nil。
+*/
+func blockingPopGenericCommand(c *GodisClient, where int8) {
+	var timeout int64
+	if getTimeoutFromObjectOrReply(c, c.args[len(c.args)-1], &timeout) != GODIS_OK {
+		return
+	}
+	keys := c.args[1 : len(c.args)-1]
+	for _, key := range keys {
+		o := lookupKeyWrite(c.db, key)
+		if o == nil {
+			continue
+		}
+		if o.Type_ != GLIST {
+			c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return
+		}
+		list := o.Val_.(*List)
+		if list.Length() == 0 {
+			continue
+		}
+		// 非空的列表，和 LPOP / RPOP 一样
+		var node *Node
+		if where == LIST_HEAD {
+			node = list.First()
+		} else {
+			node = list.Last()
+		}
+		list.DelNode(node)
+		c.AddReplyArrayLen(2)
+		c.AddReplyBulk(key)
+		c.AddReplyBulk(node.Val)
+		node.Val.DecrRefCount()
+		if list.Length() == 0 {
+			dbDelete(c.db, key)
+		}
+		server.dirty++
+		// 按照 LPOP / RPOP 写入 AOF
+		rewriteClientCommandVector(c, CreateObject(GSTR, listPopCommandName(where)), key)
+		return
+	}
+	// 加载 AOF 时的伪客户端不能阻塞，当作超时处理
+	if c.fd < 0 {
+		c.AddReplyStr("*-1\r\n")
+		return
+	}
+	blockForKeys(c, BLOCKED_LIST, keys, timeout, nil, where, 0)
+}
+
+func blpopCommand(c *GodisClient) {
+	blockingPopGenericCommand(c, LIST_HEAD)
+}
+
+func brpopCommand(c *GodisClient) {
+	blockingPopGenericCommand(c, LIST_TAIL)
+}
+
+/*
+BLMOVE source destination LEFT|RIGHT LEFT|RIGHT timeout：source 非空时和 LMOVE 一样，
+否则阻塞等待 source 有数据。
+*/
+func blmoveCommand(c *GodisClient) {
+	var wherefrom, whereto int8
+	if getListPositionFromObjectOrReply(c, c.args[3], &wherefrom) != GODIS_OK ||
+		getListPositionFromObjectOrReply(c, c.args[4], &whereto) != GODIS_OK {
+		return
+	}
+	var timeout int64
+	if getTimeoutFromObjectOrReply(c, c.args[5], &timeout) != GODIS_OK {
+		return
+	}
+	o := lookupKeyWrite(c.db, c.args[1])
+	if o != nil && o.Type_ != GLIST {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	if o != nil && o.Val_.(*List).Length() > 0 {
+		lmoveGenericCommand(c, wherefrom, whereto)
+		return
+	}
+	if c.fd < 0 {
+		c.AddReplyStr("*-1\r\n")
+		return
+	}
+	blockForKeys(c, BLOCKED_LIST, c.args[1:2], timeout, c.args[2], wherefrom, whereto)
+}
+
+/*
+BZPOPMIN / BZPOPMAX key [key ...] timeout：从第一个非空的有序集合中弹出分数最小 / 最大的成员，
+回复 key、成员和分数。所有有序集合都为空时阻塞，超时回复 nil。
+*/
+func blockingGenericZpopCommand(c *GodisClient, where int8) {
+	var timeout int64
+	if getTimeoutFromObjectOrReply(c, c.args[len(c.args)-1], &timeout) != GODIS_OK {
+		return
+	}
+	keys := c.args[1 : len(c.args)-1]
+	for _, key := range keys {
+		o := lookupKeyWrite(c.db, key)
+		if o == nil {
+			continue
+		}
+		if o.Type_ != GZSET {
+			c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return
+		}
+		if o.Val_.(zset).zsl.length == 0 {
+			continue
+		}
+		// 非空的有序集合，和 ZPOPMIN / ZPOPMAX 一样，按照 ZPOPMIN / ZPOPMAX 写入 AOF
+		genericZpopCommand(c, []*Gobj{key}, where, true, nil)
+		name := "ZPOPMIN"
+		if where == ZSET_MAX {
+			name = "ZPOPMAX"
+		}
+		rewriteClientCommandVector(c, CreateObject(GSTR, name), key)
+		return
+	}
+	if c.fd < 0 {
+		c.AddReplyStr("*-1\r\n")
+		return
+	}
+	blockForKeys(c, BLOCKED_ZSET, keys, timeout, nil, where, 0)
+}
+
+func bzpopminCommand(c *GodisClient) {
+	blockingGenericZpopCommand(c, ZSET_MIN)
+}
+
+func bzpopmaxCommand(c *GodisClient) {
+	blockingGenericZpopCommand(c, ZSET_MAX)
+}
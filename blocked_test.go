@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+)
+
+// 超时的时候 BLPOP 回复 null array，BLMOVE 回复 null bulk
+func TestBlockedClientTimeoutReply(t *testing.T) {
+	newTestServer(t, `"appendonly":false,"save":""`)
+	cases := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"blpop", "list", "1"}, "*-1\r\n"},
+		{[]string{"brpop", "list", "1"}, "*-1\r\n"},
+		{[]string{"blmove", "list", "dst", "left", "right", "1"}, "$-1\r\n"},
+		{[]string{"bzpopmin", "zset", "1"}, "*-1\r\n"},
+	}
+	for _, tc := range cases {
+		c := newTestClient(t)
+		if got := c.do(tc.args...); got != "" {
+			t.Fatalf("%v should block, got %q", tc.args, got)
+		}
+		blockedClientTimeout(server.aeLoop, c.c.bpop.timeEventId, c.c)
+		if got := c.read(); got != tc.reply {
+			t.Errorf("%v: got %q, want %q", tc.args, got, tc.reply)
+		}
+		if c.c.btype != BLOCKED_NONE {
+			t.Errorf("%v: client still blocked after timeout", tc.args)
+		}
+	}
+}
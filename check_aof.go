@@ -0,0 +1,115 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+/*
+godis-check-aof [--fix] <file.aof>
+
+用和 loadAppendOnlyFile 相同的 aofReader 解析整个 AOF 文件，报告第一条无法解析的命令的偏移量。
+--fix 会把文件截断到最后一条完整的命令，和 redis-check-aof --fix 一样。
+参数是 manifest 文件时依次检查其中的 base 和 incr 文件。
+*/
+func checkAofMain(args []string) int {
+	fix := false
+	var filename string
+	switch {
+	case len(args) == 1:
+		filename = args[0]
+	case len(args) == 2 && args[0] == "--fix":
+		fix = true
+		filename = args[1]
+	default:
+		fmt.Fprintf(os.Stderr, "Usage: godis-check-aof [--fix] <file.aof|file.manifest>\n")
+		return 1
+	}
+	if strings.HasSuffix(filename, MANIFEST_NAME_SUFFIX) {
+		return checkMultiPartAof(filename, fix)
+	}
+	return checkSingleAof(filename, fix)
+}
+
+func checkSingleAof(filename string, fix bool) int {
+	fp, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("Cannot open file: %s: %v\n", filename, err)
+		return 1
+	}
+	info, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		fmt.Printf("Cannot stat file: %s: %v\n", filename, err)
+		return 1
+	}
+	size := info.Size()
+	ar := newAofReader(fp)
+	var cmdErr error
+	for {
+		if _, err := ar.ReadCommand(); err != nil {
+			if err != io.EOF {
+				cmdErr = err
+			}
+			break
+		}
+	}
+	fp.Close()
+
+	if cmdErr == io.ErrUnexpectedEOF {
+		fmt.Printf("0x%16x: Unexpected EOF\n", ar.pos)
+	} else if cmdErr != nil {
+		fmt.Printf("0x%16x: %v\n", ar.pos, cmdErr)
+	}
+	diff := size - ar.offset
+	fmt.Printf("AOF analyzed: filename=%s, size=%d, ok_up_to=%d, diff=%d\n", filename, size, ar.offset, diff)
+	if diff == 0 {
+		fmt.Printf("AOF %s is valid\n", filename)
+		return 0
+	}
+	if !fix {
+		fmt.Printf("AOF %s is not valid. Use the --fix option to try fixing it.\n", filename)
+		return 1
+	}
+	if err := os.Truncate(filename, ar.offset); err != nil {
+		fmt.Printf("Failed to truncate AOF %s: %v\n", filename, err)
+		return 1
+	}
+	fmt.Printf("Successfully truncated AOF %s\n", filename)
+	return 0
+}
+
+// 只有最后一个 incr 文件可以用 --fix 截断，其它文件出错说明数据已经丢失了
+func checkMultiPartAof(manifest string, fix bool) int {
+	am, err := aofLoadManifestFromFile(manifest)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		return 1
+	}
+	dir := filepath.Dir(manifest)
+	if am.base != nil {
+		path := filepath.Join(dir, am.base.filename)
+		fmt.Printf("Start checking base AOF %s\n", path)
+		var ret int
+		if strings.HasSuffix(am.base.filename, RDB_FORMAT_SUFFIX) {
+			ret = checkRdbMain([]string{path})
+		} else {
+			ret = checkSingleAof(path, false)
+		}
+		if ret != 0 {
+			return ret
+		}
+	}
+	for i, incr := range am.incrList {
+		path := filepath.Join(dir, incr.filename)
+		fmt.Printf("Start checking incr AOF %s\n", path)
+		if ret := checkSingleAof(path, fix && i == len(am.incrList)-1); ret != 0 {
+			return ret
+		}
+	}
+	fmt.Printf("All AOF files and manifest are valid\n")
+	return 0
+}
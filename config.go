@@ -2,12 +2,31 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
+	"math"
 	"os"
+	"strconv"
+	"strings"
 )
 
+const CONFIG_DEFAULT_DBNUM = 16
+
 type Config struct {
-	Port int `json:"port"`
+	Port              int    `json:"port"`
+	Databases         int    `json:"databases"` // 数据库的个数，SELECT 的参数范围是 [0, databases)
+	AppendOnly        bool   `json:"appendonly"`
+	AppendFsync       string `json:"appendfsync"` // always / everysec / no
+	AppendFilename    string `json:"appendfilename"`
+	AppendDirname     string `json:"appenddirname"`     // 混合持久化时 AOF 文件所在的目录
+	AofUseRdbPreamble bool   `json:"aofuserdbpreamble"` // 混合持久化：RDB 格式的 base 文件 + 命令格式的 incr 文件
+	DbFilename        string `json:"dbfilename"`
+	RdbFormat         string `json:"rdbformat"`         // godis / redis，加载时会自动识别
+	MaxMemory         string `json:"maxmemory"`         // 例如 "100mb"，"0" 表示不限制
+	MaxMemoryPolicy   string `json:"maxmemory-policy"`  // noeviction / allkeys-lru / volatile-lru / allkeys-lfu / volatile-lfu / allkeys-random / volatile-random / volatile-ttl
+	MaxMemorySamples  int    `json:"maxmemory-samples"` // 每次淘汰抽样的 key 数量
+	Save              string `json:"save"`              // save <seconds> <changes> 规则，例如 "3600 1 300 100"，空字符串表示关闭
 }
 
 func LoadConfig(path string) (config *Config, err error) {
@@ -22,12 +41,88 @@ func LoadConfig(path string) (config *Config, err error) {
 		return
 	}
 
-	config = &Config{}
+	// 默认值，配置文件中没有出现的字段保持不变
+	config = &Config{
+		Databases:        CONFIG_DEFAULT_DBNUM,
+		AppendOnly:       true,
+		AppendFsync:      AOF_FSYNC_EVERYSEC,
+		AppendFilename:   "./redis.aof",
+		AppendDirname:    "./appendonlydir",
+		DbFilename:       "./dump.rdb",
+		RdbFormat:        RDB_FORMAT_GODIS,
+		Save:             "3600 1 300 100 60 10000",
+		MaxMemory:        "0",
+		MaxMemoryPolicy:  "noeviction",
+		MaxMemorySamples: CONFIG_DEFAULT_MAXMEMORY_SAMPLES,
+	}
 	if err = json.Unmarshal(jsonStr, config); err != nil {
 		return nil, err
 	}
-	server.appendonly = 1
-	server.appendfilename = "./redis.aof"
-	server.dbfilename = "./dump.rdb"
 	return
 }
+
+/*
+memtoull 解析带单位的内存大小，例如 "1gb"、"100mb"、"4096"。
+k/m/g 是 1000 的倍数，kb/mb/gb 是 1024 的倍数，不区分大小写（和 Redis 的配置文件一致）。
+*/
+func memtoull(s string) (uint64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	units := []struct {
+		suffix string
+		mul    uint64
+	}{
+		{"kb", 1024}, {"mb", 1024 * 1024}, {"gb", 1024 * 1024 * 1024},
+		{"k", 1000}, {"m", 1000 * 1000}, {"g", 1000 * 1000 * 1000},
+		{"b", 1},
+	}
+	mul := uint64(1)
+	for _, u := range units {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSuffix(s, u.suffix)
+			mul = u.mul
+			break
+		}
+	}
+	val, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if val > math.MaxUint64/mul {
+		return 0, errors.New("value out of range")
+	}
+	return val * mul, nil
+}
+
+// setSaveParamsFromString 解析 "<seconds> <changes> [<seconds> <changes> ...]" 形式的 save 规则
+func setSaveParamsFromString(s string) error {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return errors.New("invalid save parameters")
+	}
+	params := make([]saveparam, 0, len(fields)/2)
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.ParseUint(fields[i], 10, 32)
+		if err != nil {
+			return errors.New("invalid save parameters")
+		}
+		changes, err := strconv.Atoi(fields[i+1])
+		if err != nil || changes < 0 {
+			return errors.New("invalid save parameters")
+		}
+		params = append(params, saveparam{seconds: uint(seconds), changes: changes})
+	}
+	server.saveparams = params
+	server.saveparamslen = len(params)
+	return nil
+}
+
+func saveParamsToString() string {
+	var sb strings.Builder
+	for i, sp := range server.saveparams {
+		if i > 0 {
+			sb.WriteString(" ")
+		}
+		sb.WriteString(fmt.Sprintf("%d %d", sp.seconds, sp.changes))
+	}
+	return sb.String()
+}
@@ -0,0 +1,20 @@
+package main
+
+import "hash/crc64"
+
+/*
+Redis 使用的 CRC-64/Jones 校验（反射多项式 0x95AC9329AC4BC9B5，初始值 0，结果不取反），
+标准库 hash/crc64 的 Update 会在开始和结束时对 crc 取反，和 Redis 的结果不一致，
+所以这里只借用标准库生成的查找表。
+crc64(0, "123456789") == 0xe9c6d914c4b8d9ca
+*/
+const CRC64_JONES_POLY = 0x95AC9329AC4BC9B5
+
+var crc64JonesTable = crc64.MakeTable(CRC64_JONES_POLY)
+
+func crc64Update(crc uint64, p []byte) uint64 {
+	for _, v := range p {
+		crc = crc64JonesTable[byte(crc)^v] ^ (crc >> 8)
+	}
+	return crc
+}
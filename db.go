@@ -0,0 +1,210 @@
+package main
+
+import (
+	"strings"
+	"time"
+)
+
+/*
+多个数据库（参考 Redis 的 db.c）：server.db 是 dbnum 个 GodisDB，客户端通过 SELECT 切换 c.db。
+SWAPDB 和 FLUSHDB/FLUSHALL 只替换 GodisDB 中的字典，不替换 GodisDB 本身，
+这样客户端持有的 c.db 指针始终有效，并且仍然指向原来编号的数据库。
+*/
+
+// 切换客户端当前的数据库，id 超出范围时返回 GODIS_ERR
+func selectDb(c *GodisClient, id int64) int8 {
+	if id < 0 || id >= int64(server.dbnum) {
+		return GODIS_ERR
+	}
+	c.db = server.db[id]
+	return GODIS_OK
+}
+
+// 清空一个数据库，返回删除的 key 数量
+func emptyDb(db *GodisDB) int64 {
+	removed := db.data.usedSize()
+	db.data = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+	db.expire = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+	db.hexpires = DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+	return removed
+}
+
+// dbid 为 -1 时清空所有数据库
+func emptyData(dbid int) int64 {
+	var removed int64
+	for _, db := range server.db {
+		if dbid == -1 || db.id == dbid {
+			removed += emptyDb(db)
+		}
+	}
+	return removed
+}
+
+// FLUSHDB/FLUSHALL [ASYNC|SYNC]，godis 总是同步清空
+func getFlushCommandFlags(c *GodisClient) int8 {
+	if len(c.args) > 2 {
+		c.AddReplyError("syntax error")
+		return GODIS_ERR
+	}
+	if len(c.args) == 2 {
+		flag := strings.ToLower(c.args[1].StrVal())
+		if flag != "async" && flag != "sync" {
+			c.AddReplyError("syntax error")
+			return GODIS_ERR
+		}
+	}
+	return GODIS_OK
+}
+
+// 替换 key 的值，过期时间保持不变，key 不存在时直接添加。LFU 策略下新的值继承原来的访问频率
+func dbOverwrite(db *GodisDB, key *Gobj, val *Gobj) {
+	if server.maxmemorypolicy&MAXMEMORY_FLAG_LFU != 0 {
+		if old := db.data.Find(key); old != nil {
+			val.lru = old.Value.lru
+		}
+	}
+	db.data.Set(key, val)
+}
+
+// 设置 key 的值并清除原来的过期时间，和 SET 命令的语义一致
+func setKey(db *GodisDB, key *Gobj, val *Gobj) {
+	dbOverwrite(db, key, val)
+	db.expire.Delete(key)
+}
+
+// 删除 key 和它的过期时间，key 不存在时返回 false
+func dbDelete(db *GodisDB, key *Gobj) bool {
+	if db.data.Delete(key) != nil {
+		return false
+	}
+	db.expire.Delete(key)
+	return true
+}
+
+// 不是由命令直接删除的 key（例如被淘汰）要单独写入一条 DEL，否则重放 AOF 时这个 key 又回来了
+func propagateDeletion(db *GodisDB, key *Gobj) {
+	if server.appendonly != 1 {
+		return
+	}
+	del := CreateObject(GSTR, "DEL")
+	FeedAppendOnlyFile(&GodisCommand{name: "del"}, db.id, []*Gobj{del, key})
+	del.DecrRefCount()
+}
+
+func selectCommand(c *GodisClient) {
+	var id int64
+	if c.getLongFromObject(c.args[1], &id) != GODIS_OK {
+		c.AddReplyError("invalid DB index")
+		return
+	}
+	if selectDb(c, id) == GODIS_ERR {
+		c.AddReplyError("DB index is out of range")
+		return
+	}
+	c.AddReplyStr("+OK" + CRLF)
+}
+
+// MOVE key db：目标数据库中已经存在这个 key 时不移动，返回 0
+func moveCommand(c *GodisClient) {
+	key := c.args[1]
+	var dbid int64
+	if c.getLongFromObjectOrReply(c.args[2], &dbid) != GODIS_OK {
+		return
+	}
+	if dbid < 0 || dbid >= int64(server.dbnum) {
+		c.AddReplyError("DB index is out of range")
+		return
+	}
+	src := c.db
+	dst := server.db[dbid]
+	if src == dst {
+		c.AddReplyError("source and destination objects are the same")
+		return
+	}
+	o := lookupKeyWrite(src, key)
+	if o == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if lookupKeyWrite(dst, key) != nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	// 过期时间跟着 key 一起移动
+	expire := getExpire(src, key)
+	dst.data.Set(key, o)
+	if expire != -1 {
+		setExpire(dst, key, expire)
+	}
+	if o.Type_ == GHASH {
+		dbTrackHashFieldExpires(dst, key, o)
+	}
+	// 目标数据库中可能有客户端阻塞在这个 key 上
+	signalKeyAsReady(dst, key)
+	src.data.Delete(key)
+	src.expire.Delete(key)
+	server.dirty++
+	c.AddReplyInt8(1)
+}
+
+// SWAPDB index1 index2：交换两个数据库中的数据，连接在这两个数据库上的客户端会立即看到对方的数据
+func swapdbCommand(c *GodisClient) {
+	var id1, id2 int64
+	if c.getLongFromObject(c.args[1], &id1) != GODIS_OK {
+		c.AddReplyError("invalid first DB index")
+		return
+	}
+	if c.getLongFromObject(c.args[2], &id2) != GODIS_OK {
+		c.AddReplyError("invalid second DB index")
+		return
+	}
+	if id1 < 0 || id1 >= int64(server.dbnum) || id2 < 0 || id2 >= int64(server.dbnum) {
+		c.AddReplyError("DB index is out of range")
+		return
+	}
+	db1 := server.db[id1]
+	db2 := server.db[id2]
+	db1.data, db2.data = db2.data, db1.data
+	db1.expire, db2.expire = db2.expire, db1.expire
+	db1.hexpires, db2.hexpires = db2.hexpires, db1.hexpires
+	// 阻塞的客户端留在原来编号的数据库上，交换过来的数据中可能已经有它们等待的 key
+	scanDatabaseForReadyKeys(db1)
+	scanDatabaseForReadyKeys(db2)
+	server.dirty++
+	c.AddReplyStr("+OK" + CRLF)
+}
+
+func flushdbCommand(c *GodisClient) {
+	if getFlushCommandFlags(c) == GODIS_ERR {
+		return
+	}
+	server.dirty += emptyData(c.db.id)
+	// 即使数据库本来就是空的也写入 AOF
+	server.dirty++
+	c.AddReplyStr("+OK" + CRLF)
+}
+
+// FLUSHALL 之后如果配置了 save 规则，立即保存一个空的 RDB 文件，否则重启后旧的 RDB 会把数据加载回来
+func flushallCommand(c *GodisClient) {
+	if getFlushCommandFlags(c) == GODIS_ERR {
+		return
+	}
+	server.dirty += emptyData(-1)
+	// 正在进行的 BGSAVE 保存的是清空之前的数据，不能让它在下面的 rdbSave 之后覆盖 RDB 文件
+	killRDBChild()
+	if server.saveparamslen > 0 && rdbSave(server.dbfilename, server.db) == nil {
+		server.dirty = 0
+		server.lastsave = time.Now().Unix()
+		server.lastbgsavestatus = GODIS_OK
+	}
+	server.dirty++
+	/* Without the forceCommandPropagation, when DB was already empty,
+	 * FLUSHALL will not be replicated nor put into the AOF.
+	 * 上面的 rdbSave 会把 dirty 清零，同样需要强制写入 */
+	forceCommandPropagation(c)
+	c.AddReplyStr("+OK" + CRLF)
+}
+
+func dbsizeCommand(c *GodisClient) {
+	c.AddReplyLong(c.db.data.usedSize())
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"testing"
+)
+
+// MOVE 到另一个数据库的 key 要唤醒在那个数据库中等待这个 key 的客户端
+func TestMoveWakesBlockedClient(t *testing.T) {
+	newTestServer(t, `"appendonly":false,"save":""`)
+	blocked := newTestClient(t)
+	blocked.do("select", "1")
+	if got := blocked.do("blpop", "list", "0"); got != "" {
+		t.Fatalf("blpop should block, got %q", got)
+	}
+	c := newTestClient(t)
+	c.do("rpush", "list", "a")
+	if got := c.do("move", "list", "1"); got != ":1\r\n" {
+		t.Fatalf("move: %q", got)
+	}
+	if got := blocked.read(); got != "*2\r\n$4\r\nlist\r\n$1\r\na\r\n" {
+		t.Fatalf("blocked client got %q", got)
+	}
+}
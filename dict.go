@@ -2,6 +2,7 @@ package main
 
 import (
 	"errors"
+	"math/bits"
 	"math/rand"
 )
 
@@ -51,6 +52,9 @@ type Dict struct {
 	hts           [2]*htable
 	rehashidx     int64 // -1 表示未进行rehash
 	safeIterators int32 // 新增：安全迭代器计数
+
+	// 使用者附加的数据，例如哈希字段的过期时间（参考 Redis 的 dict metadata）
+	metadata interface{}
 }
 
 func DictCreate(dictType DictType) *Dict {
@@ -121,7 +125,8 @@ func (dict *Dict) expandIfNeeded() error {
 	if dict.hts[0] == nil {
 		return dict.expand(INIT_SIZE)
 	}
-	if (dict.hts[0].used > dict.hts[0].size) && (dict.hts[0].used/dict.hts[1].size > FORCE_RATIO) {
+	// 用乘法比较负载因子，整数除法会把 2.9 截断成 2，表要到 3 倍才扩容
+	if dict.hts[0].used > dict.hts[0].size*FORCE_RATIO {
 		return dict.expand(dict.hts[0].size * GROW_RATIO)
 	}
 	return nil
@@ -393,6 +398,10 @@ func (iter *DictIterator) Next() (key, val *Gobj, exists bool) {
 		if iter.entry == nil {
 			// 移动到下一个桶
 			ht := iter.d.hts[iter.table]
+			if ht == nil {
+				// 空字典，还没有分配哈希表
+				return nil, nil, false
+			}
 
 			iter.index++
 			if iter.index >= ht.size {
@@ -428,4 +437,63 @@ func (iter *DictIterator) Close() {
 	}
 }
 
+/*
+Scan 遍历游标 cursor 指向的桶（参考 Redis 的 dictScan），对其中每个 entry 调用 fn，返回下一个游标，
+返回 0 表示遍历结束。
+
+游标按反向二进制递增（先加最高位）：表大小是 2 的幂，扩容后小表中的桶 v 对应大表中所有
+低位与 v 相同的桶，缩容时反过来，这些桶在反向二进制顺序中是连续的。所以表在两次调用之间
+扩容、缩容或者正在 rehash 时，已经遍历过的桶不会再被遍历，遍历开始时就存在的元素至少返回一次
+（可能重复）。rehash 时先遍历小表中的桶，再遍历大表中它扩展出来的所有桶。
+*/
+func (dict *Dict) Scan(cursor uint64, fn func(e *Entry)) uint64 {
+	if dict.usedSize() == 0 {
+		return 0
+	}
+	// fn 执行期间暂停 rehash，否则桶中的元素可能被移走
+	dict.safeIterators++
+	defer func() { dict.safeIterators-- }()
+
+	v := cursor
+	if !dict.isRehashing() {
+		t0 := dict.hts[0]
+		m0 := uint64(t0.mask)
+		scanBucket(t0.table[v&m0], fn)
+		return scanNextCursor(v, m0)
+	}
+	t0, t1 := dict.hts[0], dict.hts[1]
+	// 保证 t0 是小表
+	if t0.size > t1.size {
+		t0, t1 = t1, t0
+	}
+	m0, m1 := uint64(t0.mask), uint64(t1.mask)
+	scanBucket(t0.table[v&m0], fn)
+	// 遍历大表中由小表的桶 v 扩展出来的桶
+	for {
+		scanBucket(t1.table[v&m1], fn)
+		v = scanNextCursor(v, m1)
+		// 两个掩码之间的位全部变回 0 时，说明这些桶已经遍历完了
+		if v&(m0^m1) == 0 {
+			break
+		}
+	}
+	return v
+}
+
+func scanBucket(e *Entry, fn func(e *Entry)) {
+	for e != nil {
+		next := e.next
+		fn(e)
+		e = next
+	}
+}
+
+// 把掩码之外的位置 1 后反转、加 1、再反转，即在反向二进制上加 1
+func scanNextCursor(v, mask uint64) uint64 {
+	v |= ^mask
+	v = bits.Reverse64(v)
+	v++
+	return bits.Reverse64(v)
+}
+
 // TODO 理解 这里的 迭代器 和 Rehash
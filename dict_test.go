@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+// 元素个数超过 FORCE_RATIO 倍的桶数之后，下一次添加就要开始扩容
+func TestDictExpandLoadFactor(t *testing.T) {
+	dict := DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+	for i := 0; i < 1000; i++ {
+		key := CreateObject(GSTR, strconv.Itoa(i))
+		if err := dict.Add(key, key); err != nil {
+			t.Fatal(err)
+		}
+		for dict.isRehashing() {
+			dict.rehash(DEFAULT_STEP)
+		}
+		if ht := dict.hts[0]; ht.used > ht.size*FORCE_RATIO+1 {
+			t.Fatalf("used %d with %d buckets", ht.used, ht.size)
+		}
+	}
+	for i := 0; i < 1000; i++ {
+		if dict.Find(CreateObject(GSTR, strconv.Itoa(i))) == nil {
+			t.Fatalf("key %d not found", i)
+		}
+	}
+}
@@ -0,0 +1,454 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"runtime/debug"
+	"runtime/metrics"
+	"strings"
+	"time"
+)
+
+/*
+maxmemory 淘汰（参考 Redis 的 evict.c）：
+执行 CMD_DENYOOM 的命令之前，如果使用的内存超过了 maxmemory，按 maxmemory-policy 删除 key，
+删不出足够的空间时（例如 noeviction）拒绝执行命令。
+
+近似 LRU / LFU：每个对象的 lru 字段记录最近访问的时钟（LRU）或者访问时间 + 对数计数器（LFU），
+每次从字典中随机抽取 maxmemory-samples 个 key 放入淘汰池，淘汰池中按空闲程度排序，
+每次淘汰池中最"空闲"的 key。
+
+Go 没有 zmalloc 那样的内存计数，使用的内存取上一次 GC 标记出的存活对象的大小，
+不包括还没有回收的垃圾，否则会为了"释放"垃圾而淘汰有用的 key。
+被淘汰的对象要等到下一次 GC 之后才会从这个值中去掉，所以在两次 GC 之间减去已经淘汰的对象的估算大小。
+同时把 Go 运行时的内存上限设为 maxmemory，数据集接近 maxmemory 时 GC 会更频繁，这个值也就更及时。
+*/
+
+const (
+	MAXMEMORY_FLAG_LRU     = 1 << 0
+	MAXMEMORY_FLAG_LFU     = 1 << 1
+	MAXMEMORY_FLAG_ALLKEYS = 1 << 2
+
+	MAXMEMORY_VOLATILE_LRU    = (0 << 8) | MAXMEMORY_FLAG_LRU
+	MAXMEMORY_VOLATILE_LFU    = (1 << 8) | MAXMEMORY_FLAG_LFU
+	MAXMEMORY_VOLATILE_TTL    = 2 << 8
+	MAXMEMORY_VOLATILE_RANDOM = 3 << 8
+	MAXMEMORY_ALLKEYS_LRU     = (4 << 8) | MAXMEMORY_FLAG_LRU | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_ALLKEYS_LFU     = (5 << 8) | MAXMEMORY_FLAG_LFU | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_ALLKEYS_RANDOM  = (6 << 8) | MAXMEMORY_FLAG_ALLKEYS
+	MAXMEMORY_NO_EVICTION     = 7 << 8
+)
+
+var maxmemoryPolicies = []struct {
+	name   string
+	policy int
+}{
+	{"volatile-lru", MAXMEMORY_VOLATILE_LRU},
+	{"volatile-lfu", MAXMEMORY_VOLATILE_LFU},
+	{"volatile-random", MAXMEMORY_VOLATILE_RANDOM},
+	{"volatile-ttl", MAXMEMORY_VOLATILE_TTL},
+	{"allkeys-lru", MAXMEMORY_ALLKEYS_LRU},
+	{"allkeys-lfu", MAXMEMORY_ALLKEYS_LFU},
+	{"allkeys-random", MAXMEMORY_ALLKEYS_RANDOM},
+	{"noeviction", MAXMEMORY_NO_EVICTION},
+}
+
+func maxmemoryPolicyFromName(name string) (int, error) {
+	for _, p := range maxmemoryPolicies {
+		if p.name == strings.ToLower(name) {
+			return p.policy, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid maxmemory-policy: %s", name)
+}
+
+func maxmemoryPolicyName(policy int) string {
+	for _, p := range maxmemoryPolicies {
+		if p.policy == policy {
+			return p.name
+		}
+	}
+	return "unknown"
+}
+
+const CONFIG_DEFAULT_MAXMEMORY_SAMPLES = 5
+
+// 设置 maxmemory，同时调整 Go 运行时的内存上限
+func setMaxmemory(maxmemory uint64) {
+	server.maxmemory = maxmemory
+	if maxmemory == 0 || maxmemory > math.MaxInt64 {
+		debug.SetMemoryLimit(math.MaxInt64)
+		return
+	}
+	debug.SetMemoryLimit(int64(maxmemory))
+}
+
+// ----------------------------------------------------------------------------
+// LRU 时钟
+
+const (
+	LRU_BITS             = 24
+	LRU_CLOCK_MAX        = (1 << LRU_BITS) - 1 /* Max value of obj->lru */
+	LRU_CLOCK_RESOLUTION = 1000                /* LRU clock resolution in ms */
+)
+
+// 以 LRU_CLOCK_RESOLUTION 为单位的时钟，只保留低 LRU_BITS 位
+func getLRUClock() uint32 {
+	return uint32((GetMsTime() / LRU_CLOCK_RESOLUTION) & LRU_CLOCK_MAX)
+}
+
+// ServerCron 的精度足够时直接使用缓存的时钟，避免每次访问都取一次系统时间
+func LRU_CLOCK() uint32 {
+	if 1000/CONFIG_DEFAULT_HZ <= LRU_CLOCK_RESOLUTION {
+		return server.lruclock
+	}
+	return getLRUClock()
+}
+
+// 对象多久没有被访问了（毫秒）
+func estimateObjectIdleTime(o *Gobj) uint64 {
+	lruclock := LRU_CLOCK()
+	if lruclock >= o.lru {
+		return uint64(lruclock-o.lru) * LRU_CLOCK_RESOLUTION
+	}
+	return uint64(lruclock+(LRU_CLOCK_MAX-o.lru)) * LRU_CLOCK_RESOLUTION
+}
+
+// ----------------------------------------------------------------------------
+// LFU：lru 字段的高 16 位是最近一次递减计数器的时间（分钟），低 8 位是对数计数器
+
+const (
+	LFU_INIT_VAL   = 5  /* 新对象的计数器，避免刚创建的 key 马上被淘汰 */
+	LFU_LOG_FACTOR = 10 /* 计数器增长的难度，越大越难增长 */
+	LFU_DECAY_TIME = 1  /* 每过多少分钟计数器减一 */
+)
+
+func LFUGetTimeInMinutes() uint32 {
+	return uint32((time.Now().Unix() / 60) & 65535)
+}
+
+// 距离 ldt 过去了多少分钟，考虑了回绕
+func LFUTimeElapsed(ldt uint32) uint32 {
+	now := LFUGetTimeInMinutes()
+	if now >= ldt {
+		return now - ldt
+	}
+	return 65535 - ldt + now
+}
+
+// 计数器越大，增长的概率越小，255 次访问之后大约对应一百万次访问
+func LFULogIncr(counter uint32) uint32 {
+	if counter == 255 {
+		return 255
+	}
+	r := rand.Float64()
+	baseval := float64(counter) - LFU_INIT_VAL
+	if baseval < 0 {
+		baseval = 0
+	}
+	p := 1.0 / (baseval*LFU_LOG_FACTOR + 1)
+	if r < p {
+		counter++
+	}
+	return counter
+}
+
+// 按照上次递减之后经过的时间衰减计数器，只返回结果，不修改对象
+func LFUDecrAndReturn(o *Gobj) uint32 {
+	ldt := o.lru >> 8
+	counter := o.lru & 255
+	var numPeriods uint32
+	if LFU_DECAY_TIME > 0 {
+		numPeriods = LFUTimeElapsed(ldt) / LFU_DECAY_TIME
+	}
+	if numPeriods > 0 {
+		if numPeriods > counter {
+			counter = 0
+		} else {
+			counter -= numPeriods
+		}
+	}
+	return counter
+}
+
+// 访问对象时先衰减再递增计数器
+func updateLFU(o *Gobj) {
+	counter := LFUDecrAndReturn(o)
+	counter = LFULogIncr(counter)
+	o.lru = (LFUGetTimeInMinutes() << 8) | counter
+}
+
+// 新对象的 lru 字段
+func initObjectLRUOrLFU() uint32 {
+	if server.maxmemorypolicy&MAXMEMORY_FLAG_LFU != 0 {
+		return (LFUGetTimeInMinutes() << 8) | LFU_INIT_VAL
+	}
+	return LRU_CLOCK()
+}
+
+// 访问 key 时更新 LRU 时钟或 LFU 计数器，由 lookupKey 调用
+func updateObjectAccessTime(o *Gobj) {
+	if server.maxmemorypolicy&MAXMEMORY_FLAG_LFU != 0 {
+		updateLFU(o)
+	} else {
+		o.lru = LRU_CLOCK()
+	}
+}
+
+// ----------------------------------------------------------------------------
+// 内存统计
+
+var memSamples = []metrics.Sample{
+	{Name: "/gc/heap/live:bytes"},
+	{Name: "/gc/cycles/total:gc-cycles"},
+}
+
+// 数据集使用的内存（估算），见文件开头的说明
+func usedMemory() uint64 {
+	metrics.Read(memSamples)
+	heap := memSamples[0].Value.Uint64()
+	cycles := memSamples[1].Value.Uint64()
+	if cycles != server.evictgccycles {
+		// 之前淘汰的对象已经被回收了
+		server.evictgccycles = cycles
+		server.evictedmemsincegc = 0
+	}
+	if heap < server.evictedmemsincegc {
+		return 0
+	}
+	return heap - server.evictedmemsincegc
+}
+
+// 对象占用内存的估算值，集合类型只计算前 OBJ_COMPUTE_SIZE_DEF_SAMPLES 个元素再按元素个数放大
+const OBJ_COMPUTE_SIZE_DEF_SAMPLES = 5
+
+// Gobj 和字典 Entry 本身的大小
+const OBJ_OVERHEAD = 64
+
+func objectComputeSize(o *Gobj) uint64 {
+	var size uint64
+	switch o.Type_ {
+	case GSTR:
+		if o.encoding == GODIS_ENCODING_INT {
+			return OBJ_OVERHEAD
+		}
+		return OBJ_OVERHEAD + uint64(len(o.StrVal()))
+	case GLIST:
+		list := o.Val_.(*List)
+		samples := 0
+		for n := list.First(); n != nil && samples < OBJ_COMPUTE_SIZE_DEF_SAMPLES; n = n.next {
+			size += objectComputeSize(n.Val)
+			samples++
+		}
+		if samples > 0 {
+			size = size / uint64(samples) * uint64(list.Length())
+		}
+	case GSET, GHASH:
+		dict := o.Val_.(*Dict)
+		samples := 0
+		for ; samples < OBJ_COMPUTE_SIZE_DEF_SAMPLES && int64(samples) < dict.usedSize(); samples++ {
+			e := dict.RandomGet()
+			if e == nil {
+				break
+			}
+			size += objectComputeSize(e.Key)
+			if e.Value != nil {
+				size += objectComputeSize(e.Value)
+			}
+		}
+		if samples > 0 {
+			size = size / uint64(samples) * uint64(dict.usedSize())
+		}
+	case GZSET:
+		zs := o.Val_.(zset)
+		samples := 0
+		for n := zs.zsl.header.level[0].forward; n != nil && samples < OBJ_COMPUTE_SIZE_DEF_SAMPLES; n = n.level[0].forward {
+			// 跳表节点 + 字典中的分数
+			size += objectComputeSize(n.obj) + 2*OBJ_OVERHEAD
+			samples++
+		}
+		if samples > 0 {
+			size = size / uint64(samples) * zs.zsl.length
+		}
+	}
+	return OBJ_OVERHEAD + size
+}
+
+// 是否超过了 maxmemory，超过时返回需要释放的内存
+func getMaxmemoryState() (used, tofree uint64, ok bool) {
+	if server.maxmemory == 0 {
+		return 0, 0, true
+	}
+	used = usedMemory()
+	if used <= server.maxmemory {
+		return used, 0, true
+	}
+	return used, used - server.maxmemory, false
+}
+
+// ----------------------------------------------------------------------------
+// 淘汰池
+
+const EVPOOL_SIZE = 16
+
+type evictionPoolEntry struct {
+	idle uint64 /* 越大越先被淘汰：LRU 是空闲时间，LFU 是 255 - 计数器，TTL 是 MaxUint64 - 过期时间 */
+	key  *Gobj
+	dbid int
+}
+
+// 按 idle 从小到大排列，空位在右侧，淘汰时从右往左取
+var evictionPool [EVPOOL_SIZE]evictionPoolEntry
+
+/*
+从 sampledict 中抽取 maxmemory-samples 个 key 放入淘汰池。
+allkeys 策略下 sampledict 是 data 字典，volatile 策略下是 expire 字典，值要到 keydict 中查找。
+淘汰池满了的时候只有比池中最小的 idle 更大的 key 才能放进去。
+*/
+func evictionPoolPopulate(dbid int, sampledict, keydict *Dict) {
+	for i := 0; i < server.maxmemorysamples; i++ {
+		de := sampledict.RandomGet()
+		if de == nil {
+			break
+		}
+		key := de.Key
+		var idle uint64
+		if server.maxmemorypolicy == MAXMEMORY_VOLATILE_TTL {
+			// 越早过期的越先淘汰
+			idle = math.MaxUint64 - uint64(de.Value.Val_.(int64))
+		} else {
+			o := de.Value
+			if sampledict != keydict {
+				o = keydict.Get(key)
+				if o == nil {
+					continue
+				}
+			}
+			if server.maxmemorypolicy&MAXMEMORY_FLAG_LRU != 0 {
+				idle = estimateObjectIdleTime(o)
+			} else {
+				idle = 255 - uint64(LFUDecrAndReturn(o))
+			}
+		}
+
+		// 找到第一个 idle 比当前 key 大的位置
+		k := 0
+		for k < EVPOOL_SIZE && evictionPool[k].key != nil && evictionPool[k].idle < idle {
+			k++
+		}
+		if k == 0 && evictionPool[EVPOOL_SIZE-1].key != nil {
+			// 比池中所有的 key 都更不应该被淘汰，并且池已经满了
+			continue
+		} else if k < EVPOOL_SIZE && evictionPool[k].key == nil {
+			// 插入到空位，不需要移动
+		} else if evictionPool[EVPOOL_SIZE-1].key == nil {
+			// 右侧还有空位，右移腾出位置 k
+			copy(evictionPool[k+1:], evictionPool[k:EVPOOL_SIZE-1])
+		} else {
+			// 池满了，丢掉最左边（最不应该被淘汰）的元素，左移腾出位置 k-1
+			k--
+			evictionPool[0].key.DecrRefCount()
+			copy(evictionPool[:k], evictionPool[1:k+1])
+		}
+		key.IncrRefCount()
+		evictionPool[k] = evictionPoolEntry{idle: idle, key: key, dbid: dbid}
+	}
+}
+
+// 下一次随机淘汰从哪个数据库开始
+var evictRandomNextDb int
+
+var errEvictFail = errors.New("can't free enough memory")
+
+/*
+删除 key 直到使用的内存不超过 maxmemory。
+没有可以淘汰的 key（noeviction 或者 volatile 策略下没有设置过期时间的 key）时返回 errEvictFail。
+*/
+func performEvictions() error {
+	_, tofree, ok := getMaxmemoryState()
+	if ok {
+		return nil
+	}
+	if server.maxmemorypolicy == MAXMEMORY_NO_EVICTION {
+		return errEvictFail
+	}
+	var memFreed uint64
+	for memFreed < tofree {
+		var bestkey *Gobj
+		bestdbid := 0
+		allkeys := server.maxmemorypolicy&MAXMEMORY_FLAG_ALLKEYS != 0
+		if server.maxmemorypolicy&(MAXMEMORY_FLAG_LRU|MAXMEMORY_FLAG_LFU) != 0 ||
+			server.maxmemorypolicy == MAXMEMORY_VOLATILE_TTL {
+			for bestkey == nil {
+				var totalKeys int64
+				for _, db := range server.db {
+					dict := db.expire
+					if allkeys {
+						dict = db.data
+					}
+					if keys := dict.usedSize(); keys != 0 {
+						evictionPoolPopulate(db.id, dict, db.data)
+						totalKeys += keys
+					}
+				}
+				if totalKeys == 0 {
+					break
+				}
+				// 从右往左找第一个仍然存在的 key，池中的 key 可能已经被删除了
+				for k := EVPOOL_SIZE - 1; k >= 0; k-- {
+					if evictionPool[k].key == nil {
+						continue
+					}
+					pe := evictionPool[k]
+					evictionPool[k] = evictionPoolEntry{}
+					db := server.db[pe.dbid]
+					dict := db.expire
+					if allkeys {
+						dict = db.data
+					}
+					de := dict.Find(pe.key)
+					pe.key.DecrRefCount()
+					if de != nil {
+						bestkey = de.Key
+						bestdbid = pe.dbid
+						break
+					}
+				}
+			}
+		} else {
+			// 随机淘汰，轮流从各个数据库中取
+			for i := 0; i < server.dbnum; i++ {
+				db := server.db[evictRandomNextDb%server.dbnum]
+				evictRandomNextDb++
+				dict := db.expire
+				if allkeys {
+					dict = db.data
+				}
+				if dict.usedSize() == 0 {
+					continue
+				}
+				if de := dict.RandomGet(); de != nil {
+					bestkey = de.Key
+					bestdbid = db.id
+					break
+				}
+			}
+		}
+		if bestkey == nil {
+			return errEvictFail
+		}
+		db := server.db[bestdbid]
+		bestkey.IncrRefCount()
+		delta := objectComputeSize(bestkey) + objectComputeSize(db.data.Get(bestkey))
+		db.data.Delete(bestkey)
+		db.expire.Delete(bestkey)
+		propagateDeletion(db, bestkey)
+		bestkey.DecrRefCount()
+		memFreed += delta
+		server.evictedmemsincegc += delta
+		server.statevictedkeys++
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import "time"
+
+/*
+主动过期（参考 Redis 的 activeExpireCycle）：
+ServerCron 每次调用时轮流检查各个数据库，从 expire 字典中随机抽取
+ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP 个 key，删除其中已经过期的。
+如果抽到的 key 中过期的超过 ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE%，说明这个数据库中
+还有很多过期的 key，继续抽样；否则换下一个数据库。
+每次调用最多使用 ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC% 的 CPU 时间，超时后下次从中断的数据库继续。
+检查一个数据库的时候同时从 hexpires 中抽样删除过期的哈希字段（见 activeExpireHashFields）。
+*/
+const (
+	ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP    = 20 /* 每轮抽样的 key 数量 */
+	ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE = 25 /* 过期 key 的比例不超过这个百分比时停止抽样 */
+	ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC   = 25 /* 每次 cron 最多使用的 CPU 时间百分比 */
+	CRON_DBS_PER_CALL                    = 16 /* 每次最多检查的数据库个数 */
+)
+
+// 下一次从哪个数据库开始，上一次因为超时中断时从中断的数据库继续
+var activeExpireCurrentDb int
+
+func activeExpireCycle() {
+	start := time.Now()
+	// 每次 cron 调用的时间上限（微秒）
+	timelimit := int64(1000000 * ACTIVE_EXPIRE_CYCLE_SLOW_TIME_PERC / CONFIG_DEFAULT_HZ / 100)
+	timelimitExit := false
+	var totalSampled, totalExpired int64
+
+	dbsPerCall := CRON_DBS_PER_CALL
+	if dbsPerCall > server.dbnum {
+		dbsPerCall = server.dbnum
+	}
+	for j := 0; j < dbsPerCall && !timelimitExit; j++ {
+		db := server.db[activeExpireCurrentDb%server.dbnum]
+		activeExpireCurrentDb++
+		activeExpireHashFields(db, GetMsTime())
+		iteration := 0
+		for {
+			num := db.expire.usedSize()
+			if num == 0 {
+				break
+			}
+			if num > ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP {
+				num = ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP
+			}
+			now := GetMsTime()
+			var sampled, expired int64
+			for ; num > 0; num-- {
+				entry := db.expire.RandomGet()
+				if entry == nil {
+					break
+				}
+				sampled++
+				if activeExpireCycleTryExpire(db, entry, now) {
+					expired++
+				}
+			}
+			totalSampled += sampled
+			totalExpired += expired
+			// 每 16 轮检查一次是否超时
+			iteration++
+			if iteration&0xf == 0 && time.Since(start).Microseconds() > timelimit {
+				timelimitExit = true
+				server.statexpiredtimecapreachedcount++
+				break
+			}
+			if sampled == 0 || expired*100/sampled <= ACTIVE_EXPIRE_CYCLE_ACCEPTABLE_STALE {
+				break
+			}
+		}
+	}
+	server.statexpirecycletimeused += time.Since(start).Microseconds()
+
+	// 过期 key 占比的移动平均，用来估计内存中还有多少已经过期但没有删除的 key
+	currentPerc := float64(0)
+	if totalSampled > 0 {
+		currentPerc = float64(totalExpired) / float64(totalSampled)
+	}
+	server.statexpiredstaleperc = currentPerc*0.05 + server.statexpiredstaleperc*0.95
+}
+
+// 如果 entry 对应的 key 已经过期就删除它
+func activeExpireCycleTryExpire(db *GodisDB, entry *Entry, now int64) bool {
+	if entry.Value.Val_.(int64) > now {
+		return false
+	}
+	key := entry.Key
+	key.IncrRefCount()
+	db.data.Delete(key)
+	db.expire.Delete(key)
+	key.DecrRefCount()
+	server.statexpiredkeys++
+	return true
+}
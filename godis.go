@@ -6,10 +6,13 @@ import (
 	"hash/fnv"
 	"io"
 	"log"
+	"math"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 )
 
@@ -39,35 +42,88 @@ const (
 	CMD_WRITE int = 1 << iota
 	CMD_READ
 	CMD_OTHER
+	CMD_DENYOOM /* 可能增加内存使用的命令，超过 maxmemory 并且无法淘汰时拒绝执行 */
 )
 
+// 客户端标志
+const (
+	CLIENT_FORCE_AOF int = 1 << iota /* 不管 dirty 有没有增加，都把当前命令写入 AOF */
+)
+
+const GODIS_VERSION = "0.1"
+
 // CRLF 是 redis 统一的行分隔符协议
 const CRLF = "\r\n"
 
 type GodisDB struct {
 	data   *Dict
 	expire *Dict
+	id     int /* 数据库编号，SELECT 的参数 */
+
+	blockingKeys map[string][]*GodisClient /* 阻塞在 key 上的客户端，按照阻塞的先后顺序排列 */
+	readyKeys    map[string]struct{}       /* 已经放进 server.readyKeys 的 key，避免重复 */
+	hexpires     *Dict                     /* 有字段设置了过期时间的哈希：key -> 哈希对象，见 hash.go */
 }
 
 type GodisServer struct {
-	fd             int
-	port           int
-	db             *GodisDB
-	clients        map[int]*GodisClient
-	aeLoop         *AeLoop
-	dirty          int64
-	bgsavechildpid int
-	appendonly     int
-	lastfsync      int64
-	appendfd       *os.File
-	appendfsync    string
-	appendfilename string
-	lastsave       int64
-	saveparams     *saveparam
-	saveparamslen  int
-	dbfilename     string
-	bgrewritebuf   string /* buffer taken by parent during oppend only rewrite */
-	aofbuf         string /* AOF buffer, written before entering the event loop */
+	fd                int
+	port              int
+	db                []*GodisDB
+	dbnum             int /* 数据库的个数 */
+	clients           map[int]*GodisClient
+	aeLoop            *AeLoop
+	dirty             int64
+	bgsavedone        chan int8    /* goroutine 版本的 bgsavechildpid，BGSAVE 结束时发送结果，nil 表示没有正在进行的 BGSAVE */
+	bgsavechild       *bgsaveChild /* 正在进行的 BGSAVE，killRDBChild 通过它丢弃这次保存的结果 */
+	appendonly        int
+	lastfsync         int64
+	appendfd          *os.File
+	aofselecteddb     int /* AOF 中最后一条 SELECT 的数据库，-1 表示下一条命令之前需要 SELECT */
+	appendfsync       string
+	appendfilename    string
+	appenddirname     string
+	aofmanifest       *aofManifest /* 混合持久化时当前的 manifest */
+	aofuserdbpreamble bool
+	aofcurrentsize    int64 /* AOF 文件当前大小 */
+	aoffsyncoffset    int64 /* 已经 fsync 到磁盘的 AOF 偏移量 */
+	lastsave          int64 /* 上一次成功保存 RDB 的时间（秒） */
+	lastbgsavetry     int64 /* 上一次尝试 BGSAVE 的时间（秒） */
+	saveparams        []saveparam
+	saveparamslen     int
+	dbfilename        string
+	rdbformat         string
+	bgrewritebuf      []byte /* buffer taken by parent during oppend only rewrite */
+	aofbuf            []byte /* AOF buffer, written before entering the event loop */
+
+	bgrewritedone          chan int8 /* 后台 AOF 重写 goroutine 结束时发送结果，nil 表示没有正在进行的重写 */
+	aofrewritetimestart    int64     /* 当前重写的开始时间（毫秒），-1 表示没有 */
+	aofrewritetimelast     int64     /* 上一次重写耗时（秒） */
+	aoflastbgrewritestatus int8
+	aofrewritescheduled    bool  /* BGSAVE 结束之后再开始 BGREWRITEAOF */
+	dirtybeforebgsave      int64 /* BGSAVE 开始时的 dirty，用于结束后计算剩余的修改数 */
+	rdbsavetimestart       int64 /* 当前 BGSAVE 的开始时间（毫秒），-1 表示没有 */
+	rdbsavetimelast        int64 /* 上一次 BGSAVE 耗时（秒） */
+	lastbgsavestatus       int8
+	savekeystotal          int64        /* 当前后台持久化任务需要处理的 key 总数 */
+	savekeysprocessed      atomic.Int64 /* 当前后台持久化任务已经处理的 key 数，由 goroutine 更新 */
+
+	statexpiredkeys                int64   /* 被删除的过期 key 数量（包括主动和惰性删除） */
+	statexpiredsubkeys             int64   /* 被删除的过期哈希字段数量 */
+	statexpiredstaleperc           float64 /* 主动过期抽样中过期 key 比例的移动平均 */
+	statexpiredtimecapreachedcount int64   /* 主动过期因为超时提前结束的次数 */
+	statexpirecycletimeused        int64   /* 主动过期累计使用的时间（微秒） */
+	statevictedkeys                int64   /* 因为 maxmemory 被淘汰的 key 数量 */
+
+	maxmemory         uint64 /* 0 表示不限制 */
+	maxmemorypolicy   int
+	maxmemorysamples  int
+	lruclock          uint32 /* 缓存的 LRU 时钟，由 ServerCron 更新 */
+	evictedmemsincegc uint64 /* 上一次 GC 之后淘汰的对象的估算大小，见 evict.go */
+	evictgccycles     uint64 /* 计算 evictedmemsincegc 时的 GC 次数 */
+
+	blockedClients   int            /* 阻塞中的客户端数量 */
+	readyKeys        []*readyList   /* 有客户端在等待并且被添加了数据的 key，见 blocked.go */
+	unblockedClients []*GodisClient /* 解除阻塞之后需要继续处理查询缓冲区的客户端 */
 }
 
 type GodisClient struct {
@@ -80,7 +136,10 @@ type GodisClient struct {
 	queryLen int
 	cmdType  CmdType
 	bulkNum  int
-	bulkLen  int
+	bulkLen  int /* 当前参数的长度，-1 表示还没有读到 */
+	btype    int /* 阻塞的类型，BLOCKED_NONE 表示没有阻塞，见 blocked.go */
+	bpop     blockingState
+	flags    int /* CLIENT_* 标志 */
 }
 
 type CommandProc func(c *GodisClient)
@@ -97,48 +156,124 @@ type GodisCommand struct {
 var server GodisServer
 var cmdTable = []GodisCommand{
 
-	{"expireat", expireAtCommand, 3, CMD_WRITE},
-	{"expire", expireCommand, 3, CMD_WRITE},
+	{"expire", expireCommand, -3, CMD_WRITE},
+	{"pexpire", pexpireCommand, -3, CMD_WRITE},
+	{"expireat", expireatCommand, -3, CMD_WRITE},
+	{"pexpireat", pexpireatCommand, -3, CMD_WRITE},
+	{"ttl", ttlCommand, 2, CMD_READ},
+	{"pttl", pttlCommand, 2, CMD_READ},
+	{"expiretime", expiretimeCommand, 2, CMD_READ},
+	{"pexpiretime", pexpiretimeCommand, 2, CMD_READ},
+	{"persist", persistCommand, 2, CMD_WRITE},
 
 	{"del", delCommand, -2, CMD_WRITE},
 
+	// db
+	{"select", selectCommand, 2, CMD_OTHER},
+	{"move", moveCommand, 3, CMD_WRITE},
+	{"swapdb", swapdbCommand, 3, CMD_WRITE},
+	{"flushdb", flushdbCommand, -1, CMD_WRITE},
+	{"flushall", flushallCommand, -1, CMD_WRITE},
+	{"dbsize", dbsizeCommand, 1, CMD_READ},
+
 	//string
 	{"get", getCommand, 2, CMD_READ},
-	{"set", setCommand, 3, CMD_WRITE},
+	{"set", setCommand, -3, CMD_WRITE | CMD_DENYOOM},
 	{"mget", mgetCommand, -2, CMD_READ},
-	{"mset", msetCommand, -3, CMD_WRITE},
-	{"msetnx", msetnxCommand, -4, CMD_WRITE},
-	{"setnx", setnxCommand, 3, CMD_WRITE},
-	{"setex", setexCommand, 4, CMD_WRITE},
+	{"mset", msetCommand, -3, CMD_WRITE | CMD_DENYOOM},
+	{"msetnx", msetnxCommand, -4, CMD_WRITE | CMD_DENYOOM},
+	{"setnx", setnxCommand, 3, CMD_WRITE | CMD_DENYOOM},
+	{"setex", setexCommand, 4, CMD_WRITE | CMD_DENYOOM},
+	{"psetex", psetexCommand, 4, CMD_WRITE | CMD_DENYOOM},
+	{"getset", getsetCommand, 3, CMD_WRITE | CMD_DENYOOM},
+	{"getdel", getdelCommand, 2, CMD_WRITE},
+	{"getex", getexCommand, -2, CMD_WRITE},
+	{"append", appendCommand, 3, CMD_WRITE | CMD_DENYOOM},
+	{"strlen", strlenCommand, 2, CMD_READ},
+	{"getrange", getrangeCommand, 4, CMD_READ},
+	{"setrange", setrangeCommand, 4, CMD_WRITE | CMD_DENYOOM},
+	{"incrbyfloat", incrbyfloatCommand, 3, CMD_WRITE | CMD_DENYOOM},
+
+	// bitmap
+	{"setbit", setbitCommand, 4, CMD_WRITE | CMD_DENYOOM},
+	{"getbit", getbitCommand, 3, CMD_READ},
+	{"bitcount", bitcountCommand, -2, CMD_READ},
+	{"bitpos", bitposCommand, -3, CMD_READ},
+	{"bitop", bitopCommand, -4, CMD_WRITE | CMD_DENYOOM},
+	{"bitfield", bitfieldCommand, -2, CMD_WRITE | CMD_DENYOOM},
+	{"bitfield_ro", bitfieldroCommand, -2, CMD_READ},
+
+	// hyperloglog
+	{"pfadd", pfaddCommand, -2, CMD_WRITE | CMD_DENYOOM},
+	{"pfcount", pfcountCommand, -2, CMD_READ},
+	{"pfmerge", pfmergeCommand, -2, CMD_WRITE | CMD_DENYOOM},
 
 	// list
-	{"rpush", rpushCommand, -3, CMD_WRITE},
-	{"lpush", lpushCommand, -3, CMD_WRITE},
-	{"rpop", rpopCommand, 2, CMD_WRITE},
-	{"lpop", lpopCommand, 2, CMD_WRITE},
+	{"rpush", rpushCommand, -3, CMD_WRITE | CMD_DENYOOM},
+	{"lpush", lpushCommand, -3, CMD_WRITE | CMD_DENYOOM},
+	{"rpop", rpopCommand, -2, CMD_WRITE},
+	{"lpop", lpopCommand, -2, CMD_WRITE},
+	{"lpushx", lpushxCommand, -3, CMD_WRITE | CMD_DENYOOM},
+	{"rpushx", rpushxCommand, -3, CMD_WRITE | CMD_DENYOOM},
+	{"lset", lsetCommand, 4, CMD_WRITE | CMD_DENYOOM},
+	{"linsert", linsertCommand, 5, CMD_WRITE | CMD_DENYOOM},
+	{"ltrim", ltrimCommand, 4, CMD_WRITE},
+	{"lpos", lposCommand, -3, CMD_READ},
+	{"rpoplpush", rpoplpushCommand, 3, CMD_WRITE | CMD_DENYOOM},
+	{"blpop", blpopCommand, -3, CMD_WRITE},
+	{"brpop", brpopCommand, -3, CMD_WRITE},
+	{"lmove", lmoveCommand, 5, CMD_WRITE | CMD_DENYOOM},
+	{"blmove", blmoveCommand, 6, CMD_WRITE | CMD_DENYOOM},
 	{"lrange", lrangeCommand, 4, CMD_READ},
 	{"lindex", lindexCommand, 3, CMD_READ},
 	{"llen", llenCommand, 2, CMD_READ},
 	{"lrem", lremCommand, 4, CMD_WRITE},
 
 	// set
-	{"sadd", saddCommand, -3, CMD_WRITE},
+	{"sadd", saddCommand, -3, CMD_WRITE | CMD_DENYOOM},
 	{"srem", sremCommand, -3, CMD_WRITE},
 	{"sismember", sismemberCommand, 3, CMD_READ},
 	{"smembers", smembersCommand, 2, CMD_READ},
 	{"scard", scardCommand, 2, CMD_READ},
+	{"smismember", smismemberCommand, -3, CMD_READ},
+	{"smove", smoveCommand, 4, CMD_WRITE},
+	{"spop", spopCommand, -2, CMD_WRITE},
+	{"srandmember", srandmemberCommand, -2, CMD_READ},
+	{"sinter", sinterCommand, -2, CMD_READ},
+	{"sinterstore", sinterstoreCommand, -3, CMD_WRITE | CMD_DENYOOM},
+	{"sintercard", sintercardCommand, -3, CMD_READ},
+	{"sunion", sunionCommand, -2, CMD_READ},
+	{"sunionstore", sunionstoreCommand, -3, CMD_WRITE | CMD_DENYOOM},
+	{"sdiff", sdiffCommand, -2, CMD_READ},
+	{"sdiffstore", sdiffstoreCommand, -3, CMD_WRITE | CMD_DENYOOM},
 
 	// hash
-	{"hset", hsetCommand, -4, CMD_WRITE},
-	{"hsetnx", hsetnxCommand, 4, CMD_WRITE},
+	{"hset", hsetCommand, -4, CMD_WRITE | CMD_DENYOOM},
+	{"hsetnx", hsetnxCommand, 4, CMD_WRITE | CMD_DENYOOM},
 	{"hkeys", hkeysCommand, 2, CMD_READ},
 	{"hvals", hvalsCommand, 2, CMD_READ},
 	{"hget", hgetCommand, 3, CMD_READ},
 	{"hdel", hdelCommand, -3, CMD_WRITE},
+	{"hgetall", hgetallCommand, 2, CMD_READ},
+	{"hmget", hmgetCommand, -3, CMD_READ},
+	{"hexists", hexistsCommand, 3, CMD_READ},
+	{"hlen", hlenCommand, 2, CMD_READ},
+	{"hstrlen", hstrlenCommand, 3, CMD_READ},
+	{"hincrby", hincrbyCommand, 4, CMD_WRITE | CMD_DENYOOM},
+	{"hincrbyfloat", hincrbyfloatCommand, 4, CMD_WRITE | CMD_DENYOOM},
+	{"hrandfield", hrandfieldCommand, -2, CMD_READ},
+	{"hexpire", hexpireCommand, -6, CMD_WRITE},
+	{"hpexpire", hpexpireCommand, -6, CMD_WRITE},
+	{"hexpireat", hexpireatCommand, -6, CMD_WRITE},
+	{"hpexpireat", hpexpireatCommand, -6, CMD_WRITE},
+	{"httl", httlCommand, -5, CMD_READ},
+	{"hpttl", hpttlCommand, -5, CMD_READ},
+	{"hpersist", hpersistCommand, -5, CMD_WRITE},
+	{"hgetex", hgetexCommand, -5, CMD_WRITE},
 
 	//zset
-	{"zadd", zaddCommand, -4, CMD_WRITE},
-	{"zincr", zincrbyCommand, -4, CMD_WRITE},
+	{"zadd", zaddCommand, -4, CMD_WRITE | CMD_DENYOOM},
+	{"zincr", zincrbyCommand, -4, CMD_WRITE | CMD_DENYOOM},
 	{"zrem", zremCommand, -3, CMD_WRITE},
 	{"zscore", zscoreCommand, 3, CMD_READ},
 	{"zcard", zcardCommand, 2, CMD_READ},
@@ -146,23 +281,47 @@ var cmdTable = []GodisCommand{
 	{"zrevrank", zrevrankCommand, 3, CMD_READ},
 	{"zpopmin", zpopminCommand, -2, CMD_WRITE},
 	{"zpopmax", zpopmaxCommand, -2, CMD_WRITE},
+	{"bzpopmin", bzpopminCommand, -3, CMD_WRITE},
+	{"bzpopmax", bzpopmaxCommand, -3, CMD_WRITE},
 
-	// TODO LIMIT：分页参数（类似 SQL 的 LIMIT offset, count）。
 	{"zrange", zrangeCommand, -4, CMD_READ},
+	{"zrangestore", zrangestoreCommand, -5, CMD_WRITE | CMD_DENYOOM},
 	{"zrevrange", zrevrangeCommand, -4, CMD_READ},
 	{"zrangebyscore", zrangebyscoreCommand, -4, CMD_READ},
 	{"zrevrangebyscore", zrevrangebyscoreCommand, -4, CMD_READ},
-
-	{"incr", incrCommand, 2, CMD_WRITE},
-	{"decr", decrCommand, 2, CMD_WRITE},
+	{"zrangebylex", zrangebylexCommand, -4, CMD_READ},
+	{"zrevrangebylex", zrevrangebylexCommand, -4, CMD_READ},
+	{"zcount", zcountCommand, 4, CMD_READ},
+	{"zlexcount", zlexcountCommand, 4, CMD_READ},
+	{"zremrangebyscore", zremrangebyscoreCommand, 4, CMD_WRITE},
+	{"zremrangebyrank", zremrangebyrankCommand, 4, CMD_WRITE},
+	{"zremrangebylex", zremrangebylexCommand, 4, CMD_WRITE},
+	{"zunionstore", zunionstoreCommand, -4, CMD_WRITE | CMD_DENYOOM},
+	{"zinterstore", zinterstoreCommand, -4, CMD_WRITE | CMD_DENYOOM},
+	{"zdiffstore", zdiffstoreCommand, -4, CMD_WRITE | CMD_DENYOOM},
+	{"zunion", zunionCommand, -3, CMD_READ},
+	{"zinter", zinterCommand, -3, CMD_READ},
+	{"zdiff", zdiffCommand, -3, CMD_READ},
+	{"zintercard", zintercardCommand, -3, CMD_READ},
+	{"zmscore", zmscoreCommand, -3, CMD_READ},
+	{"zrandmember", zrandmemberCommand, -2, CMD_READ},
+
+	{"incr", incrCommand, 2, CMD_WRITE | CMD_DENYOOM},
+	{"decr", decrCommand, 2, CMD_WRITE | CMD_DENYOOM},
+	{"incrby", incrbyCommand, 3, CMD_WRITE | CMD_DENYOOM},
+	{"decrby", decrbyCommand, 3, CMD_WRITE | CMD_DENYOOM},
 	{"keys", keysCommand, 2, CMD_READ},
+	{"scan", scanCommand, -2, CMD_READ},
+	{"sscan", sscanCommand, -3, CMD_READ},
+	{"hscan", hscanCommand, -3, CMD_READ},
+	{"zscan", zscanCommand, -3, CMD_READ},
 
 	//persist
 	{"save", saveCommand, 1, CMD_OTHER},
 	{"bgsave", bgsaveCommand, 1, CMD_OTHER},
 	{"bgrewriteaof", bgrewriteaofCommand, 1, CMD_OTHER},
 
-	{"info", infoCommand, 2, CMD_OTHER},
+	{"info", infoCommand, -1, CMD_OTHER},
 
 	{"hello", helloCommand, 2, CMD_OTHER},
 
@@ -176,53 +335,409 @@ var cmdTable = []GodisCommand{
 }
 
 func keysCommand(c *GodisClient) {
-	// TODO 模式匹配,目前就支持输出所有的 key
-	count := server.db.data.usedSize()
-	iter := server.db.data.NewIterator(true) // 内层安全迭代器
-	c.AddReplyArrayLen(count)
-	if count == 0 {
-		return
-	}
+	pattern := c.args[1].StrVal()
+	allkeys := pattern == "*"
+	iter := c.db.data.NewIterator(true) // 内层安全迭代器
+	defer iter.Close()
+	var numkeys int64
 	reply := strings.Builder{}
 	for key, _, exists := iter.Next(); exists; key, _, exists = iter.Next() {
 		val := key.StrVal()
-		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(val), val))
+		if (allkeys || stringMatchLen(pattern, val, false)) && !keyIsExpired(c.db, key) {
+			reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(val), val))
+			numkeys++
+		}
 	}
-	c.AddReplyStr(reply.String())
+	c.AddReplyArrayLen(numkeys)
+	if numkeys > 0 {
+		c.AddReplyStr(reply.String())
+	}
+}
+
+// 游标是无符号 64 位整数
+func parseScanCursorOrReply(c *GodisClient, o *Gobj, cursor *uint64) int8 {
+	v, err := strconv.ParseUint(o.StrVal(), 10, 64)
+	if err != nil {
+		c.AddReplyError("invalid cursor")
+		return GODIS_ERR
+	}
+	*cursor = v
+	return GODIS_OK
+}
+
+/*
+SCAN / SSCAN / HSCAN / ZSCAN 的通用实现（参考 Redis 的 scanGenericCommand）：
+  - o 为 nil 时遍历整个数据库，否则遍历集合、哈希表或有序集合中的元素
+  - 用 Dict.Scan 每次遍历若干个桶，直到收集到 COUNT 个元素，或者遍历的次数超过 COUNT*10
+  - MATCH 和 TYPE 在收集之后过滤，所以返回的元素个数可能少于 COUNT，甚至为 0
+*/
+func scanGenericCommand(c *GodisClient, o *Gobj, cursor uint64) {
+	count := int64(10)
+	pattern := ""
+	typename := ""
+	novalues := false
+
+	// 选项从游标之后开始
+	i := 2
+	if o != nil {
+		i = 3
+	}
+	for i < len(c.args) {
+		opt := strings.ToLower(c.args[i].StrVal())
+		if opt == "novalues" && o != nil && o.Type_ == GHASH {
+			novalues = true
+			i++
+			continue
+		}
+		if i+1 >= len(c.args) {
+			c.AddReplyError("syntax error")
+			return
+		}
+		switch {
+		case opt == "count":
+			if c.getLongFromObjectOrReply(c.args[i+1], &count) == GODIS_ERR {
+				return
+			}
+			if count < 1 {
+				c.AddReplyError("syntax error")
+				return
+			}
+		case opt == "match":
+			pattern = c.args[i+1].StrVal()
+		case opt == "type" && o == nil:
+			typename = strings.ToLower(c.args[i+1].StrVal())
+		default:
+			c.AddReplyError("syntax error")
+			return
+		}
+		i += 2
+	}
+
+	var d *Dict
+	switch {
+	case o == nil:
+		d = c.db.data
+	case o.Type_ == GSET, o.Type_ == GHASH:
+		d = o.Val_.(*Dict)
+	case o.Type_ == GZSET:
+		d = o.Val_.(zset).dict
+	}
+	// 哈希表和有序集合中 field/value、member/score 成对出现
+	pairs := o != nil && (o.Type_ == GHASH && !novalues || o.Type_ == GZSET)
+	var keys []*Gobj
+	maxiterations := count * 10
+	for {
+		cursor = d.Scan(cursor, func(e *Entry) {
+			keys = append(keys, e.Key)
+			if !pairs {
+				return
+			}
+			if o.Type_ == GZSET {
+				score := strconv.FormatFloat(e.Value.Val_.(float64), 'g', 17, 64)
+				keys = append(keys, CreateObject(GSTR, score))
+			} else {
+				keys = append(keys, e.Value)
+			}
+		})
+		maxiterations--
+		if cursor == 0 || maxiterations <= 0 || int64(len(keys)) >= count {
+			break
+		}
+	}
+
+	step := 1
+	if pairs {
+		step = 2
+	}
+	filtered := make([]*Gobj, 0, len(keys))
+	for j := 0; j < len(keys); j += step {
+		key := keys[j]
+		if pattern != "" && !stringMatchLen(pattern, key.StrVal(), false) {
+			continue
+		}
+		if o == nil {
+			// Scan 已经结束，这里可以删除过期的键
+			if expireIfNeeded(c.db, key) {
+				continue
+			}
+			if typename != "" && getObjectTypeName(c.db.data.Get(key)) != typename {
+				continue
+			}
+		}
+		filtered = append(filtered, keys[j:j+step]...)
+	}
+
+	c.AddReplyArrayLen(2)
+	c.AddReplyBulk(CreateObject(GSTR, strconv.FormatUint(cursor, 10)))
+	c.AddReplyArrayLen(int64(len(filtered)))
+	for _, key := range filtered {
+		c.AddReplyBulk(key)
+	}
+}
+
+func scanCommand(c *GodisClient) {
+	var cursor uint64
+	if parseScanCursorOrReply(c, c.args[1], &cursor) == GODIS_ERR {
+		return
+	}
+	scanGenericCommand(c, nil, cursor)
+}
+
+// SSCAN / HSCAN / ZSCAN 的公共部分：检查键的类型，键不存在时返回空的结果
+func scanKeyGenericCommand(c *GodisClient, typ Gtype) {
+	var cursor uint64
+	if parseScanCursorOrReply(c, c.args[2], &cursor) == GODIS_ERR {
+		return
+	}
+	o := findKeyRead(c.db, c.args[1])
+	if o == nil {
+		c.AddReplyStr("*2\r\n$1\r\n0\r\n*0\r\n")
+		return
+	}
+	if o.Type_ != typ {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	scanGenericCommand(c, o, cursor)
+}
+
+func sscanCommand(c *GodisClient) {
+	scanKeyGenericCommand(c, GSET)
+}
+
+func hscanCommand(c *GodisClient) {
+	scanKeyGenericCommand(c, GHASH)
+}
+
+func zscanCommand(c *GodisClient) {
+	scanKeyGenericCommand(c, GZSET)
 }
 
 func pingCommand(c *GodisClient) {
 	c.AddReplyStr("+PONG\r\n")
 }
 func configCommand(c *GodisClient) {
-	if c.args[1].StrVal() == "GET" {
-		switch c.args[2].StrVal() {
+	if len(c.args) < 3 {
+		c.AddReplyError("wrong number of arguments for 'config' command")
+		return
+	}
+	sub := strings.ToUpper(c.args[1].StrVal())
+	option := strings.ToLower(c.args[2].StrVal())
+	if sub == "GET" {
+		var value string
+		switch option {
 		case "save":
-			c.AddReplyStr("*2\r\n$4\r\nsave\r\n$23\r\n3600 1 300 100 60 10000\r\n")
+			value = saveParamsToString()
 		case "appendonly":
-			c.AddReplyStr("*2\r\n$10\r\nappendonly\r\n$2\r\nno\r\n")
+			value = "no"
+			if server.appendonly == 1 {
+				value = "yes"
+			}
+		case "appendfsync":
+			value = server.appendfsync
+		case "rdbformat":
+			value = server.rdbformat
+		case "databases":
+			value = strconv.Itoa(server.dbnum)
+		case "maxmemory":
+			value = strconv.FormatUint(server.maxmemory, 10)
+		case "maxmemory-policy":
+			value = maxmemoryPolicyName(server.maxmemorypolicy)
+		case "maxmemory-samples":
+			value = strconv.Itoa(server.maxmemorysamples)
+		case "aofuserdbpreamble":
+			value = "no"
+			if server.aofuserdbpreamble {
+				value = "yes"
+			}
 		default:
 			c.AddReplyError("Unknown CONFIG option")
+			return
 		}
-	} else if c.args[1].StrVal() == "SET" {
-		return
+		c.AddReplyStr(fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(option), option, len(value), value))
+	} else if sub == "SET" {
+		if len(c.args) != 4 {
+			c.AddReplyError("wrong number of arguments for 'config set' command")
+			return
+		}
+		switch option {
+		case "save":
+			if err := setSaveParamsFromString(c.args[3].StrVal()); err != nil {
+				c.AddReplyError("Invalid save parameters")
+				return
+			}
+		case "rdbformat":
+			format := strings.ToLower(c.args[3].StrVal())
+			if format != RDB_FORMAT_GODIS && format != RDB_FORMAT_REDIS {
+				c.AddReplyError("Invalid rdbformat")
+				return
+			}
+			server.rdbformat = format
+		case "maxmemory":
+			maxmemory, err := memtoull(c.args[3].StrVal())
+			if err != nil {
+				c.AddReplyError("Invalid maxmemory")
+				return
+			}
+			setMaxmemory(maxmemory)
+			// 调小之后立即淘汰，不用等到下一个写命令
+			performEvictions()
+		case "maxmemory-policy":
+			policy, err := maxmemoryPolicyFromName(c.args[3].StrVal())
+			if err != nil {
+				c.AddReplyError("Invalid maxmemory-policy")
+				return
+			}
+			server.maxmemorypolicy = policy
+		case "maxmemory-samples":
+			samples, err := strconv.Atoi(c.args[3].StrVal())
+			if err != nil || samples < 1 || samples > 64 {
+				c.AddReplyError("Invalid maxmemory-samples")
+				return
+			}
+			server.maxmemorysamples = samples
+		default:
+			c.AddReplyError("Unsupported CONFIG parameter: " + option)
+			return
+		}
+		c.AddReplyStr("+OK" + CRLF)
+	} else {
+		c.AddReplyError("Unknown subcommand " + sub)
 	}
 }
 func infoCommand(c *GodisClient) {
-	if c.args[1].StrVal() != "memory" {
-		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		return
+	section := "default"
+	if len(c.args) > 1 {
+		section = strings.ToLower(c.args[1].StrVal())
+	}
+	all := section == "all" || section == "default"
+	var info strings.Builder
+	if all || section == "clients" {
+		genClientsInfo(&info)
+	}
+	if all || section == "memory" {
+		if info.Len() > 0 {
+			info.WriteString(CRLF)
+		}
+		genMemoryInfo(&info)
+	}
+	if all || section == "persistence" {
+		if info.Len() > 0 {
+			info.WriteString(CRLF)
+		}
+		genPersistenceInfo(&info)
+	}
+	if all || section == "stats" {
+		if info.Len() > 0 {
+			info.WriteString(CRLF)
+		}
+		genStatsInfo(&info)
+	}
+	if all || section == "keyspace" {
+		if info.Len() > 0 {
+			info.WriteString(CRLF)
+		}
+		genKeyspaceInfo(&info)
+	}
+	c.AddReplyStr(fmt.Sprintf("$%d\r\n%s\r\n", info.Len(), info.String()))
+}
+
+// 只列出非空的数据库
+func genKeyspaceInfo(info *strings.Builder) {
+	info.WriteString("# Keyspace\r\n")
+	for _, db := range server.db {
+		keys := db.data.usedSize()
+		if keys == 0 {
+			continue
+		}
+		info.WriteString(fmt.Sprintf("db%d:keys=%d,expires=%d\r\n", db.id, keys, db.expire.usedSize()))
 	}
+}
+
+func genClientsInfo(info *strings.Builder) {
+	info.WriteString("# Clients\r\n")
+	info.WriteString(fmt.Sprintf("connected_clients:%d\r\n", len(server.clients)))
+	info.WriteString(fmt.Sprintf("blocked_clients:%d\r\n", server.blockedClients))
+}
+
+func genStatsInfo(info *strings.Builder) {
+	info.WriteString("# Stats\r\n")
+	info.WriteString(fmt.Sprintf("expired_keys:%d\r\n", server.statexpiredkeys))
+	info.WriteString(fmt.Sprintf("expired_subkeys:%d\r\n", server.statexpiredsubkeys))
+	info.WriteString(fmt.Sprintf("expired_stale_perc:%.2f\r\n", server.statexpiredstaleperc*100))
+	info.WriteString(fmt.Sprintf("expired_time_cap_reached_count:%d\r\n", server.statexpiredtimecapreachedcount))
+	info.WriteString(fmt.Sprintf("expire_cycle_cpu_milliseconds:%d\r\n", server.statexpirecycletimeused/1000))
+	info.WriteString(fmt.Sprintf("evicted_keys:%d\r\n", server.statevictedkeys))
+}
+
+func genMemoryInfo(info *strings.Builder) {
 	var m runtime.MemStats
 	runtime.ReadMemStats(&m)
-	info := fmt.Sprintf(
+	info.WriteString(fmt.Sprintf(
 		"# Memory\r\nused_memory:%d b %.2f kb %.2f MiB %.2f GB\r\n",
 		m.Alloc,
 		float64(m.Alloc)/1024,
 		float64(m.Alloc)/1024/1024,
 		float64(m.Alloc)/1024/1024/1024,
-	)
-	c.AddReplyStr(info)
+	))
+	info.WriteString(fmt.Sprintf("maxmemory:%d\r\n", server.maxmemory))
+	info.WriteString(fmt.Sprintf("maxmemory_policy:%s\r\n", maxmemoryPolicyName(server.maxmemorypolicy)))
+}
+
+func genPersistenceInfo(info *strings.Builder) {
+	statusStr := func(status int8) string {
+		if status == GODIS_OK {
+			return "ok"
+		}
+		return "err"
+	}
+	inProgress := func(done chan int8) int {
+		if done != nil {
+			return 1
+		}
+		return 0
+	}
+	currentRewriteTime := int64(-1)
+	if server.aofrewritetimestart != -1 {
+		currentRewriteTime = (GetMsTime() - server.aofrewritetimestart) / 1000
+	}
+	// 当前后台任务的进度
+	processed := int64(0)
+	total := int64(0)
+	perc := float64(0)
+	if server.bgrewritedone != nil || server.bgsavedone != nil {
+		processed = server.savekeysprocessed.Load()
+		total = server.savekeystotal
+		if total > 0 {
+			perc = float64(processed) * 100 / float64(total)
+		}
+	}
+	scheduled := 0
+	if server.aofrewritescheduled {
+		scheduled = 1
+	}
+	currentSaveTime := int64(-1)
+	if server.rdbsavetimestart != -1 {
+		currentSaveTime = (GetMsTime() - server.rdbsavetimestart) / 1000
+	}
+	info.WriteString("# Persistence\r\n")
+	info.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", server.dirty))
+	info.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", inProgress(server.bgsavedone)))
+	info.WriteString(fmt.Sprintf("rdb_last_save_time:%d\r\n", server.lastsave))
+	info.WriteString(fmt.Sprintf("rdb_last_bgsave_status:%s\r\n", statusStr(server.lastbgsavestatus)))
+	info.WriteString(fmt.Sprintf("rdb_last_bgsave_time_sec:%d\r\n", server.rdbsavetimelast))
+	info.WriteString(fmt.Sprintf("rdb_current_bgsave_time_sec:%d\r\n", currentSaveTime))
+	info.WriteString(fmt.Sprintf("aof_enabled:%d\r\n", server.appendonly))
+	info.WriteString(fmt.Sprintf("aof_rewrite_in_progress:%d\r\n", inProgress(server.bgrewritedone)))
+	info.WriteString(fmt.Sprintf("aof_rewrite_scheduled:%d\r\n", scheduled))
+	info.WriteString(fmt.Sprintf("aof_last_rewrite_time_sec:%d\r\n", server.aofrewritetimelast))
+	info.WriteString(fmt.Sprintf("aof_current_rewrite_time_sec:%d\r\n", currentRewriteTime))
+	info.WriteString(fmt.Sprintf("aof_last_bgrewrite_status:%s\r\n", statusStr(server.aoflastbgrewritestatus)))
+	info.WriteString(fmt.Sprintf("aof_rewrite_buffer_length:%d\r\n", len(server.bgrewritebuf)))
+	info.WriteString(fmt.Sprintf("aof_current_size:%d\r\n", server.aofcurrentsize))
+	info.WriteString(fmt.Sprintf("current_save_keys_processed:%d\r\n", processed))
+	info.WriteString(fmt.Sprintf("current_save_keys_total:%d\r\n", total))
+	info.WriteString(fmt.Sprintf("current_save_perc:%.2f\r\n", perc))
 }
 
 func helloCommand(c *GodisClient) {
@@ -232,7 +747,7 @@ func helloCommand(c *GodisClient) {
 		v interface{}
 	}{
 		{"server", "godis"},
-		{"version", "0.1"},
+		{"version", GODIS_VERSION},
 		{"proto", 3},
 		{"id", 1},
 		{"mode", "standalone"},
@@ -263,30 +778,56 @@ func helloCommand(c *GodisClient) {
 	}
 }
 
-func incrDecrCommand(c *GodisClient, isIncr bool) {
+// INCR / DECR / INCRBY / DECRBY 的通用实现，值可以是整数编码也可以是原始字符串，结果总是整数编码
+func incrDecrCommand(c *GodisClient, incr int64) {
 	key := c.args[1]
-	obj := lookupKeyWrite(key)
-	if obj == nil {
-		obj = CreateObject(GSTR, int64(0))
-		err := server.db.data.Add(key, obj)
-		if err != nil {
-			return
-		}
+	obj := lookupKeyWrite(c.db, key)
+	if obj != nil && obj.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
 	}
-	// 自增操作
-	if isIncr {
-		obj.Val_ = obj.Val_.(int64) + 1
-	} else {
-		obj.Val_ = obj.Val_.(int64) - 1
+	var value int64
+	if c.getLongFromObjectOrReply(obj, &value) != GODIS_OK {
+		return
+	}
+	if (incr < 0 && value < 0 && incr < math.MinInt64-value) ||
+		(incr > 0 && value > 0 && incr > math.MaxInt64-value) {
+		c.AddReplyError("increment or decrement would overflow")
+		return
 	}
-	c.AddReplyStr(fmt.Sprintf(":%d\r\n", obj.Val_.(int64)))
+	value += incr
+	// 不在原来的对象上修改，原来的对象可能还在回复链表中等待发送
+	newObj := CreateFromInt(value)
+	dbOverwrite(c.db, key, newObj)
+	newObj.DecrRefCount()
+	server.dirty++
+	c.AddReplyLong(value)
 }
 
 func incrCommand(c *GodisClient) {
-	incrDecrCommand(c, true)
+	incrDecrCommand(c, 1)
 }
 func decrCommand(c *GodisClient) {
-	incrDecrCommand(c, false)
+	incrDecrCommand(c, -1)
+}
+func incrbyCommand(c *GodisClient) {
+	var incr int64
+	if c.getLongFromObjectOrReply(c.args[2], &incr) != GODIS_OK {
+		return
+	}
+	incrDecrCommand(c, incr)
+}
+func decrbyCommand(c *GodisClient) {
+	var incr int64
+	if c.getLongFromObjectOrReply(c.args[2], &incr) != GODIS_OK {
+		return
+	}
+	// -math.MinInt64 会溢出
+	if incr == math.MinInt64 {
+		c.AddReplyError("decrement would overflow")
+		return
+	}
+	incrDecrCommand(c, -incr)
 }
 func zaddCommand(c *GodisClient) {
 	// zaddGenericCommand(c, c.args[1], c.args[3], 0, false)
@@ -297,67 +838,110 @@ func zincrbyCommand(c *GodisClient) {
 }
 
 func zpopmaxCommand(c *GodisClient) {
-	zpopGenericCommand(c, true)
+	zpopMinMaxCommand(c, ZSET_MAX)
 }
 
 func zpopminCommand(c *GodisClient) {
-	zpopGenericCommand(c, false)
+	zpopMinMaxCommand(c, ZSET_MIN)
 }
-func zpopGenericCommand(c *GodisClient, max bool) {
-	key := c.args[1]
-	zsetObj := lookupKeyWrite(key)
-	if zsetObj == nil {
-		c.AddReplyInt(-1)
-		return
-	} else if zsetObj.Type_ != GZSET {
-		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+
+// ZPOPMIN / ZPOPMAX key [count]
+func zpopMinMaxCommand(c *GodisClient, where int8) {
+	if len(c.args) > 3 {
+		c.AddReplyError("syntax error")
 		return
 	}
-	count := int64(-1)
-	if len(c.args) > 2 {
-		c.getLongFromObjectOrReply(c.args[2], &count)
+	var countarg *Gobj
+	if len(c.args) == 3 {
+		countarg = c.args[2]
 	}
-	if count < 0 {
-		count = 1
+	genericZpopCommand(c, c.args[1:2], where, false, countarg)
+}
+
+// 弹出分数最小 / 最大的成员，返回成员和分数
+func zsetPop(zs zset, where int8) (*Gobj, float64) {
+	var zslnode *zskiplistNode
+	if where == ZSET_MIN {
+		zslnode = zs.zsl.header.level[0].forward
+	} else {
+		zslnode = zs.zsl.tail
 	}
-	zslist := zsetObj.Val_.(zset).zsl
-	pop_len := count
-	for pop_len > 0 {
-		var zslnode *zskiplistNode
-		if max {
-			zslnode = zslist.header.level[0].forward
-		} else {
-			zslnode = zslist.tail
+	member := zslnode.obj
+	score := zslnode.score
+	zs.ZsetDeleteElement(member)
+	return member, score
+}
+
+/*
+从 keys 中第一个存在的有序集合弹出 count 个成员，回复成员和分数交替的数组。
+emitkey 为 true 时（BZPOPMIN / BZPOPMAX）回复中还包含 key。有序集合为空时删除 key。
+*/
+func genericZpopCommand(c *GodisClient, keys []*Gobj, where int8, emitkey bool, countarg *Gobj) {
+	count := int64(1)
+	if countarg != nil {
+		if c.getLongFromObjectOrReply(countarg, &count) != GODIS_OK {
+			return
 		}
-		member := zslnode.obj
-		score := zslnode.score
-		zsetObj.Val_.(zset).ZsetDeleteElement(member)
-		// 构建回复
-		var reply strings.Builder
-		if pop_len == count {
-			reply.WriteString(fmt.Sprintf("*%d"+CRLF, count*2))
+		if count < 0 {
+			c.AddReplyError("value is out of range, must be positive")
+			return
 		}
-		val := member.StrVal()
-		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(val), val))
-		c.AddReplyStr(reply.String())
+	}
+	var key, zobj *Gobj
+	for _, key = range keys {
+		zobj = lookupKeyWrite(c.db, key)
+		if zobj == nil {
+			continue
+		}
+		if zobj.Type_ != GZSET {
+			c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return
+		}
+		break
+	}
+	if zobj == nil || count == 0 {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	zs := zobj.Val_.(zset)
+	if count > int64(zs.zsl.length) {
+		count = int64(zs.zsl.length)
+	}
+	if emitkey {
+		c.AddReplyArrayLen(count*2 + 1)
+		c.AddReplyBulk(key)
+	} else {
+		c.AddReplyArrayLen(count * 2)
+	}
+	for i := int64(0); i < count; i++ {
+		member, score := zsetPop(zs, where)
+		c.AddReplyBulk(member)
 		c.AddReplyDouble(score)
-		pop_len--
 	}
+	if zs.zsl.length == 0 {
+		dbDelete(c.db, key)
+	}
+	server.dirty += count
 }
+
 func zrankGenericCommand(c *GodisClient, reverse bool) {
 	key := c.args[1]
-	zsetObj := findKeyRead(key)
+	zsetObj := findKeyRead(c.db, key)
 	if zsetObj == nil {
-		c.AddReplyInt(-1)
+		c.AddReplyStr("$-1\r\n")
 		return
 	} else if zsetObj.Type_ != GZSET {
 		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
 		return
 	}
 	member := c.args[2]
+	if zsetObj.Val_.(zset).dict.Find(member) == nil {
+		c.AddReplyStr("$-1\r\n")
+		return
+	}
 	rank := zsetObj.Val_.(zset).zsetRank(member)
 	if reverse {
-		rank = zsetObj.Val_.(zset).zsl.length - rank
+		rank = zsetObj.Val_.(zset).zsl.length - 1 - rank
 	}
 	c.AddReplyLong(int64(rank))
 }
@@ -369,162 +953,44 @@ func zrevrankCommand(c *GodisClient) {
 }
 func zremCommand(c *GodisClient) {
 	key := c.args[1]
-	zsetObj := lookupKeyWrite(key)
+	zsetObj := lookupKeyWrite(c.db, key)
 	deleted := 0
 	for i := 2; i < len(c.args); i++ {
 		member := c.args[i]
 		zset_ := zsetObj.Val_.(zset)
 		if zset_.zsl.length == 0 {
-			server.db.data.Delete(key)
+			c.db.data.Delete(key)
 			c.AddReplyInt(deleted)
 			return
 		}
 		zsetObj.Val_.(zset).ZsetDeleteElement(member)
 		deleted++
 	}
+	server.dirty += int64(deleted)
 	c.AddReplyInt(deleted)
 }
 
-func zrevrangebyscoreCommand(c *GodisClient) {
-	zrangebyscoreGenericCommand(c, true)
-}
-
-func zrangebyscoreCommand(c *GodisClient) {
-	zrangebyscoreGenericCommand(c, false)
-}
-
-func zrangebyscoreGenericCommand(c *GodisClient, reverse bool) {
-	key := c.args[1]
-	start, _ := strconv.ParseFloat(c.args[2].StrVal(), 64)
-	end, _ := strconv.ParseFloat(c.args[3].StrVal(), 64)
-	withscores := false
-	argc := len(c.args)
-	// TODO limi
-	if argc == 5 && c.args[4].StrVal() == "withscores" {
-		withscores = true
-	} else if argc > 5 {
-		c.AddReplyError("ERR syntax error")
-		return
-	}
-	zsetObj := findKeyRead(key)
-	if zsetObj == nil {
-		c.AddReplyArrayLen(0)
-		return
-	} else if zsetObj.Type_ != GZSET {
-		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
-		return
-	}
-
-	range_len := int64(0)
-	reply := strings.Builder{}
-	zslNode := zsetObj.Val_.(zset).zsl.zslGetElementScore(start)
-	for zslNode != nil && zslNode.score <= end {
-		range_len++
-		member := zslNode.obj
-		str := member.StrVal()
-		reply.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(str), str))
-		if withscores {
-			reply.WriteString(fmt.Sprintf("$%d\r\n%f\r\n", len(str), zslNode.score))
-		}
-		zslNode = zslNode.level[0].forward
-	}
-	c.AddReplyArrayLen(range_len)
-	if range_len > 0 {
-		c.AddReplyStr(reply.String())
-	}
-}
-
-func zrevrangeCommand(c *GodisClient) {
-	zrangeGenericCommand(c, true)
-}
-
-func zrangeCommand(c *GodisClient) {
-	zrangeGenericCommand(c, false)
-}
-
-func zrangeGenericCommand(c *GodisClient, reverse bool) {
+func zscoreCommand(c *GodisClient) {
 	key := c.args[1]
-	var start, end int64
-	c.getLongFromObjectOrReply(c.args[2], &start)
-	c.getLongFromObjectOrReply(c.args[3], &end)
-	withscores := false
-	argc := len(c.args)
-	if argc == 5 && c.args[4].StrVal() == "withscores" {
-		withscores = true
-	} else if argc > 5 {
-		c.AddReplyError("ERR syntax error")
-		return
-	}
-
-	zsetObj := findKeyRead(key)
+	zsetObj := findKeyRead(c.db, key)
 	if zsetObj == nil {
-		c.AddReplyArrayLen(0)
+		c.AddReplyStr("$-1\r\n")
 		return
 	} else if zsetObj.Type_ != GZSET {
 		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
 		return
 	}
-
-	zslen := zsetObj.Val_.(zset).zsl.length
-	if start < 0 {
-		start = int64(zslen) + start
-	}
-	if end < 0 {
-		end = int64(zslen) + end
-	}
-	if start < 0 {
-		start = 0
-	}
-
-	if start > int64(zslen)-1 {
-		c.AddReplyArrayLen(0)
-		return
-	}
-	if end > int64(zslen)-1 {
-		end = int64(zslen) - 1
-	}
-	var zslNode *zskiplistNode
-	if reverse {
-		if start == 0 {
-			zslNode = zsetObj.Val_.(zset).zsl.tail
-		} else {
-			zslNode = zsetObj.Val_.(zset).zsl.zslGetElementByRank(int64(zslen) - start)
-		}
-	} else {
-		if start == 0 {
-			zslNode = zsetObj.Val_.(zset).zsl.header.level[0].forward
-		} else {
-			zslNode = zsetObj.Val_.(zset).zsl.zslGetElementByRank(start + 1)
-		}
-	}
-	c.AddReplyArrayLen(end - start + 1)
-	for i := start; i <= end; i++ {
-		member := zslNode.obj
-		c.AddReplyBulk(member)
-		if withscores {
-			c.AddReplyDouble(zslNode.score)
-		}
-		zslNode = zslNode.level[0].forward
-	}
-}
-
-func zscoreCommand(c *GodisClient) {
-	key := c.args[1]
-	zsetObj := findKeyRead(key)
-	if zsetObj == nil {
-		c.AddReplyInt(-1)
-		return
-	} else if zsetObj.Type_ != GZSET {
-		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+	resultScore, ok := zsetObj.Val_.(zset).zsetScore(c.args[2])
+	if !ok {
+		c.AddReplyStr("$-1\r\n")
 		return
 	}
-	resultScore := zsetObj.Val_.(zset).dict.Find(c.args[2]).Value.Val_.(float64)
 	c.AddReplyDouble(resultScore)
 }
 
 func zcardCommand(c *GodisClient) {
 	key := c.args[1]
-	zsetObj := findKeyRead(key)
+	zsetObj := findKeyRead(c.db, key)
 	if zsetObj == nil {
 		c.AddReplyInt(0)
 		return
@@ -616,14 +1082,14 @@ func zaddGenericCommand_(c *GodisClient, flag int) {
 		scores[i] = score
 	}
 	// 查询键对应的有序集合，若不存在则新建
-	zsetobj := findKeyRead(key)
+	zsetobj := findKeyRead(c.db, key)
 	if zsetobj == nil {
 		if xx {
 			c.AddReplyStr("0") // 键不存在且设置了XX选项：无需任何操作
 			return
 		}
 		zsetobj = CreateZSetObject()
-		server.db.data.Set(key, zsetobj)
+		c.db.data.Set(key, zsetobj)
 	} else if zsetobj.Type_ != GZSET {
 		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
 		return
@@ -652,6 +1118,9 @@ func zaddGenericCommand_(c *GodisClient, flag int) {
 		score = newscore
 	}
 	server.dirty += (added + updated)
+	if added > 0 {
+		signalKeyAsReady(c.db, key)
+	}
 
 	if incr { // ZINCRBY or INCR option.
 		if processed > 0 {
@@ -674,10 +1143,10 @@ func Str2Double(str string) (float64, error) {
 }
 
 func zaddGenericCommand(c *GodisClient, key *Gobj, obj *Gobj, score float64, isIncr bool) {
-	zsetobj := findKeyRead(key)
+	zsetobj := findKeyRead(c.db, key)
 	if zsetobj == nil {
 		zsetobj = CreateZSetObject()
-		server.db.data.Set(key, zsetobj)
+		c.db.data.Set(key, zsetobj)
 	} else if zsetobj.Type_ != GZSET {
 		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
 		return
@@ -713,7 +1182,7 @@ func hdelCommand(c *GodisClient) {
 	key := c.args[1]
 	deleted := 0
 	//keyremoved := 0
-	hashObej := lookupKeyWrite(key)
+	hashObej := lookupKeyWrite(c.db, key)
 	if hashObej == nil {
 		c.AddReplyInt8(0)
 		return
@@ -729,6 +1198,10 @@ func hdelCommand(c *GodisClient) {
 	 * field with expiration. The following logic checks if this is indeed the last
 	 * field with expiration and removes it from global HFE DS. */
 	deleted = hashObej.hashTypeDelete(c.args[2:])
+	if hashObej.hashTypeLength() == 0 {
+		dbDelete(c.db, key)
+	}
+	server.dirty += int64(deleted)
 	c.AddReplyInt(deleted)
 }
 
@@ -739,7 +1212,7 @@ func hvalsCommand(c *GodisClient) {
 
 func hashGenericCommand(k, v bool, c *GodisClient) {
 	key := c.args[1]
-	hashObj := lookupKeyWrite(key)
+	hashObj := lookupKeyWrite(c.db, key)
 	if hashObj == nil {
 		c.AddReplyStr("*0" + CRLF)
 		return
@@ -767,16 +1240,28 @@ func hkeysCommand(c *GodisClient) {
 	hashGenericCommand(true, false, c)
 }
 
-func getExpire(key *Gobj) int64 {
-	if server.db.expire == nil {
+func getExpire(db *GodisDB, key *Gobj) int64 {
+	if db.expire == nil {
 		return -1
 	}
-	expObj := server.db.expire.Get(key)
+	expObj := db.expire.Get(key)
 	if expObj == nil {
 		return -1
 	}
 	return expObj.Val_.(int64)
 }
+
+// 设置 key 的过期时间（毫秒时间戳），key 必须已经存在
+func setExpire(db *GodisDB, key *Gobj, when int64) {
+	expObj := CreateFromInt(when)
+	db.expire.Set(key, expObj)
+	expObj.DecrRefCount()
+}
+
+// 删除 key 的过期时间，key 原来没有过期时间时返回 false
+func removeExpire(db *GodisDB, key *Gobj) bool {
+	return db.expire.Delete(key) == nil
+}
 func hsetnxCommand(c *GodisClient) {
 	key := c.args[1]
 	field := c.args[2]
@@ -784,10 +1269,10 @@ func hsetnxCommand(c *GodisClient) {
 
 	var isHashDeleted bool
 
-	hashObj := lookupKeyWrite(key)
+	hashObj := lookupKeyWrite(c.db, key)
 	if hashObj == nil {
 		hashObj = hashTypeCreate()
-		err := server.db.data.Add(key, hashObj)
+		err := c.db.data.Add(key, hashObj)
 		if err != nil {
 			return
 		}
@@ -803,12 +1288,13 @@ func hsetnxCommand(c *GodisClient) {
 	// Field expired and in turn hash deleted. Create new one!
 	if isHashDeleted {
 		hashObj = hashTypeCreate()
-		err := server.db.data.Add(key, hashObj)
+		err := c.db.data.Add(key, hashObj)
 		if err != nil {
 			return
 		}
 	}
 	hashObj.hashTypeSet([]*Gobj{field, value})
+	server.dirty++
 	c.AddReplyInt8(1)
 }
 
@@ -817,9 +1303,9 @@ func hgetCommand(c *GodisClient) {
 	field := c.args[2]
 
 	// 查找哈希对象
-	hashObj := lookupKeyWrite(key)
+	hashObj := lookupKeyWrite(c.db, key)
 	if hashObj == nil {
-		c.AddReplyInt8(-1)
+		c.AddReplyStr("$-1\r\n")
 		return
 	}
 
@@ -831,7 +1317,7 @@ func hgetCommand(c *GodisClient) {
 	// 从哈希表中获取值
 	val := hashObj.hashTypeGet(field)
 	if val == nil {
-		c.AddReplyInt8(-1)
+		c.AddReplyStr("$-1\r\n")
 		return
 	}
 	// 返回找到的值
@@ -846,12 +1332,12 @@ func hsetCommand(c *GodisClient) {
 	}
 
 	key := c.args[1]
-	hashObj := lookupKeyWrite(key)
+	hashObj := lookupKeyWrite(c.db, key)
 
 	// 如果键不存在，创建一个新的哈希表
 	if hashObj == nil {
 		hashObj = hashTypeCreate()
-		server.db.data.Set(key, hashObj)
+		c.db.data.Set(key, hashObj)
 		hashObj.DecrRefCount() // Set 会增加引用计数，所以这里减少一次
 	} else if hashObj.Type_ != GHASH {
 		// 如果键存在但不是哈希类型，返回错误
@@ -859,12 +1345,13 @@ func hsetCommand(c *GodisClient) {
 		return
 	}
 	created := hashObj.hashTypeSet(c.args[2:])
+	server.dirty += int64(len(c.args)-2) / 2
 	c.AddReplyInt(created)
 }
 
 func scardCommand(c *GodisClient) {
 	key := c.args[1]
-	set := findKeyRead(key)
+	set := findKeyRead(c.db, key)
 	if set == nil {
 		c.AddReplyInt8(0)
 	} else if set.Type_ == GSET {
@@ -876,7 +1363,7 @@ func scardCommand(c *GodisClient) {
 
 func smembersCommand(c *GodisClient) {
 	key := c.args[1]
-	set := lookupKeyWrite(key)
+	set := lookupKeyWrite(c.db, key)
 	if set == nil {
 		c.AddReplyStr("*0" + CRLF)
 	} else if set.Type_ != GSET {
@@ -899,7 +1386,7 @@ func smembersCommand(c *GodisClient) {
 
 func sismemberCommand(c *GodisClient) {
 	key := c.args[1]
-	set := lookupKeyWrite(key)
+	set := lookupKeyWrite(c.db, key)
 	if set == nil {
 		c.AddReplyInt8(0)
 	} else if set.Type_ != GSET {
@@ -911,7 +1398,7 @@ func sismemberCommand(c *GodisClient) {
 
 func sremCommand(c *GodisClient) {
 	key := c.args[1]
-	set := lookupKeyWrite(key)
+	set := lookupKeyWrite(c.db, key)
 	if set == nil {
 		c.AddReplyInt(0)
 		return
@@ -920,6 +1407,10 @@ func sremCommand(c *GodisClient) {
 		return
 	}
 	removed := set.setTypeRemove(c.args[2:])
+	if set.setTypeSize() == 0 {
+		dbDelete(c.db, key)
+	}
+	server.dirty += removed
 	c.AddReplyLong(removed)
 }
 
@@ -933,7 +1424,7 @@ func lremCommand(c *GodisClient) {
 	countObj := c.args[2]
 	value := c.args[3]
 
-	lobj := lookupKeyWrite(key)
+	lobj := lookupKeyWrite(c.db, key)
 	if lobj == nil {
 		c.AddReplyInt(0)
 		return
@@ -977,17 +1468,21 @@ func lremCommand(c *GodisClient) {
 			node = prevNode
 		}
 	}
+	if list.Length() == 0 {
+		dbDelete(c.db, key)
+	}
+	server.dirty += removed
 	c.AddReplyLong(removed)
 }
 
 func saddCommand(c *GodisClient) {
 	key := c.args[1]
-	set := lookupKeyWrite(key)
+	set := lookupKeyWrite(c.db, key)
 
 	// 如果键不存在，创建一个新的集合
 	if set == nil {
 		set = SetTypeCreate()
-		err := server.db.data.Add(key, set)
+		err := c.db.data.Add(key, set)
 		if err != nil {
 			return
 		}
@@ -997,12 +1492,21 @@ func saddCommand(c *GodisClient) {
 		return
 	}
 	added := set.setTypeAdd(c.args[2:])
+	server.dirty += added
 	c.AddReplyLong(added)
 }
 
 func llenCommand(c *GodisClient) {
 	key := c.args[1]
-	lobj := findKeyRead(key)
+	lobj := findKeyRead(c.db, key)
+	if lobj == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if lobj.Type_ != GLIST {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
 	c.AddReplyLong(lobj.Val_.(*List).Length())
 }
 
@@ -1011,7 +1515,7 @@ func lindexCommand(c *GodisClient) {
 	indexObj := c.args[2]
 
 	// 获取列表对象
-	lobj := findKeyRead(key)
+	lobj := findKeyRead(c.db, key)
 	if lobj == nil {
 		c.AddReplyStr("$-1\r\n")
 		return
@@ -1059,18 +1563,23 @@ func lindexCommand(c *GodisClient) {
 	c.AddReplyStr(fmt.Sprintf("$%d\r\n%s\r\n", len(val), val))
 }
 
-func pushGenericCommand(c *GodisClient, where int8) {
+// LPUSH / RPUSH，xx 为 true 时（LPUSHX / RPUSHX）只在列表已经存在时插入
+func pushGenericCommand(c *GodisClient, where int8, xx bool) {
 	key := c.args[1]
-	lobj := lookupKeyWrite(key)
+	lobj := lookupKeyWrite(c.db, key)
 	// 查找或创建列表
 	var list *List
 	if lobj == nil {
+		if xx {
+			c.AddReplyInt8(0)
+			return
+		}
 		// 创建新的列表
 		lobj = CreateListObject()
-		server.db.data.Set(key, lobj)
+		c.db.data.Set(key, lobj)
 		lobj.DecrRefCount()
 	} else if lobj.Type_ != GLIST {
-		c.AddReplyError("Operation against a key holding the wrong kind of value")
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
 		return
 	}
 	list = lobj.Val_.(*List)
@@ -1085,6 +1594,8 @@ func pushGenericCommand(c *GodisClient, where int8) {
 		// 增加值的引用计数
 		val.IncrRefCount()
 	}
+	server.dirty += int64(len(c.args) - 2)
+	signalKeyAsReady(c.db, key)
 	// 回复客户端
 	c.AddReplyStr(fmt.Sprintf(":%d"+CRLF, list.Length()))
 }
@@ -1094,7 +1605,7 @@ func lrangeCommand(c *GodisClient) {
 	stopObj := c.args[3]
 
 	// 获取列表对象
-	lobj := findKeyRead(key)
+	lobj := findKeyRead(c.db, key)
 	if lobj == nil {
 		// 返回空数组
 		c.AddReplyArrayLen(0)
@@ -1173,60 +1684,427 @@ func lpopCommand(c *GodisClient) {
 	popGenericCommand(c, LIST_HEAD)
 }
 
+/*
+LPOP / RPOP key [count]：没有 count 时回复一个元素，有 count 时回复最多 count 个元素的数组。
+列表为空时删除 key。
+*/
 func popGenericCommand(c *GodisClient, where int8) {
+	if len(c.args) > 3 {
+		c.AddReplyError(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToLower(c.args[0].StrVal())))
+		return
+	}
+	hascount := len(c.args) == 3
+	count := int64(1)
+	if hascount {
+		if c.getLongFromObjectOrReply(c.args[2], &count) != GODIS_OK {
+			return
+		}
+		if count < 0 {
+			c.AddReplyError("value is out of range, must be positive")
+			return
+		}
+	}
 	key := c.args[1]
-	lobj := lookupKeyWrite(key)
+	lobj := lookupKeyWrite(c.db, key)
 	if lobj == nil {
-		c.AddReplyStr("$-1\r\n")
+		if hascount {
+			c.AddReplyStr("*-1\r\n")
+		} else {
+			c.AddReplyStr("$-1\r\n")
+		}
 		return
 	}
 	if lobj.Type_ != GLIST {
 		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
 		return
 	}
+	if hascount && count == 0 {
+		c.AddReplyArrayLen(0)
+		return
+	}
 
 	list := lobj.Val_.(*List)
-	// 如果列表为空，返回 nil
-	if list.Length() == 0 {
+	if count > list.Length() {
+		count = list.Length()
+	}
+	if hascount {
+		c.AddReplyArrayLen(count)
+	} else if count == 0 {
+		// 空列表，和 key 不存在一样
 		c.AddReplyStr("$-1\r\n")
 		return
 	}
 	// 从列表头部/尾部弹出元素
-	var node *Node
+	for i := int64(0); i < count; i++ {
+		var node *Node
+		if where == LIST_HEAD {
+			node = list.First()
+		} else {
+			node = list.Last()
+		}
+		list.DelNode(node)
+		c.AddReplyBulk(node.Val)
+		node.Val.DecrRefCount()
+	}
+	if list.Length() == 0 {
+		dbDelete(c.db, key)
+	}
+	server.dirty++
+}
+
+func rpopCommand(c *GodisClient) {
+	popGenericCommand(c, LIST_TAIL)
+}
+
+// 把 value 插入目标列表，列表不存在时创建，回复 value
+func lmoveHandlePush(c *GodisClient, db *GodisDB, dstkey *Gobj, dstobj *Gobj, value *Gobj, where int8) {
+	if dstobj == nil {
+		dstobj = CreateListObject()
+		db.data.Set(dstkey, dstobj)
+		dstobj.DecrRefCount()
+	}
+	list := dstobj.Val_.(*List)
 	if where == LIST_HEAD {
-		node = list.First()
+		list.LPush(value)
 	} else {
-		node = list.Last()
+		list.Append(value)
 	}
-	if node == nil {
+	value.IncrRefCount()
+	signalKeyAsReady(db, dstkey)
+	c.AddReplyBulk(value)
+}
+
+// RPOPLPUSH source destination：相当于 LMOVE source destination RIGHT LEFT
+func rpoplpushCommand(c *GodisClient) {
+	lmoveGenericCommand(c, LIST_TAIL, LIST_HEAD)
+}
+
+func lmoveCommand(c *GodisClient) {
+	var wherefrom, whereto int8
+	if getListPositionFromObjectOrReply(c, c.args[3], &wherefrom) != GODIS_OK ||
+		getListPositionFromObjectOrReply(c, c.args[4], &whereto) != GODIS_OK {
+		return
+	}
+	lmoveGenericCommand(c, wherefrom, whereto)
+}
+
+/*
+LMOVE source destination LEFT|RIGHT LEFT|RIGHT：从 source 弹出一个元素插入 destination，
+source 为空时删除。BLMOVE 不需要阻塞时也使用这里，按照 LMOVE 写入 AOF。
+*/
+func lmoveGenericCommand(c *GodisClient, wherefrom, whereto int8) {
+	sobj := lookupKeyWrite(c.db, c.args[1])
+	if sobj == nil {
 		c.AddReplyStr("$-1\r\n")
 		return
 	}
-	val := node.Val
+	if sobj.Type_ != GLIST {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	list := sobj.Val_.(*List)
+	if list.Length() == 0 {
+		c.AddReplyStr("$-1\r\n")
+		return
+	}
+	dobj := lookupKeyWrite(c.db, c.args[2])
+	if dobj != nil && dobj.Type_ != GLIST {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	var node *Node
+	if wherefrom == LIST_HEAD {
+		node = list.First()
+	} else {
+		node = list.Last()
+	}
 	list.DelNode(node)
+	value := node.Val
+	lmoveHandlePush(c, c.db, c.args[2], dobj, value, whereto)
+	value.DecrRefCount()
+	if list.Length() == 0 {
+		dbDelete(c.db, c.args[1])
+	}
+	server.dirty++
+	if strings.ToLower(c.args[0].StrVal()) == "blmove" {
+		rewriteClientCommandVector(c, CreateObject(GSTR, "LMOVE"), c.args[1], c.args[2], c.args[3], c.args[4])
+	}
+}
 
-	// 返回被弹出的元素
-	str := val.StrVal()
-	c.AddReplyStr(fmt.Sprintf("$%d\r\n%s\r\n", len(str), str))
+func lpushCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_HEAD, false)
 }
 
-func rpopCommand(c *GodisClient) {
-	popGenericCommand(c, LIST_TAIL)
+func rpushCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_TAIL, false)
 }
 
-func lpushCommand(c *GodisClient) {
-	pushGenericCommand(c, LIST_HEAD)
+func lpushxCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_HEAD, true)
 }
 
-func rpushCommand(c *GodisClient) {
-	pushGenericCommand(c, LIST_TAIL)
+func rpushxCommand(c *GodisClient) {
+	pushGenericCommand(c, LIST_TAIL, true)
+}
+
+// LSET key index element
+func lsetCommand(c *GodisClient) {
+	var index int64
+	if c.getLongFromObjectOrReply(c.args[2], &index) != GODIS_OK {
+		return
+	}
+	lobj := lookupKeyWrite(c.db, c.args[1])
+	if lobj == nil {
+		c.AddReplyError("no such key")
+		return
+	}
+	if lobj.Type_ != GLIST {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	node := lobj.Val_.(*List).Index(index)
+	if node == nil {
+		c.AddReplyError("index out of range")
+		return
+	}
+	value := c.args[3]
+	value.IncrRefCount()
+	node.Val.DecrRefCount()
+	node.Val = value
+	server.dirty++
+	c.AddReplyStr("+OK" + CRLF)
+}
+
+/*
+LINSERT key BEFORE|AFTER pivot element：回复插入之后的长度，
+找不到 pivot 时回复 -1，key 不存在时回复 0。
+*/
+func linsertCommand(c *GodisClient) {
+	var after bool
+	switch strings.ToLower(c.args[2].StrVal()) {
+	case "after":
+		after = true
+	case "before":
+		after = false
+	default:
+		c.AddReplyError("syntax error")
+		return
+	}
+	lobj := lookupKeyWrite(c.db, c.args[1])
+	if lobj == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if lobj.Type_ != GLIST {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	list := lobj.Val_.(*List)
+	pivot := list.Find(c.args[3])
+	if pivot == nil {
+		c.AddReplyInt8(-1)
+		return
+	}
+	value := c.args[4]
+	list.InsertNode(pivot, value, after)
+	value.IncrRefCount()
+	server.dirty++
+	c.AddReplyLong(list.Length())
+}
+
+// LTRIM key start stop：只保留 [start, stop] 范围内的元素，范围为空时删除 key
+func ltrimCommand(c *GodisClient) {
+	var start, end int64
+	if c.getLongFromObjectOrReply(c.args[2], &start) != GODIS_OK ||
+		c.getLongFromObjectOrReply(c.args[3], &end) != GODIS_OK {
+		return
+	}
+	lobj := lookupKeyWrite(c.db, c.args[1])
+	if lobj == nil {
+		c.AddReplyStr("+OK" + CRLF)
+		return
+	}
+	if lobj.Type_ != GLIST {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	list := lobj.Val_.(*List)
+	llen := list.Length()
+
+	/* convert negative indexes */
+	if start < 0 {
+		start = llen + start
+	}
+	if end < 0 {
+		end = llen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	/* Invariant: start >= 0, so this test will be true when end < 0.
+	 * The range is empty when start > end or start >= length. */
+	var ltrim, rtrim int64
+	if start > end || start >= llen {
+		/* Out of range start or start > end result in empty list */
+		ltrim = llen
+		rtrim = 0
+	} else {
+		if end >= llen {
+			end = llen - 1
+		}
+		ltrim = start
+		rtrim = llen - end - 1
+	}
+
+	/* Remove list elements to perform the trim */
+	for j := int64(0); j < ltrim; j++ {
+		node := list.First()
+		list.DelNode(node)
+		node.Val.DecrRefCount()
+	}
+	for j := int64(0); j < rtrim; j++ {
+		node := list.Last()
+		list.DelNode(node)
+		node.Val.DecrRefCount()
+	}
+	if list.Length() == 0 {
+		dbDelete(c.db, c.args[1])
+	}
+	// 没有删除任何元素时不写入 AOF
+	server.dirty += ltrim + rtrim
+	c.AddReplyStr("+OK" + CRLF)
+}
+
+/*
+LPOS key element [RANK rank] [COUNT num-matches] [MAXLEN len]
+  - RANK：从第 rank 个匹配的元素开始返回，负数表示从尾部开始查找
+  - COUNT：返回最多 num-matches 个下标的数组，0 表示所有匹配的元素
+  - MAXLEN：最多比较 len 个元素，0 表示不限制
+
+没有 COUNT 时回复第一个匹配的下标，找不到时回复 nil。
+*/
+func lposCommand(c *GodisClient) {
+	ele := c.args[2]
+	rank, count, maxlen := int64(1), int64(-1), int64(0)
+	for j := 3; j < len(c.args); j++ {
+		opt := strings.ToLower(c.args[j].StrVal())
+		moreargs := len(c.args) - 1 - j
+		if opt == "rank" && moreargs > 0 {
+			j++
+			if c.getLongFromObjectOrReply(c.args[j], &rank) != GODIS_OK {
+				return
+			}
+			if rank == math.MinInt64 {
+				c.AddReplyError("value is out of range")
+				return
+			}
+			if rank == 0 {
+				c.AddReplyError("RANK can't be zero: use 1 to start from the first match, 2 from the second ... or use negative to start from the end of the list")
+				return
+			}
+		} else if opt == "count" && moreargs > 0 {
+			j++
+			if c.getLongFromObjectOrReply(c.args[j], &count) != GODIS_OK {
+				return
+			}
+			if count < 0 {
+				c.AddReplyError("COUNT can't be negative")
+				return
+			}
+		} else if opt == "maxlen" && moreargs > 0 {
+			j++
+			if c.getLongFromObjectOrReply(c.args[j], &maxlen) != GODIS_OK {
+				return
+			}
+			if maxlen < 0 {
+				c.AddReplyError("MAXLEN can't be negative")
+				return
+			}
+		} else {
+			c.AddReplyError("syntax error")
+			return
+		}
+	}
+
+	/* A negative rank means start from the tail. */
+	fromTail := rank < 0
+	if fromTail {
+		rank = -rank
+	}
+
+	lobj := findKeyRead(c.db, c.args[1])
+	if lobj == nil {
+		if count != -1 {
+			c.AddReplyArrayLen(0)
+		} else {
+			c.AddReplyStr("$-1\r\n")
+		}
+		return
+	}
+	if lobj.Type_ != GLIST {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+
+	list := lobj.Val_.(*List)
+	llen := list.Length()
+	var matchIndexes []int64
+	index, matches, matchindex := int64(0), int64(0), int64(-1)
+	node := list.First()
+	if fromTail {
+		node = list.Last()
+	}
+	for node != nil && (maxlen == 0 || index < maxlen) {
+		if list.EqualFunc(node.Val, ele) {
+			matches++
+			if fromTail {
+				matchindex = llen - index - 1
+			} else {
+				matchindex = index
+			}
+			if matches >= rank {
+				if count == -1 {
+					break
+				}
+				matchIndexes = append(matchIndexes, matchindex)
+				if count != 0 && matches-rank+1 >= count {
+					break
+				}
+			}
+		}
+		index++
+		matchindex = -1 /* Remember if we exit the loop without a match. */
+		if fromTail {
+			node = node.prev
+		} else {
+			node = node.next
+		}
+	}
+
+	if count != -1 {
+		c.AddReplyArrayLen(int64(len(matchIndexes)))
+		for _, i := range matchIndexes {
+			c.AddReplyLong(i)
+		}
+	} else if matchindex != -1 {
+		c.AddReplyLong(matchindex)
+	} else {
+		c.AddReplyStr("$-1\r\n")
+	}
 }
 
 func bgrewriteaofCommand(c *GodisClient) {
-	// if server.bgsavechildpid != -1 {
-	// 	c.AddReplyError("Background save already in progress")
-	// 	return
-	// }
+	if server.bgrewritedone != nil {
+		c.AddReplyError("Background append only file rewriting already in progress")
+		return
+	}
+	// 正在 BGSAVE，等它结束之后再开始重写
+	if server.bgsavedone != nil {
+		server.aofrewritescheduled = true
+		c.AddReplyStr("+Background append only file rewriting scheduled" + CRLF)
+		return
+	}
 	if rewriteAppendOnlyFileBackground() != nil {
 		c.AddReplyError("Failed to start background AOF rewrite")
 		return
@@ -1235,44 +2113,59 @@ func bgrewriteaofCommand(c *GodisClient) {
 }
 
 func bgsaveCommand(c *GodisClient) {
-
+	if server.bgsavedone != nil {
+		c.AddReplyError("Background save already in progress")
+		return
+	}
+	if server.bgrewritedone != nil {
+		c.AddReplyError("An AOF log rewriting in progress: can't BGSAVE right now.")
+		return
+	}
+	if rdbSaveBackground(server.dbfilename) != nil {
+		c.AddReplyError("Failed to start background save")
+		return
+	}
+	c.AddReplyStr("+Background saving started" + CRLF)
 }
 
 func saveCommand(c *GodisClient) {
-	// TODO bgsavechildpid
-	// if server.bgsavechildpid != -1 {
-	// 	c.AddReplyError("Background save already in progress")
-	// 	return
-	// }
+	if server.bgsavedone != nil {
+		c.AddReplyError("Background save already in progress")
+		return
+	}
 	if rdbSave(server.dbfilename, server.db) != nil {
 		c.AddReplyError("Error saving DB on disk")
 		return
 	}
+	server.dirty = 0
+	server.lastsave = time.Now().Unix()
+	server.lastbgsavestatus = GODIS_OK
 	c.AddReplyStr("+OK" + CRLF)
 }
 
-func expireAtCommand(c *GodisClient) {
-
-}
-
-func lookupKey(key *Gobj) *Gobj {
-	entry := server.db.data.Find(key)
+func lookupKey(db *GodisDB, key *Gobj) *Gobj {
+	entry := db.data.Find(key)
 	if entry == nil {
 		return nil
 	}
 	val := entry.Value
-	// TODO  /* Update the access time for the aging algorithm.
-	//         * Don't do it if we have a saving child, as this will trigger
-	//         * a copy on write madness. */
+	/* Update the access time for the aging algorithm.
+	 * 后台持久化使用的是快照，不存在 copy on write 的问题，总是可以更新 */
+	updateObjectAccessTime(val)
 	return val
 }
 
-func lookupKeyWrite(key *Gobj) *Gobj {
-	if expireIfNeeded(key) {
+func lookupKeyWrite(db *GodisDB, key *Gobj) *Gobj {
+	if expireIfNeeded(db, key) {
 		// 如果过期了，直接删除了，不需要再去查了
 		return nil
 	}
-	return lookupKey(key)
+	o := lookupKey(db, key)
+	// 哈希的字段全部过期了，整个 key 也就删除了
+	if o != nil && hashTypeExpireIfNeeded(db, key, o) {
+		return nil
+	}
+	return o
 }
 
 func msetGenericCommand(c *GodisClient, nx int) {
@@ -1285,7 +2178,7 @@ func msetGenericCommand(c *GodisClient, nx int) {
 	if nx != 0 {
 		for j = 1; j < len(c.args); j += 2 {
 			key := c.args[j]
-			if lookupKeyWrite(key) != nil {
+			if lookupKeyWrite(c.db, key) != nil {
 				busykeys++
 			}
 		}
@@ -1297,9 +2190,10 @@ func msetGenericCommand(c *GodisClient, nx int) {
 	for j = 1; j < len(c.args); j += 2 {
 		key := c.args[j]
 		val := c.args[j+1]
-		server.db.data.Set(key, val)
-		server.db.expire.Delete(key)
+		c.db.data.Set(key, val)
+		c.db.expire.Delete(key)
 	}
+	server.dirty += int64(len(c.args)-1) / 2
 	c.AddReplyStr("+OK" + CRLF)
 }
 
@@ -1311,14 +2205,14 @@ func msetnxCommand(c *GodisClient) {
 }
 
 func mgetCommand(c *GodisClient) {
-	// TODO addReplyMultiBulkLen(c,c->argc-1); ??
+	c.AddReplyArrayLen(int64(len(c.args) - 1))
 	for i := 1; i < len(c.args); i++ {
 		key := c.args[i]
-		val := findKeyRead(key)
-		if val == nil {
+		val := findKeyRead(c.db, key)
+		if val == nil || val.Type_ != GSTR {
 			c.AddReplyStr("$-1\r\n")
 		} else {
-			c.AddReply(val)
+			c.AddReplyBulk(val)
 		}
 	}
 }
@@ -1327,17 +2221,20 @@ func delCommand(c *GodisClient) {
 	var deleted, j int
 	// TODO 这里参数计算的个数 是否需要 优化？
 	for j = 1; j < len(c.args); j++ {
-		err := server.db.data.Delete(c.args[j])
+		err := c.db.data.Delete(c.args[j])
 		if err == nil {
+			c.db.expire.Delete(c.args[j])
 			deleted++
 		}
 	}
+	server.dirty += int64(deleted)
 	c.AddReplyStr(fmt.Sprintf(":%d\r\n", int64(deleted)))
 }
 
 func (c *GodisClient) getLongFromObjectOrReply(o *Gobj, target *int64) int8 {
 	var value int64
 	if c.getLongFromObject(o, &value) != GODIS_OK {
+		c.AddReplyError("value is not an integer or out of range")
 		return GODIS_ERR
 	}
 	if target != nil {
@@ -1349,58 +2246,57 @@ func (c *GodisClient) getLongFromObject(o *Gobj, target *int64) int8 {
 	var value int64
 	if o == nil {
 		value = 0
-	}
-	if o.Type_ != GSTR {
-		c.AddReplyError("wrong type")
+	} else if o.Type_ != GSTR {
 		return GODIS_ERR
+	} else if o.encoding == GODIS_ENCODING_INT {
+		value = o.Val_.(int64)
+	} else {
+		//转换为 int 64
+		var err error
+		value, err = strconv.ParseInt(o.StrVal(), 10, 64)
+		if err != nil {
+			return GODIS_ERR
+		}
 	}
-	//转换为 int 64
-	value, err := strconv.ParseInt(o.StrVal(), 10, 64)
-	if err != nil {
+	if target != nil {
+		*target = value
+	}
+	return GODIS_OK
+}
+
+func (c *GodisClient) getDoubleFromObjectOrReply(o *Gobj, target *float64) int8 {
+	var value float64
+	if c.getDoubleFromObject(o, &value) != GODIS_OK {
+		c.AddReplyError("value is not a valid float")
 		return GODIS_ERR
 	}
-	// TODO 需要判断 Encoding REDIS_ENCODING_RAW/REDIS_ENCODING_INT
 	if target != nil {
 		*target = value
 	}
 	return GODIS_OK
 }
-func setexCommand(c *GodisClient) {
-	key := c.args[1]
-	value := c.args[3]
-	expire := c.args[2]
-	var seconds int64
-	if expire != nil {
-		if c.getLongFromObjectOrReply(expire, &seconds) != GODIS_OK {
-			return
-		}
-		if seconds <= 0 {
-			c.AddReplyError("invalid expire time in SETEX")
-			return
+func (c *GodisClient) getDoubleFromObject(o *Gobj, target *float64) int8 {
+	var value float64
+	if o == nil {
+		value = 0
+	} else if o.Type_ != GSTR {
+		return GODIS_ERR
+	} else if o.encoding == GODIS_ENCODING_INT {
+		value = float64(o.Val_.(int64))
+	} else {
+		var err error
+		value, err = Str2Double(o.StrVal())
+		if err != nil || math.IsNaN(value) {
+			return GODIS_ERR
 		}
 	}
-	// Force expire of old key if needed
-	expireIfNeeded(key)
-	timeout := GetMsTime() + (expire.IntVal() * 1000)
-	expObj := CreateFromInt(timeout)
-	server.db.data.Set(key, value)
-	server.db.expire.Set(key, expObj)
-	expObj.DecrRefCount()
-	c.AddReplyStr("+OK\r\n")
-}
-
-func setnxCommand(c *GodisClient) {
-	key := c.args[1]
-	if val := findKeyRead(key); val != nil {
-		c.AddReplyStr(":0\r\n")
-		return
+	if target != nil {
+		*target = value
 	}
-	setCommand(c)
-	c.AddReplyStr(":1\r\n")
+	return GODIS_OK
 }
-
-func expireIfNeeded(key *Gobj) bool {
-	entry := server.db.expire.Find(key)
+func expireIfNeeded(db *GodisDB, key *Gobj) bool {
+	entry := db.expire.Find(key)
 	if entry == nil {
 		return false
 	}
@@ -1408,67 +2304,217 @@ func expireIfNeeded(key *Gobj) bool {
 	if when > GetMsTime() {
 		return false
 	}
-	server.db.expire.Delete(key)
-	server.db.data.Delete(key)
+	db.expire.Delete(key)
+	db.data.Delete(key)
+	server.statexpiredkeys++
 	return true
 }
 
-func findKeyRead(key *Gobj) *Gobj {
-	if expireIfNeeded(key) {
+// keyIsExpired 只检查不删除，遍历数据库的过程中不能删除键
+func keyIsExpired(db *GodisDB, key *Gobj) bool {
+	when := getExpire(db, key)
+	return when != -1 && when <= GetMsTime()
+}
+
+func findKeyRead(db *GodisDB, key *Gobj) *Gobj {
+	if expireIfNeeded(db, key) {
 		// 如果过期了，直接删除了，不需要再去查了
 		return nil
 	}
-	return server.db.data.Get(key)
+	o := lookupKey(db, key)
+	// 哈希的字段全部过期了，整个 key 也就删除了
+	if o != nil && hashTypeExpireIfNeeded(db, key, o) {
+		return nil
+	}
+	return o
 }
 
 func getCommand(c *GodisClient) {
-	key := c.args[1]
-	valObj := findKeyRead(key)
-	if valObj == nil {
-		//TODO: extract shared.strings
-		c.AddReplyStr("$-1\r\n")
-	} else if valObj.Type_ != GSTR {
-		//TODO: extract shared.strings
-		c.AddReplyError("wrong type")
-	} else {
-		var str string
-		switch valObj.encoding {
-		case GODIS_ENCODING_INT:
-			str = fmt.Sprintf("%d", valObj.Val_.(int64))
-		case GODIS_ENCODING_RAW:
-			str = valObj.StrVal()
+	getGenericCommand(c)
+}
+
+const (
+	UNIT_SECONDS      = 0
+	UNIT_MILLISECONDS = 1
+)
+
+// EXPIRE 系列命令的 NX / XX / GT / LT 选项
+const (
+	EXPIRE_NX = 1 << iota /* 只在 key 没有过期时间时设置 */
+	EXPIRE_XX             /* 只在 key 已经有过期时间时设置 */
+	EXPIRE_GT             /* 只在新的过期时间比原来的大时设置，没有过期时间视为无穷大 */
+	EXPIRE_LT             /* 只在新的过期时间比原来的小时设置 */
+)
+
+// 解析 EXPIRE key time 之后的选项
+func parseExtendedExpireArgumentsOrReply(c *GodisClient, flags *int) int8 {
+	var nx, xx, gt, lt bool
+	for j := 3; j < len(c.args); j++ {
+		opt := c.args[j].StrVal()
+		switch strings.ToLower(opt) {
+		case "nx":
+			*flags |= EXPIRE_NX
+			nx = true
+		case "xx":
+			*flags |= EXPIRE_XX
+			xx = true
+		case "gt":
+			*flags |= EXPIRE_GT
+			gt = true
+		case "lt":
+			*flags |= EXPIRE_LT
+			lt = true
+		default:
+			c.AddReplyError(fmt.Sprintf("Unsupported option %s", opt))
+			return GODIS_ERR
 		}
-		c.AddReplyStr(fmt.Sprintf("$%d\r\n%v\r\n", len(str), str))
 	}
+	if nx && (xx || gt || lt) {
+		c.AddReplyError("NX and XX, GT or LT options at the same time are not compatible")
+		return GODIS_ERR
+	}
+	if gt && lt {
+		c.AddReplyError("GT and LT options at the same time are not compatible")
+		return GODIS_ERR
+	}
+	return GODIS_OK
 }
 
-func setCommand(c *GodisClient) {
+/*
+EXPIRE / PEXPIRE / EXPIREAT / PEXPIREAT 的通用实现，过期时间统一换算为绝对的毫秒时间戳保存在 expire 字典中
+  - basetime: 相对过期时间的基准时间（毫秒），绝对时间的命令传 0
+  - unit:     参数的单位，秒或者毫秒
+
+写入 AOF 时统一转换为 PEXPIREAT（见 FeedAppendOnlyFile），所以选项不需要写入 AOF。
+*/
+func expireGenericCommand(c *GodisClient, basetime int64, unit int) {
 	key := c.args[1]
-	val := c.args[2]
-	if val.Type_ != GSTR {
-		//TODO: extract shared.strings
-		c.AddReplyStr("-ERR: wrong type\r\n")
+	var when int64
+	flag := 0
+	if parseExtendedExpireArgumentsOrReply(c, &flag) != GODIS_OK {
+		return
 	}
-	server.db.data.Set(key, val)
-	server.db.expire.Delete(key)
-	c.AddReplyStr("+OK\r\n")
+	if c.getLongFromObjectOrReply(c.args[2], &when) != GODIS_OK {
+		return
+	}
+	// 换算成毫秒时间戳时不能溢出
+	if unit == UNIT_SECONDS {
+		if when > math.MaxInt64/1000 || when < math.MinInt64/1000 {
+			c.AddReplyError(fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(c.args[0].StrVal())))
+			return
+		}
+		when *= 1000
+	}
+	if when > math.MaxInt64-basetime {
+		c.AddReplyError(fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(c.args[0].StrVal())))
+		return
+	}
+	when += basetime
+	if lookupKeyWrite(c.db, key) == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if flag != 0 {
+		current := getExpire(c.db, key)
+		if flag&EXPIRE_NX != 0 && current != -1 {
+			c.AddReplyInt8(0)
+			return
+		}
+		if flag&EXPIRE_XX != 0 && current == -1 {
+			c.AddReplyInt8(0)
+			return
+		}
+		if flag&EXPIRE_GT != 0 && (current == -1 || when <= current) {
+			c.AddReplyInt8(0)
+			return
+		}
+		if flag&EXPIRE_LT != 0 && current != -1 && when >= current {
+			c.AddReplyInt8(0)
+			return
+		}
+	}
+	// 过期时间已经过去了，直接删除 key（重放 AOF 时也就跳过了这个 key）
+	if when <= GetMsTime() {
+		c.db.data.Delete(key)
+		c.db.expire.Delete(key)
+		server.dirty++
+		c.AddReplyInt8(1)
+		return
+	}
+	setExpire(c.db, key, when)
+	server.dirty++
+	c.AddReplyInt8(1)
 }
 
 func expireCommand(c *GodisClient) {
+	expireGenericCommand(c, GetMsTime(), UNIT_SECONDS)
+}
+
+func pexpireCommand(c *GodisClient) {
+	expireGenericCommand(c, GetMsTime(), UNIT_MILLISECONDS)
+}
+
+func expireatCommand(c *GodisClient) {
+	expireGenericCommand(c, 0, UNIT_SECONDS)
+}
+
+func pexpireatCommand(c *GodisClient) {
+	expireGenericCommand(c, 0, UNIT_MILLISECONDS)
+}
+
+/*
+TTL / PTTL / EXPIRETIME / PEXPIRETIME 的通用实现：
+key 不存在返回 -2，没有过期时间返回 -1。
+  - outputMs:  以毫秒为单位返回，否则以秒为单位（四舍五入）
+  - outputAbs: 返回绝对的时间戳，否则返回剩余的时间
+*/
+func ttlGenericCommand(c *GodisClient, outputMs bool, outputAbs bool) {
 	key := c.args[1]
-	if lookupKeyWrite(key) == nil {
-		c.AddReplyInt8(0)
+	if findKeyRead(c.db, key) == nil {
+		c.AddReplyLong(-2)
+		return
+	}
+	expire := getExpire(c.db, key)
+	if expire == -1 {
+		c.AddReplyLong(-1)
 		return
 	}
-	val := c.args[2]
-	if val.Type_ != GSTR {
-		//TODO: extract shared.strings
-		c.AddReplyStr("-ERR: wrong type" + CRLF)
+	ttl := expire
+	if !outputAbs {
+		ttl = expire - GetMsTime()
 	}
-	expire := GetMsTime() + (val.IntVal() * 1000)
-	expObj := CreateFromInt(expire)
-	server.db.expire.Set(key, expObj)
-	expObj.DecrRefCount()
+	if ttl < 0 {
+		ttl = 0
+	}
+	if !outputMs {
+		ttl = (ttl + 500) / 1000
+	}
+	c.AddReplyLong(ttl)
+}
+
+func ttlCommand(c *GodisClient) {
+	ttlGenericCommand(c, false, false)
+}
+
+func pttlCommand(c *GodisClient) {
+	ttlGenericCommand(c, true, false)
+}
+
+func expiretimeCommand(c *GodisClient) {
+	ttlGenericCommand(c, false, true)
+}
+
+func pexpiretimeCommand(c *GodisClient) {
+	ttlGenericCommand(c, true, true)
+}
+
+func persistCommand(c *GodisClient) {
+	key := c.args[1]
+	if lookupKeyWrite(c.db, key) == nil || !removeExpire(c.db, key) {
+		c.AddReplyInt8(0)
+		return
+	}
+	server.dirty++
 	c.AddReplyInt8(1)
 }
 
@@ -1546,18 +2592,56 @@ func ProcessCommand(c *GodisClient) {
 		resetClient(c)
 		return
 	}
+	/* Handle the maxmemory directive.
+	 * 先尝试淘汰，仍然超过 maxmemory 时拒绝可能增加内存的命令 */
+	if server.maxmemory > 0 && performEvictions() != nil && cmd.flags&CMD_DENYOOM != 0 {
+		c.AddReplyStr("-OOM command not allowed when used memory > 'maxmemory'." + CRLF)
+		SendReplyToClient(server.aeLoop, c.fd, c)
+		resetClient(c)
+		return
+	}
+	c.flags &^= CLIENT_FORCE_AOF
+	dirty := server.dirty
 	cmd.proc(c)
-	// TODO server.dirty > 0
-	if cmd.flags == CMD_WRITE {
-		// FeedAppendOnlyFile(cmd, c.args)
+	// SAVE 之类的命令会把 dirty 清零，所以只看增量，减少了也当作没有修改
+	dirty = server.dirty - dirty
+	if dirty < 0 {
+		dirty = 0
+	}
+	// 只有真正修改了数据集的命令才需要写入 AOF，其他需要写入的命令调用 forceCommandPropagation
+	if server.appendonly == 1 && (dirty > 0 || c.flags&CLIENT_FORCE_AOF != 0) {
+		FeedAppendOnlyFile(cmd, c.db.id, c.args)
+	}
+	// 服务等待这个命令添加了数据的 key 的客户端
+	if len(server.readyKeys) > 0 {
+		handleClientsBlockedOnKeys()
 	}
 	resetClient(c)
 }
 
+// 不管命令有没有修改 dirty，都把它写入 AOF
+func forceCommandPropagation(c *GodisClient) {
+	c.flags |= CLIENT_FORCE_AOF
+}
+
 func freeArgs(client *GodisClient) {
 	for _, v := range client.args {
-		v.DecrRefCount()
+		// 命令还没有读完时客户端就断开了，后面的参数是空的
+		if v != nil {
+			v.DecrRefCount()
+		}
+	}
+	// resetClient 之后客户端断开时还会再调用一次，不能重复释放
+	client.args = nil
+}
+
+// 替换客户端的参数，之后按照新的参数写入 AOF，例如 BLPOP 按照 LPOP 写入
+func rewriteClientCommandVector(c *GodisClient, args ...*Gobj) {
+	for _, arg := range args {
+		arg.IncrRefCount()
 	}
+	freeArgs(c)
+	c.args = args
 }
 
 func freeReplyList(client *GodisClient) {
@@ -1569,6 +2653,7 @@ func freeReplyList(client *GodisClient) {
 }
 
 func freeClient(client *GodisClient) {
+	unblockClient(client)
 	freeArgs(client)
 	delete(server.clients, client.fd)
 	server.aeLoop.RemoveFileEvent(client.fd, AE_READABLE)
@@ -1580,7 +2665,7 @@ func freeClient(client *GodisClient) {
 func resetClient(client *GodisClient) {
 	freeArgs(client)
 	client.cmdType = COMMAND_UNKNOWN
-	client.bulkLen = 0
+	client.bulkLen = -1
 	client.bulkNum = 0
 }
 
@@ -1637,7 +2722,7 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 	// read every bulk string
 	for client.bulkNum > 0 {
 		// read bulk length
-		if client.bulkLen == 0 {
+		if client.bulkLen == -1 {
 			index, err := client.findLineInQuery()
 			if index < 0 {
 				return false, err
@@ -1648,9 +2733,12 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 			}
 
 			blen, err := client.getNumInQuery(1, index)
-			if err != nil || blen == 0 {
+			if err != nil {
 				return false, err
 			}
+			if blen < 0 {
+				return false, errors.New("invalid bulk length")
+			}
 			if blen > GODIS_MAX_BULK {
 				return false, errors.New("too big bulk")
 			}
@@ -1667,7 +2755,7 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 		client.args[len(client.args)-client.bulkNum] = CreateObject(GSTR, string(client.queryBuf[:index]))
 		client.queryBuf = client.queryBuf[index+2:]
 		client.queryLen -= index + 2
-		client.bulkLen = 0
+		client.bulkLen = -1
 		client.bulkNum -= 1
 	}
 	// complete reading every bulk
@@ -1676,6 +2764,10 @@ func handleBulkBuf(client *GodisClient) (bool, error) {
 
 func ProcessQueryBuf(client *GodisClient) error {
 	for client.queryLen > 0 {
+		// 阻塞中的客户端先不处理后面的命令，解除阻塞之后在 beforeSleep 中继续
+		if client.btype != BLOCKED_NONE {
+			break
+		}
 		if client.cmdType == COMMAND_UNKNOWN {
 			if client.queryBuf[0] == '*' {
 				client.cmdType = COMMAND_BULK
@@ -1722,6 +2814,12 @@ func ReadQueryFromClient(loop *AeLoop, fd int, extra interface{}) {
 		freeClient(client)
 		return
 	}
+	// 读到 0 个字节说明客户端已经关闭了连接，不释放的话这个 fd 会一直可读，事件循环空转
+	if n == 0 {
+		log.Printf("client %v closed connection\n", fd)
+		freeClient(client)
+		return
+	}
 	client.queryLen += n
 	log.Printf("read %v bytes from client:%v\n", n, client.fd)
 	log.Printf("ReadQueryFromClient, queryBuf : %v\n", string(client.queryBuf))
@@ -1785,7 +2883,8 @@ func GStrHash(key *Gobj) int64 {
 func CreateClient(fd int) *GodisClient {
 	var client GodisClient
 	client.fd = fd
-	client.db = server.db
+	client.db = server.db[0]
+	client.bulkLen = -1
 	client.queryBuf = make([]byte, GODIS_IO_BUF)
 	client.reply = ListCreate(ListType{EqualFunc: GStrEqual})
 	return &client
@@ -1804,32 +2903,92 @@ func AcceptHandler(loop *AeLoop, fd int, extra interface{}) {
 	log.Printf("accept client, fd: %v\n", cfd)
 }
 
-const EXPIRE_CHECK_COUNT int = 100
+// ServerCron 每秒执行的次数
+const CONFIG_DEFAULT_HZ = 10
 
-// background job, runs every 100ms
-// 随机过期删除策略 每 100ms执行一次 每次选 100个key
+// 每次事件循环进入等待之前，把本轮累积的 AOF 缓冲写入文件
+func beforeSleep(loop *AeLoop) {
+	// 解除阻塞的客户端继续处理阻塞期间收到的命令，产生的 AOF 在下面一起写入
+	processUnblockedClients()
+	if server.appendonly == 1 {
+		flushAppendOnlyFile(false)
+	}
+}
+
+// background job, runs every 1000/CONFIG_DEFAULT_HZ ms
+// 主动过期：抽样删除过期的 key（见 expire.go）
 // 惰性删除策略，访问的时候检查
 func ServerCron(loop *AeLoop, id int, extra interface{}) {
-	for i := 0; i < EXPIRE_CHECK_COUNT; i++ {
-		entry := server.db.expire.RandomGet()
-		if entry == nil {
-			break
-		}
-		if entry.Value.Val_.(int64) < time.Now().Unix() {
-			server.db.data.Delete(entry.Key)
-			server.db.expire.Delete(entry.Key)
-		}
+	server.lruclock = getLRUClock()
+	activeExpireCycle()
+	// 后台重写 / BGSAVE 是否已经完成
+	checkBackgroundRewriteDone()
+	checkBackgroundSaveDone()
+	// 被 BGSAVE 推迟的 BGREWRITEAOF
+	if server.aofrewritescheduled && server.bgsavedone == nil && server.bgrewritedone == nil {
+		server.aofrewritescheduled = false
+		rewriteAppendOnlyFileBackground()
+	}
+	// save <seconds> <changes> 自动保存
+	rdbCheckSaveParams()
+	// appendfsync everysec: 每秒 fsync 一次
+	if server.appendonly == 1 && server.appendfsync == AOF_FSYNC_EVERYSEC &&
+		GetMsTime()-server.lastfsync >= 1000 {
+		aofFsync()
 	}
 }
 
 func initServer(config *Config) error {
 	server.port = config.Port
+	server.appendonly = 0
+	if config.AppendOnly {
+		server.appendonly = 1
+	}
+	switch config.AppendFsync {
+	case AOF_FSYNC_ALWAYS, AOF_FSYNC_EVERYSEC, AOF_FSYNC_NO:
+		server.appendfsync = config.AppendFsync
+	default:
+		return fmt.Errorf("invalid appendfsync: %s", config.AppendFsync)
+	}
+	server.appendfilename = config.AppendFilename
+	server.appenddirname = config.AppendDirname
+	server.aofuserdbpreamble = config.AofUseRdbPreamble
+	server.dbfilename = config.DbFilename
+	switch config.RdbFormat {
+	case RDB_FORMAT_GODIS, RDB_FORMAT_REDIS:
+		server.rdbformat = config.RdbFormat
+	default:
+		return fmt.Errorf("invalid rdbformat: %s", config.RdbFormat)
+	}
+	server.aofrewritetimestart = -1
+	server.aofrewritetimelast = -1
+	server.aoflastbgrewritestatus = GODIS_OK
+	server.rdbsavetimestart = -1
+	server.rdbsavetimelast = -1
+	server.lastbgsavestatus = GODIS_OK
+	server.lastsave = time.Now().Unix()
+	if err := setSaveParamsFromString(config.Save); err != nil {
+		return err
+	}
 	server.clients = make(map[int]*GodisClient)
-	server.db = &GodisDB{
-		data:   DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
-		expire: DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+	if config.Databases < 1 {
+		return fmt.Errorf("invalid databases: %d", config.Databases)
 	}
-	var err error
+	server.dbnum = config.Databases
+	server.db = createDBs(server.dbnum)
+	maxmemory, err := memtoull(config.MaxMemory)
+	if err != nil {
+		return fmt.Errorf("invalid maxmemory: %s", config.MaxMemory)
+	}
+	setMaxmemory(maxmemory)
+	if server.maxmemorypolicy, err = maxmemoryPolicyFromName(config.MaxMemoryPolicy); err != nil {
+		return err
+	}
+	if config.MaxMemorySamples < 1 {
+		return fmt.Errorf("invalid maxmemory-samples: %d", config.MaxMemorySamples)
+	}
+	server.maxmemorysamples = config.MaxMemorySamples
+	server.lruclock = getLRUClock()
 	if server.aeLoop, err = AeLoopCreate(); err != nil {
 		return err
 	}
@@ -1837,7 +2996,82 @@ func initServer(config *Config) error {
 	return err
 }
 
+// 启动时加载数据：开启了 AOF 就从 AOF 文件恢复（AOF 的数据更完整），否则加载 RDB 文件
+func loadDataFromDisk() error {
+	start := GetMsTime()
+	if server.appendonly == 1 {
+		if err := loadAppendOnlyFile(); err != nil {
+			return err
+		}
+		log.Printf("DB loaded from append only file: %.3f seconds\n", float64(GetMsTime()-start)/1000)
+	} else {
+		if err := rdbLoad(server.dbfilename); err != nil {
+			if !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		} else {
+			log.Printf("DB loaded from disk: %.3f seconds\n", float64(GetMsTime()-start)/1000)
+		}
+	}
+	// 加载过程中执行的命令不算作新的修改
+	server.dirty = 0
+	return nil
+}
+
+func dbCreate(id int) *GodisDB {
+	return &GodisDB{
+		data:   DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+		expire: DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+		id:     id,
+
+		hexpires: DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+
+		blockingKeys: make(map[string][]*GodisClient),
+		readyKeys:    make(map[string]struct{}),
+	}
+}
+
+// 创建 dbnum 个空的数据库，编号从 0 开始
+func createDBs(dbnum int) []*GodisDB {
+	dbs := make([]*GodisDB, dbnum)
+	for i := range dbs {
+		dbs[i] = dbCreate(i)
+	}
+	return dbs
+}
+
+// dupDBs 深拷贝所有数据库，作为后台持久化 goroutine 使用的快照
+func dupDBs(dbs []*GodisDB) []*GodisDB {
+	snapshot := make([]*GodisDB, len(dbs))
+	for i, db := range dbs {
+		snapshot[i] = dbCreate(db.id)
+		dupDict(db.data, snapshot[i].data)
+		dupDict(db.expire, snapshot[i].expire)
+	}
+	return snapshot
+}
+
+// 所有数据库中 key 的总数
+func dbsKeyCount(dbs []*GodisDB) int64 {
+	var count int64
+	for _, db := range dbs {
+		count += db.data.usedSize()
+	}
+	return count
+}
+
 func main() {
+	// 检查工具：godis check-aof / godis check-rdb，或者通过名为 godis-check-aof / godis-check-rdb 的链接运行
+	switch {
+	case filepath.Base(os.Args[0]) == "godis-check-aof":
+		os.Exit(checkAofMain(os.Args[1:]))
+	case filepath.Base(os.Args[0]) == "godis-check-rdb":
+		os.Exit(checkRdbMain(os.Args[1:]))
+	case len(os.Args) > 1 && os.Args[1] == "check-aof":
+		os.Exit(checkAofMain(os.Args[2:]))
+	case len(os.Args) > 1 && os.Args[1] == "check-rdb":
+		os.Exit(checkRdbMain(os.Args[2:]))
+	}
 	//path := os.Args[1]
 	log.SetOutput(io.Discard) // 关闭日志输出
 	path := "./config.json"
@@ -1851,12 +3085,19 @@ func main() {
 		log.Printf("init server error: %v\n", err)
 		return
 	}
-	// 加载AOF 文件
-	//loadAppendOnlyFile()
-	// 加载 RDB 数据库
-	//rdbLoad(server.dbfilename)
+	if err = loadDataFromDisk(); err != nil {
+		log.Printf("load data from disk error: %v\n", err)
+		return
+	}
+	if server.appendonly == 1 {
+		if err = openAppendOnlyFile(); err != nil {
+			log.Printf("open append only file error: %v\n", err)
+			return
+		}
+	}
+	server.aeLoop.SetBeforeSleepProc(beforeSleep)
 	server.aeLoop.AddFileEvent(server.fd, AE_READABLE, AcceptHandler, nil)
-	server.aeLoop.AddTimeEvent(AE_NORMAL, 100, ServerCron, nil)
+	server.aeLoop.AddTimeEvent(AE_NORMAL, 1000/CONFIG_DEFAULT_HZ, ServerCron, nil)
 	log.Println("godis server is up.")
 	server.aeLoop.AeMain()
 }
@@ -1,66 +1,102 @@
 package main
 
-import "log"
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
 
 func hashTypeCreate() *Gobj {
 	return CreateHashObject()
 }
 
+// 设置多个字段的值，返回新创建的字段数量。覆盖已有的字段时同时清除它的过期时间
 func (hash *Gobj) hashTypeSet(values []*Gobj) int {
 	created := 0
-	hashDict := hash.Val_.(*Dict)
 	// 处理字段和值的配对
 	for i := 0; i < len(values); i += 2 {
-		field := values[i]
-		value := values[i+1]
-
-		// 尝试添加字段-值对，如果字段已存在则更新
-		err := hashDict.Add(field, value)
-		if err == nil {
-			// 添加成功，说明是新字段
+		if hash.hashTypeSetValue(values[i], values[i+1], false) {
 			created++
-		} else {
-			// 字段已存在，更新值
-			entry := hashDict.Find(field)
-			if entry != nil {
-				entry.Value.DecrRefCount()
-				entry.Value = value
-				value.IncrRefCount()
-			}
 		}
 	}
 	return created
 }
 
-func (hash *Gobj) hashTypeGet(field *Gobj) *Gobj {
+/*
+设置一个字段的值，字段是新创建的时候返回 true。
+keepttl 为 true 时保留字段原来的过期时间（HINCRBY / HINCRBYFLOAT），否则清除（HSET）。
+*/
+func (hash *Gobj) hashTypeSetValue(field, value *Gobj, keepttl bool) bool {
 	hashDict := hash.Val_.(*Dict)
-	entry := hashDict.Get(field)
-	if entry != nil {
-		return entry
+	// 尝试添加字段-值对，如果字段已存在则更新
+	if hashDict.Add(field, value) == nil {
+		return true
+	}
+	// 字段已存在，更新值
+	entry := hashDict.Find(field)
+	entry.Value.DecrRefCount()
+	entry.Value = value
+	value.IncrRefCount()
+	if !keepttl {
+		hash.hashTypeRemoveExpire(field)
 	}
-	return nil
+	return false
 }
 
-func (hash *Gobj) hashTypeExists(field *Gobj, isHashDeleted *bool) bool {
+// 获取字段的值，字段不存在或者已经过期时返回 nil，过期的字段在这里惰性删除
+func (hash *Gobj) hashTypeGet(field *Gobj) *Gobj {
 	hashDict := hash.Val_.(*Dict)
 	entry := hashDict.Find(field)
-	// TODO isHashDeleted
-	return entry != nil
+	if entry == nil {
+		return nil
+	}
+	if when := hash.hashTypeGetExpire(field); when != -1 && when <= GetMsTime() {
+		hash.hashTypeDelete([]*Gobj{field})
+		server.statexpiredsubkeys++
+		return nil
+	}
+	return entry.Value
 }
 
+func (hash *Gobj) hashTypeExists(field *Gobj, isHashDeleted *bool) bool {
+	// 过期的字段在 hashTypeGet 中删除，key 已经在查找的时候处理过了（见 hashTypeExpireIfNeeded），这里不会删除整个哈希
+	*isHashDeleted = false
+	return hash.hashTypeGet(field) != nil
+}
+
+// 删除字段（以及它的过期时间），返回真正删除了的字段数量，不存在的字段不计数
 func (hash *Gobj) hashTypeDelete(fields []*Gobj) int {
 	deleted := 0
 	hashDict := hash.Val_.(*Dict)
 	for i := 0; i < len(fields); i++ {
-		hashDict.Delete(fields[i])
-		deleted++
+		// 参数可能就是哈希中保存的字段对象，删除的过程中不能被释放
+		field := fields[i]
+		field.IncrRefCount()
+		hash.hashTypeRemoveExpire(field)
+		if hashDict.Delete(field) == nil {
+			deleted++
+		}
+		field.DecrRefCount()
 	}
-	// TODO bug 没有正确计算用了的个数
+	return deleted
+}
+
+func (hash *Gobj) hashTypeLength() int64 {
+	return hash.Val_.(*Dict).usedSize()
+}
+
+// 随机返回一个字段，和 setTypeRandomElement 一样，稀疏的哈希表上 Dict.RandomGet 找不到时重试
+func (hash *Gobj) hashTypeRandomEntry() *Entry {
+	hashDict := hash.Val_.(*Dict)
 	if hashDict.usedSize() == 0 {
-		server.db.data.Delete(hash)
+		return nil
+	}
+	for {
+		if e := hashDict.RandomGet(); e != nil {
+			return e
+		}
 	}
-	log.Default().Printf("hashTypeDelete deleted %d fields", hashDict.usedSize())
-	return deleted
 }
 
 func (hash *Gobj) hashTypeFields(k, v bool) []*Gobj {
@@ -78,3 +114,770 @@ func (hash *Gobj) hashTypeFields(k, v bool) []*Gobj {
 	iter.Close()
 	return results
 }
+
+/*
+查找哈希类型的 key，key 不存在时返回 nil。
+key 存在但不是哈希时回复 WRONGTYPE 并返回 GODIS_ERR。
+*/
+func lookupHashOrReply(c *GodisClient, key *Gobj, write bool) (*Gobj, int8) {
+	var hashObj *Gobj
+	if write {
+		hashObj = lookupKeyWrite(c.db, key)
+	} else {
+		hashObj = findKeyRead(c.db, key)
+	}
+	if hashObj != nil && hashObj.Type_ != GHASH {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, GODIS_ERR
+	}
+	return hashObj, GODIS_OK
+}
+
+// 写命令用：查找哈希类型的 key，不存在时创建一个空的哈希
+func hashTypeLookupWriteOrCreate(c *GodisClient, key *Gobj) *Gobj {
+	hashObj, ok := lookupHashOrReply(c, key, true)
+	if ok != GODIS_OK {
+		return nil
+	}
+	if hashObj == nil {
+		hashObj = hashTypeCreate()
+		c.db.data.Set(key, hashObj)
+		hashObj.DecrRefCount()
+	}
+	return hashObj
+}
+
+// 获取哈希表的所有字段和值
+func hgetallCommand(c *GodisClient) {
+	hashGenericCommand(true, true, c)
+}
+
+// HMGET key field [field ...]：不存在的字段回复 nil
+func hmgetCommand(c *GodisClient) {
+	hashObj, ok := lookupHashOrReply(c, c.args[1], false)
+	if ok != GODIS_OK {
+		return
+	}
+	c.AddReplyArrayLen(int64(len(c.args) - 2))
+	for _, field := range c.args[2:] {
+		var val *Gobj
+		if hashObj != nil {
+			val = hashObj.hashTypeGet(field)
+		}
+		if val == nil {
+			c.AddReplyStr("$-1\r\n")
+		} else {
+			c.AddReplyBulk(val)
+		}
+	}
+}
+
+func hexistsCommand(c *GodisClient) {
+	hashObj, ok := lookupHashOrReply(c, c.args[1], false)
+	if ok != GODIS_OK {
+		return
+	}
+	if hashObj != nil && hashObj.hashTypeGet(c.args[2]) != nil {
+		c.AddReplyInt8(1)
+	} else {
+		c.AddReplyInt8(0)
+	}
+}
+
+func hlenCommand(c *GodisClient) {
+	hashObj, ok := lookupHashOrReply(c, c.args[1], false)
+	if ok != GODIS_OK {
+		return
+	}
+	if hashObj == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	c.AddReplyLong(hashObj.hashTypeLength())
+}
+
+// HSTRLEN key field：字段不存在时回复 0
+func hstrlenCommand(c *GodisClient) {
+	hashObj, ok := lookupHashOrReply(c, c.args[1], false)
+	if ok != GODIS_OK {
+		return
+	}
+	var val *Gobj
+	if hashObj != nil {
+		val = hashObj.hashTypeGet(c.args[2])
+	}
+	if val == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	c.AddReplyLong(int64(len(val.StrVal())))
+}
+
+/*
+HINCRBY key field increment：字段的值是 Dict 中的字符串对象，字段不存在时看作 0。
+和 INCRBY 一样不在原来的对象上修改（它可能是某个客户端的参数，或者还在回复链表中），而是换成新的对象。
+字段的过期时间保持不变。
+*/
+func hincrbyCommand(c *GodisClient) {
+	var incr, value int64
+	if c.getLongFromObjectOrReply(c.args[3], &incr) != GODIS_OK {
+		return
+	}
+	hashObj := hashTypeLookupWriteOrCreate(c, c.args[1])
+	if hashObj == nil {
+		return
+	}
+	field := c.args[2]
+	if cur := hashObj.hashTypeGet(field); cur != nil {
+		if c.getLongFromObject(cur, &value) != GODIS_OK {
+			c.AddReplyError("hash value is not an integer")
+			return
+		}
+	}
+	if (incr < 0 && value < 0 && incr < math.MinInt64-value) ||
+		(incr > 0 && value > 0 && incr > math.MaxInt64-value) {
+		c.AddReplyError("increment or decrement would overflow")
+		return
+	}
+	value += incr
+	newObj := CreateFromInt(value)
+	hashObj.hashTypeSetValue(field, newObj, true)
+	newObj.DecrRefCount()
+	server.dirty++
+	c.AddReplyLong(value)
+}
+
+// HINCRBYFLOAT key field increment：结果的格式和 INCRBYFLOAT 一样
+func hincrbyfloatCommand(c *GodisClient) {
+	var incr, value float64
+	if c.getDoubleFromObjectOrReply(c.args[3], &incr) != GODIS_OK {
+		return
+	}
+	if math.IsNaN(incr) || math.IsInf(incr, 0) {
+		c.AddReplyError("value is NaN or Infinity")
+		return
+	}
+	hashObj := hashTypeLookupWriteOrCreate(c, c.args[1])
+	if hashObj == nil {
+		return
+	}
+	field := c.args[2]
+	if cur := hashObj.hashTypeGet(field); cur != nil {
+		if c.getDoubleFromObject(cur, &value) != GODIS_OK {
+			c.AddReplyError("hash value is not a float")
+			return
+		}
+	}
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		c.AddReplyError("increment would produce NaN or Infinity")
+		return
+	}
+	newObj := CreateObject(GSTR, strconv.FormatFloat(value, 'f', -1, 64))
+	hashObj.hashTypeSetValue(field, newObj, true)
+	newObj.DecrRefCount()
+	server.dirty++
+	c.AddReplyBulk(newObj)
+}
+
+func addHashFieldToReply(c *GodisClient, e *Entry, withvalues bool) {
+	c.AddReplyBulk(e.Key)
+	if withvalues {
+		c.AddReplyBulk(e.Value)
+	}
+}
+
+/*
+HRANDFIELD key [count [WITHVALUES]]：随机返回字段，语义和 SRANDMEMBER 一样：
+count 为正数时返回不重复的字段，为负数时同一个字段可能出现多次。
+*/
+func hrandfieldCommand(c *GodisClient) {
+	withvalues := false
+	hascount := len(c.args) >= 3
+	var count int64 = 1
+	if len(c.args) > 4 || (len(c.args) == 4 && strings.ToLower(c.args[3].StrVal()) != "withvalues") {
+		c.AddReplyError("syntax error")
+		return
+	}
+	if len(c.args) == 4 {
+		withvalues = true
+	}
+	uniq := true
+	if hascount {
+		if c.getLongFromObjectOrReply(c.args[2], &count) != GODIS_OK {
+			return
+		}
+		if count < 0 {
+			// 带 WITHVALUES 时回复的元素个数是 count 的两倍
+			if count < -math.MaxInt64/2 {
+				c.AddReplyError("value is out of range")
+				return
+			}
+			count = -count
+			uniq = false
+		}
+	}
+	hashObj, ok := lookupHashOrReply(c, c.args[1], false)
+	if ok != GODIS_OK {
+		return
+	}
+	if hashObj == nil {
+		if hascount {
+			c.AddReplyArrayLen(0)
+		} else {
+			c.AddReplyStr("$-1\r\n")
+		}
+		return
+	}
+	if !hascount {
+		c.AddReplyBulk(hashObj.hashTypeRandomEntry().Key)
+		return
+	}
+	if count == 0 {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	multiplier := int64(1)
+	if withvalues {
+		multiplier = 2
+	}
+
+	/* CASE 1: The count was negative, so the extraction method is just:
+	 * "return N random elements" sampling the whole set every time. */
+	if !uniq {
+		c.AddReplyArrayLen(count * multiplier)
+		for ; count > 0; count-- {
+			addHashFieldToReply(c, hashObj.hashTypeRandomEntry(), withvalues)
+		}
+		return
+	}
+
+	/* CASE 2: The number of requested elements is greater than the number of
+	 * elements inside the hash: simply return the whole hash. */
+	size := hashObj.hashTypeLength()
+	if count >= size {
+		fields := hashObj.hashTypeFields(true, true)
+		c.AddReplyArrayLen(size * multiplier)
+		for i := 0; i < len(fields); i += 2 {
+			addHashFieldToReply(c, &Entry{Key: fields[i], Value: fields[i+1]}, withvalues)
+		}
+		return
+	}
+
+	/* CASE 3: The number of elements inside the hash is not greater than
+	 * 3 times the number of requested elements. Copy the hash and remove
+	 * random elements to reach the requested number of elements.
+	 *
+	 * CASE 4: We have a big hash compared to the requested number of elements.
+	 * Get random elements and add them to a temporary hash until we have
+	 * enough unique elements. */
+	result := hashTypeCreate()
+	if count*3 > size {
+		result.hashTypeSet(hashObj.hashTypeFields(true, true))
+		for result.hashTypeLength() > count {
+			result.hashTypeDelete([]*Gobj{result.hashTypeRandomEntry().Key})
+		}
+	} else {
+		for result.hashTypeLength() < count {
+			e := hashObj.hashTypeRandomEntry()
+			result.hashTypeSet([]*Gobj{e.Key, e.Value})
+		}
+	}
+	fields := result.hashTypeFields(true, true)
+	c.AddReplyArrayLen(count * multiplier)
+	for i := 0; i < len(fields); i += 2 {
+		addHashFieldToReply(c, &Entry{Key: fields[i], Value: fields[i+1]}, withvalues)
+	}
+	result.DecrRefCount()
+}
+
+/*
+哈希字段的过期时间（参考 Redis 7.4 的 hash field expiration）：
+每个哈希的字段过期时间保存在它的 Dict 的 metadata 中（field -> 毫秒时间戳，和 db.expire 的结构一样），
+有字段设置了过期时间的哈希同时记录在 db.hexpires 中，ServerCron 从中抽样主动删除过期的字段（见 activeExpireHashFields）。
+访问时惰性删除：hashTypeGet 检查单个字段，查找 key 时（hashTypeExpireIfNeeded）删除所有过期的字段，
+哈希因此变成空的时候删除 key。
+
+过期时间写入 AOF 时统一转换为 HPEXPIREAT，和 key 的过期时间一样是绝对时间，所以重放的结果是一致的。
+*/
+type hashExpireMeta struct {
+	expires   *Dict /* field -> 过期时间（毫秒时间戳） */
+	minExpire int64 /* 最早的过期时间的下界，当前时间比它小时不需要检查任何字段 */
+}
+
+// 字段过期时间的上限，和 Redis 一样是 2^48 - 1 毫秒
+const HFE_MAX_ABS_TIME_MSEC = 1<<48 - 1
+
+func (hash *Gobj) hashTypeExpireMeta() *hashExpireMeta {
+	meta, _ := hash.Val_.(*Dict).metadata.(*hashExpireMeta)
+	return meta
+}
+
+// 返回字段的过期时间，没有过期时间时返回 -1
+func (hash *Gobj) hashTypeGetExpire(field *Gobj) int64 {
+	meta := hash.hashTypeExpireMeta()
+	if meta == nil {
+		return -1
+	}
+	expObj := meta.expires.Get(field)
+	if expObj == nil {
+		return -1
+	}
+	return expObj.Val_.(int64)
+}
+
+// 设置字段的过期时间，字段必须已经存在
+func (hash *Gobj) hashTypeSetExpire(field *Gobj, when int64) {
+	hashDict := hash.Val_.(*Dict)
+	meta := hash.hashTypeExpireMeta()
+	if meta == nil {
+		meta = &hashExpireMeta{
+			expires:   DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual}),
+			minExpire: math.MaxInt64,
+		}
+		hashDict.metadata = meta
+	}
+	// 和哈希共用同一个字段对象
+	expObj := CreateFromInt(when)
+	meta.expires.Set(hashDict.Find(field).Key, expObj)
+	expObj.DecrRefCount()
+	if when < meta.minExpire {
+		meta.minExpire = when
+	}
+}
+
+/*
+删除字段的过期时间，字段原来没有过期时间时返回 false。
+minExpire 只是下界，这里不需要更新，下一次检查的时候会重新计算。
+*/
+func (hash *Gobj) hashTypeRemoveExpire(field *Gobj) bool {
+	meta := hash.hashTypeExpireMeta()
+	if meta == nil || meta.expires.Delete(field) != nil {
+		return false
+	}
+	if meta.expires.usedSize() == 0 {
+		hash.Val_.(*Dict).metadata = nil
+	}
+	return true
+}
+
+// 删除所有在 now 之前过期的字段，返回删除的字段数量
+func (hash *Gobj) hashTypeExpireFields(now int64) int64 {
+	meta := hash.hashTypeExpireMeta()
+	if meta == nil || now < meta.minExpire {
+		return 0
+	}
+	var expired []*Gobj
+	minExpire := int64(math.MaxInt64)
+	iter := meta.expires.NewIterator(true)
+	for field, expObj, exists := iter.Next(); exists; field, expObj, exists = iter.Next() {
+		if when := expObj.Val_.(int64); when <= now {
+			expired = append(expired, field)
+		} else if when < minExpire {
+			minExpire = when
+		}
+	}
+	iter.Close()
+	meta.minExpire = minExpire
+	hash.hashTypeDelete(expired)
+	server.statexpiredsubkeys += int64(len(expired))
+	return int64(len(expired))
+}
+
+/*
+查找 key 时调用：删除哈希中所有已经过期的字段，哈希因此变成空的时候删除 key 并返回 true。
+*/
+func hashTypeExpireIfNeeded(db *GodisDB, key, hash *Gobj) bool {
+	if hash.Type_ != GHASH || hash.hashTypeExpireFields(GetMsTime()) == 0 {
+		return false
+	}
+	if hash.hashTypeLength() == 0 {
+		dbDelete(db, key)
+		return true
+	}
+	return false
+}
+
+// hashTypeGet 可能惰性删除了最后一个字段，这时删除 key 并返回 true
+func hashTypeDeleteIfEmpty(db *GodisDB, key, hash *Gobj) bool {
+	if hash.hashTypeLength() == 0 {
+		dbDelete(db, key)
+		return true
+	}
+	return false
+}
+
+/*
+把有字段设置了过期时间的哈希记录到 db.hexpires 中。
+key 被删除或者覆盖之后这里的记录不会马上删除，主动过期抽样到的时候发现 key 对应的已经不是这个哈希了才删除。
+*/
+func dbTrackHashFieldExpires(db *GodisDB, key, hash *Gobj) {
+	if hash.hashTypeExpireMeta() != nil && db.hexpires.Get(key) != hash {
+		db.hexpires.Set(key, hash)
+	}
+}
+
+/*
+主动删除过期的字段：从 db.hexpires 中随机抽取最多 ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP 个哈希，
+删除其中过期的字段，返回删除的字段数量
+*/
+func activeExpireHashFields(db *GodisDB, now int64) int64 {
+	var expired int64
+	for num := 0; num < ACTIVE_EXPIRE_CYCLE_KEYS_PER_LOOP && db.hexpires.usedSize() > 0; num++ {
+		entry := db.hexpires.RandomGet()
+		if entry == nil {
+			break
+		}
+		key, hash := entry.Key, entry.Value
+		key.IncrRefCount()
+		if db.data.Get(key) != hash || hash.hashTypeExpireMeta() == nil {
+			// key 被删除或者覆盖了，或者哈希中已经没有设置了过期时间的字段
+			db.hexpires.Delete(key)
+		} else {
+			n := hash.hashTypeExpireFields(now)
+			expired += n
+			if n > 0 && hash.hashTypeLength() == 0 {
+				dbDelete(db, key)
+				db.hexpires.Delete(key)
+			}
+		}
+		key.DecrRefCount()
+	}
+	return expired
+}
+
+// 解析 FIELDS numfields field [field ...]，fieldsAt 是 FIELDS 的位置，返回字段列表
+func getHashFieldsOrReply(c *GodisClient, fieldsAt int) ([]*Gobj, int8) {
+	if fieldsAt >= len(c.args) || strings.ToLower(c.args[fieldsAt].StrVal()) != "fields" {
+		c.AddReplyError("Mandatory argument FIELDS is missing or not at the right position")
+		return nil, GODIS_ERR
+	}
+	var numFields int64
+	if fieldsAt+1 >= len(c.args) || c.getLongFromObject(c.args[fieldsAt+1], &numFields) != GODIS_OK || numFields <= 0 {
+		c.AddReplyError("Parameter `numFields` should be greater than 0")
+		return nil, GODIS_ERR
+	}
+	if numFields != int64(len(c.args)-fieldsAt-2) {
+		c.AddReplyError("The `numfields` parameter must match the number of arguments")
+		return nil, GODIS_ERR
+	}
+	return c.args[fieldsAt+2:], GODIS_OK
+}
+
+// HEXPIRE 系列命令对每个字段的回复
+const (
+	HFE_NO_FIELD  = -2 /* 字段不存在 */
+	HFE_NO_CHANGE = 0  /* NX / XX / GT / LT 的条件不满足 */
+	HFE_UPDATED   = 1  /* 设置了过期时间 */
+	HFE_DELETED   = 2  /* 过期时间已经过去了，字段被删除 */
+	HFE_NO_TTL    = -1 /* HPERSIST / HTTL：字段没有过期时间 */
+	HFE_PERSISTED = 1  /* HPERSIST：删除了过期时间 */
+)
+
+/*
+设置一个字段的过期时间，返回 HFE_* 之一。when 已经过去时删除这个字段。
+*/
+func hashTypeSetExpireWithFlag(hash *Gobj, field *Gobj, when int64, flag int) int {
+	if hash.hashTypeGet(field) == nil {
+		return HFE_NO_FIELD
+	}
+	if flag != 0 {
+		current := hash.hashTypeGetExpire(field)
+		if flag&EXPIRE_NX != 0 && current != -1 ||
+			flag&EXPIRE_XX != 0 && current == -1 ||
+			flag&EXPIRE_GT != 0 && (current == -1 || when <= current) ||
+			flag&EXPIRE_LT != 0 && current != -1 && when >= current {
+			return HFE_NO_CHANGE
+		}
+	}
+	if when <= GetMsTime() {
+		hash.hashTypeDelete([]*Gobj{field})
+		return HFE_DELETED
+	}
+	hash.hashTypeSetExpire(field, when)
+	return HFE_UPDATED
+}
+
+/*
+HEXPIRE / HPEXPIRE / HEXPIREAT / HPEXPIREAT key time [NX | XX | GT | LT] FIELDS numfields field [field ...]
+对每个字段回复 -2（字段不存在）、0（条件不满足）、1（设置了过期时间）或 2（时间已经过去，字段被删除）。
+写入 AOF 时改写为只包含改变了的字段的 HPEXPIREAT。
+*/
+func hexpireGenericCommand(c *GodisClient, basetime int64, unit int) {
+	key := c.args[1]
+	var when int64
+	if c.getLongFromObjectOrReply(c.args[2], &when) != GODIS_OK {
+		return
+	}
+	if when < 0 {
+		c.AddReplyError("invalid expire time, must be >= 0")
+		return
+	}
+	if unit == UNIT_SECONDS {
+		if when > HFE_MAX_ABS_TIME_MSEC/1000 {
+			c.AddReplyError(fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(c.args[0].StrVal())))
+			return
+		}
+		when *= 1000
+	}
+	if when > HFE_MAX_ABS_TIME_MSEC-basetime {
+		c.AddReplyError(fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(c.args[0].StrVal())))
+		return
+	}
+	when += basetime
+
+	// 可选的 NX / XX / GT / LT，只能有一个
+	flag := 0
+	fieldsAt := 3
+	if fieldsAt < len(c.args) {
+		switch strings.ToLower(c.args[fieldsAt].StrVal()) {
+		case "nx":
+			flag = EXPIRE_NX
+		case "xx":
+			flag = EXPIRE_XX
+		case "gt":
+			flag = EXPIRE_GT
+		case "lt":
+			flag = EXPIRE_LT
+		}
+		if flag != 0 {
+			fieldsAt++
+		}
+	}
+	fields, ok := getHashFieldsOrReply(c, fieldsAt)
+	if ok != GODIS_OK {
+		return
+	}
+	hashObj, ok := lookupHashOrReply(c, key, true)
+	if ok != GODIS_OK {
+		return
+	}
+	c.AddReplyArrayLen(int64(len(fields)))
+	if hashObj == nil {
+		for range fields {
+			c.AddReplyLong(HFE_NO_FIELD)
+		}
+		return
+	}
+
+	var changed []*Gobj
+	for _, field := range fields {
+		res := hashTypeSetExpireWithFlag(hashObj, field, when, flag)
+		if res == HFE_UPDATED || res == HFE_DELETED {
+			changed = append(changed, field)
+		}
+		c.AddReplyLong(int64(res))
+	}
+	if len(changed) == 0 {
+		return
+	}
+	if !hashTypeDeleteIfEmpty(c.db, key, hashObj) {
+		dbTrackHashFieldExpires(c.db, key, hashObj)
+	}
+	server.dirty += int64(len(changed))
+	rewriteHashFieldsCommandVector(c, "HPEXPIREAT", key, CreateFromInt(when), changed)
+}
+
+// 把命令改写为 name key [arg] FIELDS numfields field [field ...]，arg 为 nil 时省略
+func rewriteHashFieldsCommandVector(c *GodisClient, name string, key, arg *Gobj, fields []*Gobj) {
+	argv := []*Gobj{CreateObject(GSTR, name), key}
+	if arg != nil {
+		argv = append(argv, arg)
+	}
+	argv = append(argv, CreateObject(GSTR, "FIELDS"), CreateFromInt(int64(len(fields))))
+	rewriteClientCommandVector(c, append(argv, fields...)...)
+}
+
+func hexpireCommand(c *GodisClient) {
+	hexpireGenericCommand(c, GetMsTime(), UNIT_SECONDS)
+}
+
+func hpexpireCommand(c *GodisClient) {
+	hexpireGenericCommand(c, GetMsTime(), UNIT_MILLISECONDS)
+}
+
+func hexpireatCommand(c *GodisClient) {
+	hexpireGenericCommand(c, 0, UNIT_SECONDS)
+}
+
+func hpexpireatCommand(c *GodisClient) {
+	hexpireGenericCommand(c, 0, UNIT_MILLISECONDS)
+}
+
+/*
+HTTL / HPTTL key FIELDS numfields field [field ...]
+对每个字段回复剩余的生存时间，-2 表示字段不存在，-1 表示字段没有过期时间
+*/
+func httlGenericCommand(c *GodisClient, outputMs bool) {
+	fields, ok := getHashFieldsOrReply(c, 2)
+	if ok != GODIS_OK {
+		return
+	}
+	hashObj, ok := lookupHashOrReply(c, c.args[1], false)
+	if ok != GODIS_OK {
+		return
+	}
+	c.AddReplyArrayLen(int64(len(fields)))
+	now := GetMsTime()
+	for _, field := range fields {
+		if hashObj == nil || hashObj.hashTypeGet(field) == nil {
+			c.AddReplyLong(HFE_NO_FIELD)
+			continue
+		}
+		expire := hashObj.hashTypeGetExpire(field)
+		if expire == -1 {
+			c.AddReplyLong(HFE_NO_TTL)
+			continue
+		}
+		ttl := expire - now
+		if ttl < 0 {
+			ttl = 0
+		}
+		if !outputMs {
+			ttl = (ttl + 999) / 1000
+		}
+		c.AddReplyLong(ttl)
+	}
+	if hashObj != nil {
+		hashTypeDeleteIfEmpty(c.db, c.args[1], hashObj)
+	}
+}
+
+func httlCommand(c *GodisClient) {
+	httlGenericCommand(c, false)
+}
+
+func hpttlCommand(c *GodisClient) {
+	httlGenericCommand(c, true)
+}
+
+/*
+HPERSIST key FIELDS numfields field [field ...]
+对每个字段回复 1（删除了过期时间）、-1（字段没有过期时间）或 -2（字段不存在）
+*/
+func hpersistCommand(c *GodisClient) {
+	fields, ok := getHashFieldsOrReply(c, 2)
+	if ok != GODIS_OK {
+		return
+	}
+	hashObj, ok := lookupHashOrReply(c, c.args[1], true)
+	if ok != GODIS_OK {
+		return
+	}
+	c.AddReplyArrayLen(int64(len(fields)))
+	var persisted int64
+	for _, field := range fields {
+		if hashObj == nil || hashObj.hashTypeGet(field) == nil {
+			c.AddReplyLong(HFE_NO_FIELD)
+		} else if hashObj.hashTypeRemoveExpire(field) {
+			persisted++
+			c.AddReplyLong(HFE_PERSISTED)
+		} else {
+			c.AddReplyLong(HFE_NO_TTL)
+		}
+	}
+	if hashObj != nil {
+		hashTypeDeleteIfEmpty(c.db, c.args[1], hashObj)
+	}
+	server.dirty += persisted
+}
+
+/*
+HGETEX key [EX seconds | PX milliseconds | EXAT unix-time-seconds | PXAT unix-time-milliseconds | PERSIST]
+FIELDS numfields field [field ...]
+
+返回字段的值（和 HMGET 一样），同时设置或者删除这些字段的过期时间。
+过期时间已经过去时字段在返回之后被删除。写入 AOF 时改写为 HPEXPIREAT 或 HPERSIST。
+*/
+func hgetexCommand(c *GodisClient) {
+	key := c.args[1]
+	var when int64 = -1
+	persist := false
+	fieldsAt := 2
+	if fieldsAt < len(c.args) {
+		opt := strings.ToLower(c.args[fieldsAt].StrVal())
+		switch opt {
+		case "persist":
+			persist = true
+			fieldsAt++
+		case "ex", "px", "exat", "pxat":
+			if fieldsAt+1 >= len(c.args) {
+				c.AddReplyError("syntax error")
+				return
+			}
+			if c.getLongFromObjectOrReply(c.args[fieldsAt+1], &when) != GODIS_OK {
+				return
+			}
+			if when < 0 {
+				c.AddReplyError("invalid expire time, must be >= 0")
+				return
+			}
+			if opt == "ex" || opt == "exat" {
+				if when > HFE_MAX_ABS_TIME_MSEC/1000 {
+					c.AddReplyError("invalid expire time in 'hgetex' command")
+					return
+				}
+				when *= 1000
+			}
+			if opt == "ex" || opt == "px" {
+				basetime := GetMsTime()
+				if when > HFE_MAX_ABS_TIME_MSEC-basetime {
+					c.AddReplyError("invalid expire time in 'hgetex' command")
+					return
+				}
+				when += basetime
+			}
+			if when > HFE_MAX_ABS_TIME_MSEC {
+				c.AddReplyError("invalid expire time in 'hgetex' command")
+				return
+			}
+			fieldsAt += 2
+		}
+	}
+	fields, ok := getHashFieldsOrReply(c, fieldsAt)
+	if ok != GODIS_OK {
+		return
+	}
+	hashObj, ok := lookupHashOrReply(c, key, true)
+	if ok != GODIS_OK {
+		return
+	}
+	c.AddReplyArrayLen(int64(len(fields)))
+	if hashObj == nil {
+		for range fields {
+			c.AddReplyStr("$-1\r\n")
+		}
+		return
+	}
+
+	var changed []*Gobj
+	for _, field := range fields {
+		val := hashObj.hashTypeGet(field)
+		if val == nil {
+			c.AddReplyStr("$-1\r\n")
+			continue
+		}
+		c.AddReplyBulk(val)
+		if persist {
+			if hashObj.hashTypeRemoveExpire(field) {
+				changed = append(changed, field)
+			}
+		} else if when != -1 {
+			hashTypeSetExpireWithFlag(hashObj, field, when, 0)
+			changed = append(changed, field)
+		}
+	}
+	if len(changed) == 0 {
+		hashTypeDeleteIfEmpty(c.db, key, hashObj)
+		return
+	}
+	if !hashTypeDeleteIfEmpty(c.db, key, hashObj) {
+		dbTrackHashFieldExpires(c.db, key, hashObj)
+	}
+	server.dirty += int64(len(changed))
+	if persist {
+		rewriteHashFieldsCommandVector(c, "HPERSIST", key, nil, changed)
+	} else {
+		rewriteHashFieldsCommandVector(c, "HPEXPIREAT", key, CreateFromInt(when), changed)
+	}
+}
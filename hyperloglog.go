@@ -0,0 +1,760 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"math/bits"
+)
+
+/*
+HyperLogLog（参考 Redis 的 hyperloglog.c），和位图一样保存在普通的字符串对象中，
+格式和 Redis 完全一致，所以 RDB、AOF 重写都不需要额外处理，数据也可以在两边互相使用。
+
+	+------+---+-----+----------+
+	| HYLL | E | N/U | Cardin.  |
+	+------+---+-----+----------+
+
+4 字节的魔数 "HYLL"，1 字节的编码方式（稠密或者稀疏），3 字节保留，
+8 字节小端序的基数缓存，最高字节的最高位为 1 时表示缓存失效。后面是寄存器数据。
+
+稠密编码：16384 个 6 位的寄存器，第一个寄存器放在第一个字节的低 6 位。
+稀疏编码：用三种操作码对寄存器做游程编码，
+  - ZERO：00xxxxxx，xxxxxx+1 个值为 0 的寄存器（1 到 64 个）
+  - XZERO：01xxxxxx yyyyyyyy，14 位的长度 +1 个值为 0 的寄存器（1 到 16384 个）
+  - VAL：1vvvvvxx，xx+1 个值为 vvvvv+1 的寄存器（值 1 到 32，长度 1 到 4）
+值超过 32 或者稀疏编码的长度超过 HLL_SPARSE_MAX_BYTES 时转换为稠密编码，不会再转换回去。
+
+修改时和其他字符串命令一样，先拷贝出一个字节数组，修改完再创建新的对象替换原来的值。
+*/
+
+const (
+	HLL_P                = 14 /* 寄存器下标占用的 hash 位数，越大误差越小 */
+	HLL_Q                = 64 - HLL_P
+	HLL_REGISTERS        = 1 << HLL_P
+	HLL_P_MASK           = HLL_REGISTERS - 1
+	HLL_BITS             = 6 /* 每个寄存器的位数，能表示的最大值是 63 */
+	HLL_REGISTER_MAX     = (1 << HLL_BITS) - 1
+	HLL_HDR_SIZE         = 16
+	HLL_DENSE_SIZE       = HLL_HDR_SIZE + (HLL_REGISTERS*HLL_BITS+7)/8
+	HLL_ALPHA_INF        = 0.721347520444481703680 /* 0.5/ln(2) */
+	HLL_HASH_SEED        = 0xadc83b19
+	HLL_SPARSE_MAX_BYTES = 3000 /* 稀疏编码超过这个大小时转换为稠密编码 */
+)
+
+// 编码方式，HLL_RAW 是 PFCOUNT 合并多个 key 时内部使用的，每个寄存器一个字节
+const (
+	HLL_DENSE        = 0
+	HLL_SPARSE       = 1
+	HLL_RAW          = 255
+	HLL_MAX_ENCODING = 1
+)
+
+const (
+	HLL_SPARSE_VAL_BITS      = 5
+	HLL_SPARSE_VAL_MAX_VALUE = 32
+	HLL_SPARSE_VAL_MAX_LEN   = 4
+	HLL_SPARSE_ZERO_MAX_LEN  = 64
+	HLL_SPARSE_XZERO_MAX_LEN = 16384
+	HLL_SPARSE_XZERO_BIT     = 0x40
+	HLL_SPARSE_VAL_BIT       = 0x80
+	HLL_SPARSE_OPCODE_MASK   = 0xc0
+	HLL_SPARSE_ZERO_LEN_MASK = 0x3f
+)
+
+const invalidHllErr = "INVALIDOBJ Corrupted HLL object detected"
+
+/* ========================= 头部和寄存器的访问 ============================ */
+
+func hllValidCache(hll string) bool {
+	return hll[15]&(1<<7) == 0
+}
+
+func hllInvalidateCache(hll []byte) {
+	hll[15] |= 1 << 7
+}
+
+// 稠密编码的寄存器可能跨越两个字节，最后一个寄存器只占用最后一个字节
+func hllDenseGetRegister(registers []byte, regnum int) uint8 {
+	byte_ := regnum * HLL_BITS / 8
+	fb := uint(regnum * HLL_BITS & 7)
+	fb8 := 8 - fb
+	b0 := uint(registers[byte_])
+	var b1 uint
+	if byte_+1 < len(registers) {
+		b1 = uint(registers[byte_+1])
+	}
+	return uint8(((b0 >> fb) | (b1 << fb8)) & HLL_REGISTER_MAX)
+}
+
+func hllDenseSetRegister(registers []byte, regnum int, val uint8) {
+	byte_ := regnum * HLL_BITS / 8
+	fb := uint(regnum * HLL_BITS & 7)
+	fb8 := 8 - fb
+	v := uint(val)
+	registers[byte_] &= ^byte(HLL_REGISTER_MAX << fb)
+	registers[byte_] |= byte(v << fb)
+	if byte_+1 < len(registers) {
+		registers[byte_+1] &= ^byte(HLL_REGISTER_MAX >> fb8)
+		registers[byte_+1] |= byte(v >> fb8)
+	}
+}
+
+func hllSparseIsZero(b byte) bool {
+	return b&HLL_SPARSE_OPCODE_MASK == 0
+}
+
+func hllSparseIsXZero(b byte) bool {
+	return b&HLL_SPARSE_OPCODE_MASK == HLL_SPARSE_XZERO_BIT
+}
+
+func hllSparseIsVal(b byte) bool {
+	return b&HLL_SPARSE_VAL_BIT != 0
+}
+
+func hllSparseZeroLen(b byte) int {
+	return int(b&HLL_SPARSE_ZERO_LEN_MASK) + 1
+}
+
+func hllSparseXZeroLen(b0, b1 byte) int {
+	return (int(b0&HLL_SPARSE_ZERO_LEN_MASK)<<8 | int(b1)) + 1
+}
+
+func hllSparseValValue(b byte) uint8 {
+	return (b>>2)&0x1f + 1
+}
+
+func hllSparseValLen(b byte) int {
+	return int(b&0x3) + 1
+}
+
+func hllSparseValSet(val uint8, len_ int) byte {
+	return byte((int(val)-1)<<2|(len_-1)) | HLL_SPARSE_VAL_BIT
+}
+
+func hllSparseZeroSet(len_ int) byte {
+	return byte(len_ - 1)
+}
+
+func hllSparseXZeroSet(len_ int) (byte, byte) {
+	l := len_ - 1
+	return byte(l>>8) | HLL_SPARSE_XZERO_BIT, byte(l & 0xff)
+}
+
+/* ========================= HyperLogLog 算法 ============================== */
+
+// MurmurHash2 的 64 位版本，按小端序读取，保证不同平台的结果一致
+func MurmurHash64A(key string, seed uint64) uint64 {
+	const m uint64 = 0xc6a4a7935bd1e995
+	const r = 47
+	h := seed ^ (uint64(len(key)) * m)
+
+	data := key
+	for len(data) >= 8 {
+		k := uint64(data[0]) | uint64(data[1])<<8 | uint64(data[2])<<16 | uint64(data[3])<<24 |
+			uint64(data[4])<<32 | uint64(data[5])<<40 | uint64(data[6])<<48 | uint64(data[7])<<56
+		k *= m
+		k ^= k >> r
+		k *= m
+		h ^= k
+		h *= m
+		data = data[8:]
+	}
+	if len(data) > 0 {
+		for i := len(data) - 1; i >= 0; i-- {
+			h ^= uint64(data[i]) << (8 * uint(i))
+		}
+		h *= m
+	}
+	h ^= h >> r
+	h *= m
+	h ^= h >> r
+	return h
+}
+
+/*
+计算元素对应的寄存器下标，以及 hash 剩余部分从低位开始第一个 1 出现的位置（"000..1" 的长度）。
+剩余部分的第 Q 位强制设为 1，所以返回值最大为 Q+1。
+*/
+func hllPatLen(ele string) (int, uint8) {
+	hash := MurmurHash64A(ele, HLL_HASH_SEED)
+	index := int(hash & HLL_P_MASK)
+	hash >>= HLL_P
+	hash |= 1 << HLL_Q
+	count := uint8(bits.TrailingZeros64(hash)) + 1
+	return index, count
+}
+
+// 寄存器的值小于 count 时更新，返回是否修改
+func hllDenseSet(registers []byte, index int, count uint8) int {
+	oldcount := hllDenseGetRegister(registers, index)
+	if count > oldcount {
+		hllDenseSetRegister(registers, index, count)
+		return 1
+	}
+	return 0
+}
+
+func hllDenseAdd(registers []byte, ele string) int {
+	index, count := hllPatLen(ele)
+	return hllDenseSet(registers, index, count)
+}
+
+// 统计每个值出现的寄存器个数
+func hllDenseRegHisto(registers []byte, reghisto *[64]int) {
+	for j := 0; j < HLL_REGISTERS; j++ {
+		reghisto[hllDenseGetRegister(registers, j)]++
+	}
+}
+
+/*
+把稀疏编码转换为稠密编码，已经是稠密编码时直接返回。
+稀疏编码的寄存器总数不等于 HLL_REGISTERS 时说明数据损坏，返回 GODIS_ERR。
+*/
+func hllSparseToDense(hll *[]byte) int8 {
+	sparse := *hll
+	if sparse[4] == HLL_DENSE {
+		return GODIS_OK
+	}
+	dense := make([]byte, HLL_DENSE_SIZE)
+	// 拷贝魔数和基数缓存
+	copy(dense, sparse[:HLL_HDR_SIZE])
+	dense[4] = HLL_DENSE
+	registers := dense[HLL_HDR_SIZE:]
+
+	idx := 0
+	p := HLL_HDR_SIZE
+	for p < len(sparse) {
+		if hllSparseIsZero(sparse[p]) {
+			idx += hllSparseZeroLen(sparse[p])
+			p++
+		} else if hllSparseIsXZero(sparse[p]) {
+			if p+1 >= len(sparse) {
+				break
+			}
+			idx += hllSparseXZeroLen(sparse[p], sparse[p+1])
+			p += 2
+		} else {
+			runlen := hllSparseValLen(sparse[p])
+			regval := hllSparseValValue(sparse[p])
+			if runlen+idx > HLL_REGISTERS {
+				break
+			}
+			for ; runlen > 0; runlen-- {
+				hllDenseSetRegister(registers, idx, regval)
+				idx++
+			}
+			p++
+		}
+	}
+	if idx != HLL_REGISTERS {
+		return GODIS_ERR
+	}
+	*hll = dense
+	return GODIS_OK
+}
+
+/*
+设置稀疏编码中 index 对应的寄存器，原来的值更大时不修改。
+修改之后可能需要把一个操作码拆成最多三个，必要时转换为稠密编码。
+返回 1 表示修改了寄存器，0 表示没有修改，-1 表示数据损坏。
+*/
+func hllSparseSet(hll *[]byte, index int, count uint8) int {
+	if count > HLL_SPARSE_VAL_MAX_VALUE {
+		return hllSparsePromote(hll, index, count)
+	}
+	b := *hll
+	end := len(b)
+
+	// 第一步：找到包含 index 的操作码
+	first, span := 0, 0
+	p, prev := HLL_HDR_SIZE, -1
+	for p < end {
+		oplen := 1
+		if hllSparseIsZero(b[p]) {
+			span = hllSparseZeroLen(b[p])
+		} else if hllSparseIsVal(b[p]) {
+			span = hllSparseValLen(b[p])
+		} else {
+			if p+1 >= end {
+				return -1
+			}
+			span = hllSparseXZeroLen(b[p], b[p+1])
+			oplen = 2
+		}
+		if index <= first+span-1 {
+			break
+		}
+		prev = p
+		p += oplen
+		first += span
+	}
+	if span == 0 || p >= end {
+		return -1
+	}
+
+	var isZero, isXZero, isVal bool
+	var runlen int
+	if hllSparseIsZero(b[p]) {
+		isZero = true
+		runlen = hllSparseZeroLen(b[p])
+	} else if hllSparseIsXZero(b[p]) {
+		isXZero = true
+		runlen = hllSparseXZeroLen(b[p], b[p+1])
+	} else {
+		isVal = true
+		runlen = hllSparseValLen(b[p])
+	}
+
+	// 第二步：简单的情况直接原地修改
+	updated := false
+	if isVal {
+		oldcount := hllSparseValValue(b[p])
+		// 原来的值更大，不需要修改
+		if oldcount >= count {
+			return 0
+		}
+		// 只有一个寄存器的 VAL，直接修改值
+		if runlen == 1 {
+			b[p] = hllSparseValSet(count, 1)
+			updated = true
+		}
+	}
+	// 只有一个寄存器的 ZERO，直接换成 VAL
+	if !updated && isZero && runlen == 1 {
+		b[p] = hllSparseValSet(count, 1)
+		updated = true
+	}
+
+	// 第三步：把原来的操作码拆成最多三个：前面的部分、新的值、后面的部分
+	if !updated {
+		seq := make([]byte, 0, 5)
+		last := first + span - 1
+		if isZero || isXZero {
+			if index != first {
+				seq = hllSparseAppendZero(seq, index-first)
+			}
+			seq = append(seq, hllSparseValSet(count, 1))
+			if index != last {
+				seq = hllSparseAppendZero(seq, last-index)
+			}
+		} else {
+			curval := hllSparseValValue(b[p])
+			if index != first {
+				seq = append(seq, hllSparseValSet(curval, index-first))
+			}
+			seq = append(seq, hllSparseValSet(count, 1))
+			if index != last {
+				seq = append(seq, hllSparseValSet(curval, last-index))
+			}
+		}
+		oldlen := 1
+		if isXZero {
+			oldlen = 2
+		}
+		deltalen := len(seq) - oldlen
+		if deltalen > 0 && len(b)+deltalen > HLL_SPARSE_MAX_BYTES {
+			return hllSparsePromote(hll, index, count)
+		}
+		tail := append([]byte{}, b[p+oldlen:]...)
+		b = append(append(b[:p], seq...), tail...)
+		end = len(b)
+	}
+
+	// 第四步：从前一个操作码开始，尝试合并相邻的值相同的 VAL
+	if prev >= 0 {
+		p = prev
+	} else {
+		p = HLL_HDR_SIZE
+	}
+	for scanlen := 5; p < end && scanlen > 0; scanlen-- {
+		if hllSparseIsXZero(b[p]) {
+			p += 2
+			continue
+		} else if hllSparseIsZero(b[p]) {
+			p++
+			continue
+		}
+		if p+1 < end && hllSparseIsVal(b[p+1]) {
+			v1 := hllSparseValValue(b[p])
+			v2 := hllSparseValValue(b[p+1])
+			if v1 == v2 {
+				len_ := hllSparseValLen(b[p]) + hllSparseValLen(b[p+1])
+				if len_ <= HLL_SPARSE_VAL_MAX_LEN {
+					b[p+1] = hllSparseValSet(v1, len_)
+					b = append(b[:p], b[p+1:]...)
+					end--
+					// 合并之后不移动 p，继续尝试和右边的值合并
+					continue
+				}
+			}
+		}
+		p++
+	}
+	hllInvalidateCache(b)
+	*hll = b
+	return 1
+}
+
+// 在稀疏编码的序列后面追加 len_ 个值为 0 的寄存器
+func hllSparseAppendZero(seq []byte, len_ int) []byte {
+	if len_ > HLL_SPARSE_ZERO_MAX_LEN {
+		b0, b1 := hllSparseXZeroSet(len_)
+		return append(seq, b0, b1)
+	}
+	return append(seq, hllSparseZeroSet(len_))
+}
+
+// 转换为稠密编码之后再设置寄存器，需要转换说明寄存器一定会被修改
+func hllSparsePromote(hll *[]byte, index int, count uint8) int {
+	if hllSparseToDense(hll) == GODIS_ERR {
+		return -1
+	}
+	return hllDenseSet((*hll)[HLL_HDR_SIZE:], index, count)
+}
+
+func hllSparseAdd(hll *[]byte, ele string) int {
+	index, count := hllPatLen(ele)
+	return hllSparseSet(hll, index, count)
+}
+
+// 统计稀疏编码中每个值出现的寄存器个数，寄存器总数不对时设置 invalid
+func hllSparseRegHisto(sparse []byte, invalid *bool, reghisto *[64]int) {
+	idx := 0
+	p := 0
+	for p < len(sparse) {
+		if hllSparseIsZero(sparse[p]) {
+			runlen := hllSparseZeroLen(sparse[p])
+			idx += runlen
+			reghisto[0] += runlen
+			p++
+		} else if hllSparseIsXZero(sparse[p]) {
+			if p+1 >= len(sparse) {
+				break
+			}
+			runlen := hllSparseXZeroLen(sparse[p], sparse[p+1])
+			idx += runlen
+			reghisto[0] += runlen
+			p += 2
+		} else {
+			runlen := hllSparseValLen(sparse[p])
+			idx += runlen
+			reghisto[hllSparseValValue(sparse[p])] += runlen
+			p++
+		}
+	}
+	if idx != HLL_REGISTERS && invalid != nil {
+		*invalid = true
+	}
+}
+
+func hllRawRegHisto(registers []byte, reghisto *[64]int) {
+	for j := 0; j < HLL_REGISTERS; j++ {
+		reghisto[registers[j]]++
+	}
+}
+
+// Ertl 论文 "New cardinality estimation algorithms for HyperLogLog sketches" 中的 sigma 函数
+func hllSigma(x float64) float64 {
+	if x == 1. {
+		return math.Inf(1)
+	}
+	var zPrime float64
+	y := 1.0
+	z := x
+	for {
+		x *= x
+		zPrime = z
+		z += x * y
+		y += y
+		if zPrime == z {
+			break
+		}
+	}
+	return z
+}
+
+// 同一篇论文中的 tau 函数
+func hllTau(x float64) float64 {
+	if x == 0. || x == 1. {
+		return 0.
+	}
+	var zPrime float64
+	y := 1.0
+	z := 1 - x
+	for {
+		x = math.Sqrt(x)
+		zPrime = z
+		y *= 0.5
+		z -= math.Pow(1-x, 2) * y
+		if zPrime == z {
+			break
+		}
+	}
+	return z / 3
+}
+
+/*
+估算基数，hll 包含头部，encoding 为 HLL_RAW 时寄存器是每个一个字节的数组。
+稀疏编码损坏时设置 invalid。
+*/
+func hllCount(hll []byte, invalid *bool) uint64 {
+	m := float64(HLL_REGISTERS)
+	var reghisto [64]int
+	switch hll[4] {
+	case HLL_DENSE:
+		hllDenseRegHisto(hll[HLL_HDR_SIZE:], &reghisto)
+	case HLL_SPARSE:
+		hllSparseRegHisto(hll[HLL_HDR_SIZE:], invalid, &reghisto)
+	case HLL_RAW:
+		hllRawRegHisto(hll[HLL_HDR_SIZE:], &reghisto)
+	default:
+		panic("Unknown HyperLogLog encoding in hllCount()")
+	}
+
+	z := m * hllTau((m-float64(reghisto[HLL_Q+1]))/m)
+	for j := HLL_Q; j >= 1; j-- {
+		z += float64(reghisto[j])
+		z *= 0.5
+	}
+	z += m * hllSigma(float64(reghisto[0])/m)
+	return uint64(math.Round(HLL_ALPHA_INF * m * m / z))
+}
+
+// 添加一个元素，返回 1 表示有寄存器被修改，0 表示没有，-1 表示数据损坏
+func hllAdd(hll *[]byte, ele string) int {
+	switch (*hll)[4] {
+	case HLL_DENSE:
+		return hllDenseAdd((*hll)[HLL_HDR_SIZE:], ele)
+	case HLL_SPARSE:
+		return hllSparseAdd(hll, ele)
+	default:
+		return -1
+	}
+}
+
+/*
+把 hll 的寄存器合并到 max 中，每个寄存器取较大的值，max 是每个寄存器一个字节的数组。
+稀疏编码损坏时返回 GODIS_ERR。
+*/
+func hllMerge(max []byte, hll []byte) int8 {
+	if hll[4] == HLL_DENSE {
+		registers := hll[HLL_HDR_SIZE:]
+		for i := 0; i < HLL_REGISTERS; i++ {
+			if val := hllDenseGetRegister(registers, i); val > max[i] {
+				max[i] = val
+			}
+		}
+		return GODIS_OK
+	}
+	i := 0
+	p := HLL_HDR_SIZE
+	for p < len(hll) {
+		if hllSparseIsZero(hll[p]) {
+			i += hllSparseZeroLen(hll[p])
+			p++
+		} else if hllSparseIsXZero(hll[p]) {
+			if p+1 >= len(hll) {
+				break
+			}
+			i += hllSparseXZeroLen(hll[p], hll[p+1])
+			p += 2
+		} else {
+			runlen := hllSparseValLen(hll[p])
+			regval := hllSparseValValue(hll[p])
+			if runlen+i > HLL_REGISTERS {
+				break
+			}
+			for ; runlen > 0; runlen-- {
+				if regval > max[i] {
+					max[i] = regval
+				}
+				i++
+			}
+			p++
+		}
+	}
+	if i != HLL_REGISTERS {
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+/* ========================= HyperLogLog 命令 ============================== */
+
+// 创建一个空的 HyperLogLog，所有寄存器都是 0，用稀疏编码的 XZERO 表示
+func createHLLObject() []byte {
+	sparselen := HLL_HDR_SIZE + (HLL_REGISTERS+(HLL_SPARSE_XZERO_MAX_LEN-1))/HLL_SPARSE_XZERO_MAX_LEN*2
+	hll := make([]byte, HLL_HDR_SIZE, sparselen)
+	copy(hll, "HYLL")
+	hll[4] = HLL_SPARSE
+	for aux := HLL_REGISTERS; aux > 0; {
+		xzero := HLL_SPARSE_XZERO_MAX_LEN
+		if xzero > aux {
+			xzero = aux
+		}
+		b0, b1 := hllSparseXZeroSet(xzero)
+		hll = append(hll, b0, b1)
+		aux -= xzero
+	}
+	return hll
+}
+
+// 检查对象是不是合法的 HyperLogLog，不是时回复错误
+func isHLLObjectOrReply(c *GodisClient, o *Gobj) int8 {
+	if o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return GODIS_ERR
+	}
+	str := o.StrVal()
+	if len(str) < HLL_HDR_SIZE || str[:4] != "HYLL" || str[4] > HLL_MAX_ENCODING ||
+		(str[4] == HLL_DENSE && len(str) != HLL_DENSE_SIZE) {
+		c.AddReplyError("WRONGTYPE Key is not a valid HyperLogLog string value.")
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+// 把修改之后的 HyperLogLog 写回 key，过期时间保持不变
+func setHLLObject(c *GodisClient, key *Gobj, hll []byte) {
+	newObj := CreateObject(GSTR, string(hll))
+	dbOverwrite(c.db, key, newObj)
+	newObj.DecrRefCount()
+}
+
+// PFADD key [element ...]：有寄存器被修改或者 key 被创建时返回 1
+func pfaddCommand(c *GodisClient) {
+	var hll []byte
+	updated := 0
+	o := lookupKeyWrite(c.db, c.args[1])
+	if o == nil {
+		hll = createHLLObject()
+		updated++
+	} else {
+		if isHLLObjectOrReply(c, o) != GODIS_OK {
+			return
+		}
+		hll = []byte(o.StrVal())
+	}
+	for _, ele := range c.args[2:] {
+		switch hllAdd(&hll, ele.StrVal()) {
+		case 1:
+			updated++
+		case -1:
+			c.AddReplyError(invalidHllErr)
+			return
+		}
+	}
+	if updated > 0 {
+		hllInvalidateCache(hll)
+		setHLLObject(c, c.args[1], hll)
+		server.dirty += int64(updated)
+		c.AddReplyInt8(1)
+	} else {
+		c.AddReplyInt8(0)
+	}
+}
+
+/*
+PFCOUNT key [key ...]：只有一个 key 时优先使用缓存的基数，缓存失效时重新计算并写回。
+多个 key 时把所有寄存器合并到一个临时的 HLL_RAW 中再计算，不修改任何 key。
+*/
+func pfcountCommand(c *GodisClient) {
+	if len(c.args) > 2 {
+		max := make([]byte, HLL_HDR_SIZE+HLL_REGISTERS)
+		max[4] = HLL_RAW
+		for _, key := range c.args[1:] {
+			o := findKeyRead(c.db, key)
+			if o == nil {
+				continue
+			}
+			if isHLLObjectOrReply(c, o) != GODIS_OK {
+				return
+			}
+			if hllMerge(max[HLL_HDR_SIZE:], []byte(o.StrVal())) == GODIS_ERR {
+				c.AddReplyError(invalidHllErr)
+				return
+			}
+		}
+		c.AddReplyLong(int64(hllCount(max, nil)))
+		return
+	}
+
+	o := lookupKeyWrite(c.db, c.args[1])
+	if o == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if isHLLObjectOrReply(c, o) != GODIS_OK {
+		return
+	}
+	str := o.StrVal()
+	var card uint64
+	if hllValidCache(str) {
+		card = binary.LittleEndian.Uint64([]byte(str[8:HLL_HDR_SIZE]))
+	} else {
+		hll := []byte(str)
+		invalid := false
+		card = hllCount(hll, &invalid)
+		if invalid {
+			c.AddReplyError(invalidHllErr)
+			return
+		}
+		// 更新缓存，和 Redis 一样算作一次修改
+		binary.LittleEndian.PutUint64(hll[8:HLL_HDR_SIZE], card)
+		setHLLObject(c, c.args[1], hll)
+		server.dirty++
+	}
+	c.AddReplyLong(int64(card))
+}
+
+/*
+PFMERGE destkey [sourcekey ...]：destkey 也参与合并。
+只要有一个输入是稠密编码，结果就转换为稠密编码，否则保持稀疏编码。
+*/
+func pfmergeCommand(c *GodisClient) {
+	max := make([]byte, HLL_REGISTERS)
+	useDense := false
+	for _, key := range c.args[1:] {
+		o := findKeyRead(c.db, key)
+		if o == nil {
+			continue
+		}
+		if isHLLObjectOrReply(c, o) != GODIS_OK {
+			return
+		}
+		hll := []byte(o.StrVal())
+		if hll[4] == HLL_DENSE {
+			useDense = true
+		}
+		if hllMerge(max, hll) == GODIS_ERR {
+			c.AddReplyError(invalidHllErr)
+			return
+		}
+	}
+
+	var hll []byte
+	if o := lookupKeyWrite(c.db, c.args[1]); o == nil {
+		hll = createHLLObject()
+	} else {
+		hll = []byte(o.StrVal())
+	}
+	if useDense && hllSparseToDense(&hll) == GODIS_ERR {
+		c.AddReplyError(invalidHllErr)
+		return
+	}
+	for j := 0; j < HLL_REGISTERS; j++ {
+		if max[j] == 0 {
+			continue
+		}
+		switch hll[4] {
+		case HLL_DENSE:
+			hllDenseSet(hll[HLL_HDR_SIZE:], j, max[j])
+		case HLL_SPARSE:
+			hllSparseSet(&hll, j, max[j])
+		}
+	}
+	hllInvalidateCache(hll)
+	setHLLObject(c, c.args[1], hll)
+	server.dirty++
+	c.AddReplyStr("+OK" + CRLF)
+}
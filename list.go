@@ -75,29 +75,64 @@ func (list *List) DelNode(n *Node) {
 	if n == nil {
 		return
 	}
-	if list.head == n {
-		if n.next != nil {
-			n.next.prev = nil
-		}
+	if n.prev != nil {
+		n.prev.next = n.next
+	} else {
 		list.head = n.next
-		n.next = nil
-	} else if list.tail == n {
-		if n.prev != nil {
-			n.prev.next = nil
-		}
+	}
+	if n.next != nil {
+		n.next.prev = n.prev
+	} else {
 		list.tail = n.prev
-		n.prev = nil
+	}
+	n.prev = nil
+	n.next = nil
+	list.length -= 1
+}
+
+// 在 old 之前或之后插入一个节点，after 为 true 时插入到 old 之后
+func (list *List) InsertNode(old *Node, val *Gobj, after bool) {
+	n := &Node{Val: val}
+	if after {
+		n.prev = old
+		n.next = old.next
+		if list.tail == old {
+			list.tail = n
+		}
 	} else {
-		if n.prev != nil {
-			n.prev.next = n.next
+		n.next = old
+		n.prev = old.prev
+		if list.head == old {
+			list.head = n
 		}
-		if n.next != nil {
-			n.next.prev = n.prev
+	}
+	if n.prev != nil {
+		n.prev.next = n
+	}
+	if n.next != nil {
+		n.next.prev = n
+	}
+	list.length += 1
+}
+
+// 返回下标为 index 的节点，负数从尾部开始计算（-1 是最后一个），超出范围时返回 nil
+func (list *List) Index(index int64) *Node {
+	var n *Node
+	if index < 0 {
+		index = (-index) - 1
+		n = list.tail
+		for n != nil && index > 0 {
+			n = n.prev
+			index--
+		}
+	} else {
+		n = list.head
+		for n != nil && index > 0 {
+			n = n.next
+			index--
 		}
-		n.prev = nil
-		n.next = nil
 	}
-	list.length -= 1
+	return n
 }
 
 func (list *List) Delete(val *Gobj) {
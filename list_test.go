@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+)
+
+// LTRIM 只把真正删除的元素计入 dirty
+func TestLtrimDirty(t *testing.T) {
+	newTestServer(t, `"appendonly":false,"save":""`)
+	c := newTestClient(t)
+	c.do("rpush", "list", "a", "b", "c", "d", "e")
+	cases := []struct {
+		start, end string
+		dirty      int64
+		reply      string
+	}{
+		{"0", "-1", 0, "*5\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n$1\r\nd\r\n$1\r\ne\r\n"},
+		{"1", "2", 3, "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{"0", "1", 0, "*2\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{"1", "0", 2, "*0\r\n"},
+	}
+	for _, tc := range cases {
+		dirty := server.dirty
+		if got := c.do("ltrim", "list", tc.start, tc.end); got != "+OK\r\n" {
+			t.Fatalf("ltrim: %q", got)
+		}
+		if server.dirty-dirty != tc.dirty {
+			t.Errorf("ltrim %s %s: dirty +%d, want +%d", tc.start, tc.end, server.dirty-dirty, tc.dirty)
+		}
+		if got := c.do("lrange", "list", "0", "-1"); got != tc.reply {
+			t.Errorf("ltrim %s %s: lrange got %q, want %q", tc.start, tc.end, got, tc.reply)
+		}
+	}
+}
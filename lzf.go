@@ -0,0 +1,59 @@
+package main
+
+import "errors"
+
+var errLzfCorrupted = errors.New("lzf: corrupted compressed data")
+
+/*
+LZF 解压（Redis RDB 中长字符串的压缩格式），out 的长度必须等于解压后的长度。
+控制字节 ctrl:
+  - ctrl < 32:  后面跟着 ctrl+1 个字面字节
+  - ctrl >= 32: 回溯引用，长度为 (ctrl>>5)+2（为 7 时再读一个字节累加），
+    偏移为 ((ctrl&0x1f)<<8 | 下一个字节) + 1
+*/
+func lzfDecompress(in []byte, out []byte) error {
+	ip, op := 0, 0
+	for ip < len(in) {
+		ctrl := int(in[ip])
+		ip++
+		if ctrl < 32 {
+			// literal run
+			ctrl++
+			if op+ctrl > len(out) || ip+ctrl > len(in) {
+				return errLzfCorrupted
+			}
+			copy(out[op:], in[ip:ip+ctrl])
+			op += ctrl
+			ip += ctrl
+			continue
+		}
+		// back reference
+		length := ctrl >> 5
+		if length == 7 {
+			if ip >= len(in) {
+				return errLzfCorrupted
+			}
+			length += int(in[ip])
+			ip++
+		}
+		if ip >= len(in) {
+			return errLzfCorrupted
+		}
+		ref := op - ((ctrl & 0x1f) << 8) - 1 - int(in[ip])
+		ip++
+		length += 2
+		if ref < 0 || op+length > len(out) {
+			return errLzfCorrupted
+		}
+		// 引用区间可能和输出区间重叠，只能逐字节拷贝
+		for i := 0; i < length; i++ {
+			out[op] = out[ref]
+			op++
+			ref++
+		}
+	}
+	if op != len(out) {
+		return errLzfCorrupted
+	}
+	return nil
+}
@@ -10,7 +10,14 @@ const BACKLOG int = 64
 
 func Accept(fd int) (int, error) {
 	nfd, _, err := unix.Accept(fd)
-	return nfd, err
+	if err != nil {
+		return nfd, err
+	}
+	// 同 anetEnableTcpNoDelay：一条回复可能分多次 write，开启 Nagle 会和客户端的延迟 ACK 互相等待
+	if err := unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_NODELAY, 1); err != nil {
+		log.Printf("set TCP_NODELAY error: %v\n", err)
+	}
+	return nfd, nil
 }
 
 func TcpServer(port int) (int, error) {
@@ -16,6 +16,24 @@ const (
 
 type Gval interface{}
 
+// 类型名，用于 SCAN 的 TYPE 选项
+func getObjectTypeName(o *Gobj) string {
+	switch o.Type_ {
+	case GSTR:
+		return "string"
+	case GLIST:
+		return "list"
+	case GSET:
+		return "set"
+	case GZSET:
+		return "zset"
+	case GHASH:
+		return "hash"
+	default:
+		return "unknown"
+	}
+}
+
 /*
 type 表示 Redis 对象的逻辑类型，即这个 key 在命令层面属于哪种类型，主要有：
 GSTR（字符串）、GLIST（列表）、GSET（集合）、GZSET（有序集合）和GHASH（哈希表）。
@@ -55,6 +73,7 @@ type Gobj struct {
 	Val_     Gval
 	refCount int
 	encoding int
+	lru      uint32 /* LRU 时钟，或者 LFU 数据（高 16 位是时间，低 8 位是计数器），见 evict.go */
 }
 
 const (
@@ -72,6 +91,9 @@ func (o *Gobj) IntVal() int64 {
 	if o.Type_ != GSTR {
 		return 0
 	}
+	if o.encoding == GODIS_ENCODING_INT {
+		return o.Val_.(int64)
+	}
 	val, _ := strconv.ParseInt(o.Val_.(string), 10, 64)
 	return val
 }
@@ -80,7 +102,7 @@ func (o *Gobj) DoubleVal() float64 {
 	if o.Type_ != GSTR {
 		return 0
 	}
-	val, _ := strconv.ParseFloat(o.Val_.(string), 64)
+	val, _ := strconv.ParseFloat(o.StrVal(), 64)
 	return val
 }
 
@@ -88,7 +110,7 @@ func (o *Gobj) IntVal_32() int {
 	if o.Type_ != GSTR {
 		return 0
 	}
-	val, _ := strconv.Atoi(o.Val_.(string))
+	val, _ := strconv.Atoi(o.StrVal())
 	return val
 }
 
@@ -96,6 +118,9 @@ func (o *Gobj) StrVal() string {
 	if o.Type_ != GSTR {
 		return ""
 	}
+	if o.encoding == GODIS_ENCODING_INT {
+		return strconv.FormatInt(o.Val_.(int64), 10)
+	}
 	return o.Val_.(string)
 }
 
@@ -105,6 +130,7 @@ func CreateFromInt(val int64) *Gobj {
 		Val_:     val,
 		refCount: 1,
 		encoding: GODIS_ENCODING_INT,
+		lru:      initObjectLRUOrLFU(),
 	}
 }
 
@@ -133,6 +159,7 @@ func CreateObject(typ Gtype, ptr interface{}) *Gobj {
 		Val_:     ptr,
 		refCount: 1,
 		encoding: encoding,
+		lru:      initObjectLRUOrLFU(),
 	}
 }
 
@@ -183,6 +210,65 @@ func (o *Gobj) DecrRefCount() {
 	}
 }
 
+// dupObject 深拷贝一个对象，后台持久化的快照不能和主线程共享任何可变的对象
+func dupObject(o *Gobj) *Gobj {
+	switch o.Type_ {
+	case GSTR:
+		return CreateObject(GSTR, o.Val_)
+	case GLIST:
+		lobj := CreateListObject()
+		list := o.Val_.(*List)
+		for node := list.First(); node != nil; node = node.next {
+			lobj.Val_.(*List).Append(dupObject(node.Val))
+		}
+		return lobj
+	case GSET:
+		setObj := CreateSetObject()
+		dupDict(o.Val_.(*Dict), setObj.Val_.(*Dict))
+		return setObj
+	case GHASH:
+		hashObj := CreateHashObject()
+		dupDict(o.Val_.(*Dict), hashObj.Val_.(*Dict))
+		// 字段的过期时间
+		if meta := o.hashTypeExpireMeta(); meta != nil {
+			iter := meta.expires.NewIterator(true)
+			for field, expObj, exists := iter.Next(); exists; field, expObj, exists = iter.Next() {
+				hashObj.hashTypeSetExpire(field, expObj.Val_.(int64))
+			}
+			iter.Close()
+		}
+		return hashObj
+	case GZSET:
+		zsetObj := CreateZSetObject()
+		zs := zsetObj.Val_.(zset)
+		zsl := o.Val_.(zset).zsl
+		for x := zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			member := dupObject(x.obj)
+			znode := zs.zsl.zslInsert(x.score, member)
+			zs.dict.Set(member, &Gobj{Type_: GSTR, Val_: znode.score, encoding: GODIS_ENCODING_RAW})
+		}
+		return zsetObj
+	default:
+		panic("Unknown object type")
+	}
+}
+
+// dupDict 把 src 中的所有键值对深拷贝到 dst
+func dupDict(src *Dict, dst *Dict) {
+	if src.usedSize() == 0 {
+		return
+	}
+	iter := src.NewIterator(true)
+	for key, val, exists := iter.Next(); exists; key, val, exists = iter.Next() {
+		if val == nil {
+			dst.Set(dupObject(key), nil)
+		} else {
+			dst.Set(dupObject(key), dupObject(val))
+		}
+	}
+	iter.Close()
+}
+
 func getDecodedObject(o *Gobj) *Gobj {
 	if o.Type_ == GSTR {
 		return o
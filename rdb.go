@@ -1,11 +1,16 @@
 package main
 
 import (
+	"encoding/binary"
 	"errors"
 	"fmt"
-	"io"
+	"log"
+	"math"
 	"os"
+	"runtime"
 	"strconv"
+	"sync"
+	"time"
 )
 
 type saveparam struct {
@@ -13,120 +18,422 @@ type saveparam struct {
 	changes int
 }
 
+const CONFIG_BGSAVE_RETRY_DELAY = 5 /* Wait a few secs before trying again. */
+
+/*
+RDB 文件格式：
+
+	GODIS0002                      魔数 + 4 位版本号
+	[0xfa][key][value]...          辅助字段：godis-ver / ctime / used-mem
+	[0xfe][db 编号]                 SELECTDB，之后的键值对属于这个数据库，空的数据库不保存
+	[0xfd][8 字节过期时间] (可选)
+	[类型][key][value]...          键值对，有字段设置了过期时间的哈希使用 GODIS_RDB_TYPE_HASH_METADATA 类型
+	[0xff]                         EOF
+	[8 字节 CRC64]                 之前所有字节的校验和（小端序）
+*/
 const (
+	GODIS_RDB_MAGIC   = "GODIS"
+	GODIS_RDB_VERSION = 3 /* 2: 增加 SELECTDB，版本 1 的文件只有 0 号数据库；3: 增加 GODIS_RDB_TYPE_HASH_METADATA */
+)
+
+/*
+有字段设置了过期时间的哈希（和 Redis 的 RDB_TYPE_HASH_METADATA 编号相同，格式不同）：
+
+	[字段数量]([8 字节过期时间，-1 表示没有][field][value])...
+
+没有字段设置过期时间的哈希仍然使用 GHASH 类型，和旧版本兼容。
+*/
+const GODIS_RDB_TYPE_HASH_METADATA = 24
+
+const (
+	GODIS_AUX        = 0xfa
 	GODIS_EXPIRETIME = 0xfd
+	GODIS_SELECTDB   = 0xfe
 	GODIS_EOF        = 0xff
 )
 
+var errRdbCorrupted = errors.New("corrupted rdb file")
+
+/*
+加载时长度字段的上限：字符串最长 512MB（和 AOF_MAX_BULK_LEN 相同），集合的元素个数也不会超过这个值。
+长度是从文件中读出来的，损坏的文件不能让它直接决定分配多少内存。
+*/
+const RDB_MAX_LEN = 512 * 1024 * 1024
+
 // 写二进制数据
-func rdbWriteRaw(file *os.File, data []byte) (int, error) {
-	if file == nil {
+func rdbWriteRaw(rdb *rio, data []byte) (int, error) {
+	if rdb == nil {
 		return 0, os.ErrInvalid
 	}
-	n, err := file.Write(data)
+	n, err := rdb.Write(data)
 	if err != nil {
 		return n, err
 	}
 	return n, nil
 }
 
-func rdbSave(filename string, db *GodisDB) error {
+func rdbSave(filename string, dbs []*GodisDB) error {
+	return rdbSaveWithFormat(filename, dbs, server.rdbformat)
+}
+
+// format 为 RDB_FORMAT_REDIS 时写出 Redis 的 RDB 格式，否则写出 godis 自己的格式
+func rdbSaveWithFormat(filename string, dbs []*GodisDB, format string) error {
+	tmpfile, err := rdbSaveTempFile(dbs, format)
+	if err != nil {
+		return err
+	}
+	// 重命名临时文件为目标文件
+	if err = os.Rename(tmpfile, filename); err != nil {
+		os.Remove(tmpfile)
+		return err
+	}
+	return nil
+}
+
+// 把数据库写入一个新的临时文件并刷盘，返回临时文件的名字
+func rdbSaveTempFile(dbs []*GodisDB, format string) (string, error) {
 	// 创建临时文件
 	tmpFile, err := os.CreateTemp("./", fmt.Sprintf("temp-%d.rdb", os.Getpid()))
 	if err != nil {
+		return "", err
+	}
+	rdb := rioInitWithWriter(tmpFile)
+	save := rdbSaveRio
+	if format == RDB_FORMAT_REDIS {
+		save = redisRdbSaveRio
+	}
+	if err = save(rdb, dbs); err == nil {
+		err = rdb.Flush()
+	}
+	if err == nil {
+		err = tmpFile.Sync()
+	}
+	tmpFile.Close()
+	if err != nil {
+		os.Remove(tmpFile.Name())
+		return "", err
+	}
+	return tmpFile.Name(), nil
+}
+
+// rdbSaveRio 把所有数据库按 RDB 格式写入 rdb，包括文件头和末尾的校验和
+func rdbSaveRio(rdb *rio, dbs []*GodisDB) error {
+	magic := fmt.Sprintf("%s%04d", GODIS_RDB_MAGIC, GODIS_RDB_VERSION)
+	if _, err := rdbWriteRaw(rdb, []byte(magic)); err != nil {
 		return err
 	}
+	if err := rdbSaveInfoAuxFields(rdb); err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		if db.data.usedSize() == 0 {
+			continue
+		}
+		if _, err := rdbSaveType(rdb, []byte{GODIS_SELECTDB}); err != nil {
+			return err
+		}
+		if _, err := rdbSaveLen(rdb, uint32(db.id)); err != nil {
+			return err
+		}
+		if err := rdbSaveDB(rdb, db, rdbSaveKeyValuePair); err != nil {
+			return err
+		}
+	}
+	if _, err := rdbSaveType(rdb, []byte{GODIS_EOF}); err != nil {
+		return err
+	}
+	// 校验和覆盖了 EOF 之前（含 EOF）的所有字节
+	var cksum [8]byte
+	binary.LittleEndian.PutUint64(cksum[:], rdb.cksum)
+	_, err := rdbWriteRaw(rdb, cksum[:])
+	return err
+}
+
+// 写出一个数据库中的所有键值对，saveKeyValuePair 决定键值对的格式
+func rdbSaveDB(rdb *rio, db *GodisDB, saveKeyValuePair func(rdb *rio, key, value *Gobj, expiretime int64) error) error {
 	iter := db.data.NewIterator(true)
 	defer iter.Close()
 	for key, value, exists := iter.Next(); exists; key, value, exists = iter.Next() {
-		expiretime := getExpire(key)
-		if expiretime != -1 {
-			if n, err := rdbSaveType(tmpFile, []byte{GODIS_EXPIRETIME}); err != nil || n == 0 {
-				return err
-			}
-			if n, err := rdbSaveTime(tmpFile, expiretime); err != nil || n == 0 {
-				return err
-			}
+		server.savekeysprocessed.Add(1)
+		expiretime := getExpire(db, key)
+		if err := saveKeyValuePair(rdb, key, value, expiretime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// [过期时间][类型][key][value]
+func rdbSaveKeyValuePair(rdb *rio, key, value *Gobj, expiretime int64) error {
+	if expiretime != -1 {
+		if _, err := rdbSaveType(rdb, []byte{GODIS_EXPIRETIME}); err != nil {
+			return err
+		}
+		if _, err := rdbSaveTime(rdb, expiretime); err != nil {
+			return err
+		}
+	}
+	if value.Type_ == GHASH && value.hashTypeExpireMeta() != nil {
+		if _, err := rdbSaveType(rdb, []byte{GODIS_RDB_TYPE_HASH_METADATA}); err != nil {
+			return err
+		}
+		if _, err := rdbSaveStringObject(rdb, key); err != nil {
+			return err
+		}
+		return rdbSaveHashMetadataObject(rdb, value)
+	}
+	if _, err := rdbSaveType(rdb, []byte{byte(value.Type_)}); err != nil {
+		return err
+	}
+	if _, err := rdbSaveStringObject(rdb, key); err != nil {
+		return err
+	}
+	_, err := rdbSaveObject(rdb, value)
+	return err
+}
+
+// 保存有字段设置了过期时间的哈希，格式见 GODIS_RDB_TYPE_HASH_METADATA
+func rdbSaveHashMetadataObject(rdb *rio, o *Gobj) error {
+	dict := o.Val_.(*Dict)
+	if _, err := rdbSaveLen(rdb, uint32(dict.usedSize())); err != nil {
+		return err
+	}
+	iter := dict.NewIterator(true) // 内层安全迭代器
+	defer iter.Close()
+	for key, val, exists := iter.Next(); exists; key, val, exists = iter.Next() {
+		if _, err := rdbSaveTime(rdb, o.hashTypeGetExpire(key)); err != nil {
+			return err
+		}
+		if _, err := rdbSaveStringObject(rdb, key); err != nil {
+			return err
+		}
+		if _, err := rdbSaveStringObject(rdb, val); err != nil {
+			return err
 		}
-		// [类型][len][key(string)][list,hash,set len]{[value(字节数组)],[len][value(字节数组)],[len][value(字节数组)]}
-		rdbSaveType(tmpFile, []byte{byte(value.Type_)})
-		rdbSaveStringObject(tmpFile, key)
-		rdbSaveObject(tmpFile, value)
 	}
+	return nil
+}
 
-	if n, err := rdbSaveType(tmpFile, []byte{GODIS_EOF}); err != nil || n == 0 {
+func rdbSaveAuxField(rdb *rio, key, val string) error {
+	if _, err := rdbSaveType(rdb, []byte{GODIS_AUX}); err != nil {
 		return err
 	}
+	if _, err := rdbSaveRawStringWithLen(rdb, key); err != nil {
+		return err
+	}
+	_, err := rdbSaveRawStringWithLen(rdb, val)
+	return err
+}
 
-	tmpFile.Sync()
-	tmpFile.Close()
-	// 重命名临时文件为目标文件
-	err = os.Rename(tmpFile.Name(), filename)
-	if err != nil {
+// 保存生成这个 RDB 文件时的一些信息，加载时只做记录
+func rdbSaveInfoAuxFields(rdb *rio) error {
+	var m runtime.MemStats
+	runtime.ReadMemStats(&m)
+	if err := rdbSaveAuxField(rdb, "godis-ver", GODIS_VERSION); err != nil {
 		return err
 	}
-	server.lastfsync = GetMsTime()
-	server.dirty = 0
+	if err := rdbSaveAuxField(rdb, "ctime", strconv.FormatInt(time.Now().Unix(), 10)); err != nil {
+		return err
+	}
+	return rdbSaveAuxField(rdb, "used-mem", strconv.FormatUint(m.Alloc, 10))
+}
+
+/*
+BGSAVE 的 goroutine 没有办法像子进程一样被杀掉，killRDBChild 只是设置 killed，
+goroutine 在持有 mu 的时候检查 killed 再重命名临时文件，所以 killRDBChild 返回之后
+这次 BGSAVE 不会再覆盖 RDB 文件，结果也不会再交给 backgroundSaveDoneHandler。
+*/
+type bgsaveChild struct {
+	mu     sync.Mutex
+	killed bool
+}
+
+/*
+BGSAVE：在主线程中给数据集做一份快照，由 goroutine 写入 RDB 文件，不阻塞事件循环。
+goroutine 结束后由 ServerCron 调用 backgroundSaveDoneHandler 更新 dirty 和 lastsave。
+*/
+func rdbSaveBackground(filename string) error {
+	if server.bgsavedone != nil {
+		return errors.New("background save already in progress")
+	}
+	server.dirtybeforebgsave = server.dirty
+	server.lastbgsavetry = time.Now().Unix()
+	snapshot := dupDBs(server.db)
+	format := server.rdbformat
+	done := make(chan int8, 1)
+	child := &bgsaveChild{}
+	server.bgsavedone = done
+	server.bgsavechild = child
+	server.rdbsavetimestart = GetMsTime()
+	server.savekeystotal = dbsKeyCount(snapshot)
+	server.savekeysprocessed.Store(0)
+	go func() {
+		tmpfile, err := rdbSaveTempFile(snapshot, format)
+		if err != nil {
+			log.Printf("Background saving error: %v\n", err)
+			done <- GODIS_ERR
+			return
+		}
+		child.mu.Lock()
+		defer child.mu.Unlock()
+		if child.killed {
+			// 已经没有人等待这个结果了，done 有缓冲，不会阻塞
+			os.Remove(tmpfile)
+			done <- GODIS_ERR
+			return
+		}
+		if err = os.Rename(tmpfile, filename); err != nil {
+			log.Printf("Background saving error: %v\n", err)
+			os.Remove(tmpfile)
+			done <- GODIS_ERR
+			return
+		}
+		done <- GODIS_OK
+	}()
+	log.Printf("Background saving started\n")
 	return nil
 }
 
-func rdbSaveBackground() {
+// 丢弃正在进行的 BGSAVE，例如 FLUSHALL 之后快照中的数据已经过时了
+func killRDBChild() {
+	if server.bgsavedone == nil {
+		return
+	}
+	server.bgsavechild.mu.Lock()
+	server.bgsavechild.killed = true
+	server.bgsavechild.mu.Unlock()
+	log.Printf("Background saving killed\n")
+	server.bgsavedone = nil
+	server.bgsavechild = nil
+	server.dirtybeforebgsave = 0
+	server.rdbsavetimestart = -1
+}
 
+// 检查 BGSAVE 是否已经结束，由 ServerCron 调用
+func checkBackgroundSaveDone() {
+	if server.bgsavedone == nil {
+		return
+	}
+	select {
+	case status := <-server.bgsavedone:
+		backgroundSaveDoneHandler(status)
+	default:
+	}
+}
+
+func backgroundSaveDoneHandler(status int8) {
+	if status == GODIS_OK {
+		log.Printf("Background saving terminated with success\n")
+		// 快照之后产生的修改还没有保存
+		server.dirty -= server.dirtybeforebgsave
+		server.lastsave = time.Now().Unix()
+	}
+	server.lastbgsavestatus = status
+	server.rdbsavetimelast = (GetMsTime() - server.rdbsavetimestart) / 1000
+	server.rdbsavetimestart = -1
+	server.bgsavedone = nil
+	server.bgsavechild = nil
+}
+
+// 根据 save <seconds> <changes> 规则判断是否需要触发 BGSAVE，由 ServerCron 调用
+func rdbCheckSaveParams() {
+	if server.bgsavedone != nil || server.bgrewritedone != nil {
+		return
+	}
+	now := time.Now().Unix()
+	for _, sp := range server.saveparams {
+		/* Save if we reached the given amount of changes,
+		 * the given amount of seconds, and if the latest bgsave was
+		 * successful or if, in case of an error, at least
+		 * CONFIG_BGSAVE_RETRY_DELAY seconds already elapsed. */
+		if server.dirty >= int64(sp.changes) &&
+			now-server.lastsave > int64(sp.seconds) &&
+			(now-server.lastbgsavetry > CONFIG_BGSAVE_RETRY_DELAY || server.lastbgsavestatus == GODIS_OK) {
+			log.Printf("%d changes in %d seconds. Saving...\n", sp.changes, sp.seconds)
+			rdbSaveBackground(server.dbfilename)
+			break
+		}
+	}
 }
-func rdbSaveObject(file *os.File, o *Gobj) (int, error) {
+func rdbSaveObject(rdb *rio, o *Gobj) (int, error) {
 	switch o.Type_ {
 	case GSTR:
-		return rdbSaveStringObject(file, o)
+		return rdbSaveStringObject(rdb, o)
 	case GLIST:
 		//GODIS_ENCODING_LINKEDLIST
 		list := o.Val_.(*List)
 		// 先保存长度
-		rdbSaveLen(file, uint32(list.Length()))
+		if _, err := rdbSaveLen(rdb, uint32(list.Length())); err != nil {
+			return 0, err
+		}
 		// 保存每个元素
 		for e := list.First(); e != nil; e = e.next {
-			elem := e.Val
-			rdbSaveStringObject(file, elem)
+			if _, err := rdbSaveStringObject(rdb, e.Val); err != nil {
+				return 0, err
+			}
 		}
-		return 0, nil
 	case GZSET:
 		zsetObj := o.Val_.(zset)
 		// 先保存长度
-		rdbSaveLen(file, uint32(zsetObj.zsl.length))
-		// 保存每个元素
-		zslNode := zsetObj.zsl.header.level[0].forward
-		for zslNode != nil {
-			rdbSaveStringObject(file, zslNode.obj)
-			rdbSaveStringObject(file, &Gobj{
-				Type_:    GSTR,
-				Val_:     strconv.FormatFloat(zslNode.score, 'g', 17, 64),
-				refCount: 1,
-				encoding: GODIS_ENCODING_RAW})
-			dictEntry := zsetObj.dict.Find(zslNode.obj)
-			rdbSaveStringObject(file, dictEntry.Key)
-			rdbSaveStringObject(file, dictEntry.Value)
-			zslNode = zslNode.level[0].forward
+		if _, err := rdbSaveLen(rdb, uint32(zsetObj.zsl.length)); err != nil {
+			return 0, err
+		}
+		// 保存每个元素：[member][8 字节 double 分数]，分数保存在跳表节点中，dict 中的是同一个值
+		for zslNode := zsetObj.zsl.header.level[0].forward; zslNode != nil; zslNode = zslNode.level[0].forward {
+			if _, err := rdbSaveStringObject(rdb, zslNode.obj); err != nil {
+				return 0, err
+			}
+			if _, err := rdbSaveBinaryDoubleValue(rdb, zslNode.score); err != nil {
+				return 0, err
+			}
 		}
 	case GSET:
 		// o.encoding == GODIS_ENCODING_HT
 		dict := o.Val_.(*Dict)
 		// 先保存长度
-		rdbSaveLen(file, uint32(dict.usedSize()))
+		if _, err := rdbSaveLen(rdb, uint32(dict.usedSize())); err != nil {
+			return 0, err
+		}
 		// 保存每个元素
 		iter := dict.NewIterator(true) // 内层安全迭代器
+		defer iter.Close()
 		for key, _, exists := iter.Next(); exists; key, _, exists = iter.Next() {
-			rdbSaveStringObject(file, key)
+			if _, err := rdbSaveStringObject(rdb, key); err != nil {
+				return 0, err
+			}
 		}
-		iter.Close()
 	case GHASH:
 		// o.encoding == GODIS_ENCODING_HT
+		/* Redis 格式（版本 9）不能保存字段的过期时间，只能跳过已经过期的字段，
+		 * 其余的字段保存为没有过期时间的字段。godis 格式见 rdbSaveHashMetadataObject */
 		dict := o.Val_.(*Dict)
-		rdbSaveLen(file, uint32(dict.usedSize()))
+		now := GetMsTime()
+		size := dict.usedSize()
+		if meta := o.hashTypeExpireMeta(); meta != nil {
+			iter := meta.expires.NewIterator(true)
+			for _, expObj, exists := iter.Next(); exists; _, expObj, exists = iter.Next() {
+				if expObj.Val_.(int64) <= now {
+					size--
+				}
+			}
+			iter.Close()
+		}
+		if _, err := rdbSaveLen(rdb, uint32(size)); err != nil {
+			return 0, err
+		}
 		iter := dict.NewIterator(true) // 内层安全迭代器
+		defer iter.Close()
 		for key, val, exists := iter.Next(); exists; key, val, exists = iter.Next() {
-			rdbSaveStringObject(file, key)
-			rdbSaveStringObject(file, val)
+			if when := o.hashTypeGetExpire(key); when != -1 && when <= now {
+				continue
+			}
+			if _, err := rdbSaveStringObject(rdb, key); err != nil {
+				return 0, err
+			}
+			if _, err := rdbSaveStringObject(rdb, val); err != nil {
+				return 0, err
+			}
 		}
-		iter.Close()
 	default:
 		return 0, fmt.Errorf("unsupported type: %d", o.Type_)
 	}
@@ -134,49 +441,47 @@ func rdbSaveObject(file *os.File, o *Gobj) (int, error) {
 	return 1, nil
 }
 
-func rdbSaveRawString(file *os.File, s string) (int, error) {
-	n, err := rdbWriteRaw(file, []byte(s))
+func rdbSaveRawString(rdb *rio, s string) (int, error) {
+	n, err := rdbWriteRaw(rdb, []byte(s))
 	return n, err
 }
 
-func rdbSaveStringObject(file *os.File, o *Gobj) (int, error) {
-	switch o.encoding {
-	case GODIS_ENCODING_RAW:
-		switch val := o.Val_.(type) {
-		case float64:
-			rdbSaveLen(file, 8)
-			floatBytes := []byte(fmt.Sprintf("%f", val))
-			return rdbWriteRaw(file, floatBytes)
-		default:
-			rdbSaveLen(file, uint32(len(val.(string))))
-			return rdbSaveRawString(file, val.(string))
-		}
-	case GODIS_ENCODING_INT:
+// [len][字节数组]
+func rdbSaveRawStringWithLen(rdb *rio, s string) (int, error) {
+	n, err := rdbSaveLen(rdb, uint32(len(s)))
+	if err != nil {
+		return n, err
+	}
+	nw, err := rdbSaveRawString(rdb, s)
+	return n + nw, err
+}
+
+func rdbSaveStringObject(rdb *rio, o *Gobj) (int, error) {
+	if o.encoding == GODIS_ENCODING_INT {
 		str := strconv.FormatInt(o.Val_.(int64), 10) // "123456789"
-		rdbSaveLen(file, uint32(len(str)))
-		return rdbSaveRawString(file, str)
+		return rdbSaveRawStringWithLen(rdb, str)
 	}
-	rdbSaveLen(file, uint32(len(o.Val_.(string))))
-	rdbSaveRawString(file, o.Val_.(string))
-	return 0, nil
+	return rdbSaveRawStringWithLen(rdb, o.StrVal())
 }
 
-func rdbSaveType(file *os.File, save_type []byte) (int, error) {
-	return rdbWriteRaw(file, save_type)
+func rdbSaveBinaryDoubleValue(rdb *rio, val float64) (int, error) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], math.Float64bits(val))
+	return rdbWriteRaw(rdb, buf[:])
+}
+
+func rdbSaveType(rdb *rio, save_type []byte) (int, error) {
+	return rdbWriteRaw(rdb, save_type)
 }
-func rdbSaveTime(file *os.File, t int64) (int, error) {
-	t_32 := uint32(t)
-	data := []byte{
-		byte(t_32 & 0xFF),
-		byte((t_32 >> 8) & 0xFF),
-		byte((t_32 >> 16) & 0xFF),
-		byte((t_32 >> 24) & 0xFF),
-	}
-	return rdbWriteRaw(file, data)
 
+// 过期时间是毫秒时间戳，需要 8 个字节（小端序）保存，4 个字节会被截断
+func rdbSaveTime(rdb *rio, t int64) (int, error) {
+	var data [8]byte
+	binary.LittleEndian.PutUint64(data[:], uint64(t))
+	return rdbWriteRaw(rdb, data[:])
 }
 
-func rdbSaveLen(file *os.File, length uint32) (int, error) {
+func rdbSaveLen(rdb *rio, length uint32) (int, error) {
 	var buf []byte
 	switch {
 	case length < 1<<6: // 0xxxxxxx
@@ -198,27 +503,90 @@ func rdbSaveLen(file *os.File, length uint32) (int, error) {
 		buf = []byte{b0, b1, b2, b3, b4}
 	}
 
-	n, err := file.Write(buf)
-	return n, err
+	return rdbWriteRaw(rdb, buf)
 }
 
+/*
+加载 RDB 文件，根据魔数自动识别 godis 和 Redis 的格式。先完整地加载到一个新的数据库中，文件被截断或者校验和不匹配时直接返回错误，
+不会把加载了一半的数据替换到 server.db 中。
+*/
 func rdbLoad(filename string) error {
 	file, err := os.Open(filename)
 	if err != nil {
-		return errors.New("open file error")
+		return err
 	}
 	defer file.Close()
-	expireTime := int64(-1)
-	var type_ byte
+	dbs := createDBs(server.dbnum)
+	rdb := rioInitWithReader(file)
+	if err := rdbLoadRio(rdb, dbs); err != nil {
+		return fmt.Errorf("%s: %w at offset %d", filename, err, rdb.processed)
+	}
+	// 客户端持有的是 server.db 中的指针，只替换其中的字典
+	for i, db := range dbs {
+		server.db[i].data = db.data
+		server.db[i].expire = db.expire
+		server.db[i].hexpires = db.hexpires
+	}
+	return nil
+}
+
+// 加载到 dbs 中，文件中的数据库编号超出 dbs 的范围时报错
+func rdbLoadRio(rdb *rio, dbs []*GodisDB) error {
+	// 文件头：魔数 + 版本号
+	var header [9]byte
+	if _, err := rdb.Read(header[:]); err != nil {
+		return err
+	}
+	if string(header[:5]) == REDIS_RDB_MAGIC {
+		version, err := strconv.Atoi(string(header[5:]))
+		if err != nil || version < 1 || version > REDIS_RDB_MAX_LOAD_VERSION {
+			return fmt.Errorf("%w: can't handle RDB format version %s", errRdbCorrupted, header[5:])
+		}
+		return redisRdbLoadRio(rdb, dbs, version)
+	}
+	if string(header[:5]) != GODIS_RDB_MAGIC {
+		return fmt.Errorf("%w: wrong signature", errRdbCorrupted)
+	}
+	version, err := strconv.Atoi(string(header[5:]))
+	if err != nil || version < 1 || version > GODIS_RDB_VERSION {
+		return fmt.Errorf("%w: can't handle RDB format version %s", errRdbCorrupted, header[5:])
+	}
+	now := GetMsTime()
+	db := dbs[0]
 	for {
-		type_, _ = rdbLoadType(file)
-		if type_ == GODIS_EXPIRETIME {
+		expireTime := int64(-1)
+		type_, err := rdbLoadType(rdb)
+		if err != nil {
+			return err
+		}
+		if type_ == GODIS_AUX {
+			auxkey, err := rdbLoadStringObject(rdb)
+			if err != nil {
+				return err
+			}
+			auxval, err := rdbLoadStringObject(rdb)
+			if err != nil {
+				return err
+			}
+			log.Printf("RDB '%s': %s\n", auxkey.StrVal(), auxval.StrVal())
+			continue
+		} else if type_ == GODIS_SELECTDB {
+			dbid, err := rdbLoadLen(rdb)
+			if err != nil {
+				return err
+			}
+			if dbid >= uint64(len(dbs)) {
+				return fmt.Errorf("%w: DB index %d out of range, the server is configured to hold %d databases", errRdbCorrupted, dbid, len(dbs))
+			}
+			db = dbs[dbid]
+			continue
+		} else if type_ == GODIS_EXPIRETIME {
 			// 处理过期时间
-			expireTime, err = rdbLoadTime(file)
+			expireTime, err = rdbLoadTime(rdb)
 			if err != nil {
 				return err
 			}
-			type_, err = rdbLoadType(file)
+			type_, err = rdbLoadType(rdb)
 			if err != nil {
 				return err
 			}
@@ -226,114 +594,186 @@ func rdbLoad(filename string) error {
 			// 文件结束
 			break
 		}
-		key, _ := rdbLoadStringObject(file)
-		value, _ := rdbLoadObject(Gtype(type_), file)
+		key, err := rdbLoadStringObject(rdb)
+		if err != nil {
+			return err
+		}
+		value, err := rdbLoadObject(Gtype(type_), rdb)
+		if err != nil {
+			return err
+		}
 		// 检查是否过期
-		if expireTime != -1 && expireTime < GetMsTime() {
+		if expireTime != -1 && expireTime < now {
 			// 过期
 			key.DecrRefCount()
 			value.DecrRefCount()
 			continue
 		}
-		expireTime = -1 // 重置过期时间
-		server.db.data.Set(key, value)
+		// 字段全部过期了的哈希
+		if value.Type_ == GHASH && value.hashTypeLength() == 0 {
+			key.DecrRefCount()
+			value.DecrRefCount()
+			continue
+		}
+		db.data.Set(key, value)
+		if value.Type_ == GHASH {
+			dbTrackHashFieldExpires(db, key, value)
+		}
+		// 恢复过期时间
+		if expireTime != -1 {
+			expObj := CreateFromInt(expireTime)
+			db.expire.Set(key, expObj)
+			expObj.DecrRefCount()
+		}
+	}
+	// 校验和
+	computed := rdb.cksum
+	var buf [8]byte
+	if _, err := rdb.Read(buf[:]); err != nil {
+		return err
+	}
+	if stored := binary.LittleEndian.Uint64(buf[:]); stored != computed {
+		return fmt.Errorf("%w: wrong RDB checksum, stored: (%x) computed: (%x)", errRdbCorrupted, stored, computed)
 	}
 	return nil
 }
 
 const DICT_HT_INITIAL_SIZE = 4
 
-func rdbLoadObject(type_ Gtype, file *os.File) (*Gobj, error) {
+func rdbLoadObject(type_ Gtype, rdb *rio) (*Gobj, error) {
 	switch type_ {
 	case GSTR:
-		o, err := rdbLoadStringObject(file)
-		if isInteger(o.StrVal()) {
-			num, err := strconv.ParseInt(string(o.StrVal()), 10, 64)
-			return CreateFromInt(num), err
+		o, err := rdbLoadStringObject(rdb)
+		if err != nil {
+			return nil, err
+		}
+		if num, ok := isInteger(o.StrVal()); ok {
+			return CreateFromInt(num), nil
 		}
-		return o, err
+		return o, nil
 	case GSET:
 		// 读取集合长度
-		length, err := rdbLoadLen(file)
+		length, err := rdbLoadLen(rdb)
 		if err != nil {
 			return nil, err
 		}
 		// 创建新的集合对象
-		set := CreateSetObject().Val_.(*Dict)
+		setObj := CreateSetObject()
+		set := setObj.Val_.(*Dict)
 		if length > DICT_HT_INITIAL_SIZE {
 			// TODO 直接拓展到指定大小
 		}
 		for i := uint64(0); i < length; i++ {
-			elem, err := rdbLoadStringObject(file)
+			elem, err := rdbLoadStringObject(rdb)
 			if err != nil {
 				return nil, err
 			}
 			set.Set(elem, nil)
 		}
-		return &Gobj{Type_: GSET, Val_: set, encoding: GODIS_ENCODING_HT}, nil
+		return setObj, nil
 	case GLIST:
 		// 读取列表长度
-		length, err := rdbLoadLen(file)
+		length, err := rdbLoadLen(rdb)
 		if err != nil {
 			return nil, err
 		}
 		// 创建新的列表对象
-		list := CreateListObject().Val_.(*List)
+		listObj := CreateListObject()
+		list := listObj.Val_.(*List)
 		for i := uint64(0); i < length; i++ {
-			elem, err := rdbLoadStringObject(file)
+			elem, err := rdbLoadStringObject(rdb)
 			if err != nil {
 				return nil, err
 			}
 			list.Append(elem)
 		}
-		return &Gobj{Type_: GLIST, Val_: list, encoding: GODIS_ENCODING_LINKEDLIST}, nil
+		return listObj, nil
 	case GHASH:
 		// 读取哈希表长度
-		length, err := rdbLoadLen(file)
+		length, err := rdbLoadLen(rdb)
 		if err != nil {
 			return nil, err
 		}
 		// 创建新的哈希表对象
-		hash := CreateHashObject().Val_.(*Dict)
+		hashObj := CreateHashObject()
+		hash := hashObj.Val_.(*Dict)
+		for i := uint64(0); i < length; i++ {
+			key, err := rdbLoadStringObject(rdb)
+			if err != nil {
+				return nil, err
+			}
+			val, err := rdbLoadStringObject(rdb)
+			if err != nil {
+				return nil, err
+			}
+			hash.Set(key, val)
+		}
+		return hashObj, nil
+	case GODIS_RDB_TYPE_HASH_METADATA:
+		// 已经过期的字段不加载
+		length, err := rdbLoadLen(rdb)
+		if err != nil {
+			return nil, err
+		}
+		now := GetMsTime()
+		hashObj := CreateHashObject()
+		hash := hashObj.Val_.(*Dict)
 		for i := uint64(0); i < length; i++ {
-			key, err := rdbLoadStringObject(file)
+			when, err := rdbLoadTime(rdb)
 			if err != nil {
 				return nil, err
 			}
-			val, err := rdbLoadStringObject(file)
+			key, err := rdbLoadStringObject(rdb)
 			if err != nil {
 				return nil, err
 			}
+			val, err := rdbLoadStringObject(rdb)
+			if err != nil {
+				return nil, err
+			}
+			if when != -1 && when <= now {
+				continue
+			}
 			hash.Set(key, val)
+			if when != -1 {
+				hashObj.hashTypeSetExpire(key, when)
+			}
 		}
-		return &Gobj{Type_: GHASH, Val_: hash, encoding: GODIS_ENCODING_HT}, nil
+		return hashObj, nil
 	case GZSET:
 		// 读取zset长度
-		length, err := rdbLoadLen(file)
+		length, err := rdbLoadLen(rdb)
 		if err != nil {
 			return nil, err
 		}
 		// 创建新的zset对象
-		zseObj := CreateZSetObject()
+		zsetObj := CreateZSetObject()
+		zs := zsetObj.Val_.(zset)
 		for i := uint64(0); i < length; i++ {
-			zsl_member_key, _ := rdbLoadStringObject(file)
-			zsl_member_score, _ := rdbLoadStringObject(file)
-			dic_member_key, _ := rdbLoadStringObject(file)
-			dic_member_score, _ := rdbLoadStringObject(file)
-			score := zsl_member_score.DoubleVal()
-			zseObj.Val_.(zset).zsl.zslInsert(score, zsl_member_key)
-			zseObj.Val_.(zset).dict.Set(dic_member_key, dic_member_score)
-		}
-		return zseObj, nil
+			member, err := rdbLoadStringObject(rdb)
+			if err != nil {
+				return nil, err
+			}
+			score, err := rdbLoadBinaryDoubleValue(rdb)
+			if err != nil {
+				return nil, err
+			}
+			if zs.dict.Find(member) != nil {
+				return nil, fmt.Errorf("%w: duplicate zset member", errRdbCorrupted)
+			}
+			znode := zs.zsl.zslInsert(score, member)
+			zs.dict.Set(member, &Gobj{Type_: GSTR, Val_: znode.score, encoding: GODIS_ENCODING_RAW})
+		}
+		return zsetObj, nil
 	default:
-		return nil, fmt.Errorf("unknown type: %d", type_)
+		return nil, fmt.Errorf("%w: unknown type: %d", errRdbCorrupted, type_)
 	}
 }
 
-func rdbLoadLen(file *os.File) (uint64, error) {
+func rdbLoadLen(rdb *rio) (uint64, error) {
 	// 读取第一个字节以确定编码方式
 	firstByte := make([]byte, 1)
-	_, err := file.Read(firstByte)
+	_, err := rdb.Read(firstByte)
 	if err != nil {
 		return 0, err
 	}
@@ -346,32 +786,37 @@ func rdbLoadLen(file *os.File) (uint64, error) {
 	case firstByte[0]>>6 == 1: // 01xxxxxx
 		// 14位长度，需要读取下一个字节
 		secondByte := make([]byte, 1)
-		_, err := file.Read(secondByte)
+		_, err := rdb.Read(secondByte)
 		if err != nil {
 			return 0, err
 		}
 		return uint64(firstByte[0]&0x3F)<<8 | uint64(secondByte[0]), nil
-	default: // 10......
-		// 6位后跟4字节长度
+	case firstByte[0] == 0x80: // 10000000
+		// 后跟4字节长度
 		buf := make([]byte, 4)
-		_, err := io.ReadFull(file, buf)
+		_, err := rdb.Read(buf)
 		if err != nil {
 			return 0, err
 		}
 		return uint64(buf[0])<<24 | uint64(buf[1])<<16 | uint64(buf[2])<<8 | uint64(buf[3]), nil
+	default:
+		return 0, fmt.Errorf("%w: unknown length encoding %x", errRdbCorrupted, firstByte[0])
 	}
 }
 
-func rdbLoadStringObject(file *os.File) (*Gobj, error) {
-	length, err := rdbLoadLen(file)
+func rdbLoadStringObject(rdb *rio) (*Gobj, error) {
+	length, err := rdbLoadLen(rdb)
 	if err != nil {
 		return nil, err
 	}
 	if length == 0 {
-		return CreateObject(GSTR, nil), nil
+		return CreateObject(GSTR, ""), nil
+	}
+	if length > RDB_MAX_LEN {
+		return nil, fmt.Errorf("%w: string length %d exceeds the limit", errRdbCorrupted, length)
 	}
 	buf := make([]byte, length)
-	_, err = io.ReadFull(file, buf)
+	_, err = rdb.Read(buf)
 	if err != nil {
 		return nil, err
 	}
@@ -379,22 +824,34 @@ func rdbLoadStringObject(file *os.File) (*Gobj, error) {
 	return CreateObject(GSTR, str), nil
 }
 
-func isInteger(s string) bool {
-	_, err := strconv.ParseInt(s, 10, 64)
-	return err == nil
+func rdbLoadBinaryDoubleValue(rdb *rio) (float64, error) {
+	var buf [8]byte
+	if _, err := rdb.Read(buf[:]); err != nil {
+		return 0, err
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(buf[:])), nil
+}
+
+// 只有规范形式的整数（没有前导 0、正号等）才能编码为整数，否则读出来的值会和原来不一样
+func isInteger(s string) (int64, bool) {
+	num, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || strconv.FormatInt(num, 10) != s {
+		return 0, false
+	}
+	return num, true
 }
 
-func rdbLoadTime(file *os.File) (int64, error) {
-	var buf [4]byte // 使用数组而非切片，避免堆分配
-	_, err := io.ReadFull(file, buf[:])
+func rdbLoadTime(rdb *rio) (int64, error) {
+	var buf [8]byte // 使用数组而非切片，避免堆分配
+	_, err := rdb.Read(buf[:])
 	if err != nil {
 		return -1, err
 	}
-	return int64(buf[0]) | int64(buf[1])<<8 | int64(buf[2])<<16 | int64(buf[3])<<24, nil
+	return int64(binary.LittleEndian.Uint64(buf[:])), nil
 }
-func rdbLoadType(file *os.File) (byte, error) {
+func rdbLoadType(rdb *rio) (byte, error) {
 	buf := make([]byte, 1)
-	_, err := file.Read(buf)
+	_, err := rdb.Read(buf)
 	if err != nil {
 		return 0, err
 	}
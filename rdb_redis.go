@@ -0,0 +1,851 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+)
+
+/*
+Redis 的 RDB 格式（和 redis-server 生成的 dump.rdb 互相兼容）：
+
+	REDIS0009                          魔数 + 4 位版本号
+	[0xfa][key][value]...              辅助字段
+	[0xfe][dbid]                       SELECTDB
+	[0xfb][db size][expires size]      RESIZEDB
+	[0xfc][8 字节毫秒] / [0xfd][4 字节秒]  过期时间（可选）
+	[类型][key][value]...              键值对
+	[0xff]                             EOF
+	[8 字节 CRC64]                     校验和（小端序，版本 5 开始才有，为 0 表示没有计算）
+
+写出时只使用最基础的编码（版本 9，Redis 5.0 及以上都能加载）；
+加载时还支持 ziplist / listpack / intset / quicklist 等紧凑编码和 LZF 压缩的字符串。
+*/
+const (
+	REDIS_RDB_MAGIC            = "REDIS"
+	REDIS_RDB_VERSION          = 9
+	REDIS_RDB_MAX_LOAD_VERSION = 12
+)
+
+const (
+	RDB_FORMAT_GODIS = "godis"
+	RDB_FORMAT_REDIS = "redis"
+)
+
+// 对象类型
+const (
+	REDIS_RDB_TYPE_STRING           = 0
+	REDIS_RDB_TYPE_LIST             = 1
+	REDIS_RDB_TYPE_SET              = 2
+	REDIS_RDB_TYPE_ZSET             = 3
+	REDIS_RDB_TYPE_HASH             = 4
+	REDIS_RDB_TYPE_ZSET_2           = 5 /* ZSET version 2 with doubles stored in binary. */
+	REDIS_RDB_TYPE_LIST_ZIPLIST     = 10
+	REDIS_RDB_TYPE_SET_INTSET       = 11
+	REDIS_RDB_TYPE_ZSET_ZIPLIST     = 12
+	REDIS_RDB_TYPE_HASH_ZIPLIST     = 13
+	REDIS_RDB_TYPE_LIST_QUICKLIST   = 14
+	REDIS_RDB_TYPE_HASH_LISTPACK    = 16
+	REDIS_RDB_TYPE_ZSET_LISTPACK    = 17
+	REDIS_RDB_TYPE_LIST_QUICKLIST_2 = 18
+	REDIS_RDB_TYPE_SET_LISTPACK     = 20
+)
+
+// 特殊操作码
+const (
+	REDIS_RDB_OPCODE_SLOT_INFO       = 244
+	REDIS_RDB_OPCODE_FUNCTION2       = 245
+	REDIS_RDB_OPCODE_FUNCTION_PRE_GA = 246
+	REDIS_RDB_OPCODE_MODULE_AUX      = 247
+	REDIS_RDB_OPCODE_IDLE            = 248
+	REDIS_RDB_OPCODE_FREQ            = 249
+	REDIS_RDB_OPCODE_AUX             = 250
+	REDIS_RDB_OPCODE_RESIZEDB        = 251
+	REDIS_RDB_OPCODE_EXPIRETIME_MS   = 252
+	REDIS_RDB_OPCODE_EXPIRETIME      = 253
+	REDIS_RDB_OPCODE_SELECTDB        = 254
+	REDIS_RDB_OPCODE_EOF             = 255
+)
+
+// 长度的最高两位为 11 时，低 6 位表示字符串的特殊编码
+const (
+	REDIS_RDB_ENC_INT8  = 0
+	REDIS_RDB_ENC_INT16 = 1
+	REDIS_RDB_ENC_INT32 = 2
+	REDIS_RDB_ENC_LZF   = 3
+)
+
+// quicklist 2 中每个节点的容器类型
+const (
+	QUICKLIST_NODE_CONTAINER_PLAIN  = 1
+	QUICKLIST_NODE_CONTAINER_PACKED = 2
+)
+
+// redisRdbSaveRio 按 Redis 的 RDB 格式写出所有数据库
+func redisRdbSaveRio(rdb *rio, dbs []*GodisDB) error {
+	magic := fmt.Sprintf("%s%04d", REDIS_RDB_MAGIC, REDIS_RDB_VERSION)
+	if _, err := rdbWriteRaw(rdb, []byte(magic)); err != nil {
+		return err
+	}
+	if err := redisRdbSaveInfoAuxFields(rdb); err != nil {
+		return err
+	}
+	for _, db := range dbs {
+		if db.data.usedSize() == 0 {
+			continue
+		}
+		if _, err := rdbSaveType(rdb, []byte{REDIS_RDB_OPCODE_SELECTDB}); err != nil {
+			return err
+		}
+		if _, err := rdbSaveLen(rdb, uint32(db.id)); err != nil {
+			return err
+		}
+		if _, err := rdbSaveType(rdb, []byte{REDIS_RDB_OPCODE_RESIZEDB}); err != nil {
+			return err
+		}
+		if _, err := rdbSaveLen(rdb, uint32(db.data.usedSize())); err != nil {
+			return err
+		}
+		if _, err := rdbSaveLen(rdb, uint32(db.expire.usedSize())); err != nil {
+			return err
+		}
+		if err := rdbSaveDB(rdb, db, redisRdbSaveKeyValuePair); err != nil {
+			return err
+		}
+	}
+	if _, err := rdbSaveType(rdb, []byte{REDIS_RDB_OPCODE_EOF}); err != nil {
+		return err
+	}
+	var cksum [8]byte
+	binary.LittleEndian.PutUint64(cksum[:], rdb.cksum)
+	_, err := rdbWriteRaw(rdb, cksum[:])
+	return err
+}
+
+func redisRdbSaveInfoAuxFields(rdb *rio) error {
+	if err := rdbSaveAuxField(rdb, "redis-ver", GODIS_VERSION); err != nil {
+		return err
+	}
+	if err := rdbSaveAuxField(rdb, "redis-bits", strconv.Itoa(strconv.IntSize)); err != nil {
+		return err
+	}
+	return rdbSaveInfoAuxFields(rdb)
+}
+
+/*
+值的编码和 godis 格式完全相同，只有类型码不同：有序集合的分数以二进制保存，对应 Redis 的 ZSET_2；
+过期时间使用毫秒的 EXPIRETIME_MS（Redis 的 EXPIRETIME 是 4 字节的秒）。
+*/
+func redisRdbSaveKeyValuePair(rdb *rio, key, value *Gobj, expiretime int64) error {
+	if expiretime != -1 {
+		if _, err := rdbSaveType(rdb, []byte{REDIS_RDB_OPCODE_EXPIRETIME_MS}); err != nil {
+			return err
+		}
+		if _, err := rdbSaveTime(rdb, expiretime); err != nil {
+			return err
+		}
+	}
+	var type_ byte
+	switch value.Type_ {
+	case GSTR:
+		type_ = REDIS_RDB_TYPE_STRING
+	case GLIST:
+		type_ = REDIS_RDB_TYPE_LIST
+	case GSET:
+		type_ = REDIS_RDB_TYPE_SET
+	case GZSET:
+		type_ = REDIS_RDB_TYPE_ZSET_2
+	case GHASH:
+		type_ = REDIS_RDB_TYPE_HASH
+	default:
+		return fmt.Errorf("unsupported type: %d", value.Type_)
+	}
+	if _, err := rdbSaveType(rdb, []byte{type_}); err != nil {
+		return err
+	}
+	if _, err := rdbSaveStringObject(rdb, key); err != nil {
+		return err
+	}
+	_, err := rdbSaveObject(rdb, value)
+	return err
+}
+
+// redisRdbLoadRio 加载魔数和版本号之后的部分，version 已经由 rdbLoadRio 检查过
+func redisRdbLoadRio(rdb *rio, dbs []*GodisDB, version int) error {
+	now := GetMsTime()
+	db := dbs[0]
+	expireTime := int64(-1)
+	for {
+		type_, err := rdbLoadType(rdb)
+		if err != nil {
+			return err
+		}
+		switch type_ {
+		case REDIS_RDB_OPCODE_EXPIRETIME:
+			var buf [4]byte
+			if _, err := rdb.Read(buf[:]); err != nil {
+				return err
+			}
+			expireTime = int64(int32(binary.LittleEndian.Uint32(buf[:]))) * 1000
+			continue
+		case REDIS_RDB_OPCODE_EXPIRETIME_MS:
+			if expireTime, err = rdbLoadTime(rdb); err != nil {
+				return err
+			}
+			continue
+		case REDIS_RDB_OPCODE_FREQ:
+			// LFU 计数，godis 不使用
+			if _, err := rdbLoadType(rdb); err != nil {
+				return err
+			}
+			continue
+		case REDIS_RDB_OPCODE_IDLE:
+			// LRU 空闲时间，godis 不使用
+			if _, _, err := redisRdbLoadLen(rdb); err != nil {
+				return err
+			}
+			continue
+		case REDIS_RDB_OPCODE_EOF:
+			return redisRdbVerifyChecksum(rdb, version)
+		case REDIS_RDB_OPCODE_SELECTDB:
+			dbid, _, err := redisRdbLoadLen(rdb)
+			if err != nil {
+				return err
+			}
+			if dbid >= uint64(len(dbs)) {
+				return fmt.Errorf("%w: DB index %d out of range, the server is configured to hold %d databases", errRdbCorrupted, dbid, len(dbs))
+			}
+			db = dbs[dbid]
+			continue
+		case REDIS_RDB_OPCODE_RESIZEDB:
+			// 只是预分配大小的提示
+			for i := 0; i < 2; i++ {
+				if _, _, err := redisRdbLoadLen(rdb); err != nil {
+					return err
+				}
+			}
+			continue
+		case REDIS_RDB_OPCODE_SLOT_INFO:
+			// 集群模式下的 slot 信息：slot id、slot 大小、slot 中带过期时间的键数量
+			for i := 0; i < 3; i++ {
+				if _, _, err := redisRdbLoadLen(rdb); err != nil {
+					return err
+				}
+			}
+			continue
+		case REDIS_RDB_OPCODE_AUX:
+			auxkey, err := redisRdbGenericLoadString(rdb)
+			if err != nil {
+				return err
+			}
+			auxval, err := redisRdbGenericLoadString(rdb)
+			if err != nil {
+				return err
+			}
+			log.Printf("RDB '%s': %s\n", auxkey, auxval)
+			continue
+		case REDIS_RDB_OPCODE_FUNCTION2:
+			// 函数库的源码，godis 不支持函数，直接跳过
+			if _, err := redisRdbGenericLoadString(rdb); err != nil {
+				return err
+			}
+			log.Printf("RDB: skipping function library\n")
+			continue
+		case REDIS_RDB_OPCODE_MODULE_AUX, REDIS_RDB_OPCODE_FUNCTION_PRE_GA:
+			return fmt.Errorf("can't load RDB opcode %d", type_)
+		}
+		key, err := redisRdbGenericLoadString(rdb)
+		if err != nil {
+			return err
+		}
+		value, err := redisRdbLoadObject(type_, rdb)
+		if err != nil {
+			return err
+		}
+		if expireTime == -1 || expireTime >= now {
+			keyObj := CreateObject(GSTR, string(key))
+			db.data.Set(keyObj, value)
+			if expireTime != -1 {
+				expObj := CreateFromInt(expireTime)
+				db.expire.Set(keyObj, expObj)
+				expObj.DecrRefCount()
+			}
+		} else {
+			value.DecrRefCount()
+		}
+		expireTime = -1
+	}
+}
+
+func redisRdbVerifyChecksum(rdb *rio, version int) error {
+	if version < 5 {
+		return nil
+	}
+	computed := rdb.cksum
+	var buf [8]byte
+	if _, err := rdb.Read(buf[:]); err != nil {
+		return err
+	}
+	stored := binary.LittleEndian.Uint64(buf[:])
+	// rdbchecksum no 时写入的是 0
+	if stored != 0 && stored != computed {
+		return fmt.Errorf("%w: wrong RDB checksum, stored: (%x) computed: (%x)", errRdbCorrupted, stored, computed)
+	}
+	return nil
+}
+
+func redisRdbLoadObject(type_ byte, rdb *rio) (*Gobj, error) {
+	switch type_ {
+	case REDIS_RDB_TYPE_STRING:
+		s, err := redisRdbGenericLoadString(rdb)
+		if err != nil {
+			return nil, err
+		}
+		if num, ok := isInteger(string(s)); ok {
+			return CreateFromInt(num), nil
+		}
+		return CreateObject(GSTR, string(s)), nil
+	case REDIS_RDB_TYPE_LIST, REDIS_RDB_TYPE_SET:
+		elems, err := redisRdbLoadStrings(rdb, 1)
+		if err != nil {
+			return nil, err
+		}
+		if type_ == REDIS_RDB_TYPE_LIST {
+			return redisRdbCreateList(elems), nil
+		}
+		return redisRdbCreateSet(elems), nil
+	case REDIS_RDB_TYPE_HASH:
+		elems, err := redisRdbLoadStrings(rdb, 2)
+		if err != nil {
+			return nil, err
+		}
+		return redisRdbCreateHash(elems)
+	case REDIS_RDB_TYPE_ZSET, REDIS_RDB_TYPE_ZSET_2:
+		length, _, err := redisRdbLoadLen(rdb)
+		if err != nil {
+			return nil, err
+		}
+		zsetObj := CreateZSetObject()
+		for i := uint64(0); i < length; i++ {
+			member, err := redisRdbGenericLoadString(rdb)
+			if err != nil {
+				return nil, err
+			}
+			var score float64
+			if type_ == REDIS_RDB_TYPE_ZSET_2 {
+				score, err = rdbLoadBinaryDoubleValue(rdb)
+			} else {
+				score, err = redisRdbLoadDoubleValue(rdb)
+			}
+			if err != nil {
+				return nil, err
+			}
+			if err := redisRdbZsetAdd(zsetObj, string(member), score); err != nil {
+				return nil, err
+			}
+		}
+		return zsetObj, nil
+	case REDIS_RDB_TYPE_LIST_QUICKLIST, REDIS_RDB_TYPE_LIST_QUICKLIST_2:
+		length, _, err := redisRdbLoadLen(rdb)
+		if err != nil {
+			return nil, err
+		}
+		var elems []string
+		for i := uint64(0); i < length; i++ {
+			container := uint64(QUICKLIST_NODE_CONTAINER_PACKED)
+			if type_ == REDIS_RDB_TYPE_LIST_QUICKLIST_2 {
+				if container, _, err = redisRdbLoadLen(rdb); err != nil {
+					return nil, err
+				}
+			}
+			blob, err := redisRdbGenericLoadString(rdb)
+			if err != nil {
+				return nil, err
+			}
+			var nodeElems []string
+			switch {
+			case container == QUICKLIST_NODE_CONTAINER_PLAIN:
+				nodeElems = []string{string(blob)}
+			case container != QUICKLIST_NODE_CONTAINER_PACKED:
+				return nil, fmt.Errorf("%w: unknown quicklist container %d", errRdbCorrupted, container)
+			case type_ == REDIS_RDB_TYPE_LIST_QUICKLIST:
+				nodeElems, err = ziplistEntries(blob)
+			default:
+				nodeElems, err = listpackEntries(blob)
+			}
+			if err != nil {
+				return nil, err
+			}
+			elems = append(elems, nodeElems...)
+		}
+		return redisRdbCreateList(elems), nil
+	case REDIS_RDB_TYPE_LIST_ZIPLIST, REDIS_RDB_TYPE_SET_INTSET, REDIS_RDB_TYPE_ZSET_ZIPLIST,
+		REDIS_RDB_TYPE_HASH_ZIPLIST, REDIS_RDB_TYPE_HASH_LISTPACK, REDIS_RDB_TYPE_ZSET_LISTPACK,
+		REDIS_RDB_TYPE_SET_LISTPACK:
+		// 整个对象被编码成一个字符串
+		blob, err := redisRdbGenericLoadString(rdb)
+		if err != nil {
+			return nil, err
+		}
+		var elems []string
+		switch type_ {
+		case REDIS_RDB_TYPE_SET_INTSET:
+			elems, err = intsetEntries(blob)
+		case REDIS_RDB_TYPE_LIST_ZIPLIST, REDIS_RDB_TYPE_ZSET_ZIPLIST, REDIS_RDB_TYPE_HASH_ZIPLIST:
+			elems, err = ziplistEntries(blob)
+		default:
+			elems, err = listpackEntries(blob)
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch type_ {
+		case REDIS_RDB_TYPE_LIST_ZIPLIST:
+			return redisRdbCreateList(elems), nil
+		case REDIS_RDB_TYPE_SET_INTSET, REDIS_RDB_TYPE_SET_LISTPACK:
+			return redisRdbCreateSet(elems), nil
+		case REDIS_RDB_TYPE_HASH_ZIPLIST, REDIS_RDB_TYPE_HASH_LISTPACK:
+			return redisRdbCreateHash(elems)
+		default:
+			// 有序集合：member 和 score 交替出现
+			if len(elems)%2 != 0 {
+				return nil, fmt.Errorf("%w: zset with odd number of elements", errRdbCorrupted)
+			}
+			zsetObj := CreateZSetObject()
+			for i := 0; i < len(elems); i += 2 {
+				score, err := strconv.ParseFloat(elems[i+1], 64)
+				if err != nil {
+					return nil, fmt.Errorf("%w: invalid zset score", errRdbCorrupted)
+				}
+				if err := redisRdbZsetAdd(zsetObj, elems[i], score); err != nil {
+					return nil, err
+				}
+			}
+			return zsetObj, nil
+		}
+	default:
+		// 模块、stream 等 godis 没有的类型
+		return nil, fmt.Errorf("can't load RDB object type %d", type_)
+	}
+}
+
+// 读取 [len][elem]... 形式的字符串序列，每个元素由 group 个字符串组成（哈希表为 2）
+func redisRdbLoadStrings(rdb *rio, group uint64) ([]string, error) {
+	length, _, err := redisRdbLoadLen(rdb)
+	if err != nil {
+		return nil, err
+	}
+	// 先检查再相乘，避免溢出；预分配的大小也不能完全相信文件中的长度
+	if length > RDB_MAX_LEN/group {
+		return nil, fmt.Errorf("%w: too many elements %d", errRdbCorrupted, length)
+	}
+	total := length * group
+	elems := make([]string, 0, min(total, 1024))
+	for i := uint64(0); i < total; i++ {
+		s, err := redisRdbGenericLoadString(rdb)
+		if err != nil {
+			return nil, err
+		}
+		elems = append(elems, string(s))
+	}
+	return elems, nil
+}
+
+func redisRdbCreateList(elems []string) *Gobj {
+	listObj := CreateListObject()
+	list := listObj.Val_.(*List)
+	for _, elem := range elems {
+		list.Append(CreateObject(GSTR, elem))
+	}
+	return listObj
+}
+
+func redisRdbCreateSet(elems []string) *Gobj {
+	setObj := CreateSetObject()
+	set := setObj.Val_.(*Dict)
+	for _, elem := range elems {
+		set.Set(CreateObject(GSTR, elem), nil)
+	}
+	return setObj
+}
+
+// elems 中 field 和 value 交替出现
+func redisRdbCreateHash(elems []string) (*Gobj, error) {
+	if len(elems)%2 != 0 {
+		return nil, fmt.Errorf("%w: hash with odd number of elements", errRdbCorrupted)
+	}
+	hashObj := CreateHashObject()
+	hash := hashObj.Val_.(*Dict)
+	for i := 0; i < len(elems); i += 2 {
+		hash.Set(CreateObject(GSTR, elems[i]), CreateObject(GSTR, elems[i+1]))
+	}
+	return hashObj, nil
+}
+
+func redisRdbZsetAdd(zsetObj *Gobj, member string, score float64) error {
+	if math.IsNaN(score) {
+		return fmt.Errorf("%w: zset score is NaN", errRdbCorrupted)
+	}
+	zs := zsetObj.Val_.(zset)
+	memberObj := CreateObject(GSTR, member)
+	if zs.dict.Find(memberObj) != nil {
+		return fmt.Errorf("%w: duplicate zset member", errRdbCorrupted)
+	}
+	znode := zs.zsl.zslInsert(score, memberObj)
+	zs.dict.Set(memberObj, &Gobj{Type_: GSTR, Val_: znode.score, encoding: GODIS_ENCODING_RAW})
+	return nil
+}
+
+/*
+长度编码（最高两位）：
+  - 00: 低 6 位是长度
+  - 01: 低 6 位和下一个字节组成 14 位长度
+  - 10: 0x80 后跟 4 字节、0x81 后跟 8 字节的大端序长度
+  - 11: 特殊编码的字符串，低 6 位是编码类型，encoded 为 true
+*/
+func redisRdbLoadLen(rdb *rio) (length uint64, encoded bool, err error) {
+	first, err := rdbLoadType(rdb)
+	if err != nil {
+		return 0, false, err
+	}
+	switch first >> 6 {
+	case 0:
+		return uint64(first & 0x3F), false, nil
+	case 1:
+		second, err := rdbLoadType(rdb)
+		if err != nil {
+			return 0, false, err
+		}
+		return uint64(first&0x3F)<<8 | uint64(second), false, nil
+	case 3:
+		return uint64(first & 0x3F), true, nil
+	}
+	switch first {
+	case 0x80:
+		var buf [4]byte
+		if _, err := rdb.Read(buf[:]); err != nil {
+			return 0, false, err
+		}
+		return uint64(binary.BigEndian.Uint32(buf[:])), false, nil
+	case 0x81:
+		var buf [8]byte
+		if _, err := rdb.Read(buf[:]); err != nil {
+			return 0, false, err
+		}
+		return binary.BigEndian.Uint64(buf[:]), false, nil
+	default:
+		return 0, false, fmt.Errorf("%w: unknown length encoding %x", errRdbCorrupted, first)
+	}
+}
+
+// 读取一个字符串，整数编码和 LZF 压缩的字符串会还原成原始的字节
+func redisRdbGenericLoadString(rdb *rio) ([]byte, error) {
+	length, encoded, err := redisRdbLoadLen(rdb)
+	if err != nil {
+		return nil, err
+	}
+	if encoded {
+		switch length {
+		case REDIS_RDB_ENC_INT8, REDIS_RDB_ENC_INT16, REDIS_RDB_ENC_INT32:
+			buf := make([]byte, 1<<length)
+			if _, err := rdb.Read(buf); err != nil {
+				return nil, err
+			}
+			var val int64
+			switch length {
+			case REDIS_RDB_ENC_INT8:
+				val = int64(int8(buf[0]))
+			case REDIS_RDB_ENC_INT16:
+				val = int64(int16(binary.LittleEndian.Uint16(buf)))
+			default:
+				val = int64(int32(binary.LittleEndian.Uint32(buf)))
+			}
+			return strconv.AppendInt(nil, val, 10), nil
+		case REDIS_RDB_ENC_LZF:
+			return redisRdbLoadLzfString(rdb)
+		default:
+			return nil, fmt.Errorf("%w: unknown string encoding %d", errRdbCorrupted, length)
+		}
+	}
+	if length > RDB_MAX_LEN {
+		return nil, fmt.Errorf("%w: string length %d exceeds the limit", errRdbCorrupted, length)
+	}
+	buf := make([]byte, length)
+	if _, err := rdb.Read(buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// [压缩后长度][原始长度][压缩数据]
+func redisRdbLoadLzfString(rdb *rio) ([]byte, error) {
+	clen, _, err := redisRdbLoadLen(rdb)
+	if err != nil {
+		return nil, err
+	}
+	ulen, _, err := redisRdbLoadLen(rdb)
+	if err != nil {
+		return nil, err
+	}
+	if clen > RDB_MAX_LEN || ulen > RDB_MAX_LEN {
+		return nil, fmt.Errorf("%w: LZF string length %d/%d exceeds the limit", errRdbCorrupted, clen, ulen)
+	}
+	compressed := make([]byte, clen)
+	if _, err := rdb.Read(compressed); err != nil {
+		return nil, err
+	}
+	out := make([]byte, ulen)
+	if err := lzfDecompress(compressed, out); err != nil {
+		return nil, fmt.Errorf("%w: %v", errRdbCorrupted, err)
+	}
+	return out, nil
+}
+
+// 旧的 ZSET 类型中分数以字符串保存：[1 字节长度][字符串]，253/254/255 分别表示 NaN/+inf/-inf
+func redisRdbLoadDoubleValue(rdb *rio) (float64, error) {
+	length, err := rdbLoadType(rdb)
+	if err != nil {
+		return 0, err
+	}
+	switch length {
+	case 253:
+		return math.NaN(), nil
+	case 254:
+		return math.Inf(1), nil
+	case 255:
+		return math.Inf(-1), nil
+	}
+	buf := make([]byte, length)
+	if _, err := rdb.Read(buf); err != nil {
+		return 0, err
+	}
+	val, err := strconv.ParseFloat(string(buf), 64)
+	if err != nil {
+		return 0, fmt.Errorf("%w: invalid double value", errRdbCorrupted)
+	}
+	return val, nil
+}
+
+/*
+intset: [4 字节编码 (2/4/8)][4 字节元素个数][元素...]，全部为小端序
+*/
+func intsetEntries(is []byte) ([]string, error) {
+	if len(is) < 8 {
+		return nil, fmt.Errorf("%w: intset too short", errRdbCorrupted)
+	}
+	enc := binary.LittleEndian.Uint32(is[0:4])
+	length := binary.LittleEndian.Uint32(is[4:8])
+	if (enc != 2 && enc != 4 && enc != 8) || uint64(len(is)-8) != uint64(enc)*uint64(length) {
+		return nil, fmt.Errorf("%w: invalid intset", errRdbCorrupted)
+	}
+	elems := make([]string, 0, length)
+	for p := 8; p < len(is); p += int(enc) {
+		var val int64
+		switch enc {
+		case 2:
+			val = int64(int16(binary.LittleEndian.Uint16(is[p:])))
+		case 4:
+			val = int64(int32(binary.LittleEndian.Uint32(is[p:])))
+		default:
+			val = int64(binary.LittleEndian.Uint64(is[p:]))
+		}
+		elems = append(elems, strconv.FormatInt(val, 10))
+	}
+	return elems, nil
+}
+
+/*
+ziplist: [4 字节总长度][4 字节尾节点偏移][2 字节节点数][节点...][0xff]
+节点: [前一个节点长度 1 或 5 字节][编码][数据]
+  - 00pppppp / 01pppppp qqqqqqqq / 10000000 + 4 字节大端序：字符串长度
+  - 0xc0 int16 / 0xd0 int32 / 0xe0 int64 / 0xf0 int24 / 0xfe int8（小端序）
+  - 1111xxxx：0 到 12 的小整数，值为 xxxx-1
+*/
+func ziplistEntries(zl []byte) ([]string, error) {
+	corrupted := fmt.Errorf("%w: invalid ziplist", errRdbCorrupted)
+	if len(zl) < 11 {
+		return nil, corrupted
+	}
+	var elems []string
+	p := 10
+	for {
+		if p >= len(zl) {
+			return nil, corrupted
+		}
+		if zl[p] == 0xff {
+			break
+		}
+		// 跳过前一个节点的长度
+		if zl[p] == 254 {
+			p += 5
+		} else {
+			p++
+		}
+		if p >= len(zl) {
+			return nil, corrupted
+		}
+		enc := zl[p]
+		var header, strlen int
+		isInt := true
+		var val int64
+		switch {
+		case enc>>6 == 0:
+			header, strlen, isInt = 1, int(enc&0x3f), false
+		case enc>>6 == 1:
+			if p+2 > len(zl) {
+				return nil, corrupted
+			}
+			header, strlen, isInt = 2, int(enc&0x3f)<<8|int(zl[p+1]), false
+		case enc == 0x80:
+			if p+5 > len(zl) {
+				return nil, corrupted
+			}
+			header, strlen, isInt = 5, int(binary.BigEndian.Uint32(zl[p+1:])), false
+		case enc == 0xc0:
+			header, strlen = 1, 2
+		case enc == 0xd0:
+			header, strlen = 1, 4
+		case enc == 0xe0:
+			header, strlen = 1, 8
+		case enc == 0xf0:
+			header, strlen = 1, 3
+		case enc == 0xfe:
+			header, strlen = 1, 1
+		case enc >= 0xf1 && enc <= 0xfd:
+			header, strlen, val = 1, 0, int64(enc&0x0f)-1
+		default:
+			return nil, corrupted
+		}
+		p += header
+		if strlen < 0 || p+strlen > len(zl) {
+			return nil, corrupted
+		}
+		data := zl[p : p+strlen]
+		p += strlen
+		if !isInt {
+			elems = append(elems, string(data))
+			continue
+		}
+		switch enc {
+		case 0xc0:
+			val = int64(int16(binary.LittleEndian.Uint16(data)))
+		case 0xd0:
+			val = int64(int32(binary.LittleEndian.Uint32(data)))
+		case 0xe0:
+			val = int64(binary.LittleEndian.Uint64(data))
+		case 0xf0:
+			val = int64(int32(uint32(data[0])<<8|uint32(data[1])<<16|uint32(data[2])<<24) >> 8)
+		case 0xfe:
+			val = int64(int8(data[0]))
+		}
+		elems = append(elems, strconv.FormatInt(val, 10))
+	}
+	return elems, nil
+}
+
+/*
+listpack: [4 字节总长度][2 字节元素个数][元素...][0xff]
+元素: [编码][数据][backlen]，backlen 是编码和数据的总长度，占 1 到 5 个字节
+  - 0xxxxxxx：7 位无符号整数
+  - 10xxxxxx：6 位长度的字符串
+  - 110xxxxx yyyyyyyy：13 位有符号整数
+  - 1110xxxx yyyyyyyy：12 位长度的字符串
+  - 0xf0 + 4 字节长度：32 位长度的字符串
+  - 0xf1 int16 / 0xf2 int24 / 0xf3 int32 / 0xf4 int64（小端序）
+*/
+func listpackEntries(lp []byte) ([]string, error) {
+	corrupted := fmt.Errorf("%w: invalid listpack", errRdbCorrupted)
+	if len(lp) < 7 {
+		return nil, corrupted
+	}
+	var elems []string
+	p := 6
+	for {
+		if p >= len(lp) {
+			return nil, corrupted
+		}
+		enc := lp[p]
+		if enc == 0xff {
+			break
+		}
+		var header, strlen int
+		isInt := true
+		var val int64
+		switch {
+		case enc&0x80 == 0:
+			header, val = 1, int64(enc&0x7f)
+		case enc&0xc0 == 0x80:
+			header, strlen, isInt = 1, int(enc&0x3f), false
+		case enc&0xe0 == 0xc0:
+			if p+2 > len(lp) {
+				return nil, corrupted
+			}
+			header = 2
+			uv := int64(enc&0x1f)<<8 | int64(lp[p+1])
+			if uv >= 1<<12 {
+				uv -= 1 << 13
+			}
+			val = uv
+		case enc&0xf0 == 0xe0:
+			if p+2 > len(lp) {
+				return nil, corrupted
+			}
+			header, strlen, isInt = 2, int(enc&0x0f)<<8|int(lp[p+1]), false
+		case enc == 0xf0:
+			if p+5 > len(lp) {
+				return nil, corrupted
+			}
+			header, strlen, isInt = 5, int(binary.LittleEndian.Uint32(lp[p+1:])), false
+		case enc == 0xf1:
+			header, strlen = 1, 2
+		case enc == 0xf2:
+			header, strlen = 1, 3
+		case enc == 0xf3:
+			header, strlen = 1, 4
+		case enc == 0xf4:
+			header, strlen = 1, 8
+		default:
+			return nil, corrupted
+		}
+		if strlen < 0 || p+header+strlen > len(lp) {
+			return nil, corrupted
+		}
+		data := lp[p+header : p+header+strlen]
+		entryLen := header + strlen
+		p += entryLen + listpackBacklenSize(entryLen)
+		if !isInt {
+			elems = append(elems, string(data))
+			continue
+		}
+		switch enc {
+		case 0xf1:
+			val = int64(int16(binary.LittleEndian.Uint16(data)))
+		case 0xf2:
+			val = int64(int32(uint32(data[0])<<8|uint32(data[1])<<16|uint32(data[2])<<24) >> 8)
+		case 0xf3:
+			val = int64(int32(binary.LittleEndian.Uint32(data)))
+		case 0xf4:
+			val = int64(binary.LittleEndian.Uint64(data))
+		}
+		elems = append(elems, strconv.FormatInt(val, 10))
+	}
+	return elems, nil
+}
+
+// backlen 每个字节保存 7 位
+func listpackBacklenSize(l int) int {
+	switch {
+	case l <= 127:
+		return 1
+	case l < 16383:
+		return 2
+	case l < 2097151:
+		return 3
+	case l < 268435455:
+		return 4
+	default:
+		return 5
+	}
+}
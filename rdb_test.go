@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func testRdbRoundTrip(t *testing.T, format string) {
+	newTestServer(t, `"appendonly":false,"save":"","rdbformat":"`+format+`"`)
+	c := newTestClient(t)
+	c.do("set", "str", "hello")
+	c.do("set", "int", "12345")
+	c.do("set", "ttl", "v", "ex", "1000")
+	c.do("rpush", "list", "a", "b", "c")
+	c.do("hset", "hash", "f1", "v1", "f2", "v2")
+	c.do("sadd", "set", "m1", "m2", "m3")
+	c.do("sadd", "intset", "1", "2", "3")
+	c.do("zadd", "zset", "1.5", "one", "2", "two")
+	c.do("select", "5")
+	c.do("set", "db5", "v")
+	if got := c.do("save"); got != "+OK\r\n" {
+		t.Fatalf("save: %q", got)
+	}
+
+	restartTestServer(t)
+	c = newTestClient(t)
+	cases := []struct {
+		args  []string
+		reply string
+	}{
+		{[]string{"get", "str"}, "$5\r\nhello\r\n"},
+		{[]string{"incr", "int"}, ":12346\r\n"},
+		{[]string{"lrange", "list", "0", "-1"}, "*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n"},
+		{[]string{"hget", "hash", "f1"}, "$2\r\nv1\r\n"},
+		{[]string{"scard", "set"}, ":3\r\n"},
+		{[]string{"sismember", "intset", "2"}, ":1\r\n"},
+		{[]string{"zscore", "zset", "one"}, "$3\r\n1.5\r\n"},
+		{[]string{"dbsize"}, ":8\r\n"},
+		{[]string{"select", "5"}, "+OK\r\n"},
+		{[]string{"get", "db5"}, "$1\r\nv\r\n"},
+	}
+	for _, tc := range cases {
+		if got := c.do(tc.args...); got != tc.reply {
+			t.Errorf("%v: got %q, want %q", tc.args, got, tc.reply)
+		}
+	}
+	c.do("select", "0")
+	if ttl := c.do("ttl", "ttl"); ttl == ":-1\r\n" || ttl == ":-2\r\n" {
+		t.Errorf("ttl lost after reload: %q", ttl)
+	}
+}
+
+func TestRdbRoundTripGodis(t *testing.T) {
+	testRdbRoundTrip(t, RDB_FORMAT_GODIS)
+}
+
+func TestRdbRoundTripRedis(t *testing.T) {
+	testRdbRoundTrip(t, RDB_FORMAT_REDIS)
+}
+
+// 加载之后哈希字段的过期索引要保留，否则主动过期找不到这个 key
+func TestRdbLoadHashFieldExpires(t *testing.T) {
+	newTestServer(t, `"appendonly":false,"save":""`)
+	c := newTestClient(t)
+	c.do("hset", "hash", "f1", "v1", "f2", "v2")
+	if got := c.do("hexpire", "hash", "1000", "fields", "1", "f1"); got != "*1\r\n:1\r\n" {
+		t.Fatalf("hexpire: %q", got)
+	}
+	c.do("save")
+
+	restartTestServer(t)
+	if server.db[0].hexpires.Find(CreateObject(GSTR, "hash")) == nil {
+		t.Fatal("hash field expire index lost after loading the RDB file")
+	}
+}
+
+// FLUSHALL 要丢弃正在进行的 BGSAVE，否则 BGSAVE 结束之后清空之前的数据又写回了 RDB 文件
+func TestFlushallKillsBackgroundSave(t *testing.T) {
+	newTestServer(t, `"appendonly":false,"save":"3600 1"`)
+	c := newTestClient(t)
+	for i := 0; i < 20000; i++ {
+		c.do("set", "key:"+strconv.Itoa(i), "value")
+	}
+	if got := c.do("bgsave"); got != "+Background saving started\r\n" {
+		t.Fatalf("bgsave: %q", got)
+	}
+	done := server.bgsavedone
+	if got := c.do("flushall"); got != "+OK\r\n" {
+		t.Fatalf("flushall: %q", got)
+	}
+	if server.bgsavedone != nil || server.dirtybeforebgsave != 0 {
+		t.Fatal("background save still in progress after FLUSHALL")
+	}
+	// 等待被丢弃的 goroutine 结束，它会删除自己的临时文件
+	<-done
+	if tmpfiles, _ := filepath.Glob("temp-*.rdb"); len(tmpfiles) != 0 {
+		t.Fatalf("temp files left: %v", tmpfiles)
+	}
+	if server.dirty < 0 {
+		t.Fatalf("negative dirty: %d", server.dirty)
+	}
+
+	restartTestServer(t)
+	c = newTestClient(t)
+	if got := c.do("dbsize"); got != ":0\r\n" {
+		t.Fatalf("dbsize after restart: %q", got)
+	}
+}
+
+// 文件中的长度超过上限时报告文件损坏，而不是按照这个长度分配内存
+func TestRdbLoadCorruptedLength(t *testing.T) {
+	newTestServer(t, `"appendonly":false,"save":""`)
+	huge64 := "\x81\x7f\xff\xff\xff\xff\xff\xff\xff"
+	cases := []struct {
+		name string
+		rdb  string
+	}{
+		{"godis key", "GODIS0003\x00\x80\xff\xff\xff\xff"},
+		{"godis value", "GODIS0003\x00\x01k\x80\xff\xff\xff\xff"},
+		{"redis string", "REDIS0011\x00" + huge64},
+		{"redis lzf clen", "REDIS0011\x00\x01k\xc3" + huge64 + "\x01"},
+		{"redis lzf ulen", "REDIS0011\x00\x01k\xc3\x01" + huge64},
+		{"redis hash length", "REDIS0011\x04\x01h" + huge64},
+	}
+	for _, tc := range cases {
+		if err := os.WriteFile("corrupted.rdb", []byte(tc.rdb), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := rdbLoad("corrupted.rdb"); !errors.Is(err, errRdbCorrupted) {
+			t.Errorf("%s: got %v, want %v", tc.name, err, errRdbCorrupted)
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bufio"
+	"io"
+)
+
+/*
+rio 是 RDB 读写的统一入口（参考 Redis 的 rio.c）：
+  - 所有经过 rio 的字节都会更新 CRC64 校验和
+  - processed 记录已经处理的字节数，加载出错时用来报告出错的偏移量
+*/
+type rio struct {
+	w         *bufio.Writer
+	r         *bufio.Reader
+	cksum     uint64
+	processed int64
+}
+
+func rioInitWithWriter(w io.Writer) *rio {
+	return &rio{w: bufio.NewWriter(w)}
+}
+
+func rioInitWithReader(r io.Reader) *rio {
+	return &rio{r: bufio.NewReader(r)}
+}
+
+func (r *rio) Write(p []byte) (int, error) {
+	n, err := r.w.Write(p)
+	r.cksum = crc64Update(r.cksum, p[:n])
+	r.processed += int64(n)
+	return n, err
+}
+
+// Read 总是读满 p，读不满说明文件被截断了
+func (r *rio) Read(p []byte) (int, error) {
+	n, err := io.ReadFull(r.r, p)
+	r.cksum = crc64Update(r.cksum, p[:n])
+	r.processed += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *rio) Flush() error {
+	return r.w.Flush()
+}
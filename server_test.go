@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+/*
+测试辅助函数：在临时目录中按照 main 的流程启动服务器（不进入事件循环），
+客户端通过 socketpair 连接，命令直接交给 ProcessCommand 执行，回复从另一端读取。
+*/
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+type testClient struct {
+	t    *testing.T
+	c    *GodisClient
+	peer int
+}
+
+// newTestServer 在新的临时目录中写入配置并启动服务器，cfg 是额外的 JSON 字段，例如 `"appendonly":false`
+func newTestServer(t *testing.T, cfg string) string {
+	t.Helper()
+	dir := t.TempDir()
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		stopTestServer()
+		os.Chdir(wd)
+	})
+	conf := `{"port":0`
+	if cfg != "" {
+		conf += "," + cfg
+	}
+	conf += "}"
+	if err := os.WriteFile(filepath.Join(dir, "config.json"), []byte(conf), 0644); err != nil {
+		t.Fatal(err)
+	}
+	startTestServer(t)
+	return dir
+}
+
+// 按照 main 的顺序：读取配置、初始化、从磁盘加载数据、打开 AOF 文件
+func startTestServer(t *testing.T) {
+	t.Helper()
+	config, err := LoadConfig("./config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server = GodisServer{}
+	if err := initServer(config); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadDataFromDisk(); err != nil {
+		t.Fatal(err)
+	}
+	if server.appendonly == 1 {
+		if err := openAppendOnlyFile(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// 等待后台保存结束，断开所有客户端，把 AOF 缓冲写入文件并关闭
+func stopTestServer() {
+	if server.aeLoop == nil {
+		return
+	}
+	waitBackgroundSave()
+	for _, c := range server.clients {
+		freeClient(c)
+	}
+	if server.appendonly == 1 {
+		flushAppendOnlyFile(true)
+	}
+	if server.appendfd != nil {
+		server.appendfd.Close()
+		server.appendfd = nil
+	}
+	Close(server.fd)
+	Close(server.aeLoop.fileEventFd)
+	server.aeLoop = nil
+}
+
+// 模拟进程重启：关闭当前服务器，用同一个目录中的配置和数据文件重新启动
+func restartTestServer(t *testing.T) {
+	t.Helper()
+	stopTestServer()
+	startTestServer(t)
+}
+
+// 阻塞等待正在进行的 BGSAVE 完成并处理结果，相当于 ServerCron 中的 checkBackgroundSaveDone
+func waitBackgroundSave() {
+	if server.bgsavedone != nil {
+		backgroundSaveDoneHandler(<-server.bgsavedone)
+	}
+}
+
+func newTestClient(t *testing.T) *testClient {
+	t.Helper()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := unix.SetNonblock(fds[1], true); err != nil {
+		t.Fatal(err)
+	}
+	c := CreateClient(fds[0])
+	server.clients[fds[0]] = c
+	t.Cleanup(func() { Close(fds[1]) })
+	return &testClient{t: t, c: c, peer: fds[1]}
+}
+
+// do 执行一条命令并返回原始的 RESP 回复，同一轮事件循环的 AOF 缓冲也会写入文件
+func (tc *testClient) do(args ...string) string {
+	tc.t.Helper()
+	tc.c.args = make([]*Gobj, len(args))
+	for i, arg := range args {
+		tc.c.args[i] = CreateObject(GSTR, arg)
+	}
+	ProcessCommand(tc.c)
+	beforeSleep(server.aeLoop)
+	return tc.read()
+}
+
+// read 读取已经产生的回复，例如阻塞的客户端被唤醒或者超时之后的回复
+func (tc *testClient) read() string {
+	tc.t.Helper()
+	SendReplyToClient(server.aeLoop, tc.c.fd, tc.c)
+	var reply []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := unix.Read(tc.peer, buf)
+		if n > 0 {
+			reply = append(reply, buf[:n]...)
+		}
+		if errors.Is(err, unix.EAGAIN) || n == 0 {
+			break
+		}
+		if err != nil {
+			tc.t.Fatal(err)
+		}
+	}
+	return string(reply)
+}
+
+// 读取 AOF 文件的全部内容
+func readAppendOnlyFile(t *testing.T) string {
+	t.Helper()
+	flushAppendOnlyFile(true)
+	buf, err := os.ReadFile(server.appendfilename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(buf)
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"math"
+	"sort"
+	"strings"
+)
+
 // TODO intset （整数集合）
 func SetTypeCreate() *Gobj {
 	o := CreateSetObject()
@@ -64,3 +70,529 @@ func (set *Gobj) setTypeMembers() []*Gobj {
 	// 返回所有成员
 	return members
 }
+
+/*
+随机返回集合中的一个成员（参考 Redis 的 setTypeRandomElement）。
+集合中删除大量成员之后哈希表会变得很稀疏，Dict.RandomGet 可能找不到非空的桶，这时重试即可。
+*/
+func (set *Gobj) setTypeRandomElement() *Gobj {
+	dict := set.Val_.(*Dict)
+	if dict.usedSize() == 0 {
+		return nil
+	}
+	for {
+		if e := dict.RandomGet(); e != nil {
+			return e.Key
+		}
+	}
+}
+
+// 复制一个集合，成员对象是共享的
+func (set *Gobj) setTypeDup() *Gobj {
+	dup := SetTypeCreate()
+	dup.setTypeAdd(set.setTypeMembers())
+	return dup
+}
+
+/*
+查找集合类型的 key，key 不存在时返回 nil。
+key 存在但不是集合时回复 WRONGTYPE 并返回 GODIS_ERR。
+*/
+func lookupSetOrReply(c *GodisClient, key *Gobj, write bool) (*Gobj, int8) {
+	var set *Gobj
+	if write {
+		set = lookupKeyWrite(c.db, key)
+	} else {
+		set = findKeyRead(c.db, key)
+	}
+	if set != nil && set.Type_ != GSET {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return nil, GODIS_ERR
+	}
+	return set, GODIS_OK
+}
+
+// 回复集合中的所有成员
+func addReplySetMembers(c *GodisClient, set *Gobj) {
+	members := set.setTypeMembers()
+	c.AddReplyArrayLen(int64(len(members)))
+	for _, member := range members {
+		c.AddReplyBulk(member)
+	}
+}
+
+/*
+*STORE 命令把结果写入 dstkey：结果为空时删除 dstkey，否则覆盖原来的值（过期时间也被清除）。
+返回结果集合的大小
+*/
+func storeSetResult(c *GodisClient, dstkey *Gobj, dstset *Gobj) int64 {
+	size := dstset.setTypeSize()
+	if size == 0 {
+		if dbDelete(c.db, dstkey) {
+			server.dirty++
+		}
+	} else {
+		setKey(c.db, dstkey, dstset)
+		server.dirty++
+	}
+	dstset.DecrRefCount()
+	return size
+}
+
+/*
+计算多个集合的交集：先按集合大小从小到大排序，遍历最小的集合，在其他集合中用 Dict.Find 查找。
+只要有一个 key 不存在，交集就是空集。limit 不为 0 时最多找出 limit 个成员，
+members 为 false 时只计数（SINTERCARD），不收集成员。
+*/
+func sinterGeneric(sets []*Gobj, limit int64, members bool) (int64, []*Gobj) {
+	for _, set := range sets {
+		if set == nil {
+			return 0, nil
+		}
+	}
+	sorted := make([]*Gobj, len(sets))
+	copy(sorted, sets)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].setTypeSize() < sorted[j].setTypeSize()
+	})
+
+	var cardinality int64
+	var result []*Gobj
+	iter := sorted[0].Val_.(*Dict).NewIterator(false)
+	for member, _, exists := iter.Next(); exists; member, _, exists = iter.Next() {
+		j := 1
+		for ; j < len(sorted); j++ {
+			if sorted[j].Val_.(*Dict).Find(member) == nil {
+				break
+			}
+		}
+		// 所有集合中都有这个成员
+		if j == len(sorted) {
+			cardinality++
+			if members {
+				result = append(result, member)
+			}
+			if limit != 0 && cardinality >= limit {
+				break
+			}
+		}
+	}
+	iter.Close()
+	return cardinality, result
+}
+
+// SINTER key [key ...] / SINTERSTORE destination key [key ...]
+func sinterGenericCommand(c *GodisClient, keys []*Gobj, dstkey *Gobj) {
+	sets := make([]*Gobj, len(keys))
+	for i, key := range keys {
+		set, ok := lookupSetOrReply(c, key, dstkey != nil)
+		if ok != GODIS_OK {
+			return
+		}
+		sets[i] = set
+	}
+	_, members := sinterGeneric(sets, 0, true)
+	if dstkey == nil {
+		c.AddReplyArrayLen(int64(len(members)))
+		for _, member := range members {
+			c.AddReplyBulk(member)
+		}
+		return
+	}
+	dstset := SetTypeCreate()
+	dstset.setTypeAdd(members)
+	c.AddReplyLong(storeSetResult(c, dstkey, dstset))
+}
+
+func sinterCommand(c *GodisClient) {
+	sinterGenericCommand(c, c.args[1:], nil)
+}
+
+func sinterstoreCommand(c *GodisClient) {
+	sinterGenericCommand(c, c.args[2:], c.args[1])
+}
+
+// SINTERCARD numkeys key [key ...] [LIMIT limit]
+func sintercardCommand(c *GodisClient) {
+	var numkeys, limit int64
+	if c.getLongFromObjectOrReply(c.args[1], &numkeys) != GODIS_OK {
+		return
+	}
+	if numkeys <= 0 {
+		c.AddReplyError("numkeys should be greater than 0")
+		return
+	}
+	if numkeys > int64(len(c.args)-2) {
+		c.AddReplyError("Number of keys can't be greater than number of args")
+		return
+	}
+	for j := 2 + int(numkeys); j < len(c.args); j++ {
+		opt := strings.ToLower(c.args[j].StrVal())
+		moreargs := len(c.args) - 1 - j
+		if opt == "limit" && moreargs > 0 {
+			j++
+			if c.getLongFromObjectOrReply(c.args[j], &limit) != GODIS_OK {
+				return
+			}
+			if limit < 0 {
+				c.AddReplyError("LIMIT can't be negative")
+				return
+			}
+		} else {
+			c.AddReplyError("syntax error")
+			return
+		}
+	}
+
+	keys := c.args[2 : 2+numkeys]
+	sets := make([]*Gobj, len(keys))
+	for i, key := range keys {
+		set, ok := lookupSetOrReply(c, key, false)
+		if ok != GODIS_OK {
+			return
+		}
+		sets[i] = set
+	}
+	cardinality, _ := sinterGeneric(sets, limit, false)
+	c.AddReplyLong(cardinality)
+}
+
+const (
+	SET_OP_UNION = iota
+	SET_OP_DIFF
+	SET_OP_INTER
+)
+
+/*
+SUNION / SDIFF 以及它们的 STORE 版本。SDIFF 有两种算法（和 Redis 一样根据预估的工作量选择）：
+ 1. 遍历第一个集合，只保留在其他集合中都找不到的成员，复杂度 O(N*M)，N 是第一个集合的大小，M 是集合数量
+ 2. 复制第一个集合，再从中删除其他集合的所有成员，复杂度 O(N)，N 是所有集合的大小之和
+*/
+func sunionDiffGenericCommand(c *GodisClient, keys []*Gobj, dstkey *Gobj, op int) {
+	sets := make([]*Gobj, len(keys))
+	for i, key := range keys {
+		set, ok := lookupSetOrReply(c, key, dstkey != nil)
+		if ok != GODIS_OK {
+			return
+		}
+		sets[i] = set
+	}
+
+	diffAlgo := 1
+	if op == SET_OP_DIFF && sets[0] != nil {
+		var algoOneWork, algoTwoWork int64
+		for _, set := range sets {
+			if set == nil {
+				continue
+			}
+			algoOneWork += sets[0].setTypeSize()
+			algoTwoWork += set.setTypeSize()
+		}
+		/* Algorithm 1 has better constant times and performs less operations
+		 * if there are elements in common. Give it some advantage. */
+		algoOneWork /= 2
+		if algoOneWork > algoTwoWork {
+			diffAlgo = 2
+		}
+		if diffAlgo == 1 && len(sets) > 1 {
+			/* With algorithm 1 it is better to order the sets to subtract
+			 * by decreasing size, so that we are more likely to find
+			 * duplicated elements ASAP. */
+			rest := sets[1:]
+			sort.SliceStable(rest, func(i, j int) bool {
+				return rest[i].setTypeSizeOrZero() > rest[j].setTypeSizeOrZero()
+			})
+		}
+	}
+
+	dstset := SetTypeCreate()
+	dstdict := dstset.Val_.(*Dict)
+	if op == SET_OP_UNION {
+		for _, set := range sets {
+			if set != nil {
+				dstset.setTypeAdd(set.setTypeMembers())
+			}
+		}
+	} else if sets[0] == nil {
+		// 第一个集合不存在，差集为空集
+	} else if diffAlgo == 1 {
+		iter := sets[0].Val_.(*Dict).NewIterator(false)
+		for member, _, exists := iter.Next(); exists; member, _, exists = iter.Next() {
+			j := 1
+			for ; j < len(sets); j++ {
+				if sets[j] == nil {
+					continue
+				}
+				if sets[j].Val_.(*Dict).Find(member) != nil {
+					break
+				}
+			}
+			if j == len(sets) {
+				dstdict.Add(member, nil)
+			}
+		}
+		iter.Close()
+	} else {
+		dstset.setTypeAdd(sets[0].setTypeMembers())
+		for _, set := range sets[1:] {
+			if set != nil {
+				dstset.setTypeRemove(set.setTypeMembers())
+			}
+			/* Exit if result set is empty as any additional removal
+			 * of elements will have no effect. */
+			if dstset.setTypeSize() == 0 {
+				break
+			}
+		}
+	}
+
+	if dstkey == nil {
+		addReplySetMembers(c, dstset)
+		dstset.DecrRefCount()
+		return
+	}
+	c.AddReplyLong(storeSetResult(c, dstkey, dstset))
+}
+
+// 不存在的 key 看作空集
+func (set *Gobj) setTypeSizeOrZero() int64 {
+	if set == nil {
+		return 0
+	}
+	return set.setTypeSize()
+}
+
+func sunionCommand(c *GodisClient) {
+	sunionDiffGenericCommand(c, c.args[1:], nil, SET_OP_UNION)
+}
+
+func sunionstoreCommand(c *GodisClient) {
+	sunionDiffGenericCommand(c, c.args[2:], c.args[1], SET_OP_UNION)
+}
+
+func sdiffCommand(c *GodisClient) {
+	sunionDiffGenericCommand(c, c.args[1:], nil, SET_OP_DIFF)
+}
+
+func sdiffstoreCommand(c *GodisClient) {
+	sunionDiffGenericCommand(c, c.args[2:], c.args[1], SET_OP_DIFF)
+}
+
+// SMOVE source destination member：成功移动时回复 1，source 中没有这个成员时回复 0
+func smoveCommand(c *GodisClient) {
+	srcset, ok := lookupSetOrReply(c, c.args[1], true)
+	if ok != GODIS_OK {
+		return
+	}
+	dstset, ok := lookupSetOrReply(c, c.args[2], true)
+	if ok != GODIS_OK {
+		return
+	}
+	member := c.args[3]
+	if srcset == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	/* If srcset and dstset are equal, SMOVE is a no-op */
+	if srcset == dstset {
+		c.AddReplyInt8(srcset.setTypeIsMember(member))
+		return
+	}
+	/* If the element cannot be removed from the src set, return 0. */
+	if srcset.setTypeRemove([]*Gobj{member}) == 0 {
+		c.AddReplyInt8(0)
+		return
+	}
+	/* Remove the src set from the database when empty */
+	if srcset.setTypeSize() == 0 {
+		dbDelete(c.db, c.args[1])
+	}
+	/* Create the destination set when it doesn't exist */
+	if dstset == nil {
+		dstset = SetTypeCreate()
+		c.db.data.Set(c.args[2], dstset)
+		dstset.DecrRefCount()
+	}
+	dstset.setTypeAdd([]*Gobj{member})
+	server.dirty++
+	c.AddReplyInt8(1)
+}
+
+// SMISMEMBER key member [member ...]：对每个成员回复 1 或 0
+func smismemberCommand(c *GodisClient) {
+	set, ok := lookupSetOrReply(c, c.args[1], false)
+	if ok != GODIS_OK {
+		return
+	}
+	c.AddReplyArrayLen(int64(len(c.args) - 2))
+	for _, member := range c.args[2:] {
+		if set == nil {
+			c.AddReplyInt8(0)
+		} else {
+			c.AddReplyInt8(set.setTypeIsMember(member))
+		}
+	}
+}
+
+/*
+SPOP key [count]：随机删除并返回成员。
+弹出的成员是随机的，重放 AOF 时结果会不一样，所以改写成 SREM key member [member ...] 写入 AOF。
+*/
+func spopCommand(c *GodisClient) {
+	if len(c.args) > 3 {
+		c.AddReplyError("syntax error")
+		return
+	}
+	hascount := len(c.args) == 3
+	count := int64(1)
+	if hascount {
+		if c.getLongFromObjectOrReply(c.args[2], &count) != GODIS_OK {
+			return
+		}
+		if count < 0 {
+			c.AddReplyError("value is out of range, must be positive")
+			return
+		}
+	}
+	key := c.args[1]
+	set, ok := lookupSetOrReply(c, key, true)
+	if ok != GODIS_OK {
+		return
+	}
+	if set == nil {
+		if hascount {
+			c.AddReplyArrayLen(0)
+		} else {
+			c.AddReplyStr("$-1\r\n")
+		}
+		return
+	}
+	if hascount && count == 0 {
+		c.AddReplyArrayLen(0)
+		return
+	}
+
+	if count > set.setTypeSize() {
+		count = set.setTypeSize()
+	}
+	popped := make([]*Gobj, 0, count)
+	for i := int64(0); i < count; i++ {
+		member := set.setTypeRandomElement()
+		// 先持有成员，从集合中删除时不会被释放
+		member.IncrRefCount()
+		set.setTypeRemove([]*Gobj{member})
+		popped = append(popped, member)
+	}
+	if set.setTypeSize() == 0 {
+		dbDelete(c.db, key)
+	}
+
+	if hascount {
+		c.AddReplyArrayLen(int64(len(popped)))
+	}
+	for _, member := range popped {
+		c.AddReplyBulk(member)
+	}
+	rewriteClientCommandVector(c, append([]*Gobj{CreateObject(GSTR, "SREM"), key}, popped...)...)
+	for _, member := range popped {
+		member.DecrRefCount()
+	}
+	server.dirty++
+}
+
+/*
+SRANDMEMBER key [count]：随机返回成员，不删除。
+  - count 为正数：返回最多 count 个不重复的成员
+  - count 为负数：返回 -count 个成员，同一个成员可能出现多次
+*/
+func srandmemberCommand(c *GodisClient) {
+	if len(c.args) > 3 {
+		c.AddReplyError("syntax error")
+		return
+	}
+	hascount := len(c.args) == 3
+	var count int64 = 1
+	uniq := true
+	if hascount {
+		if c.getLongFromObjectOrReply(c.args[2], &count) != GODIS_OK {
+			return
+		}
+		if count == math.MinInt64 {
+			c.AddReplyError("value is out of range")
+			return
+		}
+		if count < 0 {
+			count = -count
+			uniq = false
+		}
+	}
+	set, ok := lookupSetOrReply(c, c.args[1], false)
+	if ok != GODIS_OK {
+		return
+	}
+	if set == nil {
+		if hascount {
+			c.AddReplyArrayLen(0)
+		} else {
+			c.AddReplyStr("$-1\r\n")
+		}
+		return
+	}
+	if !hascount {
+		c.AddReplyBulk(set.setTypeRandomElement())
+		return
+	}
+	if count == 0 {
+		c.AddReplyArrayLen(0)
+		return
+	}
+
+	/* CASE 1: The count was negative, so the extraction method is just:
+	 * "return N random elements" sampling the whole set every time.
+	 * This case is trivial and can be served without auxiliary data
+	 * structures. */
+	if !uniq {
+		c.AddReplyArrayLen(count)
+		for ; count > 0; count-- {
+			c.AddReplyBulk(set.setTypeRandomElement())
+		}
+		return
+	}
+
+	/* CASE 2:
+	 * The number of requested elements is greater than the number of
+	 * elements inside the set: simply return the whole set. */
+	size := set.setTypeSize()
+	if count >= size {
+		addReplySetMembers(c, set)
+		return
+	}
+
+	/* CASE 3:
+	 * The number of elements inside the set is not greater than
+	 * 3 times the number of requested elements. In this case we create
+	 * a set from scratch with all the elements, and subtract random
+	 * elements to reach the requested number of elements.
+	 *
+	 * This is done because if the number of requested elements is just
+	 * a bit less than the number of elements in the set, the natural approach
+	 * used into CASE 4 is highly inefficient. */
+	var result *Gobj
+	if count*3 > size {
+		result = set.setTypeDup()
+		for result.setTypeSize() > count {
+			result.setTypeRemove([]*Gobj{result.setTypeRandomElement()})
+		}
+	} else {
+		/* CASE 4: We have a big set compared to the requested number of elements.
+		 * In this case we can simply get random elements from the set and add
+		 * to the temporary set, trying to eventually get enough unique elements
+		 * to reach the specified count. */
+		result = SetTypeCreate()
+		for result.setTypeSize() < count {
+			result.setTypeAdd([]*Gobj{set.setTypeRandomElement()})
+		}
+	}
+	addReplySetMembers(c, result)
+	result.DecrRefCount()
+}
@@ -0,0 +1,431 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+/*
+字符串命令（参考 Redis 的 t_string.c）。
+字符串对象有整数编码（GODIS_ENCODING_INT）和原始字符串（GODIS_ENCODING_RAW）两种，
+只读的命令统一通过 StrVal() 读取；修改值的命令总是创建一个新的对象替换原来的值，
+原来的对象可能还在某个客户端的回复链表中等待发送，不能直接修改。
+*/
+
+// 字符串的最大长度（参考 Redis 的 proto-max-bulk-len）
+const PROTO_MAX_BULK_LEN = 512 * 1024 * 1024
+
+// SET 和 GETEX 的选项
+const (
+	OBJ_SET_NX  = 1 << iota /* 只在 key 不存在时设置 */
+	OBJ_SET_XX              /* 只在 key 已经存在时设置 */
+	OBJ_EX                  /* 以秒为单位的相对过期时间 */
+	OBJ_PX                  /* 以毫秒为单位的相对过期时间 */
+	OBJ_KEEPTTL             /* 保留原来的过期时间 */
+	OBJ_SET_GET             /* 返回原来的值 */
+	OBJ_EXAT                /* 以秒为单位的过期时间戳 */
+	OBJ_PXAT                /* 以毫秒为单位的过期时间戳 */
+	OBJ_PERSIST             /* 删除过期时间 */
+)
+
+const (
+	COMMAND_GET = 0
+	COMMAND_SET = 1
+)
+
+func checkStringLength(c *GodisClient, size int64) int8 {
+	if size > PROTO_MAX_BULK_LEN {
+		c.AddReplyError("string exceeds maximum allowed size (proto-max-bulk-len)")
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+/*
+解析 SET key value 或 GETEX key 之后的选项：
+  - SET:   [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT timestamp | PXAT milliseconds-timestamp | KEEPTTL]
+  - GETEX: [EX seconds | PX milliseconds | EXAT timestamp | PXAT milliseconds-timestamp | PERSIST]
+
+互斥的选项同时出现时返回语法错误，同一个选项重复出现时以最后一个为准。
+过期时间的参数通过 expire 返回，unit 是它的单位。
+*/
+func parseExtendedStringArgumentsOrReply(c *GodisClient, flags *int, unit *int, expire **Gobj, commandType int) int8 {
+	j := 2
+	if commandType == COMMAND_SET {
+		j = 3
+	}
+	for ; j < len(c.args); j++ {
+		opt := strings.ToLower(c.args[j].StrVal())
+		var next *Gobj
+		if j+1 < len(c.args) {
+			next = c.args[j+1]
+		}
+		if opt == "nx" && *flags&OBJ_SET_XX == 0 && commandType == COMMAND_SET {
+			*flags |= OBJ_SET_NX
+		} else if opt == "xx" && *flags&OBJ_SET_NX == 0 && commandType == COMMAND_SET {
+			*flags |= OBJ_SET_XX
+		} else if opt == "get" && commandType == COMMAND_SET {
+			*flags |= OBJ_SET_GET
+		} else if opt == "keepttl" && *flags&(OBJ_PERSIST|OBJ_EX|OBJ_EXAT|OBJ_PX|OBJ_PXAT) == 0 && commandType == COMMAND_SET {
+			*flags |= OBJ_KEEPTTL
+		} else if opt == "persist" && *flags&(OBJ_EX|OBJ_EXAT|OBJ_PX|OBJ_PXAT|OBJ_KEEPTTL) == 0 && commandType == COMMAND_GET {
+			*flags |= OBJ_PERSIST
+		} else if opt == "ex" && *flags&(OBJ_KEEPTTL|OBJ_PERSIST|OBJ_EXAT|OBJ_PX|OBJ_PXAT) == 0 && next != nil {
+			*flags |= OBJ_EX
+			*expire = next
+			j++
+		} else if opt == "px" && *flags&(OBJ_KEEPTTL|OBJ_PERSIST|OBJ_EX|OBJ_EXAT|OBJ_PXAT) == 0 && next != nil {
+			*flags |= OBJ_PX
+			*unit = UNIT_MILLISECONDS
+			*expire = next
+			j++
+		} else if opt == "exat" && *flags&(OBJ_KEEPTTL|OBJ_PERSIST|OBJ_EX|OBJ_PX|OBJ_PXAT) == 0 && next != nil {
+			*flags |= OBJ_EXAT
+			*expire = next
+			j++
+		} else if opt == "pxat" && *flags&(OBJ_KEEPTTL|OBJ_PERSIST|OBJ_EX|OBJ_EXAT|OBJ_PX) == 0 && next != nil {
+			*flags |= OBJ_PXAT
+			*unit = UNIT_MILLISECONDS
+			*expire = next
+			j++
+		} else {
+			c.AddReplyError("syntax error")
+			return GODIS_ERR
+		}
+	}
+	return GODIS_OK
+}
+
+// 把 EX / PX / EXAT / PXAT 的参数换算成绝对的毫秒时间戳，过期时间必须是正数并且换算时不能溢出
+func getExpireMillisecondsOrReply(c *GodisClient, expire *Gobj, flags int, unit int, milliseconds *int64) int8 {
+	if c.getLongFromObjectOrReply(expire, milliseconds) != GODIS_OK {
+		return GODIS_ERR
+	}
+	invalid := *milliseconds <= 0 || (unit == UNIT_SECONDS && *milliseconds > math.MaxInt64/1000)
+	if !invalid {
+		if unit == UNIT_SECONDS {
+			*milliseconds *= 1000
+		}
+		if flags&(OBJ_EX|OBJ_PX) != 0 {
+			now := GetMsTime()
+			invalid = *milliseconds > math.MaxInt64-now
+			*milliseconds += now
+		}
+	}
+	if invalid {
+		c.AddReplyError(fmt.Sprintf("invalid expire time in '%s' command", strings.ToLower(c.args[0].StrVal())))
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+// GET 系列命令的通用部分：回复 key 的值，key 不存在时回复 nil，类型不对时返回 GODIS_ERR
+func getGenericCommand(c *GodisClient) int8 {
+	o := findKeyRead(c.db, c.args[1])
+	if o == nil {
+		c.AddReplyStr("$-1\r\n")
+		return GODIS_OK
+	}
+	if o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return GODIS_ERR
+	}
+	c.AddReplyBulk(o)
+	return GODIS_OK
+}
+
+/*
+SET / SETNX / SETEX / PSETEX 的通用实现，值和过期时间在同一个命令中设置。
+  - okReply:    设置成功时的回复，为空时回复 +OK
+  - abortReply: 因为 NX / XX 没有设置时的回复，为空时回复 nil
+
+带 GET 选项时总是回复原来的值。写入 AOF 时过期时间转换为 PEXPIREAT（见 FeedAppendOnlyFile）。
+*/
+func setGenericCommand(c *GodisClient, flags int, key *Gobj, val *Gobj, expire *Gobj, unit int, okReply string, abortReply string) {
+	var milliseconds int64
+	if expire != nil && getExpireMillisecondsOrReply(c, expire, flags, unit, &milliseconds) != GODIS_OK {
+		return
+	}
+	if flags&OBJ_SET_GET != 0 {
+		if getGenericCommand(c) == GODIS_ERR {
+			return
+		}
+	}
+	found := lookupKeyWrite(c.db, key) != nil
+	if (flags&OBJ_SET_NX != 0 && found) || (flags&OBJ_SET_XX != 0 && !found) {
+		if flags&OBJ_SET_GET == 0 {
+			if abortReply == "" {
+				abortReply = "$-1\r\n"
+			}
+			c.AddReplyStr(abortReply)
+		}
+		return
+	}
+	if flags&OBJ_KEEPTTL != 0 {
+		dbOverwrite(c.db, key, val)
+	} else {
+		setKey(c.db, key, val)
+	}
+	server.dirty++
+	if expire != nil {
+		// 过期时间已经过去了，直接删除 key
+		if milliseconds <= GetMsTime() {
+			dbDelete(c.db, key)
+		} else {
+			setExpire(c.db, key, milliseconds)
+		}
+	}
+	if flags&OBJ_SET_GET == 0 {
+		if okReply == "" {
+			okReply = "+OK\r\n"
+		}
+		c.AddReplyStr(okReply)
+	}
+}
+
+// SET key value [NX | XX] [GET] [EX seconds | PX milliseconds | EXAT timestamp | PXAT milliseconds-timestamp | KEEPTTL]
+func setCommand(c *GodisClient) {
+	var expire *Gobj
+	unit := UNIT_SECONDS
+	flags := 0
+	if parseExtendedStringArgumentsOrReply(c, &flags, &unit, &expire, COMMAND_SET) != GODIS_OK {
+		return
+	}
+	setGenericCommand(c, flags, c.args[1], c.args[2], expire, unit, "", "")
+}
+
+func setnxCommand(c *GodisClient) {
+	setGenericCommand(c, OBJ_SET_NX, c.args[1], c.args[2], nil, 0, ":1\r\n", ":0\r\n")
+}
+
+func setexCommand(c *GodisClient) {
+	setGenericCommand(c, OBJ_EX, c.args[1], c.args[3], c.args[2], UNIT_SECONDS, "", "")
+}
+
+func psetexCommand(c *GodisClient) {
+	setGenericCommand(c, OBJ_PX, c.args[1], c.args[3], c.args[2], UNIT_MILLISECONDS, "", "")
+}
+
+// GETSET key value：设置新值并返回旧值，和 SET 一样会清除过期时间
+func getsetCommand(c *GodisClient) {
+	if getGenericCommand(c) == GODIS_ERR {
+		return
+	}
+	setKey(c.db, c.args[1], c.args[2])
+	server.dirty++
+}
+
+func getdelCommand(c *GodisClient) {
+	if getGenericCommand(c) == GODIS_ERR {
+		return
+	}
+	if dbDelete(c.db, c.args[1]) {
+		server.dirty++
+	}
+}
+
+/*
+GETEX key [EX seconds | PX milliseconds | EXAT timestamp | PXAT milliseconds-timestamp | PERSIST]
+返回 key 的值并修改它的过期时间。写入 AOF 时转换为 PEXPIREAT 或 PERSIST（见 FeedAppendOnlyFile）。
+*/
+func getexCommand(c *GodisClient) {
+	key := c.args[1]
+	var expire *Gobj
+	unit := UNIT_SECONDS
+	flags := 0
+	if parseExtendedStringArgumentsOrReply(c, &flags, &unit, &expire, COMMAND_GET) != GODIS_OK {
+		return
+	}
+	var milliseconds int64
+	if expire != nil && getExpireMillisecondsOrReply(c, expire, flags, unit, &milliseconds) != GODIS_OK {
+		return
+	}
+	o := findKeyRead(c.db, key)
+	if o == nil {
+		c.AddReplyStr("$-1\r\n")
+		return
+	}
+	if o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	c.AddReplyBulk(o)
+	if expire != nil {
+		// 过期时间已经过去了，直接删除 key
+		if milliseconds <= GetMsTime() {
+			dbDelete(c.db, key)
+		} else {
+			setExpire(c.db, key, milliseconds)
+		}
+		server.dirty++
+	} else if flags&OBJ_PERSIST != 0 {
+		if removeExpire(c.db, key) {
+			server.dirty++
+		}
+	}
+}
+
+func appendCommand(c *GodisClient) {
+	key := c.args[1]
+	var totlen int64
+	o := lookupKeyWrite(c.db, key)
+	if o == nil {
+		// key 不存在时等同于 SET
+		setKey(c.db, key, c.args[2])
+		totlen = int64(len(c.args[2].StrVal()))
+	} else {
+		if o.Type_ != GSTR {
+			c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return
+		}
+		str := o.StrVal()
+		appendStr := c.args[2].StrVal()
+		totlen = int64(len(str) + len(appendStr))
+		if checkStringLength(c, totlen) != GODIS_OK {
+			return
+		}
+		newObj := CreateObject(GSTR, str+appendStr)
+		dbOverwrite(c.db, key, newObj)
+		newObj.DecrRefCount()
+	}
+	server.dirty++
+	c.AddReplyLong(totlen)
+}
+
+func strlenCommand(c *GodisClient) {
+	o := findKeyRead(c.db, c.args[1])
+	if o == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	c.AddReplyLong(int64(len(o.StrVal())))
+}
+
+// GETRANGE key start end：start 和 end 都包含在内，负数表示从末尾开始计算
+func getrangeCommand(c *GodisClient) {
+	var start, end int64
+	if c.getLongFromObjectOrReply(c.args[2], &start) != GODIS_OK {
+		return
+	}
+	if c.getLongFromObjectOrReply(c.args[3], &end) != GODIS_OK {
+		return
+	}
+	o := findKeyRead(c.db, c.args[1])
+	if o == nil {
+		c.AddReplyStr("$0" + CRLF + CRLF)
+		return
+	}
+	if o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	str := o.StrVal()
+	strlen := int64(len(str))
+
+	// 转换负数下标
+	if start < 0 && end < 0 && start > end {
+		c.AddReplyStr("$0" + CRLF + CRLF)
+		return
+	}
+	if start < 0 {
+		start = strlen + start
+	}
+	if end < 0 {
+		end = strlen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= strlen {
+		end = strlen - 1
+	}
+	if strlen == 0 || start > end {
+		c.AddReplyStr("$0" + CRLF + CRLF)
+		return
+	}
+	c.AddReplyBulk(CreateObject(GSTR, str[start:end+1]))
+}
+
+// SETRANGE key offset value：从 offset 开始覆盖，原来的字符串不够长时用 0 字节补齐
+func setrangeCommand(c *GodisClient) {
+	key := c.args[1]
+	var offset int64
+	if c.getLongFromObjectOrReply(c.args[2], &offset) != GODIS_OK {
+		return
+	}
+	if offset < 0 {
+		c.AddReplyError("offset is out of range")
+		return
+	}
+	value := c.args[3].StrVal()
+	var str string
+	o := lookupKeyWrite(c.db, key)
+	if o == nil {
+		// value 为空时不创建 key
+		if len(value) == 0 {
+			c.AddReplyInt8(0)
+			return
+		}
+	} else {
+		if o.Type_ != GSTR {
+			c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return
+		}
+		str = o.StrVal()
+		if len(value) == 0 {
+			c.AddReplyLong(int64(len(str)))
+			return
+		}
+	}
+	if checkStringLength(c, offset+int64(len(value))) != GODIS_OK {
+		return
+	}
+	size := int64(len(str))
+	if offset+int64(len(value)) > size {
+		size = offset + int64(len(value))
+	}
+	buf := make([]byte, size)
+	copy(buf, str)
+	copy(buf[offset:], value)
+	newObj := CreateObject(GSTR, string(buf))
+	dbOverwrite(c.db, key, newObj)
+	newObj.DecrRefCount()
+	server.dirty++
+	c.AddReplyLong(size)
+}
+
+// INCRBYFLOAT key increment：结果以最短的十进制形式保存为原始字符串
+func incrbyfloatCommand(c *GodisClient) {
+	key := c.args[1]
+	o := lookupKeyWrite(c.db, key)
+	if o != nil && o.Type_ != GSTR {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	var value, incr float64
+	if c.getDoubleFromObjectOrReply(o, &value) != GODIS_OK {
+		return
+	}
+	if c.getDoubleFromObjectOrReply(c.args[2], &incr) != GODIS_OK {
+		return
+	}
+	value += incr
+	if math.IsNaN(value) || math.IsInf(value, 0) {
+		c.AddReplyError("increment would produce NaN or Infinity")
+		return
+	}
+	newObj := CreateObject(GSTR, strconv.FormatFloat(value, 'f', -1, 64))
+	dbOverwrite(c.db, key, newObj)
+	newObj.DecrRefCount()
+	server.dirty++
+	c.AddReplyBulk(newObj)
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAppendMissingKey(t *testing.T) {
+	newTestServer(t, `"appendonly":false,"save":""`)
+	c := newTestClient(t)
+	if got := c.do("append", "k", "abc"); got != ":3\r\n" {
+		t.Fatalf("append: %q", got)
+	}
+	if got := c.do("append", "k", "de"); got != ":5\r\n" {
+		t.Fatalf("append: %q", got)
+	}
+	if got := c.do("get", "k"); got != "$5\r\nabcde\r\n" {
+		t.Fatalf("get: %q", got)
+	}
+	if got := c.do("ttl", "k"); got != ":-1\r\n" {
+		t.Fatalf("ttl: %q", got)
+	}
+}
@@ -2,30 +2,31 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
-	"os"
 	"strconv"
 )
 
-func fwriteBulkLongLong(fp *os.File, data int64, l int) int8 {
-	s := fmt.Sprintf("$%v\r\n%s\r\n", l, strconv.FormatInt(data, 10))
-	if _, err := fp.WriteString(s); err != nil {
+func fwriteBulkLongLong(fp io.Writer, data int64) int8 {
+	str := strconv.FormatInt(data, 10)
+	s := fmt.Sprintf("$%v\r\n%s\r\n", len(str), str)
+	if _, err := io.WriteString(fp, s); err != nil {
 		log.Printf("Error writing long long to file: %v\n", err)
 		return GODIS_ERR
 	}
 	return GODIS_OK
 }
 
-func fwriteBulkString(fp *os.File, s string) int8 {
+func fwriteBulkString(fp io.Writer, s string) int8 {
 	s = "$" + strconv.Itoa(len(s)) + CRLF + s + CRLF
-	if _, err := fp.WriteString(s); err != nil {
+	if _, err := io.WriteString(fp, s); err != nil {
 		log.Printf("Error writing bulk string to file: %v\n", err)
 		return GODIS_ERR
 	}
 	return GODIS_OK
 }
 
-func fwriteBulkObject(fp *os.File, o *Gobj) int8 {
+func fwriteBulkObject(fp io.Writer, o *Gobj) int8 {
 	switch o.encoding {
 	case GODIS_ENCODING_INT:
 		// 把 整形转为 字符串 在写到AOF文件中
@@ -37,9 +38,9 @@ func fwriteBulkObject(fp *os.File, o *Gobj) int8 {
 		return fwriteBulkString(fp, o.StrVal())
 	}
 }
-func fwriteBulkCount(fp *os.File, char byte, count int) int8 {
+func fwriteBulkCount(fp io.Writer, char byte, count int) int8 {
 	s := fmt.Sprintf("%c%v\r\n", char, count)
-	if _, err := fp.WriteString(s); err != nil {
+	if _, err := io.WriteString(fp, s); err != nil {
 		log.Printf("Error writing bulk count to file: %v\n", err)
 		return GODIS_ERR
 	}
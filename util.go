@@ -0,0 +1,132 @@
+package main
+
+/*
+glob 风格的模式匹配（参考 Redis 的 stringmatchlen），支持：
+  - *       匹配任意长度的字符串
+  - ?       匹配任意一个字符
+  - [abc]   匹配括号中的任意一个字符，[^abc] 取反，[a-z] 匹配范围
+  - \x      转义，匹配字符 x 本身
+*/
+func stringMatchLen(pattern, str string, nocase bool) bool {
+	skipLongerMatches := false
+	return stringMatchLenImpl(pattern, str, nocase, &skipLongerMatches, 0)
+}
+
+/*
+skipLongerMatches：某个 * 之后的部分在 str 的任何后缀上都匹配不了时，
+更前面的 * 多吃掉一些字符也不可能匹配，直接返回，避免 "a*a*a*a*b" 这样的模式导致指数级回溯。
+*/
+func stringMatchLenImpl(pattern, str string, nocase bool, skipLongerMatches *bool, nesting int) bool {
+	// 防止嵌套过深导致栈溢出
+	if nesting > 1000 {
+		return false
+	}
+	for len(pattern) > 0 && len(str) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 1 && pattern[1] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 1 {
+				return true /* match */
+			}
+			for len(str) > 0 {
+				if stringMatchLenImpl(pattern[1:], str, nocase, skipLongerMatches, nesting+1) {
+					return true /* match */
+				}
+				if *skipLongerMatches {
+					return false /* no match */
+				}
+				str = str[1:]
+			}
+			/* There was no match for the rest of the pattern starting
+			 * from anywhere in the rest of the string. If there were
+			 * any '*' earlier in the pattern, we can terminate the
+			 * search early without trying to match them to longer
+			 * substrings. This is because a longer match for the
+			 * earlier part of the pattern would require the rest of the
+			 * pattern to match starting later in the string, and we
+			 * have just determined that there is no match for the rest
+			 * of the pattern starting from anywhere in the current
+			 * string. */
+			*skipLongerMatches = true
+			return false /* no match */
+		case '?':
+			str = str[1:]
+		case '[':
+			pattern = pattern[1:]
+			not := len(pattern) > 0 && pattern[0] == '^'
+			if not {
+				pattern = pattern[1:]
+			}
+			match := false
+			for len(pattern) > 0 {
+				if pattern[0] == '\\' && len(pattern) >= 2 {
+					pattern = pattern[1:]
+					if pattern[0] == str[0] {
+						match = true
+					}
+				} else if pattern[0] == ']' {
+					break
+				} else if len(pattern) >= 3 && pattern[1] == '-' {
+					start, end, c := pattern[0], pattern[2], str[0]
+					if start > end {
+						start, end = end, start
+					}
+					if nocase {
+						start, end, c = toLower(start), toLower(end), toLower(c)
+					}
+					pattern = pattern[2:]
+					if c >= start && c <= end {
+						match = true
+					}
+				} else if charEqual(pattern[0], str[0], nocase) {
+					match = true
+				}
+				pattern = pattern[1:]
+			}
+			// 没有闭合的 ']' 时，把模式的结尾当作 ']'
+			if not {
+				match = !match
+			}
+			if !match {
+				return false /* no match */
+			}
+			str = str[1:]
+		case '\\':
+			if len(pattern) >= 2 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if !charEqual(pattern[0], str[0], nocase) {
+				return false /* no match */
+			}
+			str = str[1:]
+		}
+		if len(pattern) > 0 {
+			pattern = pattern[1:]
+		}
+		if len(str) == 0 {
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			break
+		}
+	}
+	return len(pattern) == 0 && len(str) == 0
+}
+
+func charEqual(a, b byte, nocase bool) bool {
+	if nocase {
+		return toLower(a) == toLower(b)
+	}
+	return a == b
+}
+
+func toLower(c byte) byte {
+	if c >= 'A' && c <= 'Z' {
+		return c + 'a' - 'A'
+	}
+	return c
+}
@@ -2,7 +2,11 @@ package main
 
 import (
 	"errors"
+	"fmt"
+	"math"
 	"math/rand"
+	"sort"
+	"strings"
 )
 
 /*
@@ -80,7 +84,7 @@ func (zsl *zskiplist) zslInsert(score float64, obj *Gobj) *zskiplistNode {
 		}
 		for x.level[i].forward != nil &&
 			(x.level[i].forward.score < score ||
-				x.level[i].forward.score == score && GStrEqual(x.level[i].forward.obj, obj)) {
+				x.level[i].forward.score == score && x.level[i].forward.obj.StrVal() < obj.StrVal()) {
 			rank[i] += x.level[i].span
 			x = x.level[i].forward
 		}
@@ -137,7 +141,7 @@ func (zsl *zskiplist) zslUpdateScore(ele *Gobj, curscore float64, newscore float
 	for i := zsl.level - 1; i >= 0; i-- {
 		for x.level[i].forward != nil &&
 			(x.level[i].forward.score < curscore ||
-				x.level[i].forward.score == curscore && !GStrEqual(x.level[i].forward.obj, ele)) {
+				x.level[i].forward.score == curscore && x.level[i].forward.obj.StrVal() < ele.StrVal()) {
 			x = x.level[i].forward
 		}
 		update[i] = x
@@ -210,16 +214,6 @@ func (zsl *zskiplist) zslGetElementByRank(rank int64) *zskiplistNode {
 	return nil
 }
 
-func (zsl *zskiplist) zslGetElementScore(start_score float64) *zskiplistNode {
-	x := zsl.header
-	for i := zsl.level - 1; i >= 0; i-- {
-		for x.level[i].forward != nil && x.score < start_score {
-			x = x.level[i].forward
-		}
-	}
-	return x.level[0].forward
-}
-
 func (zset_ zset) zsetFindElement(ele *Gobj) (*zskiplistNode, []*zskiplistNode, uint64) {
 	// 遍历跳表
 	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
@@ -231,9 +225,9 @@ func (zset_ zset) zsetFindElement(ele *Gobj) (*zskiplistNode, []*zskiplistNode,
 	for i := zset_.zsl.level - 1; i >= 0; i-- {
 		for x.level[i].forward != nil &&
 			(x.level[i].forward.score < curscore ||
-				x.level[i].forward.score == curscore && !GStrEqual(x.level[i].forward.obj, ele)) {
-			x = x.level[i].forward
+				x.level[i].forward.score == curscore && x.level[i].forward.obj.StrVal() < ele.StrVal()) {
 			rank += uint64(x.level[i].span)
+			x = x.level[i].forward
 		}
 		update[i] = x
 	}
@@ -263,6 +257,27 @@ func (zset_ zset) zsetRank(member *Gobj) uint64 {
 	return rank
 }
 
+// 查找成员的分数，成员不存在时第二个返回值为 false
+func (zset_ zset) zsetScore(member *Gobj) (float64, bool) {
+	de := zset_.dict.Find(member)
+	if de == nil {
+		return 0, false
+	}
+	return de.Value.Val_.(float64), true
+}
+
+/*
+随机返回一个成员和它的分数。和 setTypeRandomElement 一样，
+Dict.RandomGet 在稀疏的哈希表上可能找不到元素，这时重试即可。调用者保证有序集合不为空。
+*/
+func (zset_ zset) zsetRandomElement() (*Gobj, float64) {
+	for {
+		if de := zset_.dict.RandomGet(); de != nil {
+			return de.Key, de.Value.Val_.(float64)
+		}
+	}
+}
+
 const (
 	// ZADD 命令输出标志位
 	ZADD_OUT_NOP     = 1 << iota // 由于条件限制未执行操作
@@ -320,3 +335,1283 @@ func (zset_ zset) zsetAdd(zsetObjct *Gobj, score float64, ele *Gobj, flag int) (
 		return out_flag, curScore, nil
 	}
 }
+
+/*
+Find the rank for an element by both score and key.
+Returns 0 when the element cannot be found, rank otherwise.
+Note that the rank is 1-based due to the span of zsl->header to the
+first element.
+*/
+func (zsl *zskiplist) zslGetRank(score float64, ele *Gobj) uint64 {
+	x := zsl.header
+	rank := uint64(0)
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil &&
+			(x.level[i].forward.score < score ||
+				x.level[i].forward.score == score && x.level[i].forward.obj.StrVal() <= ele.StrVal()) {
+			rank += uint64(x.level[i].span)
+			x = x.level[i].forward
+		}
+		/* x might be equal to zsl->header, so test if obj is non-NULL */
+		if x.obj != nil && x.score == score && GStrEqual(x.obj, ele) {
+			return rank
+		}
+	}
+	return 0
+}
+
+/*
+分数范围（参考 Redis 的 t_zset.c）：ZRANGEBYSCORE、ZCOUNT 等命令的 min 和 max，
+以 "(" 开头表示不包含边界，支持 -inf 和 +inf。
+*/
+type zrangespec struct {
+	min, max     float64
+	minex, maxex bool // are min or max exclusive?
+}
+
+func zslValueGteMin(value float64, spec *zrangespec) bool {
+	if spec.minex {
+		return value > spec.min
+	}
+	return value >= spec.min
+}
+
+func zslValueLteMax(value float64, spec *zrangespec) bool {
+	if spec.maxex {
+		return value < spec.max
+	}
+	return value <= spec.max
+}
+
+// Returns if there is a part of the zset is in range.
+func (zsl *zskiplist) zslIsInRange(spec *zrangespec) bool {
+	/* Test for ranges that will always be empty. */
+	if spec.min > spec.max || (spec.min == spec.max && (spec.minex || spec.maxex)) {
+		return false
+	}
+	x := zsl.tail
+	if x == nil || !zslValueGteMin(x.score, spec) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !zslValueLteMax(x.score, spec) {
+		return false
+	}
+	return true
+}
+
+/*
+Find the first node that is contained in the specified range.
+Returns NULL when no element is contained in the range.
+*/
+func (zsl *zskiplist) zslFirstInRange(spec *zrangespec) *zskiplistNode {
+	/* If everything is out of range, return early. */
+	if !zsl.zslIsInRange(spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		/* Go forward while *OUT* of range. */
+		for x.level[i].forward != nil && !zslValueGteMin(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+	}
+	/* This is an inner range, so the next node cannot be NULL. */
+	x = x.level[0].forward
+	/* Check if score <= max. */
+	if !zslValueLteMax(x.score, spec) {
+		return nil
+	}
+	return x
+}
+
+/*
+Find the last node that is contained in the specified range.
+Returns NULL when no element is contained in the range.
+*/
+func (zsl *zskiplist) zslLastInRange(spec *zrangespec) *zskiplistNode {
+	/* If everything is out of range, return early. */
+	if !zsl.zslIsInRange(spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		/* Go forward while *IN* range. */
+		for x.level[i].forward != nil && zslValueLteMax(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+	}
+	/* This is an inner range, so this node cannot be NULL. */
+	/* Check if score >= min. */
+	if !zslValueGteMin(x.score, spec) {
+		return nil
+	}
+	return x
+}
+
+// 解析一个分数边界，"(" 开头表示不包含边界。NaN 不是合法的边界
+func zslParseRangeItem(item string, dest *float64, ex *bool) int8 {
+	if len(item) > 0 && item[0] == '(' {
+		*ex = true
+		item = item[1:]
+	} else {
+		*ex = false
+	}
+	value, err := Str2Double(item)
+	if err != nil || math.IsNaN(value) {
+		return GODIS_ERR
+	}
+	*dest = value
+	return GODIS_OK
+}
+
+// 解析 min 和 max，任意一个不合法时返回 GODIS_ERR
+func zslParseRange(min, max *Gobj, spec *zrangespec) int8 {
+	if zslParseRangeItem(min.StrVal(), &spec.min, &spec.minex) != GODIS_OK ||
+		zslParseRangeItem(max.StrVal(), &spec.max, &spec.maxex) != GODIS_OK {
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+/*
+字典序范围：ZRANGEBYLEX、ZLEXCOUNT 等命令的 min 和 max，只在所有成员分数相同时有意义。
+"[" 开头表示包含边界，"(" 开头表示不包含边界，"-" 和 "+" 表示无穷小和无穷大，
+对应 Redis 中的 shared.minstring 和 shared.maxstring。
+*/
+type zlexrangespec struct {
+	min, max       string
+	minex, maxex   bool // are min or max exclusive?
+	mininf, maxinf int8 // -1 表示 "-"，1 表示 "+"，0 表示普通字符串
+}
+
+// 比较两个字典序边界，"-" 比任何字符串都小，"+" 比任何字符串都大
+func zslLexCmp(a string, ainf int8, b string, binf int8) int {
+	if ainf != binf {
+		if ainf < binf {
+			return -1
+		}
+		return 1
+	}
+	if ainf != 0 {
+		return 0
+	}
+	return strings.Compare(a, b)
+}
+
+func zslLexValueGteMin(value string, spec *zlexrangespec) bool {
+	if spec.minex {
+		return zslLexCmp(value, 0, spec.min, spec.mininf) > 0
+	}
+	return zslLexCmp(value, 0, spec.min, spec.mininf) >= 0
+}
+
+func zslLexValueLteMax(value string, spec *zlexrangespec) bool {
+	if spec.maxex {
+		return zslLexCmp(value, 0, spec.max, spec.maxinf) < 0
+	}
+	return zslLexCmp(value, 0, spec.max, spec.maxinf) <= 0
+}
+
+// Returns if there is a part of the zset is in the lex range.
+func (zsl *zskiplist) zslIsInLexRange(spec *zlexrangespec) bool {
+	/* Test for ranges that will always be empty. */
+	cmp := zslLexCmp(spec.min, spec.mininf, spec.max, spec.maxinf)
+	if cmp > 0 || (cmp == 0 && (spec.minex || spec.maxex)) {
+		return false
+	}
+	x := zsl.tail
+	if x == nil || !zslLexValueGteMin(x.obj.StrVal(), spec) {
+		return false
+	}
+	x = zsl.header.level[0].forward
+	if x == nil || !zslLexValueLteMax(x.obj.StrVal(), spec) {
+		return false
+	}
+	return true
+}
+
+/*
+Find the first node that is contained in the specified lex range.
+Returns NULL when no element is contained in the range.
+*/
+func (zsl *zskiplist) zslFirstInLexRange(spec *zlexrangespec) *zskiplistNode {
+	/* If everything is out of range, return early. */
+	if !zsl.zslIsInLexRange(spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		/* Go forward while *OUT* of range. */
+		for x.level[i].forward != nil && !zslLexValueGteMin(x.level[i].forward.obj.StrVal(), spec) {
+			x = x.level[i].forward
+		}
+	}
+	/* This is an inner range, so the next node cannot be NULL. */
+	x = x.level[0].forward
+	/* Check if score <= max. */
+	if !zslLexValueLteMax(x.obj.StrVal(), spec) {
+		return nil
+	}
+	return x
+}
+
+/*
+Find the last node that is contained in the specified lex range.
+Returns NULL when no element is contained in the range.
+*/
+func (zsl *zskiplist) zslLastInLexRange(spec *zlexrangespec) *zskiplistNode {
+	/* If everything is out of range, return early. */
+	if !zsl.zslIsInLexRange(spec) {
+		return nil
+	}
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		/* Go forward while *IN* range. */
+		for x.level[i].forward != nil && zslLexValueLteMax(x.level[i].forward.obj.StrVal(), spec) {
+			x = x.level[i].forward
+		}
+	}
+	/* This is an inner range, so this node cannot be NULL. */
+	/* Check if score >= min. */
+	if !zslLexValueGteMin(x.obj.StrVal(), spec) {
+		return nil
+	}
+	return x
+}
+
+// 解析一个字典序边界，必须以 "["、"(" 开头，或者是单独的 "-"、"+"
+func zslParseLexRangeItem(item string, dest *string, ex *bool, inf *int8) int8 {
+	if len(item) == 0 {
+		return GODIS_ERR
+	}
+	switch item[0] {
+	case '+':
+		if len(item) != 1 {
+			return GODIS_ERR
+		}
+		*ex, *inf = true, 1
+	case '-':
+		if len(item) != 1 {
+			return GODIS_ERR
+		}
+		*ex, *inf = true, -1
+	case '(':
+		*dest, *ex, *inf = item[1:], true, 0
+	case '[':
+		*dest, *ex, *inf = item[1:], false, 0
+	default:
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+// 解析 min 和 max，任意一个不合法时返回 GODIS_ERR
+func zslParseLexRange(min, max *Gobj, spec *zlexrangespec) int8 {
+	if zslParseLexRangeItem(min.StrVal(), &spec.min, &spec.minex, &spec.mininf) != GODIS_OK ||
+		zslParseLexRangeItem(max.StrVal(), &spec.max, &spec.maxex, &spec.maxinf) != GODIS_OK {
+		return GODIS_ERR
+	}
+	return GODIS_OK
+}
+
+// ZRANGE 的范围类型和方向，AUTO 表示由命令参数决定
+const (
+	ZRANGE_AUTO = iota
+	ZRANGE_RANK
+	ZRANGE_SCORE
+	ZRANGE_LEX
+)
+
+const (
+	ZRANGE_DIRECTION_AUTO = iota
+	ZRANGE_DIRECTION_FORWARD
+	ZRANGE_DIRECTION_REVERSE
+)
+
+func zrangeCommand(c *GodisClient) {
+	zrangeGenericCommand(c, 1, false, ZRANGE_AUTO, ZRANGE_DIRECTION_AUTO)
+}
+
+// ZRANGESTORE dst src min max [BYSCORE | BYLEX] [REV] [LIMIT offset count]
+func zrangestoreCommand(c *GodisClient) {
+	zrangeGenericCommand(c, 2, true, ZRANGE_AUTO, ZRANGE_DIRECTION_AUTO)
+}
+
+func zrevrangeCommand(c *GodisClient) {
+	zrangeGenericCommand(c, 1, false, ZRANGE_RANK, ZRANGE_DIRECTION_REVERSE)
+}
+
+func zrangebyscoreCommand(c *GodisClient) {
+	zrangeGenericCommand(c, 1, false, ZRANGE_SCORE, ZRANGE_DIRECTION_FORWARD)
+}
+
+func zrevrangebyscoreCommand(c *GodisClient) {
+	zrangeGenericCommand(c, 1, false, ZRANGE_SCORE, ZRANGE_DIRECTION_REVERSE)
+}
+
+func zrangebylexCommand(c *GodisClient) {
+	zrangeGenericCommand(c, 1, false, ZRANGE_LEX, ZRANGE_DIRECTION_FORWARD)
+}
+
+func zrevrangebylexCommand(c *GodisClient) {
+	zrangeGenericCommand(c, 1, false, ZRANGE_LEX, ZRANGE_DIRECTION_REVERSE)
+}
+
+/*
+ZRANGE key start stop [BYSCORE | BYLEX] [REV] [LIMIT offset count] [WITHSCORES]
+
+所有范围查询命令的实现（参考 Redis 6.2 的 zrangeGenericCommand），argsStart 是源 key 的下标。
+旧的命令（ZREVRANGE、ZRANGEBYSCORE 等）直接指定 rangetype 和 direction，不接受 BYSCORE、BYLEX、REV；
+按分数和字典序逆序查询时，范围按 max min 的顺序给出。store 为 true 时（ZRANGESTORE）
+把结果保存到 c.args[1] 中并回复结果的数量。
+*/
+func zrangeGenericCommand(c *GodisClient, argsStart int, store bool, rangetype int, direction int) {
+	key := c.args[argsStart]
+	minidx, maxidx := argsStart+1, argsStart+2
+	withscores := false
+	offset, limit := int64(0), int64(-1)
+
+	/* Step 1: Skip the <src> <min> <max> args and parse remaining optional arguments. */
+	for j := argsStart + 3; j < len(c.args); j++ {
+		opt := strings.ToLower(c.args[j].StrVal())
+		leftargs := len(c.args) - j - 1
+		if !store && opt == "withscores" {
+			withscores = true
+		} else if opt == "limit" && leftargs >= 2 {
+			if c.getLongFromObjectOrReply(c.args[j+1], &offset) != GODIS_OK ||
+				c.getLongFromObjectOrReply(c.args[j+2], &limit) != GODIS_OK {
+				return
+			}
+			j += 2
+		} else if direction == ZRANGE_DIRECTION_AUTO && opt == "rev" {
+			direction = ZRANGE_DIRECTION_REVERSE
+		} else if rangetype == ZRANGE_AUTO && opt == "bylex" {
+			rangetype = ZRANGE_LEX
+		} else if rangetype == ZRANGE_AUTO && opt == "byscore" {
+			rangetype = ZRANGE_SCORE
+		} else {
+			c.AddReplyError("syntax error")
+			return
+		}
+	}
+
+	/* Use defaults if not overridden by arguments. */
+	if direction == ZRANGE_DIRECTION_AUTO {
+		direction = ZRANGE_DIRECTION_FORWARD
+	}
+	if rangetype == ZRANGE_AUTO {
+		rangetype = ZRANGE_RANK
+	}
+
+	/* Check for conflicting arguments. */
+	if limit != -1 && rangetype == ZRANGE_RANK {
+		c.AddReplyError("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+		return
+	}
+	if withscores && rangetype == ZRANGE_LEX {
+		c.AddReplyError("syntax error, WITHSCORES not supported in combination with BYLEX")
+		return
+	}
+
+	reverse := direction == ZRANGE_DIRECTION_REVERSE
+	if reverse && (rangetype == ZRANGE_SCORE || rangetype == ZRANGE_LEX) {
+		/* Range is given as [max,min] */
+		minidx, maxidx = maxidx, minidx
+	}
+
+	/* Step 2: Parse the range. */
+	var start, end int64
+	var spec zrangespec
+	var lexspec zlexrangespec
+	switch rangetype {
+	case ZRANGE_RANK:
+		if c.getLongFromObjectOrReply(c.args[minidx], &start) != GODIS_OK ||
+			c.getLongFromObjectOrReply(c.args[maxidx], &end) != GODIS_OK {
+			return
+		}
+	case ZRANGE_SCORE:
+		if zslParseRange(c.args[minidx], c.args[maxidx], &spec) != GODIS_OK {
+			c.AddReplyError("min or max is not a float")
+			return
+		}
+	case ZRANGE_LEX:
+		if zslParseLexRange(c.args[minidx], c.args[maxidx], &lexspec) != GODIS_OK {
+			c.AddReplyError("min or max not valid string range item")
+			return
+		}
+	}
+
+	/* Step 3: Lookup the key and get the range. */
+	zobj := findKeyRead(c.db, key)
+	if zobj != nil && zobj.Type_ != GZSET {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	var nodes []*zskiplistNode
+	if zobj != nil {
+		zsl := zobj.Val_.(zset).zsl
+		switch rangetype {
+		case ZRANGE_RANK:
+			nodes = zsl.zslRangeByRank(start, end, reverse)
+		case ZRANGE_SCORE:
+			nodes = zsl.zslRangeByScore(&spec, reverse, offset, limit)
+		case ZRANGE_LEX:
+			nodes = zsl.zslRangeByLex(&lexspec, reverse, offset, limit)
+		}
+	}
+
+	/* Step 4: Emit the result. */
+	if store {
+		zrangeResultStore(c, c.args[1], nodes)
+		return
+	}
+	if withscores {
+		c.AddReplyArrayLen(int64(len(nodes)) * 2)
+	} else {
+		c.AddReplyArrayLen(int64(len(nodes)))
+	}
+	for _, ln := range nodes {
+		c.AddReplyBulk(ln.obj)
+		if withscores {
+			c.AddReplyDouble(ln.score)
+		}
+	}
+}
+
+// ZRANGESTORE 把范围内的节点保存到目标 key 中，回复结果的数量
+func zrangeResultStore(c *GodisClient, dstkey *Gobj, nodes []*zskiplistNode) {
+	dstobj := CreateZSetObject()
+	for _, ln := range nodes {
+		dstobj.Val_.(zset).zsetAdd(dstobj, ln.score, ln.obj, ZADD_IN_NONE)
+	}
+	c.AddReplyLong(storeZsetResult(c, dstkey, dstobj))
+}
+
+/*
+*STORE 命令把结果写入 dstkey：结果为空时删除 dstkey，否则覆盖原来的值（过期时间也被清除）。
+返回结果有序集合的大小
+*/
+func storeZsetResult(c *GodisClient, dstkey *Gobj, dstobj *Gobj) int64 {
+	length := int64(dstobj.Val_.(zset).zsl.length)
+	if length == 0 {
+		if dbDelete(c.db, dstkey) {
+			server.dirty++
+		}
+	} else {
+		setKey(c.db, dstkey, dstobj)
+		signalKeyAsReady(c.db, dstkey)
+		server.dirty++
+	}
+	dstobj.DecrRefCount()
+	return length
+}
+
+// 按排名取出 [start, end] 范围内的节点，负数表示从尾部开始计数，reverse 为 true 时从尾部开始排名
+func (zsl *zskiplist) zslRangeByRank(start, end int64, reverse bool) []*zskiplistNode {
+	llen := int64(zsl.length)
+
+	/* Sanitize indexes. */
+	if start < 0 {
+		start = llen + start
+	}
+	if end < 0 {
+		end = llen + end
+	}
+	if start < 0 {
+		start = 0
+	}
+
+	/* Invariant: start >= 0, so this test will be true when end < 0.
+	 * The range is empty when start > end or start >= length. */
+	if start > end || start >= llen {
+		return nil
+	}
+	if end >= llen {
+		end = llen - 1
+	}
+	rangelen := end - start + 1
+
+	/* Check if starting point is trivial, before doing log(N) lookup. */
+	var ln *zskiplistNode
+	if reverse {
+		ln = zsl.tail
+		if start > 0 {
+			ln = zsl.zslGetElementByRank(llen - start)
+		}
+	} else {
+		ln = zsl.header.level[0].forward
+		if start > 0 {
+			ln = zsl.zslGetElementByRank(start + 1)
+		}
+	}
+	nodes := make([]*zskiplistNode, 0, rangelen)
+	for ; rangelen > 0; rangelen-- {
+		nodes = append(nodes, ln)
+		if reverse {
+			ln = ln.backward
+		} else {
+			ln = ln.level[0].forward
+		}
+	}
+	return nodes
+}
+
+/*
+从第一个（reverse 为 true 时从最后一个）在范围内的节点开始，跳过 offset 个节点后最多取出 limit 个，
+limit 为负数时取出所有剩下的节点。
+*/
+func (zsl *zskiplist) zslRangeByScore(spec *zrangespec, reverse bool, offset, limit int64) []*zskiplistNode {
+	/* For invalid offset, return directly. */
+	if offset > 0 && offset >= int64(zsl.length) {
+		return nil
+	}
+	var ln *zskiplistNode
+	if reverse {
+		ln = zsl.zslLastInRange(spec)
+	} else {
+		ln = zsl.zslFirstInRange(spec)
+	}
+	/* If there is an offset, just element by element */
+	for ; ln != nil && offset != 0; offset-- {
+		ln = zslNextNode(ln, reverse)
+	}
+	var nodes []*zskiplistNode
+	for ; ln != nil && limit != 0; limit-- {
+		/* Abort when the node is no longer in range. */
+		if reverse && !zslValueGteMin(ln.score, spec) || !reverse && !zslValueLteMax(ln.score, spec) {
+			break
+		}
+		nodes = append(nodes, ln)
+		ln = zslNextNode(ln, reverse)
+	}
+	return nodes
+}
+
+// 和 zslRangeByScore 相同，只是按成员的字典序比较
+func (zsl *zskiplist) zslRangeByLex(spec *zlexrangespec, reverse bool, offset, limit int64) []*zskiplistNode {
+	/* For invalid offset, return directly. */
+	if offset > 0 && offset >= int64(zsl.length) {
+		return nil
+	}
+	var ln *zskiplistNode
+	if reverse {
+		ln = zsl.zslLastInLexRange(spec)
+	} else {
+		ln = zsl.zslFirstInLexRange(spec)
+	}
+	/* If there is an offset, just element by element */
+	for ; ln != nil && offset != 0; offset-- {
+		ln = zslNextNode(ln, reverse)
+	}
+	var nodes []*zskiplistNode
+	for ; ln != nil && limit != 0; limit-- {
+		/* Abort when the node is no longer in range. */
+		if reverse && !zslLexValueGteMin(ln.obj.StrVal(), spec) || !reverse && !zslLexValueLteMax(ln.obj.StrVal(), spec) {
+			break
+		}
+		nodes = append(nodes, ln)
+		ln = zslNextNode(ln, reverse)
+	}
+	return nodes
+}
+
+func zslNextNode(ln *zskiplistNode, reverse bool) *zskiplistNode {
+	if reverse {
+		return ln.backward
+	}
+	return ln.level[0].forward
+}
+
+// ZCOUNT key min max：用第一个和最后一个在范围内的节点的排名计算数量，不需要遍历
+func zcountCommand(c *GodisClient) {
+	var spec zrangespec
+	if zslParseRange(c.args[2], c.args[3], &spec) != GODIS_OK {
+		c.AddReplyError("min or max is not a float")
+		return
+	}
+	zobj := findKeyRead(c.db, c.args[1])
+	if zobj == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if zobj.Type_ != GZSET {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	zsl := zobj.Val_.(zset).zsl
+	count := uint64(0)
+
+	/* Find first element in range */
+	zn := zsl.zslFirstInRange(&spec)
+
+	/* Use rank of first element, if any, to determine preliminary count */
+	if zn != nil {
+		rank := zsl.zslGetRank(zn.score, zn.obj)
+		count = zsl.length - (rank - 1)
+
+		/* Find last element in range */
+		zn = zsl.zslLastInRange(&spec)
+
+		/* Use rank of last element, if any, to determine the actual count */
+		if zn != nil {
+			rank = zsl.zslGetRank(zn.score, zn.obj)
+			count -= zsl.length - rank
+		}
+	}
+	c.AddReplyLong(int64(count))
+}
+
+// ZLEXCOUNT key min max
+func zlexcountCommand(c *GodisClient) {
+	var spec zlexrangespec
+	if zslParseLexRange(c.args[2], c.args[3], &spec) != GODIS_OK {
+		c.AddReplyError("min or max not valid string range item")
+		return
+	}
+	zobj := findKeyRead(c.db, c.args[1])
+	if zobj == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if zobj.Type_ != GZSET {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	zsl := zobj.Val_.(zset).zsl
+	count := uint64(0)
+
+	/* Find first element in range */
+	zn := zsl.zslFirstInLexRange(&spec)
+
+	/* Use rank of first element, if any, to determine preliminary count */
+	if zn != nil {
+		rank := zsl.zslGetRank(zn.score, zn.obj)
+		count = zsl.length - (rank - 1)
+
+		/* Find last element in range */
+		zn = zsl.zslLastInLexRange(&spec)
+
+		/* Use rank of last element, if any, to determine the actual count */
+		if zn != nil {
+			rank = zsl.zslGetRank(zn.score, zn.obj)
+			count -= zsl.length - rank
+		}
+	}
+	c.AddReplyLong(int64(count))
+}
+
+/*
+Delete all the elements with score between min and max from the skiplist.
+Both min and max can be inclusive or exclusive (see range->minex and
+range->maxex). When inclusive a score >= min && score <= max is deleted.
+Note that this function takes the reference to the hash table view of the
+sorted set, in order to remove the elements from the hash table too.
+*/
+func (zsl *zskiplist) zslDeleteRangeByScore(spec *zrangespec, dict *Dict) uint64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	removed := uint64(0)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslValueGteMin(x.level[i].forward.score, spec) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	/* Current node is the last with score < or <= min. */
+	x = x.level[0].forward
+
+	/* Delete nodes while in range. */
+	for x != nil && zslValueLteMax(x.score, spec) {
+		next := x.level[0].forward
+		zsl.zslDeleteNode(x, update)
+		dict.Delete(x.obj)
+		removed++
+		x = next
+	}
+	return removed
+}
+
+// 和 zslDeleteRangeByScore 相同，只是按成员的字典序比较
+func (zsl *zskiplist) zslDeleteRangeByLex(spec *zlexrangespec, dict *Dict) uint64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	removed := uint64(0)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !zslLexValueGteMin(x.level[i].forward.obj.StrVal(), spec) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	/* Current node is the last with score < or <= min. */
+	x = x.level[0].forward
+
+	/* Delete nodes while in range. */
+	for x != nil && zslLexValueLteMax(x.obj.StrVal(), spec) {
+		next := x.level[0].forward
+		zsl.zslDeleteNode(x, update)
+		dict.Delete(x.obj)
+		removed++
+		x = next
+	}
+	return removed
+}
+
+/*
+Delete all the elements with rank between start and end from the skiplist.
+Start and end are inclusive. Note that start and end need to be 1-based
+*/
+func (zsl *zskiplist) zslDeleteRangeByRank(start, end uint64, dict *Dict) uint64 {
+	update := make([]*zskiplistNode, ZSKIPLIST_MAXLEVEL)
+	traversed, removed := uint64(0), uint64(0)
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+uint64(x.level[i].span) < start {
+			traversed += uint64(x.level[i].span)
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	traversed++
+	x = x.level[0].forward
+	for x != nil && traversed <= end {
+		next := x.level[0].forward
+		zsl.zslDeleteNode(x, update)
+		dict.Delete(x.obj)
+		removed++
+		traversed++
+		x = next
+	}
+	return removed
+}
+
+func zremrangebyrankCommand(c *GodisClient) {
+	zremrangeGenericCommand(c, ZRANGE_RANK)
+}
+
+func zremrangebyscoreCommand(c *GodisClient) {
+	zremrangeGenericCommand(c, ZRANGE_SCORE)
+}
+
+func zremrangebylexCommand(c *GodisClient) {
+	zremrangeGenericCommand(c, ZRANGE_LEX)
+}
+
+// ZREMRANGEBYRANK / ZREMRANGEBYSCORE / ZREMRANGEBYLEX key min max：回复删除的成员数量，有序集合为空时删除 key
+func zremrangeGenericCommand(c *GodisClient, rangetype int) {
+	key := c.args[1]
+	var start, end int64
+	var spec zrangespec
+	var lexspec zlexrangespec
+
+	/* Step 1: Parse the range. */
+	switch rangetype {
+	case ZRANGE_RANK:
+		if c.getLongFromObjectOrReply(c.args[2], &start) != GODIS_OK ||
+			c.getLongFromObjectOrReply(c.args[3], &end) != GODIS_OK {
+			return
+		}
+	case ZRANGE_SCORE:
+		if zslParseRange(c.args[2], c.args[3], &spec) != GODIS_OK {
+			c.AddReplyError("min or max is not a float")
+			return
+		}
+	case ZRANGE_LEX:
+		if zslParseLexRange(c.args[2], c.args[3], &lexspec) != GODIS_OK {
+			c.AddReplyError("min or max not valid string range item")
+			return
+		}
+	}
+
+	/* Step 2: Lookup & range sanity checks if needed. */
+	zobj := lookupKeyWrite(c.db, key)
+	if zobj == nil {
+		c.AddReplyInt8(0)
+		return
+	}
+	if zobj.Type_ != GZSET {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	zs := zobj.Val_.(zset)
+	if rangetype == ZRANGE_RANK {
+		/* Sanitize indexes. */
+		llen := int64(zs.zsl.length)
+		if start < 0 {
+			start = llen + start
+		}
+		if end < 0 {
+			end = llen + end
+		}
+		if start < 0 {
+			start = 0
+		}
+
+		/* Invariant: start >= 0, so this test will be true when end < 0.
+		 * The range is empty when start > end or start >= length. */
+		if start > end || start >= llen {
+			c.AddReplyInt8(0)
+			return
+		}
+		if end >= llen {
+			end = llen - 1
+		}
+	}
+
+	/* Step 3: Perform the range deletion operation. */
+	var deleted uint64
+	switch rangetype {
+	case ZRANGE_RANK:
+		deleted = zs.zsl.zslDeleteRangeByRank(uint64(start+1), uint64(end+1), zs.dict)
+	case ZRANGE_SCORE:
+		deleted = zs.zsl.zslDeleteRangeByScore(&spec, zs.dict)
+	case ZRANGE_LEX:
+		deleted = zs.zsl.zslDeleteRangeByLex(&lexspec, zs.dict)
+	}
+	if zs.zsl.length == 0 {
+		dbDelete(c.db, key)
+	}
+	server.dirty += int64(deleted)
+	c.AddReplyLong(int64(deleted))
+}
+
+// ZUNIONSTORE / ZINTERSTORE 的 AGGREGATE 参数
+const (
+	REDIS_AGGR_SUM = iota
+	REDIS_AGGR_MIN
+	REDIS_AGGR_MAX
+)
+
+/*
+ZUNION、ZINTER、ZDIFF 的输入，可以是有序集合，也可以是集合（成员的分数都看作 1），
+key 不存在时 subject 为 nil，看作空集。
+*/
+type zsetopsrc struct {
+	subject *Gobj
+	weight  float64
+}
+
+func (src *zsetopsrc) zuiLength() int64 {
+	if src.subject == nil {
+		return 0
+	}
+	if src.subject.Type_ == GSET {
+		return src.subject.setTypeSize()
+	}
+	return int64(src.subject.Val_.(zset).zsl.length)
+}
+
+// 依次对每个成员和它的分数调用 fn，fn 返回 false 时停止遍历
+func (src *zsetopsrc) zuiForEach(fn func(member *Gobj, score float64) bool) {
+	if src.subject == nil {
+		return
+	}
+	if src.subject.Type_ == GSET {
+		for _, member := range src.subject.setTypeMembers() {
+			if !fn(member, 1.0) {
+				return
+			}
+		}
+		return
+	}
+	for x := src.subject.Val_.(zset).zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+		if !fn(x.obj, x.score) {
+			return
+		}
+	}
+}
+
+// 查找成员的分数，集合中的成员分数为 1
+func (src *zsetopsrc) zuiFind(member *Gobj) (float64, bool) {
+	if src.subject == nil {
+		return 0, false
+	}
+	if src.subject.Type_ == GSET {
+		return 1.0, src.subject.setTypeIsMember(member) == 1
+	}
+	return src.subject.Val_.(zset).zsetScore(member)
+}
+
+func zunionInterAggregate(target *float64, val float64, aggregate int) {
+	switch aggregate {
+	case REDIS_AGGR_SUM:
+		*target = *target + val
+		/* The result of adding two doubles is NaN when one variable
+		 * is +inf and the other is -inf. When these numbers are added,
+		 * we maintain the convention of the result being 0.0. */
+		if math.IsNaN(*target) {
+			*target = 0.0
+		}
+	case REDIS_AGGR_MIN:
+		if val < *target {
+			*target = val
+		}
+	case REDIS_AGGR_MAX:
+		if val > *target {
+			*target = val
+		}
+	}
+}
+
+func zunionstoreCommand(c *GodisClient) {
+	zunionInterDiffGenericCommand(c, c.args[1], 2, SET_OP_UNION, false)
+}
+
+func zinterstoreCommand(c *GodisClient) {
+	zunionInterDiffGenericCommand(c, c.args[1], 2, SET_OP_INTER, false)
+}
+
+func zdiffstoreCommand(c *GodisClient) {
+	zunionInterDiffGenericCommand(c, c.args[1], 2, SET_OP_DIFF, false)
+}
+
+func zunionCommand(c *GodisClient) {
+	zunionInterDiffGenericCommand(c, nil, 1, SET_OP_UNION, false)
+}
+
+func zinterCommand(c *GodisClient) {
+	zunionInterDiffGenericCommand(c, nil, 1, SET_OP_INTER, false)
+}
+
+func zdiffCommand(c *GodisClient) {
+	zunionInterDiffGenericCommand(c, nil, 1, SET_OP_DIFF, false)
+}
+
+func zintercardCommand(c *GodisClient) {
+	zunionInterDiffGenericCommand(c, nil, 1, SET_OP_INTER, true)
+}
+
+/*
+ZUNION / ZINTER / ZDIFF numkeys key [key ...] [WEIGHTS weight ...] [AGGREGATE SUM|MIN|MAX] [WITHSCORES]
+以及它们的 STORE 版本和 ZINTERCARD numkeys key [key ...] [LIMIT limit]（参考 Redis 的 zunionInterDiffGenericCommand）。
+
+numkeysIndex 是 numkeys 参数的下标，dstkey 不为 nil 时把结果保存到 dstkey 中并回复结果的数量，
+cardinalityOnly 为 true 时（ZINTERCARD）只回复交集的大小。ZDIFF 不接受 WEIGHTS 和 AGGREGATE。
+*/
+func zunionInterDiffGenericCommand(c *GodisClient, dstkey *Gobj, numkeysIndex int, op int, cardinalityOnly bool) {
+	var setnum int64
+	aggregate := REDIS_AGGR_SUM
+	withscores := false
+	limit := int64(0)
+
+	/* expect setnum input keys to be given */
+	if c.getLongFromObjectOrReply(c.args[numkeysIndex], &setnum) != GODIS_OK {
+		return
+	}
+	if setnum < 1 {
+		c.AddReplyError(fmt.Sprintf("at least 1 input key is needed for '%s' command", strings.ToLower(c.args[0].StrVal())))
+		return
+	}
+
+	/* test if the expected number of keys would overflow */
+	if setnum > int64(len(c.args)-(numkeysIndex+1)) {
+		c.AddReplyError("syntax error")
+		return
+	}
+
+	/* read keys to be used for input */
+	src := make([]zsetopsrc, setnum)
+	j := numkeysIndex + 1
+	for i := range src {
+		obj := findKeyRead(c.db, c.args[j])
+		if obj != nil && obj.Type_ != GZSET && obj.Type_ != GSET {
+			c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+			return
+		}
+		src[i].subject = obj
+		/* Default all weights to 1. */
+		src[i].weight = 1.0
+		j++
+	}
+
+	/* parse optional extra arguments */
+	for remaining := len(c.args) - j; remaining > 0; remaining = len(c.args) - j {
+		opt := strings.ToLower(c.args[j].StrVal())
+		if op != SET_OP_DIFF && !cardinalityOnly && remaining >= int(setnum)+1 && opt == "weights" {
+			j++
+			for i := range src {
+				if c.getDoubleFromObject(c.args[j], &src[i].weight) != GODIS_OK {
+					c.AddReplyError("weight value is not a float")
+					return
+				}
+				j++
+			}
+		} else if op != SET_OP_DIFF && !cardinalityOnly && remaining >= 2 && opt == "aggregate" {
+			switch strings.ToLower(c.args[j+1].StrVal()) {
+			case "sum":
+				aggregate = REDIS_AGGR_SUM
+			case "min":
+				aggregate = REDIS_AGGR_MIN
+			case "max":
+				aggregate = REDIS_AGGR_MAX
+			default:
+				c.AddReplyError("syntax error")
+				return
+			}
+			j += 2
+		} else if dstkey == nil && !cardinalityOnly && opt == "withscores" {
+			withscores = true
+			j++
+		} else if cardinalityOnly && remaining >= 2 && opt == "limit" {
+			if c.getLongFromObjectOrReply(c.args[j+1], &limit) != GODIS_OK {
+				return
+			}
+			if limit < 0 {
+				c.AddReplyError("LIMIT can't be negative")
+				return
+			}
+			j += 2
+		} else {
+			c.AddReplyError("syntax error")
+			return
+		}
+	}
+
+	if op != SET_OP_DIFF {
+		/* sort sets from the smallest to largest, this will improve our
+		 * algorithm's performance */
+		sort.SliceStable(src, func(a, b int) bool {
+			return src[a].zuiLength() < src[b].zuiLength()
+		})
+	}
+
+	dstobj := CreateZSetObject()
+	dstzset := dstobj.Val_.(zset)
+	cardinality := int64(0)
+
+	switch op {
+	case SET_OP_INTER:
+		/* Skip everything if the smallest input is empty. */
+		src[0].zuiForEach(func(member *Gobj, score float64) bool {
+			score *= src[0].weight
+			if math.IsNaN(score) {
+				score = 0
+			}
+			for i := 1; i < len(src); i++ {
+				value, ok := src[i].zuiFind(member)
+				if !ok {
+					/* Only continue when present in every input. */
+					return true
+				}
+				zunionInterAggregate(&score, value*src[i].weight, aggregate)
+			}
+			if cardinalityOnly {
+				cardinality++
+				/* We stop the searching after reaching the limit. */
+				return limit == 0 || cardinality < limit
+			}
+			dstzset.zsetAdd(dstobj, score, member, ZADD_IN_NONE)
+			return true
+		})
+	case SET_OP_UNION:
+		/* Step 1: Create a dictionary of elements -> aggregated-scores
+		 * by iterating one sorted set after the other. */
+		accumulator := DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+		for i := range src {
+			src[i].zuiForEach(func(member *Gobj, score float64) bool {
+				/* Initialize value */
+				score *= src[i].weight
+				if math.IsNaN(score) {
+					score = 0
+				}
+				/* Search for this element in the accumulating dictionary. */
+				if existing := accumulator.Find(member); existing != nil {
+					current := existing.Value.Val_.(float64)
+					zunionInterAggregate(&current, score, aggregate)
+					existing.Value.Val_ = current
+				} else {
+					accumulator.Set(member, &Gobj{Type_: GSTR, Val_: score, encoding: GODIS_ENCODING_RAW})
+				}
+				return true
+			})
+		}
+
+		/* Step 2: convert the dictionary into the final sorted set. */
+		iter := accumulator.NewIterator(false)
+		for member, score, exists := iter.Next(); exists; member, score, exists = iter.Next() {
+			dstzset.zsetAdd(dstobj, score.Val_.(float64), member, ZADD_IN_NONE)
+		}
+		iter.Close()
+	case SET_OP_DIFF:
+		/* 遍历第一个有序集合，只保留在其他输入中都找不到的成员 */
+		src[0].zuiForEach(func(member *Gobj, score float64) bool {
+			for i := 1; i < len(src); i++ {
+				if _, ok := src[i].zuiFind(member); ok {
+					return true
+				}
+			}
+			dstzset.zsetAdd(dstobj, score, member, ZADD_IN_NONE)
+			return true
+		})
+	}
+
+	if dstkey != nil {
+		c.AddReplyLong(storeZsetResult(c, dstkey, dstobj))
+		return
+	}
+	if cardinalityOnly {
+		c.AddReplyLong(cardinality)
+		return
+	}
+	length := int64(dstzset.zsl.length)
+	if withscores {
+		c.AddReplyArrayLen(length * 2)
+	} else {
+		c.AddReplyArrayLen(length)
+	}
+	for zn := dstzset.zsl.header.level[0].forward; zn != nil; zn = zn.level[0].forward {
+		c.AddReplyBulk(zn.obj)
+		if withscores {
+			c.AddReplyDouble(zn.score)
+		}
+	}
+	dstobj.DecrRefCount()
+}
+
+// ZMSCORE key member [member ...]：回复每个成员的分数，成员或 key 不存在时对应的位置为 nil
+func zmscoreCommand(c *GodisClient) {
+	zobj := findKeyRead(c.db, c.args[1])
+	if zobj != nil && zobj.Type_ != GZSET {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	c.AddReplyArrayLen(int64(len(c.args) - 2))
+	for _, member := range c.args[2:] {
+		if zobj != nil {
+			if score, ok := zobj.Val_.(zset).zsetScore(member); ok {
+				c.AddReplyDouble(score)
+				continue
+			}
+		}
+		c.AddReplyStr("$-1\r\n")
+	}
+}
+
+/*
+ZRANDMEMBER key [count [WITHSCORES]]：和 SRANDMEMBER 一样，count 为正数时返回不重复的成员，
+为负数时可能返回重复的成员。
+*/
+func zrandmemberCommand(c *GodisClient) {
+	if len(c.args) > 4 || (len(c.args) == 4 && strings.ToLower(c.args[3].StrVal()) != "withscores") {
+		c.AddReplyError("syntax error")
+		return
+	}
+	hascount := len(c.args) >= 3
+	withscores := len(c.args) == 4
+	var count int64 = 1
+	uniq := true
+	if hascount {
+		if c.getLongFromObjectOrReply(c.args[2], &count) != GODIS_OK {
+			return
+		}
+		if count == math.MinInt64 || (withscores && (count < -math.MaxInt64/2 || count > math.MaxInt64/2)) {
+			c.AddReplyError("value is out of range")
+			return
+		}
+		if count < 0 {
+			count = -count
+			uniq = false
+		}
+	}
+	zobj := findKeyRead(c.db, c.args[1])
+	if zobj == nil {
+		if hascount {
+			c.AddReplyArrayLen(0)
+		} else {
+			c.AddReplyStr("$-1\r\n")
+		}
+		return
+	}
+	if zobj.Type_ != GZSET {
+		c.AddReplyError("WRONGTYPE Operation against a key holding the wrong kind of value")
+		return
+	}
+	zs := zobj.Val_.(zset)
+	if !hascount {
+		member, _ := zs.zsetRandomElement()
+		c.AddReplyBulk(member)
+		return
+	}
+	if count == 0 {
+		c.AddReplyArrayLen(0)
+		return
+	}
+	addReplyMember := func(member *Gobj, score float64) {
+		c.AddReplyBulk(member)
+		if withscores {
+			c.AddReplyDouble(score)
+		}
+	}
+	replyLen := func(n int64) int64 {
+		if withscores {
+			return n * 2
+		}
+		return n
+	}
+
+	/* CASE 1: The count was negative, so the extraction method is just:
+	 * "return N random elements" sampling the whole set every time.
+	 * This case is trivial and can be served without auxiliary data
+	 * structures. This case is the only one that also needs to return the
+	 * elements in random order. */
+	if !uniq || count == 1 {
+		c.AddReplyArrayLen(replyLen(count))
+		for ; count > 0; count-- {
+			addReplyMember(zs.zsetRandomElement())
+		}
+		return
+	}
+
+	/* CASE 2:
+	 * The number of requested elements is greater than the number of
+	 * elements inside the zset: simply return the whole zset. */
+	size := int64(zs.zsl.length)
+	if count >= size {
+		c.AddReplyArrayLen(replyLen(size))
+		for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			addReplyMember(x.obj, x.score)
+		}
+		return
+	}
+
+	/* CASE 3:
+	 * The number of elements inside the zset is not greater than
+	 * 3 times the number of requested elements. In this case we create
+	 * a dict from scratch with all the elements, and subtract random
+	 * elements to reach the requested number of elements.
+	 *
+	 * This is done because if the number of requested elements is just
+	 * a bit less than the number of elements in the set, the natural approach
+	 * used into CASE 4 is highly inefficient. */
+	d := DictCreate(DictType{HashFunc: GStrHash, EqualFunc: GStrEqual})
+	if count*3 > size {
+		for x := zs.zsl.header.level[0].forward; x != nil; x = x.level[0].forward {
+			d.Add(x.obj, zs.dict.Find(x.obj).Value)
+		}
+		for d.usedSize() > count {
+			if de := d.RandomGet(); de != nil {
+				d.Delete(de.Key)
+			}
+		}
+	} else {
+		/* CASE 4: We have a big zset compared to the requested number of elements.
+		 * In this case we can simply get random elements from the zset and add
+		 * to the temporary set, trying to eventually get enough unique elements
+		 * to reach the specified count. */
+		for d.usedSize() < count {
+			de := zs.dict.RandomGet()
+			if de != nil {
+				d.Add(de.Key, de.Value)
+			}
+		}
+	}
+	c.AddReplyArrayLen(replyLen(count))
+	iter := d.NewIterator(false)
+	for member, score, exists := iter.Next(); exists; member, score, exists = iter.Next() {
+		addReplyMember(member, score.Val_.(float64))
+	}
+	iter.Close()
+}